@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// applyAdhocDevice limits the run to the --host device, a host not configured is backed up with --username and the password read from stdin (--password-stdin).
+// Settings of the configured device are overridden by the given ones, other settings (storage, mode, prefixTemplate) apply as configured
+func applyAdhocDevice(ttConfig *Config, stdin io.Reader) error {
+	device := DeviceConfig{Host: adhocHost}
+	configured := false
+	for _, m := range ttConfig.Mikrotiks {
+		if m.Host == adhocHost {
+			device, configured = m, true
+			break
+		}
+	}
+	if adhocUsername != "" {
+		device.Username = adhocUsername
+	}
+	if adhocPasswordStdin {
+		contents, err := io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		device.Password, device.PasswordFile = strings.TrimRight(string(contents), "\r\n"), ""
+		if device.Password == "" {
+			return errors.New("--password-stdin: no password given")
+		}
+	}
+	if !configured && (device.Username == "" || device.Password == "") {
+		return fmt.Errorf("Mikrotik %s is not configured, --username and --password-stdin are required", adhocHost)
+	}
+	ttConfig.Mikrotiks = []DeviceConfig{device}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"tiktocker/internal/common"
+)
+
+// maximum size of the trigger request body (annotations)
+const apiMaxBodySize = 64 * 1024
+
+type triggerRequest struct {
+	Annotations map[string]string `json:"annotations"` // recorded in the manifest of the triggered backup, override --annotate
+}
+
+type triggerResponse struct {
+	Triggered []string `json:"triggered"`         // devices which backup has started
+	Running   []string `json:"running,omitempty"` // devices skipped as their backup is already in progress
+}
+
+// serveApi serves the on-demand backup endpoints of the daemon, every request must carry the token as a bearer token
+func serveApi(listen string, token string, d *fleetDaemon) error {
+	if token == "" {
+		return fmt.Errorf("api.listen requires api.token")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/backup", func(w http.ResponseWriter, r *http.Request) {
+		d.handleTrigger(w, r, d.hosts())
+	})
+	mux.HandleFunc("POST /api/backup/{device}", func(w http.ResponseWriter, r *http.Request) {
+		host := r.PathValue("device")
+		if d.job(host) == nil {
+			http.Error(w, fmt.Sprintf("unknown device: %s", host), http.StatusNotFound)
+			return
+		}
+		d.handleTrigger(w, r, []string{host})
+	})
+
+	go func() {
+		common.Log.Infof("api listening on %s", listen)
+		if err := http.ListenAndServe(listen, authorize(token, mux)); err != nil {
+			common.Log.Errorf("api server failure: %v", err)
+		}
+	}()
+	return nil
+}
+
+// authorize rejects requests without the bearer token
+func authorize(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleTrigger starts backups of the hosts, responds 202 if any started, 409 if all are already in progress
+func (d *fleetDaemon) handleTrigger(w http.ResponseWriter, r *http.Request, hosts []string) {
+	if d.schedulingCtx.Err() != nil {
+		http.Error(w, "daemon stopping", http.StatusServiceUnavailable)
+		return
+	}
+	request := triggerRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxBodySize)).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	annotations := make(map[string]string, len(d.annotations)+len(request.Annotations))
+	for k, v := range d.annotations {
+		annotations[k] = v
+	}
+	for k, v := range request.Annotations {
+		annotations[k] = v
+	}
+
+	jobs := make([]*scheduledTarget, 0, len(hosts))
+	for _, host := range hosts {
+		if j := d.job(host); j != nil { // removed by reload meanwhile otherwise
+			jobs = append(jobs, j)
+		}
+	}
+	response := triggerResponse{}
+	response.Triggered, response.Running = d.trigger(jobs, annotations)
+	common.Log.Infof("on-demand backup requested from %s, started: %v, already in progress: %v", r.RemoteAddr, response.Triggered, response.Running)
+
+	status := http.StatusAccepted
+	if len(response.Triggered) == 0 && len(response.Running) > 0 {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/notify"
+	"tiktocker/internal/storage"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// auditSchedule parses audit.schedule, nil if the audit is disabled
+func auditSchedule(ttConfig *Config) (cron.Schedule, error) {
+	if ttConfig.Audit.Schedule == "" {
+		return nil, nil
+	}
+	schedule, err := cron.ParseStandard(ttConfig.Audit.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit.schedule: %w", err)
+	}
+	return schedule, nil
+}
+
+// scheduleAudit replaces the scheduled audit, nil schedule disables it
+func (d *fleetDaemon) scheduleAudit(schedule cron.Schedule, expression string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.auditEntry != 0 {
+		d.scheduler.Remove(d.auditEntry)
+		d.auditEntry = 0
+	}
+	if schedule == nil {
+		return
+	}
+	d.auditEntry = d.scheduler.Schedule(schedule, cron.FuncJob(d.audit))
+	common.Log.Infof("audit schedule %s, next audit: %s", expression, schedule.Next(time.Now()).Format(time.RFC3339))
+}
+
+// audit re-verifies the latest stored artifacts against their recorded checksums, the corrupted and missing ones are logged and notified.
+// Exports of the devices backed up since the daemon started are expected to be stored
+func (d *fleetDaemon) audit() {
+	defer common.CapturePanic()
+	if d.schedulingCtx.Err() != nil {
+		return
+	}
+	if !d.auditing.CompareAndSwap(false, true) {
+		common.Log.Warnf("previous audit still in progress, skipping")
+		return
+	}
+	defer d.auditing.Store(false)
+
+	ttConfig := d.config.Load()
+	runId := newRunId()
+	log := common.Log.WithField("run_id", runId)
+	ctx := common.WithLogger(d.mainCtx, log)
+	start := time.Now()
+	log.Infof("audit of %s starting", d.runner.store)
+	catalog, err := storage.LoadCatalog(ctx, d.runner.store)
+	if err != nil {
+		log.Errorf("audit failure: %v", err)
+		return
+	}
+	results, err := storage.VerifyIntegrity(ctx, d.runner.store, ttConfig.Storage.KeyPrefix(), catalog, nil, !ttConfig.Audit.Head)
+	if err != nil {
+		log.Errorf("audit failure: %v", err)
+		return
+	}
+
+	failed := make([]storage.IntegrityResult, 0)
+	for _, r := range results {
+		if r.Failed() {
+			failed = append(failed, r)
+		}
+	}
+	failed = append(failed, d.missingExports(results)...)
+	if len(failed) == 0 {
+		log.Infof("audit: %d artifacts verified in %s", len(results), time.Since(start).Round(time.Millisecond))
+		return
+	}
+	for _, r := range failed {
+		log.Errorf("audit: %s %s: %s", r.Key, r.Status, r.Detail)
+	}
+	log.Errorf("audit: %d artifacts in %s failed verification", len(failed), d.runner.store)
+	d.runner.notifier.Notify(ctx, notify.NewAudit(runId, failed, d.annotations))
+}
+
+// missingExports returns devices backed up by the daemon whose export is no longer stored (e.g. removed by a bucket lifecycle rule)
+func (d *fleetDaemon) missingExports(results []storage.IntegrityResult) []storage.IntegrityResult {
+	// stored or already reported missing by the catalog
+	verified := make(map[string]bool)
+	for _, r := range results {
+		if strings.HasPrefix(path.Base(r.Key), backup.ExportFileName(r.Device)) {
+			verified[r.Device] = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hosts := make([]string, 0, len(d.identities))
+	for host := range d.identities {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	missing := make([]storage.IntegrityResult, 0)
+	for _, host := range hosts {
+		identity := d.identities[host]
+		if !verified[identity] {
+			missing = append(missing, storage.IntegrityResult{
+				Key:    backup.ExportFileName(identity),
+				Device: identity,
+				Status: storage.IntegrityMissing,
+				Detail: fmt.Sprintf("no export of Mikrotik %s stored", host),
+			})
+		}
+	}
+	return missing
+}
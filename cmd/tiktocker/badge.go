@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"tiktocker/internal/badge"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+	"tiktocker/internal/storage"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultBadgeMaxAge = 24 * time.Hour
+
+	// the badge endpoints are meant to be public, requests over the limit are rejected with 429
+	badgeRequestsPerSecond = 5
+	badgeRequestsBurst     = 20
+)
+
+func newBadge(config *Config, st *state.Store) (*badge.Badge, error) {
+	maxAge := config.Badge.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultBadgeMaxAge
+	}
+	hosts := make([]string, 0, len(config.Mikrotiks))
+	for _, m := range config.Mikrotiks {
+		hosts = append(hosts, m.Host)
+	}
+	return badge.New(hosts, st, maxAge, time.Now())
+}
+
+// publishBadge stores the fleet status badge at the storage root
+func publishBadge(ctx context.Context, config *Config, store storage.Storage, st *state.Store) {
+	b, err := newBadge(config, st)
+	if err != nil {
+		common.Log.Errorf("failed to create status badge: %v", err)
+		return
+	}
+	if err := badge.Publish(ctx, store, b); err != nil {
+		common.Log.Errorf("failed to publish status badge: %v", err)
+		return
+	}
+	common.Log.Debugf("status badge published: %s", b.Message)
+}
+
+// serveBadge serves /badge.svg and /badge.json rendered from the current state, config returns the current configuration (changes on reload)
+func serveBadge(listen string, config func() *Config, st *state.Store) {
+	limiter := rate.NewLimiter(badgeRequestsPerSecond, badgeRequestsBurst)
+	handler := func(contentType string, render func(*badge.Badge) ([]byte, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			if !limiter.Allow() {
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			b, err := newBadge(config(), st)
+			if err != nil {
+				common.Log.Errorf("failed to create status badge: %v", err)
+				http.Error(w, "badge not available", http.StatusInternalServerError)
+				return
+			}
+			contents, err := render(b)
+			if err != nil {
+				http.Error(w, "badge not available", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Cache-Control", "max-age=60")
+			_, _ = w.Write(contents)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+badge.SVGName, handler("image/svg+xml", func(b *badge.Badge) ([]byte, error) {
+		return b.SVG(), nil
+	}))
+	mux.HandleFunc("/"+badge.JSONName, handler("application/json", (*badge.Badge).JSON))
+
+	go func() {
+		common.Log.Infof("status badge listening on %s", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			common.Log.Errorf("status badge server failure: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"tiktocker/internal/bundle"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// stdio reads or writes the bundle through stdin/stdout, e.g. to pipe it over ssh
+const stdio = "-"
+
+// runBundle exports or imports the bundle, returns the exit code
+func runBundle(ttConfig *Config, command string, file string) int {
+	ctx := context.Background()
+	store, err := storage.New(ctx, &ttConfig.Storage, nil)
+	if err != nil {
+		common.Log.Errorf("failed to create storage client: %v", err)
+		return exitFailure
+	}
+
+	switch command {
+	case "export":
+		return exportBundle(ctx, ttConfig, store)
+	case "import":
+		return importBundle(ctx, ttConfig, store, file)
+	default:
+		common.Log.Errorf("unknown bundle command: %s, must be: export, import", command)
+		return exitConfig
+	}
+}
+
+func exportBundle(ctx context.Context, ttConfig *Config, store storage.Storage) int {
+	if bundleOut == "" {
+		common.Log.Errorf("bundle export requires --out file (- for stdout)")
+		return exitConfig
+	}
+	now := time.Now()
+	var since time.Time
+	if bundleSince != "" {
+		age, err := parseAge(bundleSince)
+		if err != nil {
+			common.Log.Errorf("invalid --since: %v", err)
+			return exitConfig
+		}
+		since = now.Add(-age)
+	}
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if bundleOut != stdio {
+		// written next to the destination and renamed, a failed export doesn't leave bundle which looks complete
+		var err error
+		if f, err = os.Create(bundleOut + ".tmp"); err != nil {
+			common.Log.Errorf("failed to create bundle: %v", err)
+			return exitFailure
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		w = f
+	}
+	manifest, err := bundle.Export(ctx, store, ttConfig.Storage.KeyPrefix(), since, w, now)
+	if err != nil {
+		common.Log.Errorf("bundle export failure: %v", err)
+		return exitFailure
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			common.Log.Errorf("failed to write bundle: %v", err)
+			return exitFailure
+		}
+		if err := os.Rename(f.Name(), bundleOut); err != nil {
+			common.Log.Errorf("failed to write bundle: %v", err)
+			return exitFailure
+		}
+	}
+	common.Log.Infof("exported %d objects of %s into bundle %s", len(manifest.Objects), store, bundleOut)
+	return 0
+}
+
+func importBundle(ctx context.Context, ttConfig *Config, store storage.Storage, bundlePath string) int {
+	if bundlePath == "" {
+		common.Log.Errorf("bundle import requires bundle file: bundle import <file> (- for stdin)")
+		return exitConfig
+	}
+	var r io.Reader = os.Stdin
+	if bundlePath != stdio {
+		f, err := os.Open(bundlePath)
+		if err != nil {
+			common.Log.Errorf("failed to open bundle: %v", err)
+			return exitFailure
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var catalog *storage.Catalog
+	if ttConfig.Catalog {
+		var err error
+		if catalog, err = storage.LoadCatalog(ctx, store); err != nil {
+			common.Log.Errorf("%v", err)
+			return exitFailure
+		}
+	}
+	now := time.Now()
+	manifest, err := bundle.Import(ctx, store, r, catalog, now)
+	if err != nil {
+		common.Log.Errorf("bundle import failure (%d objects imported): %v", len(manifest.Objects), err)
+		return exitFailure
+	}
+	if catalog != nil {
+		if err := catalog.Save(ctx, store, now); err != nil {
+			common.Log.Errorf("failed to update catalog: %v", err)
+			return exitFailure
+		}
+	}
+	common.Log.Infof("imported %d objects from %s into %s", len(manifest.Objects), manifest.Source, store)
+	return 0
+}
+
+// parseAge parses duration also accepting days, e.g. 30d
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s, must be duration e.g. 30d or 12h", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("%s, must be duration e.g. 30d or 12h", value)
+	}
+	return age, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"tiktocker/internal/common"
+	"tiktocker/internal/report"
+	"tiktocker/internal/state"
+	"time"
+)
+
+// parseCanary parses percent (e.g. 10%) or count (e.g. 5) of devices, the result is at least 1
+func parseCanary(value string, total int) (int, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid canary percent: %s", value)
+		}
+		return max(1, int(float64(total)*percent/100)), nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid canary count: %s", value)
+	}
+	return min(count, total), nil
+}
+
+// selectCanary returns random subset of targets, in the same order as targets
+func selectCanary(targets []*common.BackupSettings, count int) []*common.BackupSettings {
+	selected := make([]*common.BackupSettings, len(targets))
+	copy(selected, targets)
+	rand.Shuffle(len(selected), func(i, j int) {
+		selected[i], selected[j] = selected[j], selected[i]
+	})
+	selected = selected[:count]
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].BaseUrl.Host < selected[j].BaseUrl.Host
+	})
+	return selected
+}
+
+// snapshotHistory reads state records of given devices before they are overwritten by the run
+func snapshotHistory(st *state.Store, targets []*common.BackupSettings) map[string]*state.DeviceRecord {
+	history := make(map[string]*state.DeviceRecord)
+	if st == nil {
+		return history
+	}
+	for _, t := range targets {
+		record, found, err := st.GetDevice(t.BaseUrl.Host)
+		if err != nil {
+			common.Log.Warnf("failed to read Mikrotik %s state: %v", t.BaseUrl.Host, err)
+			continue
+		}
+		if found {
+			history[t.BaseUrl.Host] = record
+		}
+	}
+	return history
+}
+
+// printCanaryReport compares canary results with the history recorded by previous runs
+func printCanaryReport(st *state.Store, previous map[string]*state.DeviceRecord, manifest *report.Manifest) {
+	fmt.Printf("canary run of %d devices:\n", len(manifest.Devices))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HOST\tSTATUS\tDURATION\tEXPORT SIZE\tBACKUP SIZE\t")
+	for _, d := range manifest.Devices {
+		prev, hasPrev := previous[d.Host]
+		var current *state.DeviceRecord
+		if st != nil && d.Status != report.StatusFailed {
+			current, _, _ = st.GetDevice(d.Host)
+		}
+		if !hasPrev || current == nil {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t\n", d.Host, d.Status, d.Duration.Round(time.Millisecond))
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s -> %s\t%s\t%s\t\n",
+			d.Host,
+			d.Status,
+			prev.Duration.Round(time.Millisecond),
+			current.Duration.Round(time.Millisecond),
+			sizeChange(prev.ExportSize, current.ExportSize),
+			sizeChange(prev.BackupSize, current.BackupSize),
+		)
+	}
+	_ = w.Flush()
+	if len(previous) == 0 {
+		fmt.Println("no history recorded for canary devices (state.path not set or first run), nothing to compare with")
+	}
+}
+
+func sizeChange(before int64, after int64) string {
+	if before == 0 {
+		return fmt.Sprintf("%d", after)
+	}
+	return fmt.Sprintf("%d -> %d (%+.1f%%)", before, after, float64(after-before)*100/float64(before))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/drift"
+	"tiktocker/internal/mirror"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// changelogEntry is the stored export version compared with the previous one
+type changelogEntry struct {
+	Key    string
+	Stored time.Time
+	First  bool // the oldest stored version, nothing to compare with
+	Change drift.Change
+	Diff   string // --diff only
+}
+
+// runChangelog prints the chronological history of config changes of the device identity, one entry per stored export version
+func runChangelog(ttConfig *Config, args []string) int {
+	identity := args[0]
+	ctx := context.Background()
+	var since time.Time
+	if bundleSince != "" {
+		age, err := parseAge(bundleSince)
+		if err != nil {
+			common.Log.Errorf("invalid --since: %v", err)
+			return exitConfig
+		}
+		since = time.Now().Add(-age)
+	}
+	normalizer, err := drift.NewNormalizer(ttConfig.ChangeDetection.Normalize)
+	if err != nil {
+		common.Log.Errorf("changeDetection.normalize: %v", err)
+		return exitConfig
+	}
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	listed, err := source.Store.List(ctx)
+	if err != nil {
+		common.Log.Errorf("%s listing failure: %v", source.Store, err)
+		return exitFailure
+	}
+
+	versions, err := exportVersions(storage.DeviceHistory(listed, identity), identity)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	if len(versions) == 0 {
+		common.Log.Errorf("no %s stored in %s", backup.ExportFileName(identity), source.Store)
+		return exitFailure
+	}
+	entries, err := changelog(ctx, source, versions, since, normalizer, changelogDiff)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	printChangelog(identity, entries)
+	if len(versions) == 1 {
+		common.Log.Infof("single export version stored in %s, previous versions are kept by versioned storage (S3, B2)", source.Store)
+	}
+	return 0
+}
+
+// exportVersions returns the stored versions of the device export oldest first, history is ordered newest first.
+// Post-processed (compressed, encrypted) exports cannot be compared
+func exportVersions(history []storage.ObjectInfo, identity string) ([]storage.ObjectInfo, error) {
+	name := backup.ExportFileName(identity)
+	versions := make([]storage.ObjectInfo, 0)
+	for _, o := range history {
+		base := path.Base(o.Key)
+		if !storage.Transferable(o.Key) || (base != name && !strings.HasPrefix(base, name+".")) {
+			continue
+		}
+		if base != name {
+			return nil, fmt.Errorf("stored export %s is post-processed, cannot be compared", o.Key)
+		}
+		versions = append(versions, o)
+	}
+	slices.Reverse(versions)
+	return versions, nil
+}
+
+// changelog compares every version with the previous one, versions stored before since are only compared with
+func changelog(ctx context.Context, source mirror.Endpoint, versions []storage.ObjectInfo, since time.Time, normalizer *drift.Normalizer, withDiff bool) ([]changelogEntry, error) {
+	entries := make([]changelogEntry, 0, len(versions))
+	var previous []byte
+	var previousEntry changelogEntry
+	for i, v := range versions {
+		key := storage.RelativeKey(source.KeyPrefix, v.Key)
+		// the version before since is the baseline of the first listed change
+		if i+1 < len(versions) && !since.IsZero() && !versions[i+1].LastModified.After(since) {
+			continue
+		}
+		current, err := readVersion(ctx, source.Store, key, v)
+		if err != nil {
+			return nil, err
+		}
+		entry := changelogEntry{Key: key, Stored: v.LastModified, First: previous == nil}
+		if previous != nil {
+			entry.Change = normalizer.Summarize(previous, current)
+			if withDiff && !entry.Change.Empty() {
+				if entry.Diff, err = normalizer.Unified(previous, versionName(previousEntry), current, versionName(entry)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if since.IsZero() || v.LastModified.After(since) {
+			entries = append(entries, entry)
+		}
+		previous, previousEntry = current, entry
+	}
+	return entries, nil
+}
+
+func readVersion(ctx context.Context, store storage.Storage, key string, version storage.ObjectInfo) ([]byte, error) {
+	r, err := storage.OpenVersion(ctx, store, key, version)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to read %s: %w", store, key, err)
+	}
+	return contents, nil
+}
+
+func versionName(e changelogEntry) string {
+	return fmt.Sprintf("%s (stored %s)", e.Key, e.Stored.UTC().Format(time.RFC3339))
+}
+
+func printChangelog(identity string, entries []changelogEntry) {
+	if len(entries) == 0 {
+		fmt.Printf("%s: no changes stored\n", identity)
+		return
+	}
+	fmt.Printf("%s config changelog:\n", identity)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		stored := e.Stored.UTC().Format(time.RFC3339)
+		switch {
+		case e.First:
+			_, _ = fmt.Fprintf(w, "  %s\t\tfirst stored export\n", stored)
+		case e.Change.Empty():
+			_, _ = fmt.Fprintf(w, "  %s\t\tno changes once normalized (e.g. forced backup)\n", stored)
+		default:
+			_, _ = fmt.Fprintf(w, "  %s\t+%d -%d\t%s\n", stored, e.Change.Added, e.Change.Removed, sectionsText(e.Change.Sections))
+		}
+		if e.Diff != "" {
+			_ = w.Flush()
+			fmt.Print(e.Diff)
+		}
+	}
+	_ = w.Flush()
+}
+
+// sectionsText returns the changed sections, e.g. /ip address, /ip firewall filter
+func sectionsText(sections []string) string {
+	if len(sections) == 0 {
+		return "(no section)"
+	}
+	return strings.Join(sections, ", ")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkSkip = "skip" // not checked, the preceding check failed
+)
+
+// preflightCheck is a row of the check table
+type preflightCheck struct {
+	Target string
+	Check  string
+	Status string
+	Detail string
+}
+
+// runCheck tests REST, credentials and SSH of every device and write access of every storage without backing up, exits with exitFailure if any check fails
+func runCheck(ttConfig *Config, _ []string) int {
+	ctx := context.Background()
+	targets := createTargets(ttConfig)
+	if len(targets) != len(ttConfig.Mikrotiks) {
+		return exitConfig // invalid device settings are logged by createTargets
+	}
+
+	deviceChecks := make([][]preflightCheck, len(targets))
+	var wg sync.WaitGroup
+	for i, settings := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deviceChecks[i] = checkDevice(ctx, settings)
+		}()
+	}
+	checks := make([]preflightCheck, 0, 3*len(targets)+1+len(ttConfig.Destinations))
+	names := make([]string, 0, len(ttConfig.Destinations))
+	for name := range ttConfig.Destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range append([]string{""}, names...) {
+		checks = append(checks, checkStorage(ctx, ttConfig, name))
+	}
+	wg.Wait()
+	for _, c := range deviceChecks {
+		checks = append(checks, c...)
+	}
+
+	printChecks(checks)
+	failed := 0
+	for _, c := range checks {
+		if c.Status == checkFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		common.Log.Errorf("%d of %d checks failed", failed, len(checks))
+		return exitFailure
+	}
+	return 0
+}
+
+// checkDevice returns rest, credentials and ssh checks of the device
+func checkDevice(ctx context.Context, settings *common.BackupSettings) []preflightCheck {
+	host := settings.BaseUrl.Host
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	rest := preflightCheck{Target: host, Check: "rest", Status: checkPass}
+	credentials := preflightCheck{Target: host, Check: "credentials", Status: checkPass}
+	ssh := preflightCheck{Target: host, Check: "ssh", Status: checkPass}
+
+	identity, err := backup.CheckRest(ctx, settings, client)
+	switch {
+	case errors.Is(err, backup.ErrUnauthorized):
+		credentials.Status, credentials.Detail = checkFail, err.Error()
+	case err != nil:
+		rest.Status, rest.Detail = checkFail, err.Error()
+		credentials.Status = checkSkip
+	default:
+		rest.Detail = "identity " + identity
+	}
+	if err := backup.CheckScp(ctx, settings); err != nil {
+		ssh.Status, ssh.Detail = checkFail, err.Error()
+	}
+	return []preflightCheck{rest, credentials, ssh}
+}
+
+// checkStorage stores and removes probe file in the destinations entry, empty name - the main storage
+func checkStorage(ctx context.Context, ttConfig *Config, name string) preflightCheck {
+	c := preflightCheck{Target: "storage", Check: "write", Status: checkPass}
+	if name != "" {
+		c.Target = "destination " + name
+	}
+	destination, err := openDestination(ctx, ttConfig, name)
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+	c.Detail = destination.Store.String()
+	if err := storage.CheckWriteAccess(ctx, destination.Store); err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+	}
+	return c
+}
+
+func printChecks(checks []preflightCheck) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TARGET\tCHECK\tRESULT\tDETAIL")
+	for _, c := range checks {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Target, c.Check, c.Status, c.Detail)
+	}
+	_ = w.Flush()
+}
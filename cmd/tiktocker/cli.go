@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"tiktocker/internal/common"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// globalFlags apply to every command, they are bound to the configuration keys of the same name, e.g. log.level
+var globalFlags = pflag.NewFlagSet("tiktocker", pflag.ContinueOnError)
+
+// commandExitCode is set by the executed command
+var commandExitCode int
+
+func init() {
+	globalFlags.String("log.level", "", "log level (overrides yaml file)")
+	globalFlags.StringVar(&configDir, "config-dir", "", "directory of *.yaml files merged in file name order over the config files, their mikrotiks are concatenated")
+	globalFlags.StringVar(&secretsDir, "secrets-dir", defaultSecretsDir, "directory of mounted secrets, files are config keys (e.g. s3.secretKey), <host>/<key> of devices")
+	globalFlags.CountVarP(&verbose, "verbose", "v", "debug logs, -vv trace logs (overrides log.level)")
+	globalFlags.StringVar(&profile, "profile", "", "write cpu or mem profile of the run (cpu|mem)")
+	globalFlags.StringVar(&profilePath, "profile-path", "", "profile output file (default tiktocker.<profile>.pprof)")
+}
+
+// newRootCommand returns the CLI, without command it backs up the devices as the backup command
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "tiktocker",
+		Short:         "Mikrotik configuration backup",
+		Args:          cobra.NoArgs,
+		Run:           runCommand(backupCommand),
+		SilenceUsage:  true,
+		SilenceErrors: false,
+	}
+	root.PersistentFlags().AddFlagSet(globalFlags)
+	backupFlags(root.Flags())
+
+	backup := &cobra.Command{
+		Use:   "backup",
+		Short: "Back up the configured devices once, or on their schedule with --daemon",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(backupCommand),
+	}
+	backupFlags(backup.Flags())
+
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete object versions beyond the retention policy",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(outputCommand(runPrune)),
+	}
+	prune.Flags().BoolVar(&dryRun, "dry-run", false, "only list object versions which would be deleted")
+	prune.Flags().BoolVar(&yesDelete, "yes-delete", false, "confirm deletion of object versions")
+	outputFlag(prune.Flags())
+
+	sync := &cobra.Command{
+		Use:   "sync",
+		Short: "Copy artifacts missing or changed in the target destination",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(outputCommand(runSync)),
+	}
+	sync.Flags().StringVar(&syncFrom, "from", "", "source destination name (default the main storage)")
+	sync.Flags().StringVar(&syncTo, "to", "", "target destination name")
+	sync.Flags().StringArrayVar(&syncDevices, "device", nil, "only artifacts of device identities matching the glob (repeatable)")
+	sync.Flags().StringVar(&syncPrefix, "prefix", "", "only artifacts under the key prefix, e.g. site directory of prefixTemplate")
+	sync.Flags().StringVar(&bundleSince, "since", "", "only artifacts stored within, e.g. 30d or 12h (default all)")
+	sync.Flags().BoolVar(&dryRun, "dry-run", false, "only list objects which would be copied")
+	outputFlag(sync.Flags())
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the stored backups per device with their timestamps, sizes and checksums",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(outputCommand(runList)),
+	}
+	list.Flags().StringVar(&syncFrom, "from", "", "destination name (default the main storage)")
+	list.Flags().StringArrayVar(&syncDevices, "device", nil, "only backups of device identities matching the glob (repeatable)")
+	list.Flags().BoolVar(&listVersions, "versions", false, "include previous versions of versioned storage")
+	outputFlag(list.Flags())
+
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Revalidate checksums of the stored artifacts, report corrupted or missing ones per device",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(runVerify),
+	}
+	verify.Flags().StringVar(&syncFrom, "from", "", "destination name (default the main storage)")
+	verify.Flags().StringArrayVar(&syncDevices, "device", nil, "only artifacts of device identities matching the glob (repeatable)")
+	verify.Flags().BoolVar(&verifyHead, "head", false, "only check the recorded checksums, the contents are not downloaded")
+
+	fetch := &cobra.Command{
+		Use:   "fetch <identity>",
+		Short: "Download the stored backup or export of the device, e.g. to prepare a restore or inspect an old config",
+		Args:  cobra.ExactArgs(1),
+		Run:   runCommand(outputCommand(runFetch)),
+	}
+	fetch.Flags().StringVar(&syncFrom, "from", "", "destination name (default the main storage)")
+	fetch.Flags().BoolVar(&fetchExport, "export", false, "download the config export instead of the binary backup")
+	fetch.Flags().StringVar(&fetchAt, "at", "", "newest version stored at the RFC3339 timestamp or by the end of the date (default the latest)")
+	fetch.Flags().StringVar(&fetchOut, "out", "", "output file, - for stdout (default the stored file name)")
+	outputFlag(fetch.Flags())
+
+	restore := &cobra.Command{
+		Use:   "restore <host> [key]",
+		Short: "Upload the stored .backup or .rsc to the configured device and load or import it, without the key pick one of the stored versions",
+		Args:  cobra.RangeArgs(1, 2),
+		Run:   runCommand(runRestore),
+	}
+	restore.Flags().StringVar(&syncFrom, "from", "", "destination name (default the main storage)")
+	restore.Flags().BoolVar(&dryRun, "dry-run", false, "only upload the file to the device")
+	restore.Flags().BoolVar(&restoreYes, "yes", false, "do not ask for confirmation")
+	restore.Flags().BoolVar(&restoreForce, "force", false, "load the backup also when its RouterOS version or architecture differs from the device")
+
+	diff := &cobra.Command{
+		Use:   "diff [host...]",
+		Short: "Print unified diff of the current device config against the last stored export, without backing it up",
+		Run:   runCommand(runDiff),
+	}
+	diff.Flags().StringVar(&syncFrom, "from", "", "destination name (default the main storage)")
+
+	changelog := &cobra.Command{
+		Use:   "changelog <identity>",
+		Short: "Print chronological history of the device config changes from its stored export versions",
+		Args:  cobra.ExactArgs(1),
+		Run:   runCommand(runChangelog),
+	}
+	changelog.Flags().StringVar(&syncFrom, "from", "", "destination name (default the main storage)")
+	changelog.Flags().StringVar(&bundleSince, "since", "", "only changes stored within, e.g. 30d or 12h (default all)")
+	changelog.Flags().BoolVar(&changelogDiff, "diff", false, "print unified diff of every change")
+
+	bundle := &cobra.Command{
+		Use:   "bundle",
+		Short: "Export or import the artifacts as a single file, e.g. for air-gapped sites",
+	}
+	bundleExport := &cobra.Command{
+		Use:   "export",
+		Short: "Write the latest artifacts into the bundle",
+		Args:  cobra.NoArgs,
+		Run: runCommand(func(ttConfig *Config, _ []string) int {
+			return runBundle(ttConfig, "export", "")
+		}),
+	}
+	bundleExport.Flags().StringVar(&bundleSince, "since", "", "only artifacts stored within, e.g. 30d or 12h (default all)")
+	bundleExport.Flags().StringVar(&bundleOut, "out", "", "bundle file, - for stdout")
+	bundleImport := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Store the artifacts of the bundle, - reads stdin",
+		Args:  cobra.ExactArgs(1),
+		Run: runCommand(func(ttConfig *Config, args []string) int {
+			return runBundle(ttConfig, "import", args[0])
+		}),
+	}
+	bundle.AddCommand(bundleExport, bundleImport)
+
+	check := &cobra.Command{
+		Use:   "check",
+		Short: "Test REST, credentials and SSH of every device and write access of every storage, without backing up",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(runCheck),
+	}
+
+	config := &cobra.Command{
+		Use:   "config",
+		Short: "Configuration commands",
+	}
+	validate := &cobra.Command{
+		Use:   "validate",
+		Short: "Report every problem of the configuration without connecting to the devices or storage",
+		Args:  cobra.NoArgs,
+		Run: func(*cobra.Command, []string) {
+			commandExitCode = runValidate(os.Stdout)
+		},
+	}
+	config.AddCommand(validate)
+
+	device := &cobra.Command{
+		Use:   "device",
+		Short: "Device inventory commands",
+	}
+	deviceAdd := &cobra.Command{
+		Use:   "add",
+		Short: "Prompt for the device settings, test connectivity and append the device to the inventory or config file",
+		Args:  cobra.NoArgs,
+		Run:   runCommand(runDeviceAdd),
+	}
+	deviceAdd.Flags().StringVar(&deviceFile, "file", "", "file the device is appended to (default the inventory, config.yaml without inventory)")
+	device.AddCommand(deviceAdd)
+
+	versionCommand := &cobra.Command{
+		Use:   "version",
+		Short: "Print version, commit and build date of the binary",
+		Args:  cobra.NoArgs,
+		Run: func(*cobra.Command, []string) {
+			fmt.Printf("tiktocker %s\n", buildVersion())
+		},
+	}
+
+	root.AddCommand(versionCommand, backup, check, list, diff, changelog, verify, fetch, restore, prune, sync, bundle, config, device)
+	return root
+}
+
+func backupFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&canary, "canary", "", "run only random subset of devices (percent e.g. 10% or count) and compare with history")
+	flags.BoolVar(&daemon, "daemon", false, "keep running and back up devices on their schedule")
+	flags.BoolVar(&force, "force", false, "skip change detection, back up and store every device, e.g. before RouterOS upgrade")
+	flags.BoolVar(&dryRun, "dry-run", false, "only detect config changes, nothing is backed up on the devices or stored")
+	flags.StringVar(&adhocHost, "host", "", "back up only this device, also one not configured (with --username and --password-stdin)")
+	flags.StringVar(&adhocUsername, "username", "", "username of the --host device")
+	flags.BoolVar(&adhocPasswordStdin, "password-stdin", false, "read password of the --host device from stdin")
+	flags.StringVar(&output, "output", "", "json - print the run result (per device status, checksums, object keys, timings, errors) as JSON instead of the summary")
+	flags.StringVar(&outputFile, "output-file", "", "write the --output json result to the file, the summary is printed")
+	flags.BoolVar(&showProgress, "progress", false, "show live per-device progress on the terminal instead of the logs, they are printed once the run finishes")
+	flags.StringArrayVar(&annotate, "annotate", nil, "key=value annotation of the run recorded in the manifest and object metadata, e.g. change=CHG0012345 (repeatable)")
+}
+
+func outputFlag(flags *pflag.FlagSet) {
+	flags.StringVar(&output, "output", "", "output format, keys - only object keys one per line")
+}
+
+// runCommand returns cobra handler running the command with the loaded configuration, see runWithConfig
+func runCommand(command func(ttConfig *Config, args []string) int) func(*cobra.Command, []string) {
+	return func(_ *cobra.Command, args []string) {
+		commandExitCode = runWithConfig(func(ttConfig *Config) int {
+			return command(ttConfig, args)
+		})
+	}
+}
+
+func backupCommand(ttConfig *Config, _ []string) int {
+	annotations, err := parseAnnotations(annotate)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+	if canary != "" && daemon {
+		common.Log.Errorf("--canary cannot be used with --daemon")
+		return exitConfig
+	}
+	if dryRun && (daemon || canary != "") {
+		common.Log.Errorf("--dry-run cannot be used with --daemon or --canary")
+		return exitConfig
+	}
+	if output != "" && output != outputJson {
+		common.Log.Errorf("invalid --output: %s, must be: %s", output, outputJson)
+		return exitConfig
+	}
+	if outputFile != "" && output != outputJson {
+		common.Log.Errorf("--output-file requires --output %s", outputJson)
+		return exitConfig
+	}
+	if showProgress && daemon {
+		common.Log.Errorf("--progress cannot be used with --daemon")
+		return exitConfig
+	}
+	if output != "" && (daemon || canary != "") {
+		common.Log.Errorf("--output cannot be used with --daemon or --canary")
+		return exitConfig
+	}
+	if adhocHost != "" {
+		if daemon {
+			common.Log.Errorf("--host cannot be used with --daemon")
+			return exitConfig
+		}
+		if err := applyAdhocDevice(ttConfig, os.Stdin); err != nil {
+			common.Log.Errorf("%v", err)
+			return exitConfig
+		}
+	} else if adhocUsername != "" || adhocPasswordStdin {
+		common.Log.Errorf("--username and --password-stdin require --host")
+		return exitConfig
+	}
+	if force && daemon {
+		common.Log.Errorf("--force cannot be used with --daemon, set force of the devices instead")
+		return exitConfig
+	}
+	if daemon {
+		return runDaemon(ttConfig, annotations)
+	}
+	return runBackup(ttConfig, annotations)
+}
+
+// outputCommand validates --output of the listing commands
+func outputCommand(command func(ttConfig *Config, args []string) int) func(*Config, []string) int {
+	return func(ttConfig *Config, args []string) int {
+		if output != "" && output != outputKeys {
+			common.Log.Errorf("invalid --output: %s, must be: %s", output, outputKeys)
+			return exitConfig
+		}
+		return command(ttConfig, args)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// mergeConfigDir merges the *.yaml files of the directory in file name order (e.g. 10-site-a.yaml, 20-site-b.yaml) over the config files.
+// Settings of the later files win, except mikrotiks which are concatenated, so every file may hold devices of one site or customer.
+// Devices of the directory replace the ones of the config files, hidden files (e.g. ..data of Kubernetes ConfigMaps) are skipped
+func mergeConfigDir(v *viper.Viper, dir string) error {
+	entries, err := os.ReadDir(dir) // sorted by file name
+	if err != nil {
+		return fmt.Errorf("error reading config directory, %w", err)
+	}
+	var devices []interface{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".yaml" {
+			continue
+		}
+		configFullPath := filepath.Join(dir, name)
+		contents, err := readConfigFile(configFullPath)
+		if err != nil {
+			return fmt.Errorf("error merging config file %s, %w", configFullPath, err)
+		}
+		file := viper.New()
+		file.SetConfigType("yaml")
+		if err := file.ReadConfig(contents); err != nil {
+			return fmt.Errorf("error merging config file %s, %w", configFullPath, err)
+		}
+		if fileDevices, ok := file.Get("mikrotiks").([]interface{}); ok {
+			devices = append(devices, fileDevices...)
+		}
+		if err := v.MergeConfigMap(file.AllSettings()); err != nil {
+			return fmt.Errorf("error merging config file %s, %w", configFullPath, err)
+		}
+	}
+	if devices != nil {
+		v.Set("mikrotiks", devices)
+	}
+	return nil
+}
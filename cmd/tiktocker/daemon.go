@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"tiktocker/internal/common"
+	"tiktocker/internal/report"
+	"time"
+
+	sd "github.com/coreos/go-systemd/v22/daemon"
+	"github.com/robfig/cron/v3"
+)
+
+// fleetDaemon backs up every device on its own cron schedule, the schedule is replaced when the configuration is reloaded
+type fleetDaemon struct {
+	mainCtx       context.Context
+	schedulingCtx context.Context
+	runner        *backupRunner
+	annotations   map[string]string
+	config        atomic.Pointer[Config] // the latest loaded configuration, every backup uses the one current when it starts
+	scheduler     *cron.Cron
+
+	mu         sync.Mutex                  // guards jobs, entries, identities and manifest writes
+	jobs       map[string]*scheduledTarget // by host
+	entries    []cron.EntryID              // one per distinct schedule of the devices
+	manifest   *report.Manifest            // the latest result of every device
+	identities map[string]string           // by host, devices successfully backed up since the daemon started
+	auditEntry cron.EntryID                // 0 - no audit scheduled
+
+	auditing atomic.Bool // audit in progress, the next one is not started again
+
+	triggered sync.WaitGroup // on-demand backups in progress, not tracked by the scheduler
+}
+
+// runDaemon keeps running and backs up every device on its own cron schedule until interrupted, SIGHUP reloads the configuration.
+// Returns the exit code of the daemon setup, 0 once stopped
+func runDaemon(ttConfig *Config, annotations map[string]string) int {
+	common.Log.Infof("Mikrotik Backup %s daemon starting", buildVersion())
+
+	mainCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	schedulingCtx := handleInterrupts(cancelRun, ttConfig.DrainTimeout)
+
+	jobs, err := scheduleTargets(createTargets(ttConfig))
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+	audit, err := auditSchedule(ttConfig)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+	runner, closeRunner, err := newBackupRunner(mainCtx, ttConfig)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	defer closeRunner()
+
+	d := &fleetDaemon{
+		mainCtx:       mainCtx,
+		schedulingCtx: schedulingCtx,
+		runner:        runner,
+		annotations:   annotations,
+		scheduler:     cron.New(),
+		manifest:      report.NewManifest(),
+		identities:    make(map[string]string),
+	}
+	d.config.Store(ttConfig)
+	d.manifest.IncludeStats = ttConfig.ManifestStats
+	d.manifest.Annotations = annotations
+	if ttConfig.Badge.Listen != "" && runner.state != nil {
+		serveBadge(ttConfig.Badge.Listen, d.config.Load, runner.state)
+	}
+	if ttConfig.Api.Listen != "" {
+		if err := serveApi(ttConfig.Api.Listen, ttConfig.Api.Token, d); err != nil {
+			common.Log.Errorf("%v", err)
+			return exitConfig
+		}
+	}
+
+	if ttConfig.Health.Listen != "" {
+		serveHealth(ttConfig.Health.Listen, d)
+	}
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	defer signal.Stop(reloads)
+	watchRemote(schedulingCtx, ttConfig.Remote, reloads)
+
+	d.schedule(jobs)
+	d.scheduleAudit(audit, ttConfig.Audit.Schedule)
+	d.scheduler.Start()
+	notifySystemd(fmt.Sprintf("%s\nSTATUS=%d devices scheduled", sd.SdNotifyReady, len(jobs)))
+	startWatchdog(schedulingCtx, d.schedulerHealth) // the same check as /healthz
+
+	for running := true; running; {
+		select {
+		case <-schedulingCtx.Done():
+			running = false
+		case <-reloads:
+			d.reload()
+		}
+	}
+	common.Log.Infof("daemon stopping, waiting for the backups in progress")
+	notifySystemd(fmt.Sprintf("%s\nSTATUS=stopping, waiting for the backups in progress", sd.SdNotifyStopping))
+	<-d.scheduler.Stop().Done()
+	d.triggered.Wait()
+	return 0
+}
+
+// schedule replaces the scheduled jobs, backups in progress finish with the settings they were started with.
+// Devices of the same schedule are backed up in the same run, the results are published once per run
+func (d *fleetDaemon) schedule(jobs []*scheduledTarget) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	previous := d.jobs
+	d.jobs = make(map[string]*scheduledTarget, len(jobs))
+	hosts := make(map[string]bool, len(jobs))
+	ticks := make(map[string][]*scheduledTarget)
+	expressions := make([]string, 0)
+	for _, j := range jobs {
+		host := j.target.BaseUrl.Host
+		if p, ok := previous[host]; ok {
+			j.running = p.running // backup started before the reload still prevents the overlapping one
+		} else {
+			j.running = &atomic.Bool{}
+		}
+		if _, ok := ticks[j.target.Schedule]; !ok {
+			expressions = append(expressions, j.target.Schedule)
+		}
+		ticks[j.target.Schedule] = append(ticks[j.target.Schedule], j)
+		d.jobs[host] = j
+		hosts[host] = true
+		common.Log.Infof("Mikrotik %s schedule %s, next backup: %s", host, j.target.Schedule, j.schedule.Next(time.Now()).Format(time.RFC3339))
+	}
+	for _, entry := range d.entries {
+		d.scheduler.Remove(entry)
+	}
+	d.entries = make([]cron.EntryID, 0, len(expressions))
+	for _, expression := range expressions {
+		tick := ticks[expression]
+		d.entries = append(d.entries, d.scheduler.Schedule(tick[0].schedule, cron.FuncJob(func() { d.tick(expression, tick) })))
+	}
+	for host := range previous {
+		if !hosts[host] {
+			delete(d.identities, host)
+			common.Log.Infof("Mikrotik %s removed from the schedule", host)
+		}
+	}
+	d.manifest.Retain(hosts)
+}
+
+// tick runs the scheduled backup of the devices due at the same time, each device has its own overlap protection:
+// a device whose backup is still in progress when the next one is due is not started again
+func (d *fleetDaemon) tick(expression string, jobs []*scheduledTarget) {
+	defer common.CapturePanic()
+	if d.schedulingCtx.Err() != nil {
+		return
+	}
+	due := make(map[string]*scheduledTarget, len(jobs))
+	targets := make([]*common.BackupSettings, 0, len(jobs))
+	for _, j := range jobs {
+		if !j.running.CompareAndSwap(false, true) {
+			common.Log.Warnf("Mikrotik %s previous backup still in progress, skipping", j.target.BaseUrl.Host)
+			continue
+		}
+		due[j.target.BaseUrl.Host] = j
+		targets = append(targets, j.target)
+	}
+	if len(targets) == 0 {
+		return
+	}
+	common.Log.Debugf("scheduled backup of %d Mikrotik devices (%s) starting", len(targets), expression)
+	d.run(targets, d.annotations, func(host string) {
+		due[host].running.Store(false)
+	})
+	common.Log.Infof("schedule %s (%d devices) next backup: %s", expression, len(jobs), jobs[0].schedule.Next(time.Now()).Format(time.RFC3339))
+}
+
+// trigger starts immediate backup of the devices as single run regardless of their backup window and minInterval,
+// returns the started ones and the ones whose backup is in progress
+func (d *fleetDaemon) trigger(jobs []*scheduledTarget, annotations map[string]string) ([]string, []string) {
+	started, running := make([]string, 0, len(jobs)), make([]string, 0)
+	due := make(map[string]*scheduledTarget, len(jobs))
+	targets := make([]*common.BackupSettings, 0, len(jobs))
+	for _, j := range jobs {
+		host := j.target.BaseUrl.Host
+		if !j.running.CompareAndSwap(false, true) {
+			running = append(running, host)
+			continue
+		}
+		target := *j.target
+		target.Window = nil
+		target.MinInterval = 0
+		due[host] = j
+		targets = append(targets, &target)
+		started = append(started, host)
+	}
+	if len(targets) == 0 {
+		return started, running
+	}
+	d.triggered.Add(1)
+	go func() {
+		defer d.triggered.Done()
+		defer common.CapturePanic()
+		common.Log.Infof("on-demand backup of Mikrotik %s starting", strings.Join(started, ", "))
+		d.run(targets, annotations, func(host string) {
+			due[host].running.Store(false)
+		})
+	}()
+	return started, running
+}
+
+// run backs up the targets as single run, publishes its results once and records them in the fleet manifest.
+// finished is called for every target once its backup is done
+func (d *fleetDaemon) run(targets []*common.BackupSettings, annotations map[string]string, finished func(host string)) {
+	ttConfig := d.config.Load()
+	result := beginRun(d.mainCtx, ttConfig, d.runner, targets, annotations)
+	backupTargets(d.mainCtx, d.schedulingCtx, ttConfig, d.runner, result, targets, finished)
+	publishRun(d.mainCtx, d.schedulingCtx, ttConfig, d.runner, result)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// devices removed from the config while backed up are not recorded
+	hosts := make(map[string]bool, len(d.jobs))
+	for host := range d.jobs {
+		hosts[host] = true
+	}
+	d.manifest.Merge(result)
+	d.manifest.Retain(hosts)
+	for _, r := range result.Devices {
+		if hosts[r.Host] && !d.runner.dryRun && r.Identity != "" && (r.Status == report.StatusChanged || r.Status == report.StatusUnchanged) {
+			d.identities[r.Host] = r.Identity
+		}
+	}
+	if ttConfig.Manifest != "" {
+		if err := d.manifest.Write(ttConfig.Manifest); err != nil {
+			common.Log.Errorf("failed to write manifest: %v", err)
+		}
+	}
+	for _, r := range result.Devices {
+		if hosts[r.Host] {
+			notifySystemd(systemdStatus(d.manifest, len(d.jobs), r))
+		}
+	}
+}
+
+// job returns the scheduled device, nil if not configured
+func (d *fleetDaemon) job(host string) *scheduledTarget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.jobs[host]
+}
+
+// hosts returns the scheduled devices in host order
+func (d *fleetDaemon) hosts() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hosts := make([]string, 0, len(d.jobs))
+	for host := range d.jobs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// reload applies added and removed devices, their credentials and schedules, invalid configuration is rejected as a whole.
+// Settings of the storage, state and post-processing are opened once, their changes require restart
+func (d *fleetDaemon) reload() {
+	common.Log.Infof("reloading configuration")
+	notifySystemd(sd.SdNotifyReloading)
+	defer notifySystemd(sd.SdNotifyReady)
+
+	ttConfig, err := loadConfig()
+	if err != nil {
+		common.Log.Errorf("configuration reload failure, keeping the previous configuration: %v", err)
+		return
+	}
+	jobs, err := scheduleTargets(createTargets(ttConfig))
+	if err != nil {
+		common.Log.Errorf("configuration reload failure, keeping the previous configuration: %v", err)
+		return
+	}
+	audit, err := auditSchedule(ttConfig)
+	if err != nil {
+		common.Log.Errorf("configuration reload failure, keeping the previous configuration: %v", err)
+		return
+	}
+	if restartRequired(d.config.Load(), ttConfig) {
+		common.Log.Warnf("storage, lock, drainTimeout, state, post-processing, notifications, sentry, remote config, metrics labels, badge listen address, api or health listen address changed, restart the daemon to apply them")
+	}
+	d.config.Store(ttConfig)
+	d.schedule(jobs)
+	d.scheduleAudit(audit, ttConfig.Audit.Schedule)
+	common.Log.Infof("configuration reloaded, %d devices scheduled", len(jobs))
+}
+
+// restartRequired returns whether settings used when the daemon starts differ
+func restartRequired(previous *Config, current *Config) bool {
+	return !reflect.DeepEqual(previous.Storage, current.Storage) ||
+		previous.Lock != current.Lock ||
+		previous.DrainTimeout != current.DrainTimeout ||
+		previous.State != current.State ||
+		!reflect.DeepEqual(previous.ChangeDetection, current.ChangeDetection) ||
+		previous.Catalog != current.Catalog ||
+		previous.LatestMarker != current.LatestMarker ||
+		previous.StoreDiff != current.StoreDiff ||
+		previous.SizeAnomaly != current.SizeAnomaly ||
+		previous.UploadRateLimit != current.UploadRateLimit ||
+		previous.Concurrency != current.Concurrency ||
+		!reflect.DeepEqual(previous.PostProcess, current.PostProcess) ||
+		previous.Badge.Listen != current.Badge.Listen ||
+		previous.Api != current.Api ||
+		previous.Health != current.Health ||
+		!reflect.DeepEqual(previous.Notifications, current.Notifications) ||
+		previous.Sentry != current.Sentry ||
+		previous.Remote != current.Remote ||
+		!reflect.DeepEqual(previous.Metrics.Labels, current.Metrics.Labels)
+}
+
+type scheduledTarget struct {
+	target   *common.BackupSettings
+	schedule cron.Schedule
+	running  *atomic.Bool // shared by the jobs of the same device across reloads
+}
+
+// scheduleTargets parses schedules of the targets, every target must have one
+func scheduleTargets(targets []*common.BackupSettings) ([]*scheduledTarget, error) {
+	jobs := make([]*scheduledTarget, 0, len(targets))
+	for _, t := range targets {
+		if t.Schedule == "" {
+			return nil, fmt.Errorf("Mikrotik %s has no schedule, set schedule or mikrotiks[].schedule", t.BaseUrl.Host)
+		}
+		schedule, err := cron.ParseStandard(t.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule of Mikrotik %s: %w", t.BaseUrl.Host, err)
+		}
+		jobs = append(jobs, &scheduledTarget{target: t, schedule: schedule})
+	}
+	return jobs, nil
+}
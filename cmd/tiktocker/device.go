@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tiktocker/internal/common"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// deviceEntry is the mikrotiks entry written by device add, unset settings come from the group
+type deviceEntry struct {
+	Host          string `yaml:"host"`
+	Group         string `yaml:"group,omitempty"`
+	Username      string `yaml:"username,omitempty"`
+	Password      string `yaml:"password,omitempty"`
+	EncryptionKey string `yaml:"encryptionKey,omitempty"`
+}
+
+// runDeviceAdd prompts for the device settings, checks the device is reachable with them and appends it to the inventory (config.yaml without inventory, --file overrides)
+func runDeviceAdd(ttConfig *Config, _ []string) int {
+	file := deviceFile
+	if file == "" {
+		file = ttConfig.Inventory
+	}
+	if file == "" {
+		file = "config.yaml"
+	}
+	in := bufio.NewReader(os.Stdin)
+	out := os.Stderr
+
+	entry, err := promptDevice(in, out, ttConfig)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+	settings, err := entrySettings(ttConfig, entry)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+
+	checks := checkDevice(context.Background(), settings)
+	printChecks(checks)
+	for _, c := range checks {
+		if c.Status != checkPass {
+			if !confirm(in, out, fmt.Sprintf("Mikrotik %s check failed, add it to %s anyway", entry.Host, file)) {
+				common.Log.Infof("Mikrotik %s not added", entry.Host)
+				return exitFailure
+			}
+			break
+		}
+	}
+
+	if err := appendDevice(file, entry); err != nil {
+		common.Log.Errorf("failed to add Mikrotik %s to %s: %v", entry.Host, file, err)
+		return exitFailure
+	}
+	common.Log.Infof("Mikrotik %s added to %s", entry.Host, file)
+	return 0
+}
+
+// promptDevice asks for the device settings, secrets may be given as ${VAR} references which are stored as such
+func promptDevice(in *bufio.Reader, out io.Writer, ttConfig *Config) (*deviceEntry, error) {
+	entry := &deviceEntry{}
+	entry.Host = prompt(in, out, "host")
+	if entry.Host == "" {
+		return nil, errors.New("host is required")
+	}
+	for _, m := range ttConfig.Mikrotiks {
+		if m.Host == entry.Host {
+			return nil, fmt.Errorf("Mikrotik %s is already configured", entry.Host)
+		}
+	}
+
+	var group GroupConfig
+	if len(ttConfig.Groups) > 0 {
+		names := make([]string, 0, len(ttConfig.Groups))
+		for name := range ttConfig.Groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		entry.Group = prompt(in, out, fmt.Sprintf("group (%s, empty - none)", strings.Join(names, ", ")))
+		if entry.Group != "" {
+			var ok bool
+			if group, ok = ttConfig.Groups[entry.Group]; !ok {
+				return nil, fmt.Errorf("unknown group %s", entry.Group)
+			}
+		}
+	}
+
+	if group.Username != "" {
+		entry.Username = prompt(in, out, "username (empty - of the group)")
+	} else if entry.Username = prompt(in, out, "username"); entry.Username == "" {
+		return nil, errors.New("username is required")
+	}
+	if group.Password != "" || group.PasswordFile != "" {
+		entry.Password = promptSecret(in, out, "password or ${VAR} (empty - of the group)")
+	} else if entry.Password = promptSecret(in, out, "password or ${VAR}"); entry.Password == "" {
+		return nil, errors.New("password is required")
+	}
+	if group.EncryptionKey == "" && group.EncryptionKeyFile == "" {
+		entry.EncryptionKey = promptSecret(in, out, "backup encryption key or ${VAR} (empty - not encrypted)")
+	}
+	return entry, nil
+}
+
+// entrySettings returns the backup settings of the entry as they would be loaded, ${VAR} references expanded
+func entrySettings(ttConfig *Config, entry *deviceEntry) (*common.BackupSettings, error) {
+	device := DeviceConfig{Host: entry.Host, Group: entry.Group}
+	var err error
+	if device.Username, err = common.ExpandEnv(entry.Username); err != nil {
+		return nil, fmt.Errorf("username: %w", err)
+	}
+	if device.Password, err = common.ExpandEnv(entry.Password); err != nil {
+		return nil, fmt.Errorf("password: %w", err)
+	}
+	if device.EncryptionKey, err = common.ExpandEnv(entry.EncryptionKey); err != nil {
+		return nil, fmt.Errorf("encryptionKey: %w", err)
+	}
+	probe := *ttConfig
+	probe.Mikrotiks = []DeviceConfig{device}
+	if err := applyGroups(&probe); err != nil {
+		return nil, err
+	}
+	m := &probe.Mikrotiks[0]
+	if err := readSecretFile(&m.Password, m.PasswordFile, "password"); err != nil {
+		return nil, err
+	}
+	if err := readSecretFile(&m.EncryptionKey, m.EncryptionKeyFile, "encryptionKey"); err != nil {
+		return nil, err
+	}
+	targets := createTargets(&probe)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("invalid Mikrotik %s settings", entry.Host) // logged by createTargets
+	}
+	return targets[0], nil
+}
+
+// appendDevice appends the entry to the mikrotiks of the config or inventory file (or its list of devices), the file is created if missing.
+// Comments and order of the other settings are kept, the file is re-indented
+func appendDevice(file string, entry *deviceEntry) error {
+	contents, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if sopsEncrypted(contents) {
+		return errors.New("the file is sops-encrypted, add the device with sops")
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return err
+	}
+	if document.Kind == 0 { // empty or missing file
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	devices, err := devicesNode(document.Content[0])
+	if err != nil {
+		return err
+	}
+	var node yaml.Node
+	if err := node.Encode(entry); err != nil {
+		return err
+	}
+	devices.Content = append(devices.Content, &node)
+
+	// written next to the file and renamed, a failure doesn't leave it truncated
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(f)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	mode := os.FileMode(0600) // the file holds credentials
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// devicesNode returns the list of devices of the document root, the mikrotiks key is added if missing
+func devicesNode(root *yaml.Node) (*yaml.Node, error) {
+	switch root.Kind {
+	case yaml.SequenceNode: // inventory being the list of devices
+		return root, nil
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value != "mikrotiks" {
+				continue
+			}
+			devices := root.Content[i+1]
+			if devices.Kind == yaml.ScalarNode && devices.Tag == "!!null" { // mikrotiks: with no devices
+				*devices = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			}
+			if devices.Kind != yaml.SequenceNode {
+				return nil, errors.New("mikrotiks must be the list of devices")
+			}
+			return devices, nil
+		}
+		devices := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "mikrotiks"}, devices)
+		return devices, nil
+	}
+	return nil, errors.New("must be YAML document or list of devices")
+}
+
+// prompt asks for the value, no input returns empty
+func prompt(in *bufio.Reader, out io.Writer, label string) string {
+	_, _ = fmt.Fprintf(out, "%s: ", label)
+	answer, _ := in.ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
+// promptSecret asks for the value without echo on terminal
+func promptSecret(in *bufio.Reader, out io.Writer, label string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(in, out, label)
+	}
+	_, _ = fmt.Fprintf(out, "%s: ", label)
+	secret, _ := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(out)
+	return strings.TrimSpace(string(secret))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/drift"
+	"tiktocker/internal/mirror"
+	"tiktocker/internal/postprocess"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// runDiff prints unified diff of the current config of the devices against their last stored exports, without backing them up.
+// Without hosts all configured devices are compared
+func runDiff(ttConfig *Config, hosts []string) int {
+	ctx := context.Background()
+	targets, err := diffTargets(ttConfig, hosts)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+	pipeline, err := postprocess.New(ttConfig.PostProcess)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitConfig
+	}
+	normalizer, err := drift.NewNormalizer(ttConfig.ChangeDetection.Normalize)
+	if err != nil {
+		common.Log.Errorf("changeDetection.normalize: %v", err)
+		return exitConfig
+	}
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+
+	failed, drifted := 0, 0
+	for _, settings := range targets {
+		diff, err := diffDevice(ctx, settings, source, pipeline, normalizer)
+		if err != nil {
+			common.Log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+			failed++
+			continue
+		}
+		if diff == "" {
+			common.Log.Infof("Mikrotik %s config matches the stored export", settings.BaseUrl.Host)
+			continue
+		}
+		drifted++
+		fmt.Print(diff)
+	}
+	switch {
+	case failed == len(targets):
+		return exitAllFailed
+	case failed > 0:
+		return exitPartial
+	case drifted > 0:
+		return exitDrift
+	}
+	return 0
+}
+
+// diffTargets returns settings of the configured devices, all without hosts
+func diffTargets(ttConfig *Config, hosts []string) ([]*common.BackupSettings, error) {
+	targets := createTargets(ttConfig)
+	if len(hosts) == 0 {
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no devices configured")
+		}
+		return targets, nil
+	}
+	byHost := make(map[string]*common.BackupSettings, len(targets))
+	for _, t := range targets {
+		byHost[t.BaseUrl.Host] = t
+	}
+	selected := make([]*common.BackupSettings, 0, len(hosts))
+	for _, host := range hosts {
+		settings, ok := byHost[host]
+		if !ok {
+			return nil, fmt.Errorf("Mikrotik %s is not configured", host)
+		}
+		selected = append(selected, settings)
+	}
+	return selected, nil
+}
+
+// diffDevice exports the device config and compares it with the stored export, returns empty diff if they match
+func diffDevice(ctx context.Context, settings *common.BackupSettings, source mirror.Endpoint, pipeline *postprocess.Pipeline, normalizer *drift.Normalizer) (string, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	ch := common.NewResultChannel()
+	go backup.MikrotikConfigExport(ctx, settings, client, ch)
+	current := common.WaitForResult(ctx, ch)
+	if current.Err != nil {
+		return "", current.Err
+	}
+	defer current.File.Remove()
+
+	metadata, err := common.RenderMetadata(settings.Metadata, settings.MetadataTemplates,
+		common.NewMetadataData(current.MikrotikIdentity, settings.BaseUrl.Host, current.Facts))
+	if err != nil {
+		return "", err
+	}
+	devicePrefix, err := common.RenderPrefix(settings.PrefixTemplate, common.NewPrefixData(current.MikrotikIdentity, settings.BaseUrl.Host, metadata))
+	if err != nil {
+		return "", err
+	}
+	storedName, err := pipeline.Name(current.File.Name)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(storedName, ".rsc") {
+		return "", fmt.Errorf("stored export %s is post-processed, cannot be compared", storedName)
+	}
+	key := path.Join(devicePrefix, storedName)
+	info, err := source.Store.Head(ctx, devicePrefix, storedName)
+	if err != nil {
+		return "", fmt.Errorf("%s failed to get %s metadata: %w", source.Store, key, err)
+	}
+	if info == nil {
+		return "", fmt.Errorf("no export stored in %s: %s", source.Store, key)
+	}
+	stored, _, err := storage.ReadObject(ctx, source.Store, key)
+	if err != nil {
+		return "", err
+	}
+	defer stored.Remove()
+
+	storedContents, err := stored.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	currentContents, err := current.File.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	return normalizer.Unified(storedContents, fmt.Sprintf("%s (stored %s)", key, info.LastModified.UTC().Format(time.RFC3339)),
+		currentContents, fmt.Sprintf("%s (current)", settings.BaseUrl.Host))
+}
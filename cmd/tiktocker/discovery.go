@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultDiscoveryTimeout = 10 * time.Second
+
+// DiscoveryConfig adds devices registered in DNS, they take their settings (credentials) from the group
+type DiscoveryConfig struct {
+	Srv     string        `mapstructure:"srv"`     // SRV record whose targets are the devices, e.g. _mikrotik._tcp.example.com
+	Names   []string      `mapstructure:"names"`   // device names completed with suffix, e.g. core1
+	Suffix  string        `mapstructure:"suffix"`  // e.g. .mgmt.example.com
+	Group   string        `mapstructure:"group"`   // groups entry of the discovered devices
+	Timeout time.Duration `mapstructure:"timeout"` // of the SRV lookup, 0 - 10s
+}
+
+func (c *DiscoveryConfig) enabled() bool {
+	return c.Srv != "" || len(c.Names) > 0
+}
+
+// discoverDevices appends the discovered devices not configured in mikrotiks, resolved again when the daemon reloads configuration
+func discoverDevices(ctx context.Context, config *Config) error {
+	c := &config.Discovery
+	if !c.enabled() {
+		return nil
+	}
+	if c.Group == "" {
+		return fmt.Errorf("discovery.group is required, discovered devices take their settings from the group")
+	}
+	hosts := make([]string, 0, len(c.Names))
+	for _, name := range c.Names {
+		hosts = append(hosts, name+c.Suffix)
+	}
+	if c.Srv != "" {
+		timeout := c.Timeout
+		if timeout == 0 {
+			timeout = defaultDiscoveryTimeout
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		_, records, err := net.DefaultResolver.LookupSRV(lookupCtx, "", "", c.Srv)
+		if err != nil {
+			return fmt.Errorf("discovery of %s failure: %w", c.Srv, err)
+		}
+		// the port is not used, REST API and SSH ports of the devices are the defaults
+		for _, r := range records {
+			hosts = append(hosts, strings.TrimSuffix(r.Target, "."))
+		}
+	}
+
+	configured := make(map[string]bool, len(config.Mikrotiks))
+	for _, m := range config.Mikrotiks {
+		configured[m.Host] = true
+	}
+	for _, host := range hosts {
+		if configured[host] {
+			continue // explicit settings win
+		}
+		configured[host] = true
+		config.Mikrotiks = append(config.Mikrotiks, DeviceConfig{Host: host, Group: c.Group})
+	}
+	return nil
+}
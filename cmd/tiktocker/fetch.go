@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// runFetch downloads the binary backup (or export with --export) of the device identity stored at --at (default the latest) to --out,
+// with --output keys only prints its key
+func runFetch(ttConfig *Config, args []string) int {
+	identity := args[0]
+	ctx := context.Background()
+	if output == outputKeys && fetchOut != "" {
+		common.Log.Errorf("--out cannot be used with --output %s", outputKeys)
+		return exitConfig
+	}
+	var at time.Time
+	if fetchAt != "" {
+		var err error
+		if at, err = parseTimestamp(fetchAt); err != nil {
+			common.Log.Errorf("invalid --at: %v", err)
+			return exitConfig
+		}
+	}
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	listed, err := source.Store.List(ctx)
+	if err != nil {
+		common.Log.Errorf("%s listing failure: %v", source.Store, err)
+		return exitFailure
+	}
+
+	name := backup.BackupFileName(identity)
+	if fetchExport {
+		name = backup.ExportFileName(identity)
+	}
+	version, ok := pickVersion(storage.DeviceHistory(listed, identity), name, at)
+	if !ok {
+		if at.IsZero() {
+			common.Log.Errorf("no %s stored in %s", name, source.Store)
+		} else {
+			common.Log.Errorf("no %s stored in %s at %s", name, source.Store, at.Format(time.RFC3339))
+		}
+		return exitFailure
+	}
+	key := storage.RelativeKey(source.KeyPrefix, version.Key)
+	if output == outputKeys {
+		fmt.Println(key)
+		return 0
+	}
+
+	out := fetchOut
+	if out == "" {
+		out = path.Base(key)
+	}
+	if err := fetchVersion(ctx, source.Store, key, version, out); err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	if out != stdio {
+		common.Log.Infof("%s (stored %s) fetched to %s", key, version.LastModified.UTC().Format(time.RFC3339), out)
+	}
+	return 0
+}
+
+// pickVersion returns the newest version of the artifact stored at the time (zero - the latest), history is ordered newest first.
+// Post-processed artifacts match too, e.g. <identity>.backup.gz
+func pickVersion(history []storage.ObjectInfo, name string, at time.Time) (storage.ObjectInfo, bool) {
+	for _, o := range history {
+		base := path.Base(o.Key)
+		if !storage.Transferable(o.Key) || (base != name && !strings.HasPrefix(base, name+".")) {
+			continue
+		}
+		if at.IsZero() {
+			if o.IsLatest {
+				return o, true
+			}
+			continue
+		}
+		if !o.LastModified.After(at) {
+			return o, true
+		}
+	}
+	return storage.ObjectInfo{}, false
+}
+
+// fetchVersion writes contents of the version to the file, - writes stdout
+func fetchVersion(ctx context.Context, store storage.Storage, key string, version storage.ObjectInfo, out string) error {
+	r, err := storage.OpenVersion(ctx, store, key, version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if out == stdio {
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			return fmt.Errorf("%s failed to read %s: %w", store, key, err)
+		}
+		return nil
+	}
+	// written next to the destination and renamed, a failed download doesn't leave file which looks complete
+	f, err := os.Create(out + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("%s failed to read %s: %w", store, key, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), out)
+}
+
+// parseTimestamp parses RFC3339 timestamp or date, the date means its end (UTC)
+func parseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s, must be RFC3339 timestamp or date e.g. 2026-10-14T03:00:00Z or 2026-10-14", value)
+	}
+	return day.Add(24*time.Hour - time.Nanosecond), nil
+}
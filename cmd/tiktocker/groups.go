@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"tiktocker/internal/common"
+	"time"
+)
+
+// GroupConfig is settings shared by the devices of the group (e.g. customer of MSP), settings of the device override them
+type GroupConfig struct {
+	Username          string             `mapstructure:"username"`
+	Password          string             `mapstructure:"password"`
+	PasswordFile      string             `mapstructure:"passwordFile"`
+	EncryptionKey     string             `mapstructure:"encryptionKey"`
+	EncryptionKeyFile string             `mapstructure:"encryptionKeyFile"`
+	Timeout           time.Duration      `mapstructure:"timeout"`
+	MinInterval       time.Duration      `mapstructure:"minInterval"`
+	Metadata          map[string]string  `mapstructure:"metadata"` // merged with the device metadata, keys of the device win
+	PrefixTemplate    string             `mapstructure:"prefixTemplate"`
+	UploadRateLimit   int64              `mapstructure:"uploadRateLimit"`
+	ExtraFiles        []string           `mapstructure:"extraFiles"`
+	Mode              string             `mapstructure:"mode"`
+	Force             bool               `mapstructure:"force"`
+	Schedule          string             `mapstructure:"schedule"`
+	BackupWindow      BackupWindowConfig `mapstructure:"backupWindow"`
+	Hooks             common.HooksConfig `mapstructure:"hooks"`
+}
+
+// applyGroups fills the settings the devices do not set from their group, called before the secret files and references are read
+func applyGroups(config *Config) error {
+	for i := range config.Mikrotiks {
+		m := &config.Mikrotiks[i]
+		if m.Group == "" {
+			continue
+		}
+		g, ok := config.Groups[m.Group]
+		if !ok {
+			return fmt.Errorf("Mikrotik %s: unknown group %s", m.Host, m.Group)
+		}
+		fill(&m.Username, g.Username)
+		// the value and its file are exclusive, the device setting either of them overrides both
+		if m.Password == "" && m.PasswordFile == "" {
+			m.Password, m.PasswordFile = g.Password, g.PasswordFile
+		}
+		if m.EncryptionKey == "" && m.EncryptionKeyFile == "" {
+			m.EncryptionKey, m.EncryptionKeyFile = g.EncryptionKey, g.EncryptionKeyFile
+		}
+		if m.Timeout == 0 {
+			m.Timeout = g.Timeout
+		}
+		if m.MinInterval == 0 {
+			m.MinInterval = g.MinInterval
+		}
+		if m.UploadRateLimit == 0 {
+			m.UploadRateLimit = g.UploadRateLimit
+		}
+		fill(&m.PrefixTemplate, g.PrefixTemplate)
+		fill(&m.Schedule, g.Schedule)
+		fill(&m.Mode, g.Mode)
+		if m.Force == nil {
+			m.Force = &g.Force
+		}
+		if len(m.ExtraFiles) == 0 {
+			m.ExtraFiles = g.ExtraFiles
+		}
+		if len(m.BackupWindow.Allow) == 0 && len(m.BackupWindow.Blackout) == 0 {
+			m.BackupWindow = g.BackupWindow
+		}
+		if len(m.Hooks.Pre) == 0 && len(m.Hooks.Post) == 0 {
+			m.Hooks = g.Hooks
+		}
+		if len(g.Metadata) > 0 {
+			metadata := make(map[string]string, len(g.Metadata)+len(m.Metadata))
+			for k, v := range g.Metadata {
+				metadata[k] = v
+			}
+			for k, v := range m.Metadata {
+				metadata[k] = v
+			}
+			m.Metadata = metadata
+		}
+	}
+	return nil
+}
+
+func fill(value *string, group string) {
+	if *value == "" {
+		*value = group
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"tiktocker/internal/common"
+	"tiktocker/internal/report"
+	"tiktocker/internal/storage"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+	// the scheduler is considered stalled when a backup due longer ago has not been started
+	schedulerMaxLag = time.Minute
+	// probes are frequent, the storage is checked at most once per interval
+	storageCheckInterval = 30 * time.Second
+)
+
+type healthCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type deviceHealth struct {
+	Host     string        `json:"host"`
+	Identity string        `json:"identity,omitempty"`
+	Status   report.Status `json:"status"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Ok      bool                   `json:"ok"`
+	Checks  map[string]healthCheck `json:"checks"`
+	Devices []deviceHealth         `json:"devices"` // the latest result of every device backed up since the daemon started
+}
+
+// storageHealth caches the result of the storage connectivity check
+type storageHealth struct {
+	store storage.Storage
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func (s *storageHealth) check(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checkedAt) < storageCheckInterval {
+		return s.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if _, err := s.store.Head(ctx, "", storage.CatalogName); err != nil {
+		s.err = fmt.Errorf("%s not reachable: %w", s.store, err)
+	} else {
+		s.err = nil
+	}
+	s.checkedAt = time.Now()
+	return s.err
+}
+
+// serveHealth serves /healthz (the scheduler runs the due backups) and /readyz (the daemon is not stopping and the storage is reachable),
+// both respond 503 when failing and report the latest results of the devices, failed backups do not fail the checks
+func serveHealth(listen string, d *fleetDaemon) {
+	st := &storageHealth{store: d.runner.store}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		d.writeHealth(w, map[string]error{"scheduler": d.schedulerHealth()})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		var running error
+		if d.schedulingCtx.Err() != nil {
+			running = fmt.Errorf("daemon stopping")
+		}
+		d.writeHealth(w, map[string]error{
+			"running": running,
+			"storage": st.check(r.Context()),
+		})
+	})
+
+	go func() {
+		common.Log.Infof("health endpoints listening on %s", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			common.Log.Errorf("health server failure: %v", err)
+		}
+	}()
+}
+
+// schedulerHealth returns error if the scheduler doesn't respond or a due backup has not been started
+func (d *fleetDaemon) schedulerHealth() error {
+	entries := make(chan []cron.Entry, 1)
+	go func() {
+		entries <- d.scheduler.Entries()
+	}()
+	select {
+	case e := <-entries:
+		now := time.Now()
+		for _, entry := range e {
+			if !entry.Next.IsZero() && now.Sub(entry.Next) > schedulerMaxLag {
+				return fmt.Errorf("scheduler stalled, backup due at %s not started", entry.Next.Format(time.RFC3339))
+			}
+		}
+		return nil
+	case <-time.After(healthCheckTimeout):
+		return fmt.Errorf("scheduler not responding")
+	}
+}
+
+func (d *fleetDaemon) writeHealth(w http.ResponseWriter, checks map[string]error) {
+	response := healthResponse{Ok: true, Checks: make(map[string]healthCheck, len(checks)), Devices: make([]deviceHealth, 0)}
+	for name, err := range checks {
+		c := healthCheck{Ok: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			response.Ok = false
+		}
+		response.Checks[name] = c
+	}
+	for _, r := range d.manifest.Results() {
+		response.Devices = append(response.Devices, deviceHealth{Host: r.Host, Identity: r.Identity, Status: r.Status, Error: r.Error})
+	}
+
+	status := http.StatusOK
+	if !response.Ok {
+		status = http.StatusServiceUnavailable
+		common.Log.Debugf("health check failure: %v", checks)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
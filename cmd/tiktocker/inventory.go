@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// loadInventory replaces the devices of the config files with the ones of the inventory file (YAML or JSON), generated e.g. from a CMDB.
+// The file is either the list of devices or the document with the mikrotiks key only, tool settings stay in the config files
+func loadInventory(v *viper.Viper, path string) error {
+	contents, err := readConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading inventory file, %w", err)
+	}
+	raw, err := io.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("error reading inventory file, %w", err)
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return fmt.Errorf("invalid inventory file %s: %w", path, err)
+	}
+	var devices interface{}
+	switch d := document.(type) {
+	case []interface{}:
+		devices = d
+	case map[string]interface{}:
+		for key, value := range d {
+			if key != "mikrotiks" {
+				return fmt.Errorf("invalid inventory file %s: unexpected key %s, only mikrotiks is allowed, tool settings belong to the config files", path, key)
+			}
+			devices = value
+		}
+	case nil: // empty inventory
+	default:
+		return fmt.Errorf("invalid inventory file %s: must be the list of devices or contain mikrotiks", path)
+	}
+	if devices == nil {
+		devices = []interface{}{}
+	}
+	if _, ok := devices.([]interface{}); !ok {
+		return fmt.Errorf("invalid inventory file %s: mikrotiks must be the list of devices", path)
+	}
+	v.Set("mikrotiks", devices)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// storedArtifact is listed artifact of the device, Key is relative to the storage root
+type storedArtifact struct {
+	storage.ObjectInfo
+	Device string
+	Sha256 string // of the latest versions only, empty if not recorded
+}
+
+func runList(ttConfig *Config, _ []string) int {
+	ctx := context.Background()
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	if p := invalidPattern(syncDevices); p != "" {
+		common.Log.Errorf("invalid --device pattern: %s", p)
+		return exitConfig
+	}
+	listed, err := source.Store.List(ctx)
+	if err != nil {
+		common.Log.Errorf("%s listing failure: %v", source.Store, err)
+		return exitFailure
+	}
+
+	artifacts := make([]storedArtifact, 0, len(listed))
+	for _, o := range listed {
+		o.Key = storage.RelativeKey(source.KeyPrefix, o.Key)
+		if !storage.Transferable(o.Key) || (!o.IsLatest && !listVersions) {
+			continue
+		}
+		a := storedArtifact{ObjectInfo: o, Device: storage.DeviceFromFileName(o.Key)}
+		if !matchesDevice(a.Device, syncDevices) {
+			continue
+		}
+		if o.IsLatest {
+			devicePrefix, name := storage.SplitKey(o.Key)
+			info, err := source.Store.Head(ctx, devicePrefix, name)
+			if err != nil {
+				common.Log.Warnf("%s failed to get %s metadata: %v", source.Store, o.Key, err)
+			} else if info != nil {
+				a.Sha256 = storedSha256(info.Metadata)
+			}
+		}
+		artifacts = append(artifacts, a)
+	}
+	sort.SliceStable(artifacts, func(i, j int) bool {
+		if artifacts[i].Device != artifacts[j].Device {
+			return artifacts[i].Device < artifacts[j].Device
+		}
+		if artifacts[i].Key != artifacts[j].Key {
+			return artifacts[i].Key < artifacts[j].Key
+		}
+		return artifacts[i].LastModified.After(artifacts[j].LastModified)
+	})
+	printArtifacts(artifacts)
+	return 0
+}
+
+// storedSha256 returns the checksum recorded with the stored artifact: of the binary backup or extra file, of the export without its timestamp line
+func storedSha256(metadata map[string]string) string {
+	if sha := metadata[common.BackupSha256]; sha != "" {
+		return sha
+	}
+	return metadata[common.Sha256WithoutFirstLine]
+}
+
+// matchesDevice returns whether the device identity matches any of the globs, no globs match all
+func matchesDevice(device string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, device); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func printArtifacts(artifacts []storedArtifact) {
+	if output == outputKeys {
+		for _, a := range artifacts {
+			fmt.Println(a.Key)
+		}
+		return
+	}
+	if len(artifacts) == 0 {
+		fmt.Println("no backups stored")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	device := ""
+	for i, a := range artifacts {
+		if i == 0 || a.Device != device {
+			device = a.Device
+			_, _ = fmt.Fprintf(w, "device: %s\n", device)
+		}
+		version := "latest"
+		if !a.IsLatest {
+			version = a.VersionId
+		}
+		sha := a.Sha256
+		if sha == "" {
+			sha = "-"
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\t%d bytes\t%s\n", a.Key, version, a.LastModified.UTC().Format(time.RFC3339), a.Size, sha)
+	}
+	_ = w.Flush()
+}
@@ -3,189 +3,723 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/spf13/pflag"
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"log"
-	"net/http"
+	"math/rand"
 	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
-	"tiktocker/internal/backup"
+	"syscall"
 	"tiktocker/internal/common"
+	"tiktocker/internal/drift"
+	"tiktocker/internal/metrics"
+	"tiktocker/internal/notify"
+	"tiktocker/internal/postprocess"
+	"tiktocker/internal/remote"
+	"tiktocker/internal/report"
+	"tiktocker/internal/secrets"
+	"tiktocker/internal/state"
 	"tiktocker/internal/storage"
 	"time"
 )
 
 type Config struct {
-	Directory string `mapstructure:"directory"` // directory to store backups, if empty - uses S3
-
-	S3 struct {
-		Host         string `mapstructure:"host"`
-		AccessKey    string `mapstructure:"accessKey"`
-		SecretKey    string `mapstructure:"secretKey"`
-		Region       string `mapstructure:"region"`
-		Path         string `mapstructure:"path"`         // bucket/pathPrefix
-		UsePathStyle bool   `mapstructure:"usePathStyle"` // ex Minio uses path style, AWS S3 does not
-	} `mapstructure:"s3"`
+	Storage         storage.Config `mapstructure:",squash"`
+	Strict          bool           `mapstructure:"strict"`          // unknown keys and missing device settings fail the load
+	Manifest        string         `mapstructure:"manifest"`        // path of the run manifest file, if empty - manifest is not written
+	ManifestStats   bool           `mapstructure:"manifestStats"`   // include per-device timings in the manifest
+	PrefixTemplate  string         `mapstructure:"prefixTemplate"`  // per-device storage prefix template, e.g. {{.Site}}/{{.Identity}}
+	LatestMarker    bool           `mapstructure:"latestMarker"`    // maintain <identity>.latest.json pointing to the newest backup and export
+	StoreDiff       bool           `mapstructure:"storeDiff"`       // store <identity>-<timestamp>.diff of the previous and the changed export
+	UploadRateLimit int64          `mapstructure:"uploadRateLimit"` // total upload bytes per second of all devices, 0 - unlimited
+	Concurrency     int            `mapstructure:"concurrency"`     // devices backed up at once (also across daemon schedules), 0 - unlimited
+	Schedule        string         `mapstructure:"schedule"`        // cron expression of the daemon mode, e.g. 0 3 * * *
+	Splay           time.Duration  `mapstructure:"splay"`           // device backups start at random offset within the window, 0 - all at once
+	DrainTimeout    time.Duration  `mapstructure:"drainTimeout"`    // time in-flight backups may take after interrupt/SIGTERM, 0 - unlimited
+	MinInterval     time.Duration  `mapstructure:"minInterval"`     // devices successfully backed up within are skipped (requires state.path), 0 - never skipped
+	Catalog         bool           `mapstructure:"catalog"`         // maintain index.json listing the latest artifacts of all devices
+	Mode            string         `mapstructure:"mode"`            // full (default) - export and binary backup, export - only the export
+
+	Hooks common.HooksConfig `mapstructure:"hooks"` // commands or webhooks executed before and after every device backup
+
+	PostProcess []postprocess.StageConfig `mapstructure:"postProcess"` // chain applied to every artifact before it is stored
+
+	Destinations map[string]storage.Config `mapstructure:"destinations"` // named storages for sync, e.g. disaster recovery bucket
+
+	BackupWindow BackupWindowConfig `mapstructure:"backupWindow"` // when devices may be backed up, backups outside are deferred
 
 	Log struct {
-		Level string `mapstructure:"level"`
+		Level      string              `mapstructure:"level"`
+		Components map[string]string   `mapstructure:"components"` // log levels of components overriding level, e.g. scp: debug
+		Syslog     common.SyslogConfig `mapstructure:"syslog"`     // logs are also sent to syslog, if network is empty - not sent
 	} `mapstructure:"log"`
 
-	Mikrotiks []struct {
-		Host          string            `mapstructure:"host"`
-		Username      string            `mapstructure:"username"`
-		Password      string            `mapstructure:"password"`
-		EncryptionKey string            `mapstructure:"encryptionKey"`
-		Timeout       time.Duration     `mapstructure:"timeout"`
-		Metadata      map[string]string `mapstructure:"metadata"`
-	} `mapstructure:"mikrotiks"`
+	Lock struct {
+		Path string        `mapstructure:"path"` // lock file preventing concurrent backup runs, if empty - no lock
+		Wait time.Duration `mapstructure:"wait"` // time to wait for the running instance, 0 - fail immediately
+	} `mapstructure:"lock"`
+
+	State struct {
+		Path string `mapstructure:"path"` // state database file, if empty - no state is kept between runs
+	} `mapstructure:"state"`
+
+	ChangeDetection struct {
+		Source    string      `mapstructure:"source"`    // storage (default) or state - previous run hash kept in the state database
+		Normalize drift.Rules `mapstructure:"normalize"` // exports whose checksums differ are compared once normalized, if none set - checksums only
+	} `mapstructure:"changeDetection"`
+
+	SqliteSnapshot struct {
+		Enabled  bool          `mapstructure:"enabled"`  // store catalog.sqlite with the state and history at the storage root
+		Interval time.Duration `mapstructure:"interval"` // minimum time between snapshots (requires state.path), 0 - after every run
+	} `mapstructure:"sqliteSnapshot"`
+
+	Metrics struct {
+		Textfile    string   `mapstructure:"textfile"` // node_exporter textfile collector file written after each run, if empty - not written
+		Labels      []string `mapstructure:"labels"`   // device metadata keys added as labels of the device metrics, e.g. site
+		Pushgateway struct {
+			Url      string            `mapstructure:"url"` // metrics of one-shot runs are pushed at the end of the run, if empty - not pushed
+			Job      string            `mapstructure:"job"`
+			Grouping map[string]string `mapstructure:"grouping"` // additional grouping labels, e.g. instance
+			Username string            `mapstructure:"username"`
+			Password string            `mapstructure:"password"`
+		} `mapstructure:"pushgateway"`
+	} `mapstructure:"metrics"`
+
+	Badge struct {
+		Enabled bool          `mapstructure:"enabled"` // store badge.svg and badge.json at the storage root after every run (requires state.path)
+		MaxAge  time.Duration `mapstructure:"maxAge"`  // devices successfully backed up within are counted as healthy, default 24h
+		Listen  string        `mapstructure:"listen"`  // address serving the badge in the daemon mode, e.g. :8080, if empty - not served
+	} `mapstructure:"badge"`
+
+	Api struct {
+		Listen string `mapstructure:"listen"` // address of the on-demand backup endpoints in the daemon mode, e.g. :8081, if empty - disabled
+		Token  string `mapstructure:"token"`  // bearer token required by the endpoints (or TT_API_TOKEN)
+	} `mapstructure:"api"`
+
+	Notifications notify.Config `mapstructure:"notifications"`
+
+	Vault secrets.VaultConfig `mapstructure:"vault"` // secrets referenced as vault:<path>#<field>
+	Aws   secrets.AwsConfig   `mapstructure:"aws"`   // Secrets Manager and SSM Parameter Store secrets referenced as arn:... or ssm:<name>
+
+	Sentry common.SentryConfig `mapstructure:"sentry"` // panics and device backup failures are reported to Sentry, if dsn is empty - not reported
+
+	Health struct {
+		Listen string `mapstructure:"listen"` // address of /healthz and /readyz in the daemon mode, e.g. :8082, if empty - disabled
+	} `mapstructure:"health"`
+
+	Pprof struct {
+		Listen string `mapstructure:"listen"` // address of pprof endpoints, e.g. localhost:6060, if empty - disabled
+	} `mapstructure:"pprof"`
+
+	AdaptiveTimeout struct {
+		Enabled    bool          `mapstructure:"enabled"`    // set timeouts of devices without explicit timeout from history, otherwise only suggested
+		Multiplier float64       `mapstructure:"multiplier"` // safety multiplier of the longest recent run
+		Min        time.Duration `mapstructure:"min"`
+		Max        time.Duration `mapstructure:"max"`
+	} `mapstructure:"adaptiveTimeout"`
+
+	Audit struct {
+		Schedule string `mapstructure:"schedule"` // cron expression of the stored artifacts integrity audit in the daemon mode, if empty - disabled
+		Head     bool   `mapstructure:"head"`     // only check the checksums are recorded, the contents are not downloaded
+	} `mapstructure:"audit"`
+
+	SizeAnomaly struct {
+		MinRatio float64 `mapstructure:"minRatio"` // changed artifacts smaller than this fraction of their recent median size are anomalous (requires state.path), e.g. 0.5, 0 - not checked
+		Block    bool    `mapstructure:"block"`    // anomalous artifacts are not stored and the device backup fails, otherwise they are stored and notified
+	} `mapstructure:"sizeAnomaly"`
+
+	Retention struct {
+		KeepLast int           `mapstructure:"keepLast"` // versions of each object always kept
+		MaxAge   time.Duration `mapstructure:"maxAge"`   // versions beyond keepLast are pruned once older than this
+	} `mapstructure:"retention"`
+
+	Remote remote.Config `mapstructure:"remote"` // configuration stored in Consul or etcd merged over the config files
+
+	Inventory string `mapstructure:"inventory"` // file with the mikrotiks list replacing the one of the config files, e.g. generated by external tooling
+
+	Discovery DiscoveryConfig `mapstructure:"discovery"` // devices registered in DNS appended to mikrotiks
+
+	Groups map[string]GroupConfig `mapstructure:"groups"` // settings shared by the devices, e.g. credentials of a customer
+
+	Mikrotiks []DeviceConfig `mapstructure:"mikrotiks"`
+}
+
+// DeviceConfig is the mikrotiks entry
+type DeviceConfig struct {
+	Host              string             `mapstructure:"host"`
+	Group             string             `mapstructure:"group"` // name of the groups entry the unset settings are taken from
+	Username          string             `mapstructure:"username"`
+	Password          string             `mapstructure:"password"`
+	PasswordFile      string             `mapstructure:"passwordFile"` // file with the password, e.g. mounted secret
+	EncryptionKey     string             `mapstructure:"encryptionKey"`
+	EncryptionKeyFile string             `mapstructure:"encryptionKeyFile"` // file with the encryption key
+	Timeout           time.Duration      `mapstructure:"timeout"`
+	MinInterval       time.Duration      `mapstructure:"minInterval"` // overrides global minInterval
+	Metadata          map[string]string  `mapstructure:"metadata"`
+	PrefixTemplate    string             `mapstructure:"prefixTemplate"`  // overrides global prefixTemplate
+	UploadRateLimit   int64              `mapstructure:"uploadRateLimit"` // upload bytes per second of this device, 0 - unlimited
+	ExtraFiles        []string           `mapstructure:"extraFiles"`      // globs of device files (REST file listing) stored next to the export
+	Mode              string             `mapstructure:"mode"`            // overrides global mode
+	Force             *bool              `mapstructure:"force"`           // skip change detection, fresh backup is stored on every run, nil - group setting
+	Schedule          string             `mapstructure:"schedule"`        // overrides global schedule
+	BackupWindow      BackupWindowConfig `mapstructure:"backupWindow"`    // overrides global backupWindow
+	Hooks             common.HooksConfig `mapstructure:"hooks"`           // executed after the global hooks
 }
 
+type BackupWindowConfig struct {
+	Allow    []string `mapstructure:"allow"`    // [days] HH:MM-HH:MM ranges the backups run within, e.g. Mon-Fri 22:00-06:00, empty - any time
+	Blackout []string `mapstructure:"blackout"` // ranges the backups never run within, take precedence over allow
+}
+
+var (
+	dryRun    bool
+	yesDelete bool
+	canary    string
+	daemon    bool
+	force     bool
+	output    string
+	annotate  []string
+
+	outputFile   string
+	showProgress bool
+
+	adhocHost          string
+	adhocUsername      string
+	adhocPasswordStdin bool
+
+	bundleSince string
+	bundleOut   string
+
+	syncFrom    string
+	syncTo      string
+	syncDevices []string
+	syncPrefix  string
+
+	listVersions bool
+	verifyHead   bool
+
+	fetchAt     string
+	fetchOut    string
+	fetchExport bool
+
+	changelogDiff bool
+
+	restoreYes   bool
+	restoreForce bool
+
+	deviceFile string
+
+	profile     string
+	profilePath string
+	secretsDir  string
+	configDir   string
+
+	verbose int
+)
+
+// exit codes of the process
+const (
+	exitFailure   = 1 // fatal error, e.g. storage not reachable
+	exitConfig    = 2 // invalid configuration or flags
+	exitPartial   = 3 // some devices failed or the run was interrupted
+	exitAllFailed = 4 // every device backed up in the run failed
+	exitDrift     = 5 // diff found devices differing from their stored exports
+)
+
 func main() {
-	ttConfig, err := setupConfig()
+	os.Exit(run())
+}
+
+// run executes the command, returns the exit code
+func run() int {
+	if err := newRootCommand().Execute(); err != nil {
+		return exitConfig // invalid command or flags
+	}
+	return commandExitCode
+}
+
+// runWithConfig loads the configuration, sets up logging, error reporting and profiling, then runs the command, returns its exit code
+func runWithConfig(command func(ttConfig *Config) int) int {
+	ttConfig, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
-		return
+		log.Printf("Failed to load configuration: %v", err)
+		return exitConfig
+	}
+	common.Setup(logLevel(ttConfig.Log.Level, verbose), ttConfig.Log.Components)
+	if ttConfig.Log.Syslog.Network != "" {
+		if err := common.AddSyslogHook(ttConfig.Log.Syslog); err != nil {
+			common.Log.Errorf("%v", err)
+			return exitConfig
+		}
+	}
+	if ttConfig.Sentry.Dsn != "" {
+		flushSentry, err := common.SetupSentry(ttConfig.Sentry)
+		if err != nil {
+			common.Log.Errorf("%v", err)
+			return exitConfig
+		}
+		defer flushSentry()
+		defer common.CapturePanic()
 	}
-	common.Setup(ttConfig.Log.Level)
-	common.Log.Infof("Mikrotik Backup starting")
 
-	mainCtx := context.Background()
+	if ttConfig.Pprof.Listen != "" {
+		servePprof(ttConfig.Pprof.Listen)
+	}
+	if profile != "" {
+		stopProfile, err := startProfile(profile, profilePath)
+		if err != nil {
+			common.Log.Errorf("%v", err)
+			return exitConfig
+		}
+		defer stopProfile()
+	}
+	return command(ttConfig)
+}
 
-	var s3Connector *common.S3Connector
-	var wg sync.WaitGroup
-	targets := createTargets(ttConfig)
+// runBackup performs single backup run, returns the exit code reflecting the device results
+func runBackup(ttConfig *Config, annotations map[string]string) int {
+	common.Log.Infof("Mikrotik Backup %s starting", buildVersion())
+	startedAt := time.Now()
+
+	mainCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	schedulingCtx := handleInterrupts(cancelRun, ttConfig.DrainTimeout)
+
+	runner, closeRunner, err := newBackupRunner(mainCtx, ttConfig)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	defer closeRunner()
+	runner.dryRun = dryRun
+	runner.force = force
+	if showProgress {
+		if runner.progress = newProgressView(os.Stderr); runner.progress != nil {
+			runner.progress.start()
+		}
+	}
 
-	localPathDownload := ttConfig.Directory
-	if localPathDownload == "" {
-		s3Connector, err = createS3Client(ttConfig)
+	targets := createTargets(ttConfig)
+	var canaryHistory map[string]*state.DeviceRecord
+	if canary != "" {
+		count, err := parseCanary(canary, len(targets))
 		if err != nil {
-			common.Log.Fatalf("failed to create S3 client: %v", err)
-			return
+			common.Log.Errorf("%v", err)
+			return exitConfig
+		}
+		targets = selectCanary(targets, count)
+		canaryHistory = snapshotHistory(runner.state, targets)
+		common.Log.Infof("canary mode: backing up %d randomly selected devices", len(targets))
+	}
+
+	manifest := runTargets(mainCtx, schedulingCtx, ttConfig, runner, targets, annotations)
+	runner.progress.stop()
+	if canary != "" {
+		printCanaryReport(runner.state, canaryHistory, manifest)
+	}
+	jsonStdout := output == outputJson && (outputFile == "" || outputFile == stdio)
+	if canary == "" && !jsonStdout { // canary report compares with the previous runs instead
+		printRunSummary(os.Stdout, manifest, runner.store.String())
+	}
+	if !dryRun {
+		if ttConfig.Manifest != "" {
+			if err := manifest.Write(ttConfig.Manifest); err != nil {
+				common.Log.Errorf("failed to write manifest: %v", err)
+			}
+		}
+		if p := ttConfig.Metrics.Pushgateway; p.Url != "" {
+			if err := metrics.Push(metrics.Pushgateway{Url: p.Url, Job: p.Job, Grouping: p.Grouping, Username: p.Username, Password: p.Password}); err != nil {
+				common.Log.Errorf("%v", err)
+			}
 		}
 	}
+	code := exitCode(manifest)
+	if output == outputJson {
+		if err := writeRunResult(manifest, runner.store.String(), startedAt, code); err != nil {
+			common.Log.Errorf("%v", err)
+			return max(code, exitFailure)
+		}
+	}
+	return code
+}
 
-	common.Log.Infof("found %d Mikrotik devices to backup (out of: %d)", len(targets), len(ttConfig.Mikrotiks))
+// exitCode returns exitAllFailed if every device backed up failed, exitPartial if some failed or the run was interrupted, skipped devices are not failures
+func exitCode(manifest *report.Manifest) int {
+	counts := manifest.Counts()
+	attempted := len(manifest.Results()) - counts[report.StatusSkipped] - counts[report.StatusCancelled]
+	switch {
+	case counts[report.StatusFailed] > 0 && counts[report.StatusFailed] == attempted:
+		return exitAllFailed
+	case counts[report.StatusFailed] > 0 || manifest.Partial:
+		return exitPartial
+	}
+	return 0
+}
+
+// newBackupRunner takes the instance lock, opens the state database and storage shared by all runs, the returned func releases them
+func newBackupRunner(ctx context.Context, ttConfig *Config) (*backupRunner, func(), error) {
+	var err error
+	var stateStore *state.Store
+	var releaseLock func()
+	closeRunner := func() {
+		if stateStore != nil {
+			stateStore.Close()
+		}
+		if releaseLock != nil {
+			releaseLock()
+		}
+	}
+	if ttConfig.Lock.Path != "" {
+		if releaseLock, err = acquireLock(ttConfig.Lock.Path, ttConfig.Lock.Wait); err != nil {
+			return nil, closeRunner, err
+		}
+	}
+	if src := ttConfig.ChangeDetection.Source; src != "" && src != changeSourceStorage && src != changeSourceState {
+		return nil, closeRunner, fmt.Errorf("invalid changeDetection.source: %s, must be one of: %s, %s", src, changeSourceStorage, changeSourceState)
+	}
+	if ttConfig.State.Path != "" {
+		if stateStore, err = state.Open(ttConfig.State.Path); err != nil {
+			return nil, closeRunner, err
+		}
+	} else {
+		if ttConfig.AdaptiveTimeout.Enabled {
+			common.Log.Warnf("adaptiveTimeout requires state.path, using configured timeouts")
+		}
+		if ttConfig.MinInterval > 0 {
+			common.Log.Warnf("minInterval requires state.path, devices are never skipped")
+		}
+		if ttConfig.Badge.Enabled || ttConfig.Badge.Listen != "" {
+			common.Log.Warnf("status badge requires state.path, badge disabled")
+		}
+		if ttConfig.SizeAnomaly.MinRatio > 0 {
+			common.Log.Warnf("sizeAnomaly requires state.path, artifact sizes are not checked")
+		}
+	}
+
+	store, err := storage.New(ctx, &ttConfig.Storage, stateStore)
+	if err != nil {
+		return nil, closeRunner, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	notifier, err := notify.New(&ttConfig.Notifications)
+	if err != nil {
+		return nil, closeRunner, err
+	}
+	if err := metrics.MetadataLabels(ttConfig.Metrics.Labels); err != nil {
+		return nil, closeRunner, err
+	}
+	postProcess, err := postprocess.New(ttConfig.PostProcess)
+	if err != nil {
+		return nil, closeRunner, err
+	}
+	normalizer, err := drift.NewNormalizer(ttConfig.ChangeDetection.Normalize)
+	if err != nil {
+		return nil, closeRunner, fmt.Errorf("changeDetection.normalize: %w", err)
+	}
+
+	runner := &backupRunner{
+		store:            store,
+		latestMarker:     ttConfig.LatestMarker,
+		storeDiff:        ttConfig.StoreDiff,
+		state:            stateStore,
+		compareWithState: ttConfig.ChangeDetection.Source == changeSourceState,
+		postProcess:      postProcess,
+		normalizer:       normalizer,
+		notifier:         notifier,
+		uploadLimiter:    common.NewRateLimiter(ttConfig.UploadRateLimit),
+		slots:            newSlots(ttConfig.Concurrency),
+		minSizeRatio:     ttConfig.SizeAnomaly.MinRatio,
+		blockSmaller:     ttConfig.SizeAnomaly.Block,
+	}
+	if runner.compareWithState && stateStore == nil {
+		return nil, closeRunner, fmt.Errorf("changeDetection.source: %s requires state.path", changeSourceState)
+	}
+	if ttConfig.Catalog {
+		if runner.catalog, err = storage.LoadCatalog(ctx, store); err != nil {
+			return nil, closeRunner, err
+		}
+	}
+	return runner, closeRunner, nil
+}
+
+// runTargets performs single backup run of the targets and publishes its results (metrics, catalog, snapshot), returns the run manifest
+func runTargets(
+	mainCtx context.Context,
+	schedulingCtx context.Context,
+	ttConfig *Config,
+	runner *backupRunner,
+	targets []*common.BackupSettings,
+	annotations map[string]string, // recorded in the manifest and object metadata of the run
+) *report.Manifest {
+	manifest := beginRun(mainCtx, ttConfig, runner, targets, annotations)
+	runLog := common.Log.WithField("run_id", manifest.RunId)
+	runLog.Infof("found %d Mikrotik devices to backup (out of: %d)", len(targets), len(ttConfig.Mikrotiks))
+	backupTargets(mainCtx, schedulingCtx, ttConfig, runner, manifest, targets, nil)
+	publishRun(mainCtx, schedulingCtx, ttConfig, runner, manifest)
+	return manifest
+}
+
+// beginRun returns manifest of the new run of the targets, the run start is notified (e.g. healthchecks start ping), the listing index refreshed
+// and the adaptive timeouts applied to the targets
+func beginRun(mainCtx context.Context, ttConfig *Config, runner *backupRunner, targets []*common.BackupSettings, annotations map[string]string) *report.Manifest {
+	manifest := report.NewManifest()
+	manifest.IncludeStats = ttConfig.ManifestStats
+	manifest.Annotations = annotations
+	// interleaved logs of concurrent device backups are told apart by the run_id and host fields
+	manifest.RunId = newRunId()
+	runCtx := common.WithLogger(mainCtx, common.Log.WithField("run_id", manifest.RunId))
+	runner.notifier.Start(runCtx)
+	if err := storage.RefreshIndex(runCtx, runner.store); err != nil {
+		common.Logger(runCtx).Warnf("%v, checking stored checksums with HEAD requests", err)
+	}
+	if runner.state != nil {
+		applyAdaptiveTimeouts(ttConfig, targets, runner.state)
+	}
+	return manifest
+}
+
+// backupTargets backs up the targets concurrently into the run manifest, failures, config changes and size anomalies are notified per device.
+// finished (if set) is called once for every target when its backup is done, skipped or cancelled
+func backupTargets(
+	mainCtx context.Context,
+	schedulingCtx context.Context,
+	ttConfig *Config,
+	runner *backupRunner,
+	manifest *report.Manifest,
+	targets []*common.BackupSettings,
+	finished func(host string),
+) {
+	var wg sync.WaitGroup
+	runId := manifest.RunId
+	annotations := manifest.Annotations
+	stateStore := runner.state
+	runLog := common.Log.WithField("run_id", runId)
+	done := func(host string) {
+		if finished != nil {
+			finished(host)
+		}
+	}
 
 	for _, settings := range targets {
-		ctx, cancel := context.WithTimeout(mainCtx, settings.Timeout)
-		defer cancel()
+		deviceLog := runLog.WithField("host", settings.BaseUrl.Host)
+		if schedulingCtx.Err() != nil {
+			manifest.Add(&report.DeviceResult{Host: settings.BaseUrl.Host, Status: report.StatusCancelled, Metadata: settings.Metadata})
+			done(settings.BaseUrl.Host)
+			continue
+		}
+		if canary == "" && backedUpRecently(deviceLog, stateStore, settings) { // canary devices are meant to be exercised
+			manifest.Add(&report.DeviceResult{Host: settings.BaseUrl.Host, Status: report.StatusSkipped, Metadata: settings.Metadata})
+			done(settings.BaseUrl.Host)
+			continue
+		}
 
 		wg.Add(1)
 
 		go func() {
 			defer wg.Done()
-			mainBackupChannel := make(chan *common.RequestResult) //experiment with moving channel out of this gorouteine
-			defer close(mainBackupChannel)
-			client := &http.Client{
-				Timeout: 10 * time.Second,
+			defer done(settings.BaseUrl.Host)
+			defer common.CapturePanic()
+			progress := runner.progress.device(settings.BaseUrl.Host)
+			waitCtx := common.WithLogger(schedulingCtx, deviceLog)
+			if !waitWindow(waitCtx, settings) || !waitSplay(waitCtx, settings.BaseUrl.Host, ttConfig.Splay) {
+				manifest.Add(&report.DeviceResult{Host: settings.BaseUrl.Host, Status: report.StatusCancelled, Metadata: settings.Metadata})
+				progress.Finish(string(report.StatusCancelled))
+				return
 			}
-
-			go backup.MikrotikConfigExport(ctx, settings, client, mainBackupChannel)
-			configFileResult := common.WaitForResult(ctx, mainBackupChannel)
-			if configFileResult.Err != nil {
-				common.Log.Errorf("failed to download Mikrotik %s config: %v", settings.BaseUrl.Host, configFileResult.Err)
+			release, ok := runner.acquire(waitCtx)
+			if !ok {
+				manifest.Add(&report.DeviceResult{Host: settings.BaseUrl.Host, Status: report.StatusCancelled, Metadata: settings.Metadata})
+				progress.Finish(string(report.StatusCancelled))
 				return
 			}
-
-			if s3Connector != nil {
-				go func() {
-					mainBackupChannel <- &common.RequestResult{
-						MikrotikIdentity:     configFileResult.MikrotikIdentity,
-						ExistingConfigSha256: s3Connector.GetObjectSha256(ctx, configFileResult.File.Name),
-					}
-				}()
-				s3MetadataResult := common.WaitForResult(ctx, mainBackupChannel)
-				configFileResult.ExistingConfigSha256 = s3MetadataResult.ExistingConfigSha256
+			defer release()
+			ctx, cancel := context.WithTimeout(common.WithProgress(common.WithLogger(mainCtx, deviceLog), progress), settings.Timeout)
+			defer cancel()
+			progress.Start()
+			result := runner.backupWithHooks(ctx, runId, settings, annotations)
+			progress.Finish(string(result.Status))
+			manifest.Add(result)
+			if result.Status == report.StatusFailed && !runner.dryRun {
+				runner.notifier.Notify(ctx, notify.NewFailure(runId, result, annotations))
+				captureFailure(ctx, settings, result)
 			}
-
-			if configFileResult.ShouldPerformNewBackup() {
-				common.Log.Infof("Mikrotik (host: %s, identity: %s) config has changed, proceeding with backup", settings.BaseUrl.Host, configFileResult.MikrotikIdentity)
-
-				go backup.MikrotikBackup(ctx, configFileResult.MikrotikIdentity, settings, client, mainBackupChannel)
-				backupFileResult := common.WaitForResult(ctx, mainBackupChannel)
-				if backupFileResult.Err != nil {
-					common.Log.Errorf("failed to backup Mikrotik %s: %v", settings.BaseUrl.Host, backupFileResult.Err)
-					return
-				}
-
-				common.Log.Infof("backup file downloaded from %s: %s (%d bytes)", settings.BaseUrl.Host, backupFileResult.File.Name, len(backupFileResult.File.Contents))
-				if s3Connector != nil {
-					go storage.UploadFile(ctx, s3Connector, &configFileResult.File, &settings.Metadata, mainBackupChannel)
-					configFileUploadResult := common.WaitForResult(ctx, mainBackupChannel)
-					if configFileUploadResult.Err != nil {
-						common.Log.Errorf("config file upload failure: %v", configFileUploadResult.Err)
-						return
-					}
-
-					go storage.UploadFile(ctx, s3Connector, &backupFileResult.File, &settings.Metadata, mainBackupChannel)
-					backupUploadResult := common.WaitForResult(ctx, mainBackupChannel)
-					if backupUploadResult.Err != nil {
-						common.Log.Errorf("backup file upload failure: %v", backupUploadResult.Err)
-						return
-					}
-				} else {
-					go storage.StoreFile(localPathDownload, &configFileResult.File, mainBackupChannel)
-					storeResult := common.WaitForResult(ctx, mainBackupChannel)
-					if storeResult.Err != nil {
-						common.Log.Errorf("config file upload failure: %v", storeResult.Err)
-						return
-					}
-
-					go storage.StoreFile(localPathDownload, &backupFileResult.File, mainBackupChannel)
-					storeResult = common.WaitForResult(ctx, mainBackupChannel)
-					if storeResult.Err != nil {
-						common.Log.Errorf("backup file upload failure: %v", storeResult.Err)
-						return
-					}
-					common.Log.Infof("Mikrotik %s backup completed successfully", settings.BaseUrl.Host)
-				}
-			} else {
-				common.Log.Infof("Mikrotik (host: %s, identity: %s) config has not changed, skipping backup", settings.BaseUrl.Host, configFileResult.MikrotikIdentity)
-				return
+			if result.Drift != nil {
+				runner.notifier.Notify(ctx, notify.NewConfigChange(runId, result, annotations))
+			}
+			if len(result.SizeAnomalies) > 0 && result.Status != report.StatusFailed {
+				runner.notifier.Notify(ctx, notify.NewSizeAnomaly(runId, result, annotations))
 			}
 		}()
 	}
 
 	wg.Wait()
+
+	manifest.Sort()
+	for _, r := range manifest.Devices {
+		if r.Status != report.StatusCancelled && r.Status != report.StatusSkipped {
+			deviceLog := runLog.WithField("host", r.Host)
+			if r.Identity != "" {
+				deviceLog = deviceLog.WithField("device", r.Identity)
+			}
+			deviceLog.Infof("Mikrotik (host: %s, identity: %s) %s, %s", r.Host, r.Identity, r.Status, r.TimingSummary())
+		}
+		metrics.RecordDevice(r)
+	}
 }
 
-func createS3Client(c *Config) (*common.S3Connector, error) {
-	s3Region := c.S3.Region
-	s3AccessKey := c.S3.AccessKey
-	s3SecretKey := c.S3.SecretKey
-	s3Host := c.S3.Host
-	s3BucketPrefix := c.S3.Path
-	s3PathStyle := c.S3.UsePathStyle
+// publishRun publishes results of the finished run once: metrics textfile, catalog, snapshot, badge and the summary notification
+func publishRun(mainCtx context.Context, schedulingCtx context.Context, ttConfig *Config, runner *backupRunner, manifest *report.Manifest) {
+	runLog := common.Log.WithField("run_id", manifest.RunId)
+	store := runner.store
+	stateStore := runner.state
+
+	runner.publishMu.Lock()
+	defer runner.publishMu.Unlock()
+	if ttConfig.Metrics.Textfile != "" && !runner.dryRun {
+		if err := metrics.WriteTextfile(ttConfig.Metrics.Textfile); err != nil {
+			common.Log.Errorf("%v", err)
+		}
+	}
+	if schedulingCtx.Err() != nil {
+		manifest.MarkPartial()
+		runLog.Warnf("run interrupted, partial results:")
+		for _, r := range manifest.Devices {
+			runLog.Warnf("Mikrotik (host: %s, identity: %s): %s %s", r.Host, r.Identity, r.Status, r.Error)
+		}
+	}
+	if runner.dryRun {
+		return
+	}
 
-	bucketPrefix := strings.SplitN(strings.TrimPrefix(s3BucketPrefix, "/"), "/", 2)
-	if (len(bucketPrefix) < 2) || (bucketPrefix[0] == "" || bucketPrefix[1] == "") {
-		return nil, fmt.Errorf("invalid S3 path: %s, must be in format bucket/prefix", s3BucketPrefix)
+	if runner.catalog != nil {
+		if err := runner.catalog.Save(mainCtx, store, time.Now()); err != nil {
+			common.Log.Errorf("failed to update catalog: %v", err)
+		}
 	}
-	bucket := bucketPrefix[0]
-	bucketPath := bucketPrefix[1]
 
-	cfg := aws.Config{
-		Region:       s3Region,
-		BaseEndpoint: &s3Host,
-		Credentials:  credentials.NewStaticCredentialsProvider(s3AccessKey, s3SecretKey, ""),
+	if ttConfig.SqliteSnapshot.Enabled {
+		publishSnapshot(mainCtx, ttConfig, store, stateStore, runner.catalog)
+	}
+	if ttConfig.Badge.Enabled && stateStore != nil {
+		publishBadge(mainCtx, ttConfig, store, stateStore)
 	}
 
-	connector := &common.S3Connector{
-		Client: s3.NewFromConfig(
-			cfg,
-			func(o *s3.Options) {
-				o.UsePathStyle = s3PathStyle
-			},
-		),
-		Bucket: bucket,
-		Prefix: bucketPath,
+	runner.notifier.Notify(common.WithLogger(mainCtx, runLog), notify.NewSummary(manifest.RunId, manifest))
+}
+
+// parseAnnotations parses key=value annotations of the run
+func parseAnnotations(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	annotations := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid annotation: %s, must be key=value", v)
+		}
+		annotations[key] = value
 	}
-	return connector, nil
+	return annotations, nil
+}
+
+// newRunId returns random identifier of the backup run
+func newRunId() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// waitSplay delays the device backup by random offset within splay, returns false if scheduling was stopped meanwhile
+func waitSplay(schedulingCtx context.Context, host string, splay time.Duration) bool {
+	if splay <= 0 {
+		return true
+	}
+	delay := time.Duration(rand.Int63n(int64(splay)))
+	common.Logger(schedulingCtx).Debugf("Mikrotik %s backup starts in %s (splay)", host, delay.Round(time.Millisecond))
+	return sleep(schedulingCtx, delay)
+}
+
+// captureFailure reports the failed device backup to Sentry tagged with the device identity and metadata
+func captureFailure(ctx context.Context, settings *common.BackupSettings, result *report.DeviceResult) {
+	tags := make(map[string]string, len(result.Metadata)+1)
+	for k, v := range result.Metadata {
+		tags["metadata."+k] = v
+	}
+	if result.Identity != "" {
+		tags["device"] = result.Identity
+	}
+	common.CaptureFailure(ctx, fmt.Sprintf("Mikrotik %s backup failed: %s", result.Host, result.Error), tags)
+}
+
+// backedUpRecently returns whether the last successful backup of the device is younger than its minInterval
+func backedUpRecently(log *logrus.Entry, stateStore *state.Store, settings *common.BackupSettings) bool {
+	if stateStore == nil || settings.MinInterval <= 0 {
+		return false
+	}
+	record, found, err := stateStore.GetDevice(settings.BaseUrl.Host)
+	if err != nil {
+		log.Warnf("failed to read Mikrotik %s state: %v", settings.BaseUrl.Host, err)
+		return false
+	}
+	if ago := time.Since(record.LastSuccess); found && ago < settings.MinInterval {
+		log.Infof("Mikrotik %s backed up %s ago (minInterval: %s), skipping", settings.BaseUrl.Host, ago.Round(time.Second), settings.MinInterval)
+		return true
+	}
+	return false
+}
+
+// waitWindow defers the device backup until its backup window opens, returns false if scheduling was stopped meanwhile
+func waitWindow(schedulingCtx context.Context, settings *common.BackupSettings) bool {
+	now := time.Now()
+	opens := settings.Window.Next(now)
+	if !opens.After(now) {
+		return true
+	}
+	common.Logger(schedulingCtx).Infof("Mikrotik %s outside of its backup window, deferred until %s", settings.BaseUrl.Host, opens.Format(time.RFC3339))
+	return sleep(schedulingCtx, opens.Sub(now))
+}
+
+// sleep returns false if ctx is done before the delay elapses
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handleInterrupts cancels the returned context on first interrupt or SIGTERM (no new devices are scheduled)
+// and calls cancelRun on the second one or once drainTimeout elapses (in-flight backups are aborted), 0 - in-flight backups are awaited
+func handleInterrupts(cancelRun context.CancelFunc, drainTimeout time.Duration) context.Context {
+	schedulingCtx, stopScheduling := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		common.Log.Warnf("%s received, no new devices will be scheduled (interrupt again to cancel in-flight backups)", sig)
+		stopScheduling()
+		var drained <-chan time.Time // nil - never
+		if drainTimeout > 0 {
+			drained = time.After(drainTimeout)
+		}
+		select {
+		case sig = <-signals:
+			common.Log.Warnf("second %s received, cancelling in-flight backups", sig)
+		case <-drained:
+			common.Log.Warnf("in-flight backups not completed within drain timeout %s, cancelling", drainTimeout)
+		}
+		cancelRun()
+	}()
+	return schedulingCtx
 }
 
 func createTargets(config *Config) []*common.BackupSettings {
@@ -197,54 +731,214 @@ func createTargets(config *Config) []*common.BackupSettings {
 			common.Log.Errorf("failed to create URL for Mikrotik %s: %v", target.Host, err)
 			continue
 		}
+		prefixTemplate := target.PrefixTemplate
+		if prefixTemplate == "" {
+			prefixTemplate = config.PrefixTemplate
+		}
+		tmpl, err := common.ParsePrefixTemplate(prefixTemplate)
+		if err != nil {
+			common.Log.Errorf("invalid prefix template for Mikrotik %s: %v", target.Host, err)
+			continue
+		}
+		if p := invalidPattern(target.ExtraFiles); p != "" {
+			common.Log.Errorf("invalid extra files pattern for Mikrotik %s: %s", target.Host, p)
+			continue
+		}
+		metadata, metadataTemplates, err := common.ParseMetadataTemplates(target.Metadata)
+		if err != nil {
+			common.Log.Errorf("Mikrotik %s: %v", target.Host, err)
+			continue
+		}
+		schedule := target.Schedule
+		if schedule == "" {
+			schedule = config.Schedule
+		}
+		windowConfig := target.BackupWindow
+		if len(windowConfig.Allow) == 0 && len(windowConfig.Blackout) == 0 {
+			windowConfig = config.BackupWindow
+		}
+		window, err := common.ParseBackupWindow(windowConfig.Allow, windowConfig.Blackout)
+		if err != nil {
+			common.Log.Errorf("invalid backup window for Mikrotik %s: %v", target.Host, err)
+			continue
+		}
 		timeout := target.Timeout
 		if timeout == 0 {
-			timeout = 10 * time.Second // Default timeout if not set
+			timeout = defaultTimeout
+		}
+		minInterval := target.MinInterval
+		if minInterval == 0 {
+			minInterval = config.MinInterval
+		}
+		mode := target.Mode
+		if mode == "" {
+			mode = config.Mode
+		}
+		if err := validateMode(mode, "mode"); err != nil {
+			common.Log.Errorf("Mikrotik %s: %v", target.Host, err)
+			continue
+		}
+		if err := validateHooks(config.Hooks, "hooks"); err != nil {
+			common.Log.Errorf("Mikrotik %s: %v", target.Host, err)
+			continue
+		}
+		if err := validateHooks(target.Hooks, "hooks"); err != nil {
+			common.Log.Errorf("Mikrotik %s: %v", target.Host, err)
+			continue
 		}
 
 		targets = append(targets, &common.BackupSettings{
-			BaseUrl:       u,
-			EncryptionKey: target.EncryptionKey,
-			Timeout:       timeout,
-			Metadata:      target.Metadata,
+			BaseUrl:         u,
+			EncryptionKey:   target.EncryptionKey,
+			Timeout:         timeout,
+			Metadata:        metadata,
+			PrefixTemplate:  tmpl,
+			UploadRateLimit: target.UploadRateLimit,
+			ExtraFiles:      target.ExtraFiles,
+			Schedule:        schedule,
+			Window:          window,
+			MinInterval:     minInterval,
+			ExportOnly:      mode == modeExport,
+			Force:           target.Force != nil && *target.Force,
+			PreHooks:        slices.Concat(config.Hooks.Pre, target.Hooks.Pre),
+			PostHooks:       slices.Concat(config.Hooks.Post, target.Hooks.Post),
+
+			MetadataTemplates: metadataTemplates,
 		})
 	}
+
+	// stable processing and reporting order regardless of the config files merge order
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].BaseUrl.Host < targets[j].BaseUrl.Host
+	})
 	return targets
 }
 
-func setupConfig() (*Config, error) {
+// invalidPattern returns the first malformed glob, empty if all are valid
+func invalidPattern(patterns []string) string {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// logLevel returns the level set by -v flags, the configured one without them
+func logLevel(configured string, verbose int) string {
+	switch {
+	case verbose == 1:
+		return "debug"
+	case verbose > 1:
+		return "trace"
+	}
+	return configured
+}
+
+// expandEnvHook expands string values of the configuration which are entirely ${VAR} references
+func expandEnvHook(from reflect.Type, _ reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String {
+		return data, nil
+	}
+	return common.ExpandEnv(reflect.ValueOf(data).String())
+}
+
+// loadConfig reads the config files overridden by flags and environment, called again when the daemon reloads configuration
+func loadConfig() (*Config, error) {
+	config, unknown, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.Strict {
+		if err := strictConfig(config, unknown); err != nil {
+			return nil, fmt.Errorf("invalid configuration (set strict: false to ignore):\n%w", err)
+		}
+	}
+	return config, nil
+}
+
+// readConfig returns the configuration and the unknown keys of the config files, e.g. misspelled settings
+func readConfig() (*Config, []string, error) {
 	v := viper.New()
 	v.SetEnvPrefix("TT")
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	v.SetConfigFile("config.yaml") // default config file full path, not adding paths as they pick single file
-
-	pflag.String("log.level", "", "log level (overrides yaml file)")
-	pflag.Parse()
-	_ = v.BindPFlags(pflag.CommandLine)
+	v.SetConfigType("yaml") // the files are read by readConfigFile, sops-encrypted ones decrypted
+	_ = v.BindPFlags(globalFlags)
 
-	if err := v.ReadInConfig(); err != nil {
-		panic(fmt.Errorf("error reading config file, %s", err))
+	contents, err := readConfigFile("config.yaml")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config file, %w", err)
+	}
+	if err := v.ReadConfig(contents); err != nil {
+		return nil, nil, fmt.Errorf("error reading config file, %w", err)
 	}
 
-	loader := func(configFullPath string) {
+	for _, configFullPath := range []string{"/etc/tiktocker/config.yaml", ".local/config.yaml"} {
 		if _, err := os.Stat(configFullPath); err == nil {
-			v.SetConfigFile(configFullPath)
-			if err := v.MergeInConfig(); err != nil {
-				panic(fmt.Errorf("error merging config file, %s", err))
+			contents, err := readConfigFile(configFullPath)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error merging config file %s, %w", configFullPath, err)
+			}
+			if err := v.MergeConfig(contents); err != nil {
+				return nil, nil, fmt.Errorf("error merging config file %s, %w", configFullPath, err)
 			}
 		}
 	}
+	if configDir != "" {
+		if err := mergeConfigDir(v, configDir); err != nil {
+			return nil, nil, err
+		}
+	}
+	decodeHook := mapstructure.ComposeDecodeHookFunc(
+		expandEnvHook,
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)
+	if err := mergeRemoteConfig(context.Background(), v, decodeHook); err != nil {
+		return nil, nil, err
+	}
+	if inventory := v.GetString("inventory"); inventory != "" {
+		inventory, err := common.ExpandEnv(inventory)
+		if err != nil {
+			return nil, nil, fmt.Errorf("inventory: %w", err)
+		}
+		if err := loadInventory(v, inventory); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	loader("/etc/tiktocker/config.yaml")
-	loader(".local/config.yaml")
-
-	var config *Config
-	err := v.Unmarshal(&config)
+	secretsFiles, err := readSecretsDir(secretsDir, configuredHosts(v))
 	if err != nil {
-		log.Fatalf("Unable to decode into struct, %v", err)
-		return config, err
+		return nil, nil, err
 	}
+	secretsFiles.apply(v)
 
-	return config, nil
+	var config *Config
+	var metadata mapstructure.Metadata
+	withMetadata := func(c *mapstructure.DecoderConfig) {
+		c.Metadata = &metadata
+	}
+	if err := v.Unmarshal(&config, viper.DecodeHook(decodeHook), withMetadata); err != nil {
+		return nil, nil, fmt.Errorf("unable to decode into struct, %w", err)
+	}
+	if err := expandHostRanges(config); err != nil {
+		return nil, nil, err
+	}
+	if err := discoverDevices(context.Background(), config); err != nil {
+		return nil, nil, err
+	}
+	if err := secretsFiles.applyDevices(config, decodeHook); err != nil {
+		return nil, nil, err
+	}
+	if err := applyGroups(config); err != nil {
+		return nil, nil, err
+	}
+	if err := readSecretFiles(config); err != nil {
+		return nil, nil, err
+	}
+	if err := resolveSecretRefs(context.Background(), config); err != nil {
+		return nil, nil, err
+	}
+	return config, unknownKeys(metadata.Unused), nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/drift"
+	"tiktocker/internal/mirror"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// pickLimit is the number of the newest stored versions offered by the restore picker
+const pickLimit = 20
+
+// recordedKeys are the metadata entries recorded by tiktocker itself, the others label the version (device metadata, run annotations)
+var recordedKeys = map[string]bool{
+	common.Sha256WithoutFirstLine: true,
+	common.BackupSha256:           true,
+	common.TiktockerVersion:       true,
+	"routeros-version":            true,
+	"architecture":                true,
+	"board-name":                  true,
+	"model":                       true,
+	"serial-number":               true,
+	"export-timestamp":            true,
+}
+
+// restoreCandidate is the stored version offered by the restore picker, Key is relative to the storage root
+type restoreCandidate struct {
+	storage.ObjectInfo
+	Key     string
+	Label   string
+	Changes string // against the previous version of the file
+}
+
+// pickRestore lists stored versions of the device newest first, asks for the one to restore and confirms the target
+func pickRestore(ctx context.Context, ttConfig *Config, source mirror.Endpoint, settings *common.BackupSettings, client *http.Client, in *bufio.Reader) (string, storage.ObjectInfo, bool) {
+	host := settings.BaseUrl.Host
+	identity, err := deviceIdentity(ctx, settings, client)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return "", storage.ObjectInfo{}, false
+	}
+	candidates, err := restoreCandidates(ctx, ttConfig, source, identity)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return "", storage.ObjectInfo{}, false
+	}
+	if len(candidates) == 0 {
+		common.Log.Errorf("no backup of Mikrotik %s (identity: %s) stored in %s", host, identity, source.Store)
+		return "", storage.ObjectInfo{}, false
+	}
+
+	printCandidates(os.Stderr, host, identity, candidates)
+	answer := prompt(in, os.Stderr, fmt.Sprintf("version to restore [1-%d]", len(candidates)))
+	index, err := strconv.Atoi(answer)
+	if err != nil || index < 1 || index > len(candidates) {
+		common.Log.Errorf("invalid choice: %q, must be 1-%d", answer, len(candidates))
+		return "", storage.ObjectInfo{}, false
+	}
+	c := candidates[index-1]
+	target := fmt.Sprintf("restore %s (stored %s) onto Mikrotik %s (identity: %s)", c.Key, c.LastModified.UTC().Format(time.RFC3339), host, identity)
+	if !restoreYes && !confirm(in, os.Stderr, target) {
+		common.Log.Infof("restore cancelled")
+		return "", storage.ObjectInfo{}, false
+	}
+	return c.Key, c.ObjectInfo, true
+}
+
+func deviceIdentity(ctx context.Context, settings *common.BackupSettings, client *http.Client) (string, error) {
+	ch := common.NewResultChannel()
+	go backup.MikrotikIdentity(ctx, settings, client, ch)
+	result := common.WaitForResult(ctx, ch)
+	if result.Err != nil {
+		return "", fmt.Errorf("failed to read identity of Mikrotik %s: %v", settings.BaseUrl.Host, result.Err)
+	}
+	return result.MikrotikIdentity, nil
+}
+
+// restoreCandidates returns the newest restorable versions of the device backup and export, exports are compared with their previous version
+func restoreCandidates(ctx context.Context, ttConfig *Config, source mirror.Endpoint, identity string) ([]restoreCandidate, error) {
+	listed, err := source.Store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s listing failure: %v", source.Store, err)
+	}
+	normalizer, err := drift.NewNormalizer(ttConfig.ChangeDetection.Normalize)
+	if err != nil {
+		return nil, fmt.Errorf("changeDetection.normalize: %v", err)
+	}
+	versions := make([]storage.ObjectInfo, 0)
+	for _, o := range storage.DeviceHistory(listed, identity) {
+		if base := path.Base(o.Key); storage.Transferable(o.Key) && (base == backup.BackupFileName(identity) || base == backup.ExportFileName(identity)) {
+			versions = append(versions, o)
+		}
+	}
+	if len(versions) > pickLimit {
+		common.Log.Infof("%d versions of %s stored, listing the newest %d", len(versions), identity, pickLimit)
+	}
+
+	exports := make(map[int][]byte) // contents by the version index, read once
+	readExport := func(i int) ([]byte, error) {
+		if contents, ok := exports[i]; ok {
+			return contents, nil
+		}
+		contents, err := readVersion(ctx, source.Store, storage.RelativeKey(source.KeyPrefix, versions[i].Key), versions[i])
+		if err != nil {
+			return nil, err
+		}
+		exports[i] = contents
+		return contents, nil
+	}
+
+	candidates := make([]restoreCandidate, 0, min(len(versions), pickLimit))
+	for i, o := range versions[:min(len(versions), pickLimit)] {
+		c := restoreCandidate{ObjectInfo: o, Key: storage.RelativeKey(source.KeyPrefix, o.Key), Label: "-", Changes: "first stored"}
+		if metadata, err := storage.VersionMetadata(ctx, source.Store, c.Key, o); err != nil {
+			common.Log.Warnf("%v", err)
+		} else if label := versionLabel(metadata); label != "" {
+			c.Label = label
+		}
+		previous := previousVersion(versions, i)
+		switch {
+		case previous < 0:
+		case strings.HasSuffix(o.Key, ".backup"):
+			// binary backups cannot be compared
+			c.Changes = fmt.Sprintf("%+d bytes", o.Size-versions[previous].Size)
+		default:
+			current, err := readExport(i)
+			if err != nil {
+				return nil, err
+			}
+			old, err := readExport(previous)
+			if err != nil {
+				return nil, err
+			}
+			change := normalizer.Summarize(old, current)
+			c.Changes = "no changes once normalized"
+			if !change.Empty() {
+				c.Changes = fmt.Sprintf("+%d -%d %s", change.Added, change.Removed, sectionsText(change.Sections))
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// previousVersion returns index of the version of the same file stored before the i-th one, -1 if it is the oldest
+func previousVersion(versions []storage.ObjectInfo, i int) int {
+	for j := i + 1; j < len(versions); j++ {
+		if path.Base(versions[j].Key) == path.Base(versions[i].Key) {
+			return j
+		}
+	}
+	return -1
+}
+
+// versionLabel returns the metadata not recorded by tiktocker itself as key=value pairs in key order, e.g. change=CHG0012345 site=waw
+func versionLabel(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		if !recordedKeys[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, metadata[k]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func printCandidates(out io.Writer, host string, identity string, candidates []restoreCandidate) {
+	_, _ = fmt.Fprintf(out, "stored versions of Mikrotik %s (identity: %s):\n", host, identity)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "  #\tSTORED\tFILE\tLABEL\tCHANGES")
+	for i, c := range candidates {
+		_, _ = fmt.Fprintf(w, "  %d\t%s\t%s\t%s\t%s\n", i+1, c.LastModified.UTC().Format(time.RFC3339), path.Base(c.Key), c.Label, c.Changes)
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"tiktocker/internal/common"
+)
+
+// startProfile starts one-shot run profiling, the returned function writes the profile and must be called once the run finishes
+func startProfile(mode string, path string) (func(), error) {
+	if path == "" {
+		path = fmt.Sprintf("tiktocker.%s.pprof", mode)
+	}
+	if mode != "cpu" && mode != "mem" {
+		return nil, fmt.Errorf("invalid profile: %s, must be one of: cpu, mem", mode)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create profile file: %w", err)
+	}
+
+	if mode == "cpu" {
+		if err := rpprof.StartCPUProfile(f); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to start cpu profile: %w", err)
+		}
+		return func() {
+			rpprof.StopCPUProfile()
+			_ = f.Close()
+			common.Log.Infof("cpu profile written to %s", path)
+		}, nil
+	}
+	return func() {
+		runtime.GC() // up-to-date statistics of live objects
+		if err := rpprof.WriteHeapProfile(f); err != nil {
+			common.Log.Errorf("failed to write memory profile: %v", err)
+		}
+		_ = f.Close()
+		common.Log.Infof("memory profile written to %s", path)
+	}, nil
+}
+
+// servePprof exposes net/http/pprof endpoints under /debug/pprof/, meant to be bound to localhost only
+func servePprof(listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		common.Log.Infof("pprof endpoints listening on %s", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			common.Log.Errorf("pprof server failure: %v", err)
+		}
+	}()
+}
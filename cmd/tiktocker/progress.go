@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"tiktocker/internal/common"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// progressView redraws live per-device progress of the run on the terminal, the logs are held back until it stops
+type progressView struct {
+	out  *os.File
+	logs lockedBuffer // written by the loggers while the view is drawn
+
+	mu      sync.Mutex
+	devices map[string]*common.DeviceProgress
+	lines   int // drawn by the last render, cleared by the next one
+
+	stopped chan struct{}
+	done    chan struct{}
+}
+
+// newProgressView returns view drawn on the terminal, nil if out is not a terminal (e.g. redirected to a file)
+func newProgressView(out *os.File) *progressView {
+	if !term.IsTerminal(int(out.Fd())) {
+		common.Log.Warnf("--progress requires terminal, logging instead")
+		return nil
+	}
+	return &progressView{
+		out:     out,
+		devices: make(map[string]*common.DeviceProgress),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start redirects the logs and draws the view until stop
+func (v *progressView) start() {
+	common.SetOutput(&v.logs)
+	go func() {
+		defer close(v.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				v.render()
+			case <-v.stopped:
+				v.render()
+				return
+			}
+		}
+	}()
+}
+
+// stop draws the final state and writes the logs held back, no-op for nil view
+func (v *progressView) stop() {
+	if v == nil {
+		return
+	}
+	close(v.stopped)
+	<-v.done
+	common.SetOutput(v.out)
+	_, _ = v.out.Write(v.logs.buffer.Bytes())
+}
+
+// device returns progress of the device backup, nil for nil view
+func (v *progressView) device(host string) *common.DeviceProgress {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	p, ok := v.devices[host]
+	if !ok {
+		p = common.NewDeviceProgress()
+		v.devices[host] = p
+	}
+	return p
+}
+
+func (v *progressView) render() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	hosts := make([]string, 0, len(v.devices))
+	for host := range v.devices {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	snapshots := make(map[string]common.ProgressSnapshot, len(hosts))
+	finished, waiting := 0, 0
+	for _, host := range hosts {
+		s := v.devices[host].Snapshot()
+		snapshots[host] = s
+		switch {
+		case s.Finished:
+			finished++
+		case s.Phase == common.PhaseWaiting:
+			waiting++
+		}
+	}
+	// a fleet not fitting the terminal shows the devices in progress only
+	rows := hosts
+	if _, height, err := term.GetSize(int(v.out.Fd())); err == nil && height > 0 && len(hosts)+2 > height {
+		rows = make([]string, 0)
+		for _, host := range hosts {
+			if s := snapshots[host]; !s.Finished && s.Phase != common.PhaseWaiting {
+				rows = append(rows, host)
+			}
+		}
+		rows = rows[:min(len(rows), max(height-2, 0))]
+	}
+
+	var b strings.Builder
+	if v.lines > 0 {
+		_, _ = fmt.Fprintf(&b, "\x1b[%dA\x1b[J", v.lines) // cursor up to the previous render and clear it
+	}
+	_, _ = fmt.Fprintf(&b, "%d devices: %d finished, %d in progress, %d waiting\n", len(hosts), finished, len(hosts)-finished-waiting, waiting)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HOST\tDEVICE\tPHASE\tTRANSFERRED\tELAPSED\t")
+	for _, host := range rows {
+		s := snapshots[host]
+		identity := s.Identity
+		if identity == "" {
+			identity = "-"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t\n", host, identity, s.Phase, s.Bytes, round(s.Elapsed))
+	}
+	_ = w.Flush()
+	v.lines = len(rows) + 2
+	_, _ = v.out.WriteString(b.String())
+}
+
+// lockedBuffer is written by the loggers concurrently, each of them serializes its own writes only
+type lockedBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// outputKeys prints only object keys, one per line, for shell pipelines
+const outputKeys = "keys"
+
+func runPrune(ttConfig *Config, _ []string) int {
+	ctx := context.Background()
+	store, err := storage.New(ctx, &ttConfig.Storage, nil)
+	if err != nil {
+		common.Log.Errorf("failed to create storage client: %v", err)
+		return exitFailure
+	}
+
+	policy := storage.RetentionPolicy{KeepLast: ttConfig.Retention.KeepLast, MaxAge: ttConfig.Retention.MaxAge}
+	candidates, err := storage.PlanPrune(ctx, store, policy, time.Now())
+	if err != nil {
+		common.Log.Errorf("failed to plan prune: %v", err)
+		return exitFailure
+	}
+
+	// the plan says what is deleted only once the deletion is confirmed
+	deleting := !dryRun && (yesDelete || ttConfig.Storage.AllowPrune())
+	printPruneCandidates(candidates, policy, deleting)
+	if dryRun || len(candidates) == 0 {
+		return 0
+	}
+	if !deleting {
+		common.Log.Errorf("refusing to delete object versions, pass --yes-delete or set allowPrune: true for the storage (use --dry-run to review)")
+		return exitConfig
+	}
+
+	if err := storage.ExecutePrune(ctx, store, candidates); err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	common.Log.Infof("pruned %d object versions", len(candidates))
+	return 0
+}
+
+func printPruneCandidates(candidates []storage.PruneCandidate, policy storage.RetentionPolicy, deleting bool) {
+	if output == outputKeys {
+		printKeys(candidates)
+		return
+	}
+	if len(candidates) == 0 {
+		fmt.Println("nothing to prune")
+		return
+	}
+	var size int64
+	for _, c := range candidates {
+		size += c.Size
+	}
+	if deleting {
+		fmt.Printf("deleting %d object versions (%d bytes) by %s:\n", len(candidates), size, &policy)
+	} else {
+		fmt.Printf("%d object versions (%d bytes) would be deleted by %s:\n", len(candidates), size, &policy)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	device := ""
+	for i, c := range candidates {
+		if i == 0 || c.Device != device {
+			device = c.Device
+			_, _ = fmt.Fprintf(w, "device: %s\n", device)
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\t%d bytes\n", c.Key, c.VersionId, c.LastModified.UTC().Format(time.RFC3339), c.Size)
+	}
+	_ = w.Flush()
+}
+
+// printKeys prints keys of the candidates, every key once even if multiple versions of it are pruned
+func printKeys(candidates []storage.PruneCandidate) {
+	printed := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		if !printed[c.Key] {
+			printed[c.Key] = true
+			fmt.Println(c.Key)
+		}
+	}
+}
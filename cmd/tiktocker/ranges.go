@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"tiktocker/internal/common"
+)
+
+// expandHostRanges replaces the devices with host range or CIDR by the device of every address, all sharing the settings of the entry
+func expandHostRanges(config *Config) error {
+	devices := make([]DeviceConfig, 0, len(config.Mikrotiks))
+	for _, m := range config.Mikrotiks {
+		hosts, err := common.ExpandHosts(m.Host)
+		if err != nil {
+			return fmt.Errorf("mikrotiks host: %w", err)
+		}
+		if len(hosts) == 1 && hosts[0] == m.Host {
+			devices = append(devices, m)
+			continue
+		}
+		for _, host := range hosts {
+			device := m
+			device.Host = host
+			if m.Metadata != nil {
+				device.Metadata = make(map[string]string, len(m.Metadata)) // modified per device, e.g. by the secrets directory
+				for k, v := range m.Metadata {
+					device.Metadata[k] = v
+				}
+			}
+			devices = append(devices, device)
+		}
+	}
+	config.Mikrotiks = devices
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"syscall"
+	"tiktocker/internal/common"
+	"tiktocker/internal/remote"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+)
+
+// mergeRemoteConfig merges the configuration of the KV store over the config files, the remote settings themselves come from the config files or environment
+func mergeRemoteConfig(ctx context.Context, v *viper.Viper, decodeHook mapstructure.DecodeHookFunc) error {
+	var cfg remote.Config
+	if err := v.UnmarshalKey("remote", &cfg, viper.DecodeHook(decodeHook)); err != nil {
+		return fmt.Errorf("invalid remote configuration, %w", err)
+	}
+	if !cfg.Enabled() {
+		return nil
+	}
+	contents, err := remote.Fetch(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error reading remote config %s %s, %w", cfg.Provider, cfg.Key, err)
+	}
+	decrypted, err := decryptConfig(cfg.Key, contents)
+	if err != nil {
+		return err
+	}
+	if err := v.MergeConfig(decrypted); err != nil {
+		return fmt.Errorf("error merging remote config %s %s, %w", cfg.Provider, cfg.Key, err)
+	}
+	return nil
+}
+
+// watchRemote requests reload of the daemon configuration when the remote configuration changes, failed checks are logged and retried
+func watchRemote(ctx context.Context, cfg remote.Config, reloads chan<- os.Signal) {
+	if !cfg.Enabled() || cfg.Watch <= 0 {
+		return
+	}
+	var last [sha256.Size]byte
+	if contents, err := remote.Fetch(ctx, cfg); err == nil {
+		last = sha256.Sum256(contents)
+	}
+	common.Log.Infof("watching remote config %s %s every %s", cfg.Provider, cfg.Key, cfg.Watch)
+	go func() {
+		ticker := time.NewTicker(cfg.Watch)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			contents, err := remote.Fetch(ctx, cfg)
+			if err != nil {
+				common.Log.Warnf("remote config %s %s check failure: %v", cfg.Provider, cfg.Key, err)
+				continue
+			}
+			if sum := sha256.Sum256(contents); sum != last {
+				last = sum
+				common.Log.Infof("remote config %s %s changed", cfg.Provider, cfg.Key)
+				select {
+				case reloads <- syscall.SIGHUP:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+}
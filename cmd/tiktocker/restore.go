@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// runRestore uploads the stored backup or export to the configured device and loads or imports it after confirmation, with --dry-run only uploads it.
+// Without the key the stored versions of the device are listed to pick one from
+func runRestore(ttConfig *Config, args []string) int {
+	host := args[0]
+	ctx := context.Background()
+	settings := configuredDevice(ttConfig, host)
+	if settings == nil {
+		common.Log.Errorf("Mikrotik %s is not configured", host)
+		return exitConfig
+	}
+	if len(args) > 1 && !restorable(args[1]) {
+		common.Log.Errorf("only .backup and .rsc files can be restored: %s (post-processed artifacts must be restored manually)", args[1])
+		return exitConfig
+	}
+
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	in := bufio.NewReader(os.Stdin)
+	var (
+		key         string
+		version     storage.ObjectInfo
+		interactive = len(args) == 1
+	)
+	if interactive {
+		var ok bool
+		if key, version, ok = pickRestore(ctx, ttConfig, source, settings, client, in); !ok {
+			return exitFailure
+		}
+	} else {
+		key = args[1]
+		version = storage.ObjectInfo{Key: key, IsLatest: true}
+	}
+	name := path.Base(key)
+	binary := strings.HasSuffix(name, ".backup")
+
+	file, metadata, err := storage.ReadVersion(ctx, source.Store, key, version)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	defer file.Remove()
+
+	if binary {
+		if err := checkRestoreTarget(ctx, settings, client, metadata); err != nil {
+			switch {
+			case !errors.Is(err, backup.ErrIncompatibleBackup) || !(restoreForce || dryRun):
+				common.Log.Errorf("%v", err)
+				return exitFailure
+			case dryRun:
+				common.Log.Warnf("%v, loading it requires --force", err)
+			default:
+				common.Log.Warnf("%v, restoring anyway (--force)", err)
+			}
+		}
+	}
+
+	if err := uploadRestore(ctx, file, name, settings, interactive); err != nil {
+		common.Log.Errorf("failed to upload %s to Mikrotik %s: %v", name, host, err)
+		return exitFailure
+	}
+	common.Log.Infof("%s uploaded to Mikrotik %s as %s", key, host, name)
+	if dryRun {
+		return 0
+	}
+
+	action := fmt.Sprintf("import %s on Mikrotik %s", name, host)
+	if binary {
+		action = fmt.Sprintf("load %s on Mikrotik %s, the device reboots with the restored configuration", name, host)
+	}
+	if !restoreYes && !confirm(in, os.Stderr, action) {
+		common.Log.Infof("restore cancelled, %s is left on the device", name)
+		return exitFailure
+	}
+	if binary {
+		err = backup.MikrotikBackupLoad(ctx, name, settings, client)
+	} else {
+		err = backup.MikrotikImport(ctx, name, settings, client)
+	}
+	if err != nil {
+		common.Log.Errorf("failed to restore %s on Mikrotik %s: %v", name, host, err)
+		return exitFailure
+	}
+	common.Log.Infof("%s restored on Mikrotik %s", key, host)
+	return 0
+}
+
+// restorable returns whether the artifact can be restored, post-processed artifacts (e.g. .backup.gz) cannot
+func restorable(key string) bool {
+	name := path.Base(key)
+	return strings.HasSuffix(name, ".backup") || strings.HasSuffix(name, ".rsc")
+}
+
+// uploadRestore uploads the file to the device, the progress is shown on the terminal when the version was picked interactively
+func uploadRestore(ctx context.Context, file *common.BackupFile, name string, settings *common.BackupSettings, interactive bool) error {
+	var view *progressView
+	if interactive && term.IsTerminal(int(os.Stderr.Fd())) {
+		view = newProgressView(os.Stderr)
+	}
+	if view == nil {
+		return backup.UploadFile(ctx, file, name, settings)
+	}
+	progress := view.device(settings.BaseUrl.Host)
+	view.start()
+	defer view.stop()
+	progress.Start()
+	progress.SetPhase(common.PhaseUpload)
+	err := backup.UploadFile(common.WithProgress(ctx, progress), file, name, settings)
+	status := "uploaded"
+	if err != nil {
+		status = "failed"
+	}
+	progress.Finish(status)
+	return err
+}
+
+// configuredDevice returns settings of the configured device, nil if not configured
+func configuredDevice(ttConfig *Config, host string) *common.BackupSettings {
+	for _, t := range createTargets(ttConfig) {
+		if t.BaseUrl.Host == host {
+			return t
+		}
+	}
+	return nil
+}
+
+// checkRestoreTarget compares the facts recorded with the binary backup with the device
+func checkRestoreTarget(ctx context.Context, settings *common.BackupSettings, client *http.Client, metadata map[string]string) error {
+	ch := common.NewResultChannel()
+	go backup.MikrotikFacts(ctx, settings, client, ch)
+	result := common.WaitForResult(ctx, ch)
+	if result.Err != nil {
+		return fmt.Errorf("failed to read facts of Mikrotik %s: %v", settings.BaseUrl.Host, result.Err)
+	}
+	return backup.CheckRestoreCompatibility(metadata, result.Facts)
+}
+
+// confirm asks to proceed with the action, anything but y or yes (also no input) declines
+func confirm(in io.Reader, out io.Writer, action string) bool {
+	_, _ = fmt.Fprintf(out, "%s? [y/N] ", action)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
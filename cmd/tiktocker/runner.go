@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/common"
+	"tiktocker/internal/drift"
+	"tiktocker/internal/hooks"
+	"tiktocker/internal/notify"
+	"tiktocker/internal/postprocess"
+	"tiktocker/internal/report"
+	"tiktocker/internal/state"
+	"tiktocker/internal/storage"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	changeSourceStorage = "storage"
+	changeSourceState   = "state"
+
+	modeFull   = "full"   // export and binary backup
+	modeExport = "export" // only the export, no binary backup is made on the device (nothing is written to its flash)
+)
+
+// backupRunner holds dependencies shared by all device backups of a run
+type backupRunner struct {
+	store            storage.Storage
+	latestMarker     bool
+	storeDiff        bool
+	state            *state.Store // nil - no state kept between runs
+	compareWithState bool         // compare with previous run hash instead of the stored file checksum
+	postProcess      *postprocess.Pipeline
+	normalizer       *drift.Normalizer  // nil - checksums only
+	catalog          *storage.Catalog   // nil - index.json is not maintained
+	uploadLimiter    *rate.Limiter      // shared by all devices, nil - unlimited
+	slots            chan struct{}      // devices backed up at once, shared by concurrent runs (daemon mode), nil - unlimited
+	notifier         *notify.Dispatcher // nil - no notifications
+	dryRun           bool               // change detection only, nothing is backed up on the devices or written to storage and state
+	force            bool               // every device is backed up and stored regardless of changes
+	progress         *progressView      // nil - progress is not shown
+	minSizeRatio     float64            // changed artifacts smaller than the fraction of their recent median size are anomalous, 0 - not checked
+	blockSmaller     bool               // anomalous artifacts are not stored
+
+	publishMu sync.Mutex // serializes publishing of results of concurrent runs (daemon mode)
+}
+
+func newSlots(concurrency int) chan struct{} {
+	if concurrency <= 0 {
+		return nil
+	}
+	return make(chan struct{}, concurrency)
+}
+
+// acquire waits for a free slot of the device backup, false if ctx is done first. The returned func frees the slot
+func (r *backupRunner) acquire(ctx context.Context) (func(), bool) {
+	if r.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case r.slots <- struct{}{}:
+		return func() { <-r.slots }, true
+	default:
+	}
+	common.Logger(ctx).Debugf("waiting for free backup slot, concurrency: %d", cap(r.slots))
+	select {
+	case r.slots <- struct{}{}:
+		return func() { <-r.slots }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// backupWithHooks backs up the device between its pre and post hooks, the device is not contacted when a pre hook fails.
+// Post hooks are executed regardless of the result, dry runs execute no hooks
+func (r *backupRunner) backupWithHooks(ctx context.Context, runId string, settings *common.BackupSettings, annotations map[string]string) *report.DeviceResult {
+	if r.dryRun {
+		return r.backupDevice(ctx, settings, annotations)
+	}
+	log := common.Logger(ctx)
+	progress := common.Progress(ctx)
+	var result *report.DeviceResult
+	if len(settings.PreHooks) > 0 {
+		progress.SetPhase(common.PhaseHooks)
+	}
+	pre := &hooks.Event{Hook: hooks.Pre, RunId: runId, Host: settings.BaseUrl.Host, Metadata: settings.Metadata}
+	if err := hooks.Run(ctx, settings.PreHooks, pre); err != nil {
+		log.Errorf("Mikrotik %s: %v, skipping backup", settings.BaseUrl.Host, err)
+		result = &report.DeviceResult{Host: settings.BaseUrl.Host, Status: report.StatusFailed, Metadata: settings.Metadata, Error: err.Error()}
+	} else {
+		result = r.backupDevice(ctx, settings, annotations)
+	}
+
+	if len(settings.PostHooks) > 0 {
+		progress.SetPhase(common.PhaseHooks)
+	}
+	post := &hooks.Event{
+		Hook:       hooks.Post,
+		RunId:      runId,
+		Host:       settings.BaseUrl.Host,
+		Identity:   result.Identity,
+		Status:     string(result.Status),
+		Error:      result.Error,
+		DurationMs: result.Duration.Milliseconds(),
+		Metadata:   result.Metadata,
+	}
+	for _, a := range result.Artifacts {
+		post.Artifacts = append(post.Artifacts, a.Key)
+	}
+	if err := hooks.Run(ctx, settings.PostHooks, post); err != nil {
+		log.Warnf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+	}
+	return result
+}
+
+func (r *backupRunner) backupDevice(ctx context.Context, settings *common.BackupSettings, annotations map[string]string) *report.DeviceResult {
+	start := time.Now()
+	log := common.Logger(ctx)
+	progress := common.Progress(ctx)
+	progress.SetPhase(common.PhaseExport)
+	result := &report.DeviceResult{Host: settings.BaseUrl.Host, Status: report.StatusFailed, Metadata: settings.Metadata}
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+	fail := func(err error) *report.DeviceResult {
+		result.Error = err.Error()
+		return result
+	}
+
+	mainBackupChannel := common.NewResultChannel()
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	go backup.MikrotikConfigExport(ctx, settings, client, mainBackupChannel)
+	configFileResult := common.WaitForResult(ctx, mainBackupChannel)
+	if configFileResult.Err != nil {
+		log.Errorf("failed to download Mikrotik %s config: %v", settings.BaseUrl.Host, configFileResult.Err)
+		return fail(configFileResult.Err)
+	}
+	defer configFileResult.File.Remove()
+	result.Identity = configFileResult.MikrotikIdentity
+	result.ConfigSha256 = configFileResult.File.ComputedSha256WithoutFirstLine
+	progress.SetIdentity(result.Identity)
+	result.Timings.Add(configFileResult.Timings)
+	log = log.WithField("device", result.Identity)
+	ctx = common.WithLogger(ctx, log)
+
+	metadata, err := common.RenderMetadata(settings.Metadata, settings.MetadataTemplates,
+		common.NewMetadataData(result.Identity, settings.BaseUrl.Host, configFileResult.Facts))
+	if err != nil {
+		log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+		return fail(err)
+	}
+	result.Metadata = metadata
+
+	devicePrefix, err := common.RenderPrefix(settings.PrefixTemplate, common.NewPrefixData(result.Identity, settings.BaseUrl.Host, metadata))
+	if err != nil {
+		log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+		return fail(err)
+	}
+
+	uploadMetadata := configFileResult.Facts.Metadata()
+	uploadMetadata[common.TiktockerVersion] = buildVersion()
+	for k, v := range metadata {
+		uploadMetadata[k] = v
+	}
+	for k, v := range annotations {
+		uploadMetadata[k] = v
+	}
+	uploadCtx := common.WithUploadLimiter(common.WithUploadLimiter(ctx, r.uploadLimiter), common.NewRateLimiter(settings.UploadRateLimit))
+
+	progress.SetPhase(common.PhaseChangeDetection)
+	forced := r.force || settings.Force
+	if forced {
+		log.Infof("Mikrotik (host: %s, identity: %s) forced backup, skipping change detection", settings.BaseUrl.Host, configFileResult.MikrotikIdentity)
+	} else if r.compareWithState {
+		configFileResult.ExistingConfigSha256 = r.previousConfigSha256(ctx, settings)
+	}
+	if configFileResult.ExistingConfigSha256 == nil && !forced {
+		storedName, err := r.postProcess.Name(configFileResult.File.Name)
+		if err != nil {
+			return fail(err)
+		}
+		go func() {
+			mainBackupChannel <- &common.RequestResult{
+				MikrotikIdentity:     configFileResult.MikrotikIdentity,
+				ExistingConfigSha256: r.store.GetChangeHash(ctx, devicePrefix, storedName),
+			}
+		}()
+		s3MetadataResult := common.WaitForResult(ctx, mainBackupChannel)
+		configFileResult.ExistingConfigSha256 = s3MetadataResult.ExistingConfigSha256
+	}
+	changed := configFileResult.ShouldPerformNewBackup()
+	if changed && !forced && r.normalizer != nil && configFileResult.ExistingConfigSha256 != nil && r.normalizedEqual(ctx, devicePrefix, &configFileResult.File) {
+		log.Infof("Mikrotik %s export differs only in lines ignored by changeDetection.normalize", settings.BaseUrl.Host)
+		changed = false
+	}
+
+	if r.dryRun {
+		if forced {
+			log.Infof("dry run: Mikrotik (host: %s, identity: %s) forced, backup would be performed and stored in %s", settings.BaseUrl.Host, configFileResult.MikrotikIdentity, r.store)
+			result.Status = report.StatusChanged
+		} else if changed {
+			log.Infof("dry run: Mikrotik (host: %s, identity: %s) config has changed, backup would be performed and stored in %s", settings.BaseUrl.Host, configFileResult.MikrotikIdentity, r.store)
+			result.Status = report.StatusChanged
+		} else {
+			log.Infof("dry run: Mikrotik (host: %s, identity: %s) config has not changed, backup would be skipped", settings.BaseUrl.Host, configFileResult.MikrotikIdentity)
+			result.Status = report.StatusUnchanged
+		}
+		return result
+	}
+	if !changed {
+		log.Infof("Mikrotik (host: %s, identity: %s) config has not changed, skipping backup", settings.BaseUrl.Host, configFileResult.MikrotikIdentity)
+		progress.SetPhase(common.PhaseExtraFiles)
+		extraFiles, err := r.backupExtraFiles(uploadCtx, client, settings, result, devicePrefix, uploadMetadata)
+		if err != nil {
+			log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+			return fail(err)
+		}
+		result.Status = report.StatusUnchanged
+		if len(extraFiles) > 0 {
+			result.Status = report.StatusChanged
+			addArtifacts(result, devicePrefix, extraFiles)
+		}
+		r.recordSuccess(ctx, settings, &configFileResult.File, nil, time.Since(start))
+		if r.catalog != nil {
+			r.catalogUnchanged(ctx, settings.BaseUrl.Host, result.Identity, devicePrefix)
+		}
+		return result
+	}
+	if !forced {
+		log.Infof("Mikrotik (host: %s, identity: %s) config has changed, proceeding with backup", settings.BaseUrl.Host, configFileResult.MikrotikIdentity)
+	}
+	var diffFile *common.BackupFile // nil - no diff stored
+	// not the first backup of the device
+	if !forced && configFileResult.ExistingConfigSha256 != nil {
+		result.Drift = r.drift(ctx, client, settings, *configFileResult.ExistingConfigSha256)
+		if r.storeDiff {
+			// read before the changed export replaces the stored one
+			if diffFile = r.storedDiff(ctx, devicePrefix, &configFileResult.File, result.Identity); diffFile != nil {
+				defer diffFile.Remove()
+			}
+		}
+	}
+
+	var backupFile *common.BackupFile // nil - export only
+	if settings.ExportOnly {
+		log.Infof("Mikrotik %s is in %s mode, skipping binary backup", settings.BaseUrl.Host, modeExport)
+	} else {
+		progress.SetPhase(common.PhaseBackup)
+		go backup.MikrotikBackup(ctx, configFileResult.MikrotikIdentity, settings, client, mainBackupChannel)
+		backupFileResult := common.WaitForResult(ctx, mainBackupChannel)
+		if backupFileResult.Err != nil {
+			log.Errorf("failed to backup Mikrotik %s: %v", settings.BaseUrl.Host, backupFileResult.Err)
+			return fail(backupFileResult.Err)
+		}
+		defer backupFileResult.File.Remove()
+		result.Timings.Add(backupFileResult.Timings)
+		backupFile = &backupFileResult.File
+		log.Infof("backup file downloaded from %s: %s (%d bytes)", settings.BaseUrl.Host, backupFile.Name, backupFile.Size)
+	}
+
+	if !forced {
+		if err := r.checkSizes(ctx, settings, result, &configFileResult.File, backupFile); err != nil {
+			log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+			return fail(err)
+		}
+	}
+
+	configFiles, err := r.process(ctx, &configFileResult.File)
+	if err != nil {
+		log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+		return fail(err)
+	}
+	defer removeFiles(configFiles)
+	artifacts := append([]*common.BackupFile{}, configFiles...)
+	if diffFile != nil {
+		diffFiles, err := r.process(ctx, diffFile)
+		if err != nil {
+			log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+			return fail(err)
+		}
+		defer removeFiles(diffFiles)
+		artifacts = append(artifacts, diffFiles...)
+		result.Drift.Diff = path.Join(devicePrefix, diffFiles[0].Name)
+	}
+	exportArtifacts := len(artifacts) // stored with the export metadata, the backup ones with the metadata of its contents
+
+	var backupFiles []*common.BackupFile
+	deduplicated := false
+	backupMetadata := uploadMetadata
+	if backupFile != nil {
+		if !forced {
+			if backupFiles, err = r.storedContents(ctx, devicePrefix, backupFile); err != nil {
+				log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+				return fail(err)
+			}
+		}
+		deduplicated = backupFiles != nil
+		if deduplicated {
+			log.Infof("Mikrotik %s backup contents unchanged, skipping %s upload", settings.BaseUrl.Host, backupFiles[0].Name)
+		} else {
+			if backupFiles, err = r.process(ctx, backupFile); err != nil {
+				log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+				return fail(err)
+			}
+			defer removeFiles(backupFiles)
+			artifacts = append(artifacts, backupFiles...)
+		}
+		backupMetadata = contentsMetadata(uploadMetadata, backupFile)
+	}
+
+	progress.SetPhase(common.PhaseUpload)
+	uploadStart := time.Now()
+	for i, f := range artifacts {
+		metadata := uploadMetadata
+		if i >= exportArtifacts {
+			metadata = backupMetadata
+		}
+		go storage.PutFile(uploadCtx, r.store, devicePrefix, f, metadata, mainBackupChannel)
+		putResult := common.WaitForResult(ctx, mainBackupChannel)
+		if putResult.Err != nil {
+			log.Errorf("file %s store failure: %v", f.Name, putResult.Err)
+			return fail(putResult.Err)
+		}
+		result.Timings.UploadBytes += f.Size
+		progress.AddBytes(f.Size)
+	}
+	result.Timings.Upload = time.Since(uploadStart)
+
+	progress.SetPhase(common.PhaseExtraFiles)
+	extraFiles, err := r.backupExtraFiles(uploadCtx, client, settings, result, devicePrefix, uploadMetadata)
+	if err != nil {
+		log.Errorf("Mikrotik %s: %v", settings.BaseUrl.Host, err)
+		return fail(err)
+	}
+	artifacts = append(artifacts, extraFiles...)
+	log.Infof("Mikrotik %s backup completed successfully", settings.BaseUrl.Host)
+
+	if r.latestMarker {
+		var storedBackup *common.BackupFile
+		if len(backupFiles) > 0 {
+			storedBackup = backupFiles[0]
+		}
+		marker, err := storage.NewLatestMarker(result.Identity, configFiles[0], storedBackup, time.Now()).File()
+		if err != nil {
+			log.Errorf("failed to create latest marker: %v", err)
+			return fail(err)
+		}
+		defer marker.Remove()
+
+		go storage.PutFile(uploadCtx, r.store, devicePrefix, marker, map[string]string{}, mainBackupChannel)
+		markerResult := common.WaitForResult(ctx, mainBackupChannel)
+		if markerResult.Err != nil {
+			log.Errorf("latest marker store failure: %v", markerResult.Err)
+			return fail(markerResult.Err)
+		}
+	}
+
+	r.recordSuccess(ctx, settings, &configFileResult.File, backupFile, time.Since(start))
+	if r.catalog != nil {
+		now := time.Now()
+		previous := r.catalog.Get(settings.BaseUrl.Host)
+		var backupEntry *storage.CatalogArtifact
+		if backupFile != nil {
+			backupEntry = storage.NewCatalogArtifact(devicePrefix, backupFiles[0], now)
+			if deduplicated && previous != nil && previous.Backup != nil && previous.Backup.Key == backupEntry.Key {
+				backupEntry = previous.Backup // keeps the time the contents were stored
+			}
+		} else if previous != nil && previous.Identity == result.Identity {
+			backupEntry = previous.Backup // export only, binary backup of the earlier runs is still stored
+		}
+		r.catalog.Update(&storage.CatalogDevice{
+			Host:      settings.BaseUrl.Host,
+			Identity:  result.Identity,
+			Export:    storage.NewCatalogArtifact(devicePrefix, configFiles[0], now),
+			Backup:    backupEntry,
+			CheckedAt: now.UTC(),
+		})
+	}
+	result.Status = report.StatusChanged
+	addArtifacts(result, devicePrefix, artifacts)
+	return result
+}
+
+// drift returns the change of the device config, with the changes of the device log when they are notified
+func (r *backupRunner) drift(ctx context.Context, client *http.Client, settings *common.BackupSettings, previousSha256 string) *report.Drift {
+	d := &report.Drift{PreviousSha256: previousSha256}
+	if !r.notifier.ConfigChanges() {
+		return d
+	}
+	changes, err := backup.ConfigChanges(ctx, client, settings)
+	if err != nil {
+		common.Logger(ctx).Warnf("Mikrotik %s config changes not available, notifying without them: %v", settings.BaseUrl.Host, err)
+		return d
+	}
+	d.Changes = changes
+	return d
+}
+
+// storedExport returns contents of the stored export with its key and time, the .rsc export post-processed (e.g. encrypted) cannot be read
+func (r *backupRunner) storedExport(ctx context.Context, devicePrefix string, exportName string) ([]byte, string, time.Time, error) {
+	storedName, err := r.postProcess.Name(exportName)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	key := path.Join(devicePrefix, storedName)
+	if !strings.HasSuffix(storedName, ".rsc") {
+		return nil, key, time.Time{}, fmt.Errorf("stored export %s is post-processed, cannot be compared", key)
+	}
+	info, err := r.store.Head(ctx, devicePrefix, storedName)
+	switch {
+	case err != nil:
+		return nil, key, time.Time{}, fmt.Errorf("%s failed to get %s metadata: %w", r.store, key, err)
+	case info == nil:
+		return nil, key, time.Time{}, fmt.Errorf("no export stored in %s: %s", r.store, key)
+	}
+	stored, _, err := storage.ReadObject(ctx, r.store, key)
+	if err != nil {
+		return nil, key, time.Time{}, err
+	}
+	defer stored.Remove()
+	contents, err := stored.ReadAll()
+	if err != nil {
+		return nil, key, time.Time{}, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return contents, key, info.LastModified, nil
+}
+
+// normalizedEqual returns whether the export whose checksum differs matches the stored one once normalized, false if they can't be compared
+func (r *backupRunner) normalizedEqual(ctx context.Context, devicePrefix string, export *common.BackupFile) bool {
+	log := common.Logger(ctx)
+	stored, _, _, err := r.storedExport(ctx, devicePrefix, export.Name)
+	if err != nil {
+		log.Warnf("%v, changeDetection.normalize not applied", err)
+		return false
+	}
+	current, err := export.ReadAll()
+	if err != nil {
+		log.Warnf("failed to read export %s, changeDetection.normalize not applied: %v", export.Name, err)
+		return false
+	}
+	return r.normalizer.Equal(stored, current)
+}
+
+// storedDiff returns unified diff of the stored export and the changed one, nil if the stored export is post-processed, missing or doesn't differ once normalized
+func (r *backupRunner) storedDiff(ctx context.Context, devicePrefix string, export *common.BackupFile, identity string) *common.BackupFile {
+	log := common.Logger(ctx)
+	storedContents, key, storedAt, err := r.storedExport(ctx, devicePrefix, export.Name)
+	if err != nil {
+		log.Warnf("%v, diff not stored", err)
+		return nil
+	}
+	currentContents, err := export.ReadAll()
+	if err != nil {
+		log.Warnf("failed to read export %s, diff not stored: %v", export.Name, err)
+		return nil
+	}
+	now := time.Now()
+	diff, err := r.normalizer.Unified(storedContents, fmt.Sprintf("%s (stored %s)", key, storedAt.UTC().Format(time.RFC3339)),
+		currentContents, fmt.Sprintf("%s (%s)", key, now.UTC().Format(time.RFC3339)))
+	if err != nil || diff == "" {
+		log.Debugf("no diff of %s stored: %v", key, err)
+		return nil
+	}
+	file, err := common.SpoolBytes(storage.DiffFileName(identity, now), []byte(diff))
+	if err != nil {
+		log.Warnf("%v, diff not stored", err)
+		return nil
+	}
+	return file
+}
+
+func addArtifacts(result *report.DeviceResult, devicePrefix string, files []*common.BackupFile) {
+	for _, f := range files {
+		result.Artifacts = append(result.Artifacts, report.Artifact{Name: f.Name, Key: path.Join(devicePrefix, f.Name), Size: f.Size, Sha256: f.ComputedSha256})
+	}
+}
+
+// backupExtraFiles stores device files matching settings.ExtraFiles whose contents differ from the stored ones, returns the uploaded files
+func (r *backupRunner) backupExtraFiles(
+	ctx context.Context,
+	client *http.Client,
+	settings *common.BackupSettings,
+	result *report.DeviceResult,
+	devicePrefix string,
+	uploadMetadata map[string]string,
+) ([]*common.BackupFile, error) {
+	names, err := backup.ListExtraFiles(ctx, client, settings, result.Identity)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	channel := common.NewResultChannel()
+
+	uploaded := make([]*common.BackupFile, 0)
+	for _, name := range names {
+		go backup.MikrotikExtraFile(ctx, result.Identity, name, settings, channel)
+		fileResult := common.WaitForResult(ctx, channel)
+		if fileResult.Err != nil {
+			return nil, fileResult.Err
+		}
+		result.Timings.Add(fileResult.Timings)
+		file := &fileResult.File
+
+		stored, err := r.storedContents(ctx, devicePrefix, file)
+		if err != nil {
+			file.Remove()
+			return nil, err
+		}
+		if stored != nil {
+			common.Logger(ctx).Debugf("Mikrotik %s file %s unchanged, skipping upload", settings.BaseUrl.Host, name)
+			file.Remove()
+			continue
+		}
+		files, err := r.process(ctx, file)
+		if err != nil {
+			file.Remove()
+			return nil, err
+		}
+		err = r.uploadFiles(ctx, result, devicePrefix, files, contentsMetadata(uploadMetadata, file))
+		removeFiles(files)
+		file.Remove()
+		if err != nil {
+			return nil, err
+		}
+		common.Logger(ctx).Infof("Mikrotik %s file %s stored as %s", settings.BaseUrl.Host, name, files[0].Name)
+		uploaded = append(uploaded, files...)
+	}
+	return uploaded, nil
+}
+
+func (r *backupRunner) uploadFiles(ctx context.Context, result *report.DeviceResult, devicePrefix string, files []*common.BackupFile, metadata map[string]string) error {
+	channel := common.NewResultChannel()
+	uploadStart := time.Now()
+	for _, f := range files {
+		go storage.PutFile(ctx, r.store, devicePrefix, f, metadata, channel)
+		putResult := common.WaitForResult(ctx, channel)
+		if putResult.Err != nil {
+			return fmt.Errorf("file %s store failure: %w", f.Name, putResult.Err)
+		}
+		result.Timings.UploadBytes += f.Size
+		common.Progress(ctx).AddBytes(f.Size)
+	}
+	result.Timings.Upload += time.Since(uploadStart)
+	return nil
+}
+
+// contentsMetadata returns the upload metadata with checksum of the file contents, used to skip uploads of identical contents
+func contentsMetadata(uploadMetadata map[string]string, file *common.BackupFile) map[string]string {
+	metadata := make(map[string]string, len(uploadMetadata)+1)
+	for k, v := range uploadMetadata {
+		metadata[k] = v
+	}
+	metadata[common.BackupSha256] = file.ComputedSha256
+	return metadata
+}
+
+// process runs the post-processing chain, the first returned file is the artifact itself followed by its sidecars
+func (r *backupRunner) process(ctx context.Context, file *common.BackupFile) ([]*common.BackupFile, error) {
+	files, err := r.postProcess.Apply(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files[1:] {
+		common.Logger(ctx).Debugf("post-processing of %s produced %s", file.Name, f.Name)
+	}
+	if files[0] != file {
+		common.Logger(ctx).Debugf("post-processed %s into %s (%d bytes)", file.Name, files[0].Name, files[0].Size)
+	}
+	return files, nil
+}
+
+// catalogUnchanged refreshes catalog entry of the device whose config has not changed, artifacts stored before the catalog was enabled are looked up in the storage
+func (r *backupRunner) catalogUnchanged(ctx context.Context, host string, identity string, devicePrefix string) {
+	entry := r.catalog.Get(host)
+	if entry == nil || entry.Identity != identity {
+		entry = &storage.CatalogDevice{Host: host, Identity: identity}
+		entry.Export = r.lookupArtifact(ctx, devicePrefix, backup.ExportFileName(identity))
+		entry.Backup = r.lookupArtifact(ctx, devicePrefix, backup.BackupFileName(identity))
+	}
+	entry.CheckedAt = time.Now().UTC()
+	r.catalog.Update(entry)
+}
+
+func (r *backupRunner) lookupArtifact(ctx context.Context, devicePrefix string, fileName string) *storage.CatalogArtifact {
+	storedName, err := r.postProcess.Name(fileName)
+	if err != nil {
+		return nil
+	}
+	info, err := r.store.Head(ctx, devicePrefix, storedName)
+	if err != nil || info == nil {
+		if err != nil {
+			common.Logger(ctx).Warnf("%s failed to get %s: %v", r.store, storedName, err)
+		}
+		return nil
+	}
+	return &storage.CatalogArtifact{
+		Key:          path.Join(devicePrefix, storedName),
+		VersionId:    info.VersionId,
+		Size:         info.Size,
+		LastModified: info.LastModified.UTC(),
+	}
+}
+
+// storedContents returns description of the stored file if its contents equal the downloaded file, nil if it has to be uploaded
+func (r *backupRunner) storedContents(ctx context.Context, devicePrefix string, file *common.BackupFile) ([]*common.BackupFile, error) {
+	storedName, err := r.postProcess.Name(file.Name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := r.store.Head(ctx, devicePrefix, storedName)
+	if err != nil {
+		common.Logger(ctx).Warnf("%s failed to get %s, uploading: %v", r.store, storedName, err)
+		return nil, nil
+	}
+	if info == nil || info.Metadata[common.BackupSha256] != file.ComputedSha256 {
+		return nil, nil
+	}
+	stored := &common.BackupFile{Name: storedName, Size: info.Size, VersionId: info.VersionId}
+	if storedName == file.Name {
+		stored.ComputedSha256 = file.ComputedSha256 // otherwise checksum of the processed contents is not known
+	}
+	return []*common.BackupFile{stored}, nil
+}
+
+// removeFiles removes spool files, files already removed are ignored
+func removeFiles(files []*common.BackupFile) {
+	for _, f := range files {
+		f.Remove()
+	}
+}
+
+// previousConfigSha256 returns the export checksum recorded by previous successful run, nil if not known
+func (r *backupRunner) previousConfigSha256(ctx context.Context, settings *common.BackupSettings) *string {
+	record, found, err := r.state.GetDevice(settings.BaseUrl.Host)
+	if err != nil {
+		common.Logger(ctx).Warnf("failed to read Mikrotik %s state: %v", settings.BaseUrl.Host, err)
+		return nil
+	}
+	if !found || record.ConfigSha256 == "" {
+		return nil
+	}
+	return &record.ConfigSha256
+}
+
+// checkSizes records the artifacts dramatically smaller than the recent ones of the device in result.SizeAnomalies before they replace the stored ones,
+// returns error if they are blocked. backupFile is nil when no backup was made
+func (r *backupRunner) checkSizes(ctx context.Context, settings *common.BackupSettings, result *report.DeviceResult, configFile *common.BackupFile, backupFile *common.BackupFile) error {
+	if r.state == nil || r.minSizeRatio <= 0 {
+		return nil
+	}
+	log := common.Logger(ctx)
+	record, found, err := r.state.GetDevice(settings.BaseUrl.Host)
+	if err != nil {
+		log.Warnf("failed to read Mikrotik %s state, artifact sizes not checked: %v", settings.BaseUrl.Host, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	check := func(file *common.BackupFile, median int64) {
+		if median > 0 && float64(file.Size) < float64(median)*r.minSizeRatio {
+			result.SizeAnomalies = append(result.SizeAnomalies, report.SizeAnomaly{Name: file.Name, Size: file.Size, MedianSize: median, Stored: !r.blockSmaller})
+			log.Warnf("Mikrotik %s %s is %d bytes, recent median %d bytes (truncated transfer or factory reset device?)", settings.BaseUrl.Host, file.Name, file.Size, median)
+		}
+	}
+	check(configFile, record.MedianExportSize())
+	if backupFile != nil {
+		check(backupFile, record.MedianBackupSize())
+	}
+	if len(result.SizeAnomalies) > 0 && r.blockSmaller {
+		return fmt.Errorf("%s dramatically smaller than the recent ones, not stored (sizeAnomaly.block), back up with --force if expected", result.SizeAnomalies[0].Name)
+	}
+	return nil
+}
+
+// recordSuccess updates device history, backupFile is nil when backup was skipped
+func (r *backupRunner) recordSuccess(ctx context.Context, settings *common.BackupSettings, configFile *common.BackupFile, backupFile *common.BackupFile, duration time.Duration) {
+	if r.state == nil {
+		return
+	}
+	record, _, err := r.state.GetDevice(settings.BaseUrl.Host)
+	if err != nil {
+		common.Logger(ctx).Warnf("failed to read Mikrotik %s state: %v", settings.BaseUrl.Host, err)
+	}
+	record.ConfigSha256 = configFile.ComputedSha256WithoutFirstLine
+	record.LastSuccess = time.Now().UTC()
+	record.AddDuration(duration)
+	var backupSize int64
+	if backupFile != nil {
+		backupSize = backupFile.Size
+	}
+	record.AddSizes(configFile.Size, backupSize)
+	if err := r.state.PutDevice(settings.BaseUrl.Host, record); err != nil {
+		common.Logger(ctx).Warnf("failed to record Mikrotik %s state: %v", settings.BaseUrl.Host, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"tiktocker/internal/common"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+)
+
+// defaultSecretsDir is where Kubernetes secret volumes are conventionally mounted, skipped if missing
+const defaultSecretsDir = "/var/run/secrets/tiktocker"
+
+// secretDirFiles reads the mounted secret directory: file names (or nested directories) are config keys, e.g. s3.secretKey or s3/secretKey,
+// directories named by the device host hold that device settings, e.g. 192.168.88.1/password.
+// The ..data links and hidden timestamped directories of Kubernetes volumes are skipped
+type secretDirFiles struct {
+	settings map[string]string                 // by config key
+	devices  map[string]map[string]interface{} // settings by device host, nested by directories, e.g. metadata/site
+}
+
+func readSecretsDir(dir string, hosts map[string]bool) (*secretDirFiles, error) {
+	files := &secretDirFiles{settings: make(map[string]string), devices: make(map[string]map[string]interface{})}
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) && dir == defaultSecretsDir {
+			return files, nil
+		}
+		return nil, fmt.Errorf("secrets directory %s: %w", dir, err)
+	}
+	entries, err := readSecretEntries(dir)
+	if err != nil {
+		return nil, err
+	}
+	for name, isDir := range entries {
+		path := filepath.Join(dir, name)
+		switch {
+		case isDir && hosts[name]:
+			device := make(map[string]interface{})
+			if err := readSecretTree(path, device); err != nil {
+				return nil, err
+			}
+			files.devices[name] = device
+		case isDir:
+			if err := readSecretKeys(path, name, files.settings); err != nil {
+				return nil, err
+			}
+		default:
+			value, err := readSecretValue(path)
+			if err != nil {
+				return nil, err
+			}
+			files.settings[name] = value
+		}
+	}
+	return files, nil
+}
+
+// readSecretEntries lists the directory following symlinks, whether the entry is directory by name
+func readSecretEntries(dir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets directory: %w", err)
+	}
+	result := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secrets directory: %w", err)
+		}
+		result[e.Name()] = info.IsDir()
+	}
+	return result, nil
+}
+
+func readSecretKeys(dir string, prefix string, settings map[string]string) error {
+	entries, err := readSecretEntries(dir)
+	if err != nil {
+		return err
+	}
+	for name, isDir := range entries {
+		path, key := filepath.Join(dir, name), prefix+"."+name
+		if isDir {
+			if err := readSecretKeys(path, key, settings); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := readSecretValue(path)
+		if err != nil {
+			return err
+		}
+		settings[key] = value
+	}
+	return nil
+}
+
+func readSecretTree(dir string, tree map[string]interface{}) error {
+	entries, err := readSecretEntries(dir)
+	if err != nil {
+		return err
+	}
+	for name, isDir := range entries {
+		path := filepath.Join(dir, name)
+		if isDir {
+			subtree := make(map[string]interface{})
+			if err := readSecretTree(path, subtree); err != nil {
+				return err
+			}
+			tree[name] = subtree
+			continue
+		}
+		value, err := readSecretValue(path)
+		if err != nil {
+			return err
+		}
+		tree[name] = value
+	}
+	return nil
+}
+
+func readSecretValue(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", path, err)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// configuredHosts returns hosts of the devices in the config files read
+func configuredHosts(v *viper.Viper) map[string]bool {
+	hosts := make(map[string]bool)
+	devices, _ := v.Get("mikrotiks").([]interface{})
+	for _, d := range devices {
+		if device, ok := d.(map[string]interface{}); ok {
+			if host, ok := device["host"].(string); ok {
+				if expanded, err := common.ExpandEnv(host); err == nil {
+					addresses, _ := common.ExpandHosts(expanded) // invalid ranges are reported when decoded
+					for _, a := range addresses {
+						hosts[a] = true
+					}
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+// apply sets the config keys, they take precedence over the config files and environment
+func (f *secretDirFiles) apply(v *viper.Viper) {
+	for key, value := range f.settings {
+		v.Set(key, value)
+	}
+}
+
+// applyDevices overrides settings of the devices, unknown settings are an error
+func (f *secretDirFiles) applyDevices(config *Config, decodeHook mapstructure.DecodeHookFunc) error {
+	for i := range config.Mikrotiks {
+		m := &config.Mikrotiks[i]
+		settings, ok := f.devices[m.Host]
+		if !ok {
+			continue
+		}
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			DecodeHook:       decodeHook,
+			WeaklyTypedInput: true,
+			ErrorUnused:      true,
+			Result:           m,
+		})
+		if err != nil {
+			return err
+		}
+		if err := decoder.Decode(settings); err != nil {
+			return fmt.Errorf("invalid secrets of Mikrotik %s: %w", m.Host, err)
+		}
+	}
+	return nil
+}
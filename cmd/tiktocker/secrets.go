@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"tiktocker/internal/secrets"
+	"tiktocker/internal/storage"
+)
+
+// readSecretFiles replaces the settings with contents of their *File counterparts, e.g. Docker or Kubernetes secret mounts
+func readSecretFiles(config *Config) error {
+	for i := range config.Mikrotiks {
+		m := &config.Mikrotiks[i]
+		if err := readSecretFile(&m.Password, m.PasswordFile, fmt.Sprintf("mikrotiks[%d].password", i)); err != nil {
+			return err
+		}
+		if err := readSecretFile(&m.EncryptionKey, m.EncryptionKeyFile, fmt.Sprintf("mikrotiks[%d].encryptionKey", i)); err != nil {
+			return err
+		}
+	}
+	if err := readS3SecretFile(&config.Storage.S3, "s3"); err != nil {
+		return err
+	}
+	for name, destination := range config.Destinations {
+		if err := readS3SecretFile(&destination.S3, fmt.Sprintf("destinations.%s.s3", name)); err != nil {
+			return err
+		}
+		config.Destinations[name] = destination
+	}
+	return nil
+}
+
+func readS3SecretFile(s3 *storage.S3Config, setting string) error {
+	return readSecretFile(&s3.SecretKey, s3.SecretKeyFile, setting+".secretKey")
+}
+
+// readSecretFile sets value to the file contents without the trailing newline, no-op if path is empty
+func readSecretFile(value *string, path string, setting string) error {
+	if path == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("%s and %sFile are mutually exclusive", setting, setting)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %sFile: %w", setting, err)
+	}
+	*value = strings.TrimRight(string(contents), "\r\n")
+	if *value == "" {
+		return fmt.Errorf("%sFile %s is empty", setting, path)
+	}
+	return nil
+}
+
+// secretSetting is setting which may reference secret of the secrets.Resolvers
+type secretSetting struct {
+	name  string
+	value *string
+}
+
+// resolveSecretRefs replaces references of the device passwords, encryption keys and S3 credentials with the secrets,
+// e.g. vault:secret/data/routers#password, ssm:/tiktocker/routers/core, file:/run/secrets/router-key or env:ROUTER_KEY
+func resolveSecretRefs(ctx context.Context, config *Config) error {
+	settings := make([]secretSetting, 0)
+	for i := range config.Mikrotiks {
+		m := &config.Mikrotiks[i]
+		settings = append(settings,
+			secretSetting{fmt.Sprintf("mikrotiks[%d].password", i), &m.Password},
+			secretSetting{fmt.Sprintf("mikrotiks[%d].encryptionKey", i), &m.EncryptionKey},
+		)
+	}
+	settings = append(settings, s3SecretSettings(&config.Storage.S3, "s3")...)
+	destinations := make(map[string]*storage.Config, len(config.Destinations))
+	for name, destination := range config.Destinations {
+		destinations[name] = &destination
+		settings = append(settings, s3SecretSettings(&destination.S3, fmt.Sprintf("destinations.%s.s3", name))...)
+	}
+
+	resolvers, err := secretResolvers(ctx, config, settings)
+	if err != nil {
+		return err
+	}
+	if len(resolvers) == 0 {
+		return nil
+	}
+	for _, s := range settings {
+		secret, err := resolvers.Resolve(ctx, *s.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		*s.value = secret
+	}
+	for name, destination := range destinations {
+		config.Destinations[name] = *destination
+	}
+	return nil
+}
+
+// secretResolvers creates resolvers of the schemes referenced by the settings only, e.g. no Vault login without vault: references
+func secretResolvers(ctx context.Context, config *Config, settings []secretSetting) (secrets.Resolvers, error) {
+	resolvers := secrets.Resolvers{}
+	var awsSecrets *secrets.Aws
+	for _, s := range settings {
+		scheme, _, _ := strings.Cut(*s.value, ":")
+		if resolvers[scheme] != nil {
+			continue
+		}
+		switch {
+		case scheme == "file":
+			resolvers[scheme] = secrets.File{}
+		case scheme == "env":
+			resolvers[scheme] = secrets.Env{}
+		case scheme == "vault":
+			vault, err := secrets.NewVault(ctx, config.Vault)
+			if err != nil {
+				return nil, err
+			}
+			resolvers[scheme] = vault
+		case scheme == "ssm" || strings.HasPrefix(*s.value, "arn:aws"):
+			if awsSecrets == nil {
+				var err error
+				if awsSecrets, err = secrets.NewAws(ctx, config.Aws); err != nil {
+					return nil, err
+				}
+			}
+			resolvers[scheme] = awsSecrets.Resolver(scheme)
+		}
+	}
+	return resolvers, nil
+}
+
+func s3SecretSettings(s3 *storage.S3Config, setting string) []secretSetting {
+	return []secretSetting{{setting + ".accessKey", &s3.AccessKey}, {setting + ".secretKey", &s3.SecretKey}}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"tiktocker/internal/common"
+	"tiktocker/internal/snapshot"
+	"tiktocker/internal/state"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+const (
+	snapshotsBucket = "snapshots"
+	sqliteSnapshot  = "sqlite"
+)
+
+// publishSnapshot stores SQLite snapshot of the state and backup history unless it was published within the interval
+func publishSnapshot(ctx context.Context, config *Config, store storage.Storage, st *state.Store, catalog *storage.Catalog) {
+	now := time.Now()
+	if st != nil && config.SqliteSnapshot.Interval > 0 {
+		var publishedAt time.Time
+		if _, err := st.Get(snapshotsBucket, sqliteSnapshot, &publishedAt); err != nil {
+			common.Log.Warnf("failed to read sqlite snapshot state: %v", err)
+		}
+		if now.Sub(publishedAt) < config.SqliteSnapshot.Interval {
+			common.Log.Debugf("sqlite snapshot published at %s, next after %s", publishedAt, config.SqliteSnapshot.Interval)
+			return
+		}
+	}
+
+	objects, err := store.List(ctx)
+	if err != nil {
+		common.Log.Errorf("sqlite snapshot: %s listing failure: %v", store, err)
+		return
+	}
+	src := &snapshot.Sources{State: st, Catalog: catalog, Objects: objects}
+	if err := snapshot.Publish(ctx, store, src, now); err != nil {
+		common.Log.Errorf("failed to publish sqlite snapshot: %v", err)
+		return
+	}
+	if st != nil {
+		if err := st.Put(snapshotsBucket, sqliteSnapshot, now.UTC()); err != nil {
+			common.Log.Warnf("failed to record sqlite snapshot state: %v", err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/getsops/sops/v3/decrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile returns contents of the config file, decrypted if it is sops-encrypted (age, KMS, PGP keys as configured for sops)
+func readConfigFile(path string) (io.Reader, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decryptConfig(path, contents)
+}
+
+// decryptConfig returns the contents decrypted if they are sops-encrypted, name identifies the source in errors
+func decryptConfig(name string, contents []byte) (io.Reader, error) {
+	if !sopsEncrypted(contents) {
+		return bytes.NewReader(contents), nil
+	}
+	plain, err := decrypt.Data(contents, "yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops-encrypted %s: %w", name, err)
+	}
+	return bytes.NewReader(plain), nil
+}
+
+// sopsEncrypted returns whether the YAML document has the sops metadata, invalid YAML is left to the config parser
+func sopsEncrypted(contents []byte) bool {
+	var document struct {
+		Sops struct {
+			Mac string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	return yaml.Unmarshal(contents, &document) == nil && document.Sops.Mac != ""
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"tiktocker/internal/report"
+	"time"
+)
+
+// outputJson prints the run result as JSON instead of the summary
+const outputJson = "json"
+
+// writeRunResult writes the run result to --output-file, stdout without it
+func writeRunResult(manifest *report.Manifest, store string, startedAt time.Time, code int) error {
+	result := report.NewRunResult(manifest)
+	result.Version = buildVersion()
+	result.Storage = store
+	result.StartedAt = startedAt.UTC()
+	result.FinishedAt = time.Now().UTC()
+	result.DryRun = dryRun
+	result.ExitCode = code
+	if outputFile == "" || outputFile == stdio {
+		return result.Write(os.Stdout)
+	}
+	// written next to the destination and renamed, readers never see a partial result
+	f, err := os.CreateTemp(filepath.Dir(outputFile), filepath.Base(outputFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write run result: %w", err)
+	}
+	if err := result.Write(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write run result: %w", err)
+	}
+	return os.Rename(f.Name(), outputFile)
+}
+
+// printRunSummary prints the per device outcome of the run, the timings are the phases of the backup
+func printRunSummary(out io.Writer, manifest *report.Manifest, store string) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HOST\tDEVICE\tSTATUS\tTOTAL\tIDENTITY\tEXPORT\tBACKUP\tSCP\tUPLOAD\tSTORED\tSTORAGE\t")
+	var storedBytes int64
+	for _, d := range manifest.Results() {
+		identity := d.Identity
+		if identity == "" {
+			identity = "-"
+		}
+		if d.Status == report.StatusCancelled || d.Status == report.StatusSkipped {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t-\t-\t-\t-\t-\t\n", d.Host, identity, d.Status)
+			continue
+		}
+		t := d.Timings
+		storedBytes += t.UploadBytes
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t\n",
+			d.Host, identity, d.Status,
+			round(d.Duration), round(t.Identity), round(t.Export), round(t.Backup), round(t.Scp), round(t.Upload),
+			t.UploadBytes, storageOutcome(d))
+	}
+	_ = w.Flush()
+
+	counts := manifest.Counts()
+	summary := fmt.Sprintf("%d devices: %d changed, %d unchanged, %d skipped, %d failed", len(manifest.Results()),
+		counts[report.StatusChanged], counts[report.StatusUnchanged], counts[report.StatusSkipped], counts[report.StatusFailed])
+	if counts[report.StatusCancelled] > 0 {
+		summary += fmt.Sprintf(", %d cancelled", counts[report.StatusCancelled])
+	}
+	if dryRun {
+		_, _ = fmt.Fprintf(out, "%s, dry run - nothing backed up or stored in %s\n", summary, store)
+		return
+	}
+	_, _ = fmt.Fprintf(out, "%s, %d bytes stored in %s\n", summary, storedBytes, store)
+}
+
+// storageOutcome describes what was stored for the device, the error of the failed one
+func storageOutcome(d *report.DeviceResult) string {
+	switch {
+	case d.Status == report.StatusFailed:
+		return "failed: " + strings.ReplaceAll(d.Error, "\n", " ")
+	case dryRun && d.Status == report.StatusChanged:
+		return "would be backed up"
+	case len(d.Artifacts) == 0:
+		return "up to date"
+	default:
+		return fmt.Sprintf("%d files stored", len(d.Artifacts))
+	}
+}
+
+func round(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
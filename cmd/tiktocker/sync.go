@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"tiktocker/internal/common"
+	"tiktocker/internal/mirror"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+func runSync(ttConfig *Config, _ []string) int {
+	ctx := context.Background()
+	if syncTo == "" {
+		common.Log.Errorf("sync requires --to destination")
+		return exitConfig
+	}
+	if syncFrom == syncTo {
+		common.Log.Errorf("sync --from and --to must differ")
+		return exitConfig
+	}
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	target, err := openDestination(ctx, ttConfig, syncTo)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+
+	now := time.Now()
+	filter := mirror.Filter{Devices: syncDevices, Prefix: syncPrefix}
+	if bundleSince != "" {
+		age, err := parseAge(bundleSince)
+		if err != nil {
+			common.Log.Errorf("invalid --since: %v", err)
+			return exitConfig
+		}
+		filter.Since = now.Add(-age)
+	}
+	if p := invalidPattern(syncDevices); p != "" {
+		common.Log.Errorf("invalid --device pattern: %s", p)
+		return exitConfig
+	}
+
+	copies, err := mirror.Plan(ctx, source, target, filter)
+	if err != nil {
+		common.Log.Errorf("failed to plan sync: %v", err)
+		return exitFailure
+	}
+	printSyncCopies(copies)
+	if dryRun || len(copies) == 0 {
+		return 0
+	}
+
+	copied, err := mirror.Execute(ctx, source, target, copies)
+	if ttConfig.Catalog && len(copied) > 0 {
+		if catalogErr := mirror.MergeCatalog(ctx, source, target, copied, now); catalogErr != nil {
+			common.Log.Errorf("failed to update catalog of %s: %v", target.Store, catalogErr)
+		}
+	}
+	if err != nil {
+		common.Log.Errorf("sync failure (%d of %d artifacts copied): %v", len(copied), len(copies), err)
+		return exitFailure
+	}
+	common.Log.Infof("copied %d artifacts from %s to %s", len(copied), source.Store, target.Store)
+	return 0
+}
+
+// openDestination creates storage of the destinations entry, empty name - the main storage config
+func openDestination(ctx context.Context, ttConfig *Config, name string) (mirror.Endpoint, error) {
+	cfg := &ttConfig.Storage
+	if name != "" {
+		destination, ok := ttConfig.Destinations[name]
+		if !ok {
+			names := make([]string, 0, len(ttConfig.Destinations))
+			for n := range ttConfig.Destinations {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return mirror.Endpoint{}, fmt.Errorf("unknown destination: %s, configured: %s", name, strings.Join(names, ", "))
+		}
+		cfg = &destination
+	}
+	store, err := storage.New(ctx, cfg, nil)
+	if err != nil {
+		return mirror.Endpoint{}, fmt.Errorf("failed to create storage client of destination %s: %w", name, err)
+	}
+	return mirror.Endpoint{Store: store, KeyPrefix: cfg.KeyPrefix()}, nil
+}
+
+func printSyncCopies(copies []mirror.Copy) {
+	if output == outputKeys {
+		for _, c := range copies {
+			fmt.Println(c.Key)
+		}
+		return
+	}
+	if len(copies) == 0 {
+		fmt.Println("nothing to copy")
+		return
+	}
+	if dryRun {
+		fmt.Printf("%d artifacts would be copied:\n", len(copies))
+	} else {
+		fmt.Printf("copying %d artifacts:\n", len(copies))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, c := range copies {
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\t%d bytes\n", c.Key, c.Reason, c.LastModified.UTC().Format(time.RFC3339), c.Size)
+	}
+	_ = w.Flush()
+}
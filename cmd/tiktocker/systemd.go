@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"tiktocker/internal/common"
+	"tiktocker/internal/report"
+	"time"
+
+	sd "github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifySystemd sends the state to systemd, it is a no-op when not running as a notify service
+func notifySystemd(state string) {
+	if _, err := sd.SdNotify(false, state); err != nil {
+		common.Log.Debugf("systemd notify failure: %v", err)
+	}
+}
+
+// startWatchdog pings the systemd watchdog (WatchdogSec of the unit) at half of its interval until ctx is done,
+// the ping is skipped while the liveness check fails, so systemd restarts the stalled daemon
+func startWatchdog(ctx context.Context, liveness func() error) {
+	interval, err := sd.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+	common.Log.Debugf("systemd watchdog enabled, interval: %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := liveness(); err != nil {
+					common.Log.Warnf("%v, skipping systemd watchdog ping", err)
+					continue
+				}
+				notifySystemd(sd.SdNotifyWatchdog)
+			}
+		}
+	}()
+}
+
+// systemdStatus describes the latest results of the fleet for the systemd status line
+func systemdStatus(manifest *report.Manifest, devices int, last *report.DeviceResult) string {
+	counts := manifest.Counts()
+	return fmt.Sprintf("STATUS=backed up %d/%d devices, failed: %d, last: %s %s at %s",
+		counts[report.StatusChanged]+counts[report.StatusUnchanged]+counts[report.StatusSkipped], devices, counts[report.StatusFailed],
+		last.Host, last.Status, time.Now().Format(time.RFC3339))
+}
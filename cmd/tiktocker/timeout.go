@@ -0,0 +1,64 @@
+package main
+
+import (
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+	"time"
+)
+
+const (
+	defaultTimeout           = 10 * time.Second
+	defaultTimeoutMultiplier = 3
+	minTimeoutSamples        = 3 // runs required before the timeout is set automatically
+)
+
+// applyAdaptiveTimeouts sets timeouts learned from the device history (if enabled) or suggests them in the logs, explicitly configured timeouts are never changed
+func applyAdaptiveTimeouts(config *Config, targets []*common.BackupSettings, st *state.Store) {
+	explicit := make(map[string]bool, len(config.Mikrotiks))
+	for _, m := range config.Mikrotiks {
+		explicit[m.Host] = m.Timeout != 0
+	}
+
+	for _, t := range targets {
+		host := t.BaseUrl.Host
+		record, found, err := st.GetDevice(host)
+		if err != nil {
+			common.Log.Warnf("failed to read Mikrotik %s state: %v", host, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		longest, samples := record.MaxRecentDuration()
+		if samples == 0 {
+			continue
+		}
+		suggested := suggestTimeout(config, longest)
+
+		if config.AdaptiveTimeout.Enabled && !explicit[host] && samples >= minTimeoutSamples {
+			common.Log.Debugf("Mikrotik %s timeout set to %s (longest of %d recent runs: %s)", host, suggested, samples, longest.Round(time.Millisecond))
+			t.Timeout = suggested
+			continue
+		}
+		if suggested > t.Timeout {
+			common.Log.Warnf("Mikrotik %s recent runs took up to %s, timeout %s may be too short, suggested: %s", host, longest.Round(time.Millisecond), t.Timeout, suggested)
+		}
+	}
+}
+
+// suggestTimeout returns the longest recent duration with the safety multiplier, bounded by configured min and max
+func suggestTimeout(config *Config, longest time.Duration) time.Duration {
+	c := config.AdaptiveTimeout
+	multiplier := c.Multiplier
+	if multiplier <= 0 {
+		multiplier = defaultTimeoutMultiplier
+	}
+	timeout := time.Duration(float64(longest) * multiplier).Round(time.Second)
+	if c.Min > 0 {
+		timeout = max(timeout, c.Min)
+	}
+	if c.Max > 0 {
+		timeout = min(timeout, c.Max)
+	}
+	return timeout
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/drift"
+	"tiktocker/internal/hooks"
+	"tiktocker/internal/metrics"
+	"tiktocker/internal/notify"
+	"tiktocker/internal/postprocess"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// runValidate reads the configuration again and reports every problem found, nothing is connected to
+func runValidate(out io.Writer) int {
+	ttConfig, unknown, err := readConfig()
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "configuration invalid:\n  %v\n", err)
+		return exitConfig
+	}
+	problems := make([]string, 0)
+	for _, key := range unknown {
+		problems = append(problems, unknownSetting(key).Error())
+	}
+	for _, err := range validateConfig(ttConfig) {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		_, _ = fmt.Fprintf(out, "configuration invalid, %d problems:\n", len(problems))
+		for _, p := range problems {
+			_, _ = fmt.Fprintf(out, "  %s\n", p)
+		}
+		return exitConfig
+	}
+	_, _ = fmt.Fprintf(out, "configuration valid: %d devices, %s storage\n", len(ttConfig.Mikrotiks), ttConfig.Storage.BackendName())
+	return 0
+}
+
+// unknownKeys returns the keys not decoded into Config in order, global flags are bound to the same keys and skipped
+func unknownKeys(unused []string) []string {
+	unknown := make([]string, 0, len(unused))
+	for _, key := range unused {
+		if globalFlags.Lookup(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// strictConfig returns the unknown keys and the missing device settings, they fail the load unless strict is disabled
+func strictConfig(config *Config, unknown []string) error {
+	errs := make([]error, 0, len(unknown))
+	for _, key := range unknown {
+		errs = append(errs, unknownSetting(key))
+	}
+	for i, m := range config.Mikrotiks {
+		errs = append(errs, requiredDeviceSettings(deviceSetting(i, m), m)...)
+	}
+	return errors.Join(errs...)
+}
+
+func unknownSetting(key string) error {
+	return fmt.Errorf("unknown setting: %s, check its spelling and nesting", key)
+}
+
+// deviceSetting returns the path of the device in errors, the index is of the devices after host ranges are expanded
+func deviceSetting(i int, m DeviceConfig) string {
+	if m.Host == "" {
+		return fmt.Sprintf("mikrotiks[%d]", i)
+	}
+	return fmt.Sprintf("mikrotiks[%d] (%s)", i, m.Host)
+}
+
+func requiredDeviceSettings(setting string, m DeviceConfig) []error {
+	var errs []error
+	if m.Host == "" {
+		errs = append(errs, fmt.Errorf("%s.host is required", setting))
+	}
+	if m.Username == "" {
+		errs = append(errs, fmt.Errorf("%s.username is required", setting))
+	}
+	if m.Password == "" {
+		errs = append(errs, fmt.Errorf("%s.password is required (or passwordFile)", setting))
+	}
+	return errs
+}
+
+// validateConfig checks the settings the backup run relies on, backups would otherwise fail or skip the misconfigured devices
+func validateConfig(config *Config) []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, unjoin(err)...)
+		}
+	}
+
+	add(config.Storage.Validate(""))
+	for name, destination := range config.Destinations {
+		add(destination.Validate(fmt.Sprintf("destinations.%s.", name)))
+	}
+
+	if len(config.Mikrotiks) == 0 {
+		add(fmt.Errorf("mikrotiks: no devices configured"))
+	}
+	hosts := make(map[string]int, len(config.Mikrotiks))
+	for i, m := range config.Mikrotiks {
+		setting := deviceSetting(i, m)
+		errs = append(errs, requiredDeviceSettings(setting, m)...)
+		if m.Host != "" {
+			if previous, duplicate := hosts[m.Host]; duplicate {
+				add(fmt.Errorf("%s: duplicate host, already configured as mikrotiks[%d]", setting, previous))
+			}
+			hosts[m.Host] = i
+			if _, err := common.CreateUrl(m.Host, m.Username, m.Password); err != nil {
+				add(fmt.Errorf("%s.host: %w", setting, err))
+			}
+		}
+		if m.Timeout < 0 {
+			add(fmt.Errorf("%s.timeout must not be negative", setting))
+		}
+		if _, err := common.ParsePrefixTemplate(m.PrefixTemplate); err != nil {
+			add(fmt.Errorf("%s.prefixTemplate: %w", setting, err))
+		}
+		if _, _, err := common.ParseMetadataTemplates(m.Metadata); err != nil {
+			add(fmt.Errorf("%s.metadata: %w", setting, err))
+		}
+		if p := invalidPattern(m.ExtraFiles); p != "" {
+			add(fmt.Errorf("%s.extraFiles: invalid pattern: %s", setting, p))
+		}
+		add(validateMode(m.Mode, setting+".mode"))
+		add(validateSchedule(m.Schedule, setting+".schedule"))
+		add(validateWindow(m.BackupWindow, setting+".backupWindow"))
+		add(validateHooks(m.Hooks, setting+".hooks"))
+	}
+
+	if _, err := common.ParsePrefixTemplate(config.PrefixTemplate); err != nil {
+		add(fmt.Errorf("prefixTemplate: %w", err))
+	}
+	add(validateSchedule(config.Schedule, "schedule"))
+	add(validateSchedule(config.Audit.Schedule, "audit.schedule"))
+	add(validateWindow(config.BackupWindow, "backupWindow"))
+	add(validateMode(config.Mode, "mode"))
+	add(validateHooks(config.Hooks, "hooks"))
+	if src := config.ChangeDetection.Source; src != "" && src != changeSourceStorage && src != changeSourceState {
+		add(fmt.Errorf("changeDetection.source: %s, must be one of: %s, %s", src, changeSourceStorage, changeSourceState))
+	}
+	if config.ChangeDetection.Source == changeSourceState && config.State.Path == "" {
+		add(fmt.Errorf("changeDetection.source: %s requires state.path", changeSourceState))
+	}
+	if _, err := drift.NewNormalizer(config.ChangeDetection.Normalize); err != nil {
+		add(fmt.Errorf("changeDetection.normalize: %w", err))
+	}
+	if config.Concurrency < 0 {
+		add(fmt.Errorf("concurrency: %d, must not be negative, 0 - unlimited", config.Concurrency))
+	}
+	if r := config.SizeAnomaly.MinRatio; r < 0 || r >= 1 {
+		add(fmt.Errorf("sizeAnomaly.minRatio: %v, must be between 0 and 1, e.g. 0.5", r))
+	}
+	if config.Log.Level != "" {
+		if _, err := logrus.ParseLevel(strings.ToLower(config.Log.Level)); err != nil {
+			add(fmt.Errorf("log.level: %w", err))
+		}
+	}
+	if n := config.Log.Syslog.Network; n != "" && n != "udp" && n != "tcp" && n != "unix" {
+		add(fmt.Errorf("log.syslog.network: %s, must be udp, tcp or unix", n))
+	}
+	if config.Api.Listen != "" && config.Api.Token == "" {
+		add(fmt.Errorf("api.token is required by api.listen"))
+	}
+	if _, err := postprocess.New(config.PostProcess); err != nil {
+		add(fmt.Errorf("postProcess: %w", err))
+	}
+	if _, err := notify.New(&config.Notifications); err != nil {
+		add(fmt.Errorf("notifications: %w", err))
+	}
+	if err := metrics.MetadataLabels(config.Metrics.Labels); err != nil {
+		add(err)
+	}
+	return errs
+}
+
+func validateHooks(cfg common.HooksConfig, setting string) error {
+	return errors.Join(hooks.Validate(cfg.Pre, setting+".pre"), hooks.Validate(cfg.Post, setting+".post"))
+}
+
+func validateSchedule(schedule string, setting string) error {
+	if schedule == "" {
+		return nil
+	}
+	if _, err := cron.ParseStandard(schedule); err != nil {
+		return fmt.Errorf("%s: %w", setting, err)
+	}
+	return nil
+}
+
+func validateMode(mode string, setting string) error {
+	if mode != "" && mode != modeFull && mode != modeExport {
+		return fmt.Errorf("%s: %s, must be one of: %s, %s", setting, mode, modeFull, modeExport)
+	}
+	return nil
+}
+
+func validateWindow(window BackupWindowConfig, setting string) error {
+	if _, err := common.ParseBackupWindow(window.Allow, window.Blackout); err != nil {
+		return fmt.Errorf("%s: %w", setting, err)
+	}
+	return nil
+}
+
+// unjoin returns the errors combined by errors.Join separately, to be reported one per line
+func unjoin(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, unjoin(e)...)
+	}
+	return errs
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+)
+
+// runVerify revalidates checksums of the stored artifacts, exits with exitFailure if any is corrupted, missing or unreadable
+func runVerify(ttConfig *Config, _ []string) int {
+	ctx := context.Background()
+	if p := invalidPattern(syncDevices); p != "" {
+		common.Log.Errorf("invalid --device pattern: %s", p)
+		return exitConfig
+	}
+	source, err := openDestination(ctx, ttConfig, syncFrom)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	catalog, err := storage.LoadCatalog(ctx, source.Store)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+	results, err := storage.VerifyIntegrity(ctx, source.Store, source.KeyPrefix, catalog, func(device string) bool {
+		return matchesDevice(device, syncDevices)
+	}, !verifyHead)
+	if err != nil {
+		common.Log.Errorf("%v", err)
+		return exitFailure
+	}
+
+	printIntegrity(results)
+	failed := 0
+	for _, r := range results {
+		if r.Failed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		common.Log.Errorf("%d of %d artifacts in %s failed verification", failed, len(results), source.Store)
+		return exitFailure
+	}
+	common.Log.Infof("%d artifacts in %s verified", len(results), source.Store)
+	return 0
+}
+
+func printIntegrity(results []storage.IntegrityResult) {
+	if len(results) == 0 {
+		fmt.Println("no backups stored")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	device := ""
+	for i, r := range results {
+		if i == 0 || r.Device != device {
+			device = r.Device
+			_, _ = fmt.Fprintf(w, "device: %s\n", device)
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", r.Key, r.Status, r.Detail)
+	}
+	_ = w.Flush()
+}
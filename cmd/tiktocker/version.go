@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// build metadata set with -ldflags "-X main.version=1.2.3 -X main.commit=<sha> -X main.buildDate=<RFC3339>"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildVersion returns version of the binary with its commit and build date, go build records them from the VCS when not set by ldflags
+func buildVersion() string {
+	revision, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && revision == "":
+				revision = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	if revision == "" {
+		revision = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", version, revision, date)
+}
@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"tiktocker/internal/common"
+)
+
+// ErrUnauthorized is returned when the device rejects the credentials
+var ErrUnauthorized = errors.New("invalid credentials")
+
+// CheckRest reads the device identity, the error satisfies errors.Is(err, ErrUnauthorized) if the device is reachable but rejects the credentials
+func CheckRest(ctx context.Context, settings *common.BackupSettings, httpClient *http.Client) (string, error) {
+	internalChannel := common.NewResultChannel()
+	go getIdentity(common.ComponentLogger(ctx, common.ComponentRest), httpClient, settings, internalChannel)
+	result := common.WaitForResult(ctx, internalChannel)
+	return result.MikrotikIdentity, result.Err
+}
+
+// CheckScp opens SSH connection to the device the files are copied over
+func CheckScp(ctx context.Context, settings *common.BackupSettings) error {
+	client, err := connectScp(common.ComponentLogger(ctx, common.ComponentScp), settings)
+	if err != nil {
+		return err
+	}
+	client.Close()
+	return nil
+}
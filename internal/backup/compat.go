@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"tiktocker/internal/common"
+)
+
+// ErrIncompatibleBackup is returned when the binary backup doesn't match the target device, restoring it requires explicit confirmation
+var ErrIncompatibleBackup = errors.New("backup incompatible with the target device")
+
+// MikrotikFacts reads facts of the device, e.g. to check the restore target
+func MikrotikFacts(ctx context.Context, settings *common.BackupSettings, httpClient *http.Client, deviceComms chan *common.RequestResult) {
+	internalChannel := common.NewResultChannel()
+
+	go getFacts(common.ComponentLogger(ctx, common.ComponentRest), httpClient, settings, internalChannel)
+	deviceComms <- common.WaitForResult(ctx, internalChannel)
+}
+
+// MikrotikIdentity reads the system identity of the device, e.g. to list its stored backups
+func MikrotikIdentity(ctx context.Context, settings *common.BackupSettings, httpClient *http.Client, deviceComms chan *common.RequestResult) {
+	internalChannel := common.NewResultChannel()
+
+	go getIdentity(common.ComponentLogger(ctx, common.ComponentRest), httpClient, settings, internalChannel)
+	deviceComms <- common.WaitForResult(ctx, internalChannel)
+}
+
+// CheckRestoreCompatibility compares facts recorded in the stored backup metadata with the target device,
+// binary backups restored onto other RouterOS version or architecture leave the device misconfigured
+func CheckRestoreCompatibility(stored map[string]string, target *common.DeviceFacts) error {
+	expected := target.Metadata()
+	mismatches := make([]string, 0)
+	for _, key := range []string{"architecture", "routeros-version"} {
+		storedValue, targetValue := normalizeFact(stored[key]), normalizeFact(expected[key])
+		switch {
+		case storedValue == "":
+			mismatches = append(mismatches, fmt.Sprintf("%s of the backup is not known", key))
+		case storedValue != targetValue:
+			mismatches = append(mismatches, fmt.Sprintf("%s: backup %s, device %s", key, storedValue, targetValue))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: %s", ErrIncompatibleBackup, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// normalizeFact strips the annotation following the value, e.g. release channel: "7.14.3 (stable)" -> "7.14.3"
+func normalizeFact(value string) string {
+	fact, _, _ := strings.Cut(value, " ")
+	return fact
+}
@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"tiktocker/internal/common"
+	"time"
+)
+
+const (
+	FilePath = "rest/file"
+
+	ExtraFilesSuffix = ".files"
+)
+
+// ExtraFileName returns name the extra file is stored under: <identity>.files/<device path>
+func ExtraFileName(identity string, devicePath string) string {
+	return identity + ExtraFilesSuffix + "/" + devicePath
+}
+
+// ListExtraFiles returns device files matching any of the settings.ExtraFiles globs, files created by tiktocker itself are excluded
+func ListExtraFiles(ctx context.Context, client *http.Client, settings *common.BackupSettings, identity string) ([]string, error) {
+	log := common.ComponentLogger(ctx, common.ComponentRest)
+	if len(settings.ExtraFiles) == 0 {
+		return nil, nil
+	}
+	var files []map[string]string
+	if err := getJson(log, client, settings, FilePath, &files); err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	own := map[string]bool{ExportFileName(identity): true, BackupFileName(identity): true}
+	matched := make([]string, 0)
+	for _, f := range files {
+		name := f["name"]
+		// stored name is derived from the device path, it must not escape the <identity>.files directory
+		if f["type"] == "directory" || f["type"] == "disk" || own[name] || path.Clean("/"+name) != "/"+name {
+			continue
+		}
+		for _, pattern := range settings.ExtraFiles {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = append(matched, name)
+				break
+			}
+		}
+	}
+	sort.Strings(matched)
+	log.Debugf("Mikrotik %s extra files: %v", identity, matched)
+	return matched, nil
+}
+
+// MikrotikExtraFile downloads single device file via SCP, the result file is named with ExtraFileName
+func MikrotikExtraFile(ctx context.Context, identity string, devicePath string, settings *common.BackupSettings, deviceComms chan *common.RequestResult) {
+	internalChannel := common.NewResultChannel()
+	start := time.Now()
+
+	go downloadFile(ctx, devicePath, settings, internalChannel)
+	downloadResponse := common.WaitForResult(ctx, internalChannel)
+	if downloadResponse.Err != nil {
+		deviceComms <- &common.RequestResult{
+			Err: fmt.Errorf("file %s download failure: %v", devicePath, downloadResponse.Err),
+		}
+		return
+	}
+	downloadResponse.MikrotikIdentity = identity
+	downloadResponse.File.Name = ExtraFileName(identity, devicePath)
+	downloadResponse.Timings = common.Timings{
+		Scp:      time.Since(start),
+		ScpBytes: downloadResponse.File.Size,
+	}
+
+	deviceComms <- downloadResponse
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"tiktocker/internal/common"
+)
+
+const (
+	LogPath = "rest/log"
+
+	// the device log may hold changes of many days, only the most recent ones are reported
+	configChangeEntries = 10
+)
+
+// changedBy matches config changes logged by the device, e.g. "address added by winbox-3.41/tcp-msg(winbox):admin@192.168.88.254 (*5 = /ip address add ...)"
+var changedBy = regexp.MustCompile(`\b(?:added|changed|removed|moved|enabled|disabled) by (\S+)`)
+
+// ConfigChanges returns the most recent config changes found in the device log, oldest first.
+// Changes made by the backup user itself (e.g. its export files) are omitted
+func ConfigChanges(ctx context.Context, client *http.Client, settings *common.BackupSettings) ([]common.ConfigChange, error) {
+	log := common.ComponentLogger(ctx, common.ComponentRest)
+	var entries []map[string]string
+	if err := getJson(log, client, settings, LogPath, &entries); err != nil {
+		return nil, fmt.Errorf("failed to read device log: %w", err)
+	}
+
+	changes := make([]common.ConfigChange, 0)
+	for _, e := range entries {
+		if !strings.Contains(e["topics"], "system") {
+			continue
+		}
+		m := changedBy.FindStringSubmatch(e["message"])
+		if m == nil {
+			continue
+		}
+		by := changeUser(m[1])
+		if user, _, _ := strings.Cut(by, "@"); user == settings.BaseUrl.User.Username() {
+			continue
+		}
+		changes = append(changes, common.ConfigChange{Time: e["time"], By: by, Message: e["message"]})
+	}
+	if len(changes) > configChangeEntries {
+		changes = changes[len(changes)-configChangeEntries:]
+	}
+	log.Debugf("Mikrotik %s config changes: %d", settings.BaseUrl.Host, len(changes))
+	return changes, nil
+}
+
+// changeUser returns the user of the logged change without the client details,
+// e.g. admin@192.168.88.254 of winbox-3.41/tcp-msg(winbox):admin@192.168.88.254/action:3
+func changeUser(by string) string {
+	by, _, _ = strings.Cut(by, "/action:")
+	if at := strings.Index(by, "@"); at >= 0 {
+		if colon := strings.LastIndex(by[:at], ":"); colon >= 0 {
+			by = by[colon+1:]
+		}
+	}
+	return by
+}
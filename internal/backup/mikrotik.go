@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"github.com/bramvdbogaerde/go-scp"
 	"github.com/bramvdbogaerde/go-scp/auth"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"tiktocker/internal/common"
 )
@@ -18,16 +20,20 @@ import (
 const (
 	BackupPath     = "rest/system/backup/save"
 	SystemIdentity = "rest/system/identity"
+	SystemResource = "rest/system/resource"
+	RouterBoard    = "rest/system/routerboard"
 	ExportPath     = "rest/export"
 
 	ContentType = "application/json"
 )
 
 func MikrotikConfigExport(ctx context.Context, settings *common.BackupSettings, httpClient *http.Client, deviceComms chan *common.RequestResult) {
-	internalChannel := make(chan *common.RequestResult)
-	defer close(internalChannel)
+	log := common.ComponentLogger(ctx, common.ComponentRest)
+	internalChannel := common.NewResultChannel()
+	timings := common.Timings{}
+	start := time.Now()
 
-	go getIdentity(httpClient, settings, internalChannel)
+	go getIdentity(log, httpClient, settings, internalChannel)
 	systemIdentityResponse := common.WaitForResult(ctx, internalChannel)
 	if systemIdentityResponse.Err != nil {
 		deviceComms <- &common.RequestResult{
@@ -36,8 +42,22 @@ func MikrotikConfigExport(ctx context.Context, settings *common.BackupSettings,
 		return
 	}
 	identity := systemIdentityResponse.MikrotikIdentity
+	log = log.WithField("device", identity)
 
-	go exportConfig(httpClient, identity, settings, internalChannel)
+	go getFacts(log, httpClient, settings, internalChannel)
+	factsResponse := common.WaitForResult(ctx, internalChannel)
+	if factsResponse.Err != nil {
+		log.Warnf("failed to get Mikrotik %s facts, proceeding without: %v", identity, factsResponse.Err)
+	}
+	facts := factsResponse.Facts
+	if facts == nil {
+		facts = &common.DeviceFacts{}
+	}
+	facts.ExportedAt = time.Now()
+	timings.Identity = time.Since(start)
+
+	start = time.Now()
+	go exportConfig(log, httpClient, identity, settings, internalChannel)
 	exportConfigResponse := common.WaitForResult(ctx, internalChannel)
 	if exportConfigResponse.Err != nil {
 		deviceComms <- &common.RequestResult{
@@ -46,7 +66,9 @@ func MikrotikConfigExport(ctx context.Context, settings *common.BackupSettings,
 		return
 	}
 	exportConfigName := exportConfigResponse.File.Name
+	timings.Export = time.Since(start)
 
+	start = time.Now()
 	go downloadFile(ctx, exportConfigName, settings, internalChannel)
 	configDownloadResponse := common.WaitForResult(ctx, internalChannel)
 	if configDownloadResponse.Err != nil {
@@ -55,20 +77,25 @@ func MikrotikConfigExport(ctx context.Context, settings *common.BackupSettings,
 		}
 		return
 	}
+	timings.Scp = time.Since(start)
+	timings.ScpBytes = configDownloadResponse.File.Size
 
 	deviceComms <- &common.RequestResult{
 		MikrotikIdentity: identity,
+		Facts:            facts,
 		File:             configDownloadResponse.File,
+		Timings:          timings,
 	}
 }
 
 func MikrotikBackup(ctx context.Context, identity string, settings *common.BackupSettings, httpClient *http.Client, deviceComms chan *common.RequestResult) {
-	common.Log.Infof("backing up Mikrotik: %s", settings.BaseUrl.Redacted())
+	log := common.ComponentLogger(ctx, common.ComponentRest)
+	log.Infof("backing up Mikrotik: %s", settings.BaseUrl.Redacted())
 
-	internalChannel := make(chan *common.RequestResult)
-	defer close(internalChannel)
+	internalChannel := common.NewResultChannel()
+	start := time.Now()
 
-	go performBackup(httpClient, identity, settings, internalChannel)
+	go performBackup(log, httpClient, identity, settings, internalChannel)
 	backupResponse := common.WaitForResult(ctx, internalChannel)
 	if backupResponse.Err != nil {
 		deviceComms <- &common.RequestResult{
@@ -76,7 +103,9 @@ func MikrotikBackup(ctx context.Context, identity string, settings *common.Backu
 		}
 		return
 	}
+	backupDuration := time.Since(start)
 
+	start = time.Now()
 	go downloadFile(ctx, backupResponse.File.Name, settings, internalChannel)
 	backupDownloadResponse := common.WaitForResult(ctx, internalChannel)
 	if backupDownloadResponse.Err != nil {
@@ -85,14 +114,19 @@ func MikrotikBackup(ctx context.Context, identity string, settings *common.Backu
 		}
 		return
 	}
+	backupDownloadResponse.Timings = common.Timings{
+		Backup:   backupDuration,
+		Scp:      time.Since(start),
+		ScpBytes: backupDownloadResponse.File.Size,
+	}
 
 	deviceComms <- backupDownloadResponse
 }
 
-func doRequest(client *http.Client, url *url.URL, method string, body *map[string]interface{}) (*http.Response, error) {
+func doRequest(log *logrus.Entry, client *http.Client, url *url.URL, method string, body *map[string]interface{}) (*http.Response, error) {
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
-		common.Log.Errorf("Failed to marshal backup request body: %v", err)
+		log.Errorf("Failed to marshal backup request body: %v", err)
 		return nil, err
 	}
 
@@ -103,33 +137,37 @@ func doRequest(client *http.Client, url *url.URL, method string, body *map[strin
 		return bytes.NewBuffer(jsonBody)
 	}())
 	if err != nil {
-		common.Log.Errorf("Failed to create request: %v", err)
+		log.Errorf("Failed to create request: %v", err)
 		return nil, err
 	}
 	req.Header.Set("Content-Type", ContentType)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		common.Log.Errorf("Request failed: %v", err)
+		log.Errorf("Request failed: %v", err)
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Warnf("request returned status: %s", resp.Status)
+		return nil, fmt.Errorf("%w, request returned status: %s", ErrUnauthorized, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
-		common.Log.Warnf("request returned status: %s", resp.Status)
+		log.Warnf("request returned status: %s", resp.Status)
 		return nil, fmt.Errorf("request returned status: %s", resp.Status)
 	}
 
 	return resp, nil
 }
 
-func getIdentity(client *http.Client, settings *common.BackupSettings, results chan<- *common.RequestResult) {
+func getIdentity(log *logrus.Entry, client *http.Client, settings *common.BackupSettings, results chan<- *common.RequestResult) {
 	identityUrl := *settings.BaseUrl
 	identityUrl.Path = identityUrl.ResolveReference(&url.URL{Path: SystemIdentity}).Path
-	common.Log.Debugf("requesting Mikrotik identity %s", identityUrl.Redacted())
+	log.Debugf("requesting Mikrotik identity %s", identityUrl.Redacted())
 
-	resp, err := doRequest(client, &identityUrl, http.MethodGet, nil)
+	resp, err := doRequest(log, client, &identityUrl, http.MethodGet, nil)
 	if err != nil {
-		common.Log.Errorf("failed to get system identity: %v", err)
+		log.Errorf("failed to get system identity: %v", err)
 		results <- &common.RequestResult{Err: err}
 		return
 	}
@@ -137,12 +175,12 @@ func getIdentity(client *http.Client, settings *common.BackupSettings, results c
 	var systemIdentity map[string]string
 	decoder := json.NewDecoder(resp.Body)
 	if err := decoder.Decode(&systemIdentity); err != nil {
-		common.Log.Errorf("failed to decode system info response: %v", err)
+		log.Errorf("failed to decode system info response: %v", err)
 		results <- &common.RequestResult{Err: err}
 		return
 	}
 
-	common.Log.Debugf("discovered Mikrotik identity: %s", systemIdentity["name"])
+	log.Debugf("discovered Mikrotik identity: %s", systemIdentity["name"])
 	results <- &common.RequestResult{
 		MikrotikIdentity: systemIdentity["name"],
 		File:             common.BackupFile{Name: systemIdentity["name"]},
@@ -150,26 +188,78 @@ func getIdentity(client *http.Client, settings *common.BackupSettings, results c
 	}
 }
 
-func exportConfig(client *http.Client, identity string, settings *common.BackupSettings, results chan<- *common.RequestResult) {
+func getJson(log *logrus.Entry, client *http.Client, settings *common.BackupSettings, path string, out interface{}) error {
+	u := *settings.BaseUrl
+	u.Path = u.ResolveReference(&url.URL{Path: path}).Path
+
+	resp, err := doRequest(log, client, &u, http.MethodGet, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", path, err)
+	}
+	return nil
+}
+
+func getFacts(log *logrus.Entry, client *http.Client, settings *common.BackupSettings, results chan<- *common.RequestResult) {
+	var resource map[string]string
+	if err := getJson(log, client, settings, SystemResource, &resource); err != nil {
+		results <- &common.RequestResult{Err: err}
+		return
+	}
+	facts := &common.DeviceFacts{
+		RouterOSVersion: resource["version"],
+		Architecture:    resource["architecture-name"],
+		BoardName:       resource["board-name"],
+	}
+
+	// not present on CHR/x86
+	var routerboard map[string]string
+	if err := getJson(log, client, settings, RouterBoard, &routerboard); err != nil {
+		log.Debugf("routerboard info not available: %v", err)
+	} else {
+		facts.Model = routerboard["model"]
+		facts.SerialNumber = routerboard["serial-number"]
+	}
+
+	log.Debugf("discovered Mikrotik facts: %+v", *facts)
+	results <- &common.RequestResult{Facts: facts}
+}
+
+// ExportFileName returns name of the config export file of the device, it is also the name the export is stored under
+func ExportFileName(identity string) string {
+	return fmt.Sprintf("%s.config.rsc", identity)
+}
+
+// BackupFileName returns name of the backup file of the device, it is also the name the backup is stored under
+func BackupFileName(identity string) string {
+	return fmt.Sprintf("%s.backup", identity)
+}
+
+func exportConfig(log *logrus.Entry, client *http.Client, identity string, settings *common.BackupSettings, results chan<- *common.RequestResult) {
 	exportUrl := *settings.BaseUrl
 	exportUrl.Path = exportUrl.ResolveReference(&url.URL{Path: ExportPath}).Path
-	common.Log.Debugf("exporting Mikrotik: %s configuration (this is not a backup)", identity)
-	exportFileName := fmt.Sprintf("%s.config.rsc", identity)
+	log.Debugf("exporting Mikrotik: %s configuration (this is not a backup)", identity)
+	exportFileName := ExportFileName(identity)
 	body := map[string]interface{}{
 		"file": exportFileName,
 	}
-	_, err := doRequest(client, &exportUrl, http.MethodPost, &body)
+	_, err := doRequest(log, client, &exportUrl, http.MethodPost, &body)
 	if err != nil {
-		common.Log.Errorf("failed to export config: %v", err)
+		log.Errorf("failed to export config: %v", err)
 		results <- &common.RequestResult{Err: err}
 		return
 	}
-	common.Log.Debugf("configuration export requested for %s", identity)
+	log.Debugf("configuration export requested for %s", identity)
 	results <- &common.RequestResult{MikrotikIdentity: identity, File: common.BackupFile{Name: exportFileName}, Err: nil}
 }
 
 // selecting encryption without password has the same effect as selecting no encryption
 func performBackup(
+	log *logrus.Entry,
 	client *http.Client,
 	identity string,
 	settings *common.BackupSettings,
@@ -178,7 +268,7 @@ func performBackup(
 	encrypt := true
 	// If encryption is requested but no key is provided, disable encryption
 	if settings.EncryptionKey == "" {
-		common.Log.Warnf("encryption disabled for: %s (no encryption key)", identity)
+		log.Warnf("encryption disabled for: %s (no encryption key)", identity)
 		encrypt = false
 	}
 
@@ -192,64 +282,77 @@ func performBackup(
 
 	backupRequestUrl := *settings.BaseUrl
 	backupRequestUrl.Path = backupRequestUrl.ResolveReference(&url.URL{Path: BackupPath}).Path
-	common.Log.Debugf("requesting backup for %s at %s", identity, backupRequestUrl.Redacted())
+	log.Debugf("requesting backup for %s at %s", identity, backupRequestUrl.Redacted())
 
-	_, err := doRequest(client, &backupRequestUrl, http.MethodPost, &body) // response is an empty array
+	_, err := doRequest(log, client, &backupRequestUrl, http.MethodPost, &body) // response is an empty array
 	if err != nil {
-		common.Log.Errorf("failed to perform backup: %v", err)
+		log.Errorf("failed to perform backup: %v", err)
 		results <- &common.RequestResult{Err: err}
 		return
 	}
 
-	common.Log.Debugf("backup requested for %s", identity)
-	backupFileName := fmt.Sprintf("%s.backup", identity)
+	log.Debugf("backup requested for %s", identity)
+	backupFileName := BackupFileName(identity)
 	results <- &common.RequestResult{MikrotikIdentity: identity, File: common.BackupFile{Name: backupFileName}, Err: nil}
 }
 
 func downloadFile(ctx context.Context, fileName string, settings *common.BackupSettings, results chan<- *common.RequestResult) {
 	//scp file, cannot use Mikrotik's REST API for this due to random encoding returned in json
+	log := common.ComponentLogger(ctx, common.ComponentScp)
+	start := time.Now()
 
-	user := settings.BaseUrl.User.Username()
-	pass, _ := settings.BaseUrl.User.Password()
 	host := fmt.Sprintf("%s:22", settings.BaseUrl.Host)
-
-	clientConfig, err := auth.PasswordKey(user, pass, ssh.InsecureIgnoreHostKey())
+	client, err := connectScp(log, settings)
 	if err != nil {
-		results <- &common.RequestResult{Err: fmt.Errorf("failed to create SSH config: %v", err)}
+		results <- &common.RequestResult{Err: err}
 		return
 	}
+	defer client.Close()
+	log.Debugf("connected to %s in %s, copying %s", host, time.Since(start), fileName)
 
-	client := scp.NewClient(host, &clientConfig)
-	err = client.Connect()
+	spool, err := common.NewSpoolWriter()
 	if err != nil {
-		results <- &common.RequestResult{Err: fmt.Errorf("failed to SSH to: %s, error: %v", host, err)}
+		results <- &common.RequestResult{Err: err}
 		return
 	}
-	defer client.Close()
-
-	var buf bytes.Buffer
 
-	err = client.CopyFromRemotePassThru(ctx, &buf, fileName, nil)
+	err = client.CopyFromRemotePassThru(ctx, spool, fileName, func(r io.Reader, _ int64) io.Reader {
+		return common.ProgressReader(ctx, r)
+	})
 	if err != nil {
+		spool.Discard()
 		results <- &common.RequestResult{Err: fmt.Errorf("failed to SCP file: %v", err)}
 		return
 	}
 
-	contents := buf.Bytes()
-	firstNl := bytes.IndexByte(contents, '\n')
-	sha256WithoutFirstLine := ""
-	if firstNl >= 0 {
-		// Skip date from the first line
-		sha256WithoutFirstLine = common.ComputeSha256(contents[firstNl+1:])
+	file, err := spool.Close(fileName)
+	if err != nil {
+		results <- &common.RequestResult{Err: err}
+		return
 	}
+	log.Debugf("copied %s from %s, %d bytes in %s", fileName, host, file.Size, time.Since(start))
 
 	results <- &common.RequestResult{
-		File: common.BackupFile{
-			Name:                           fileName,
-			Contents:                       contents,
-			ComputedSha256:                 common.ComputeSha256(contents),
-			ComputedSha256WithoutFirstLine: sha256WithoutFirstLine,
-		},
-		Err: nil,
+		File: *file,
+		Err:  nil,
+	}
+}
+
+// connectScp opens SSH connection to the device with the credentials of its REST API
+func connectScp(log *logrus.Entry, settings *common.BackupSettings) (*scp.Client, error) {
+	user := settings.BaseUrl.User.Username()
+	pass, _ := settings.BaseUrl.User.Password()
+	host := fmt.Sprintf("%s:22", settings.BaseUrl.Host)
+
+	clientConfig, err := auth.PasswordKey(user, pass, ssh.InsecureIgnoreHostKey())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH config: %v", err)
+	}
+
+	log.Debugf("connecting to %s as %s", host, user)
+	client := scp.NewClient(host, &clientConfig)
+	if err := client.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to SSH to: %s, error: %v", host, err)
 	}
+	return &client, nil
 }
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"tiktocker/internal/common"
+	"time"
+)
+
+const (
+	BackupLoadPath = "rest/system/backup/load"
+	ImportPath     = "rest/import"
+)
+
+// UploadFile copies the file onto the device via SCP, it is stored in the device root under the name. The bytes sent are counted into the progress of ctx
+func UploadFile(ctx context.Context, file *common.BackupFile, name string, settings *common.BackupSettings) error {
+	log := common.ComponentLogger(ctx, common.ComponentScp)
+	start := time.Now()
+
+	client, err := connectScp(log, settings)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	f, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	progress := func(r io.Reader, _ int64) io.Reader {
+		return common.ProgressReader(ctx, r)
+	}
+	if err := client.CopyFromFilePassThru(ctx, *f, name, "0644", progress); err != nil {
+		return fmt.Errorf("failed to SCP file: %v", err)
+	}
+	log.Debugf("copied %s to %s, %d bytes in %s", name, settings.BaseUrl.Host, file.Size, time.Since(start))
+	return nil
+}
+
+// MikrotikBackupLoad restores the uploaded binary backup, the device reboots and the request may fail when the connection drops
+func MikrotikBackupLoad(ctx context.Context, name string, settings *common.BackupSettings, httpClient *http.Client) error {
+	body := map[string]interface{}{
+		"name": name,
+	}
+	if settings.EncryptionKey != "" {
+		body["password"] = settings.EncryptionKey
+	}
+	return post(ctx, BackupLoadPath, &body, settings, httpClient)
+}
+
+// MikrotikImport runs the uploaded configuration script, commands already matching the configuration fail the import
+func MikrotikImport(ctx context.Context, name string, settings *common.BackupSettings, httpClient *http.Client) error {
+	body := map[string]interface{}{
+		"file-name": name,
+	}
+	return post(ctx, ImportPath, &body, settings, httpClient)
+}
+
+func post(ctx context.Context, path string, body *map[string]interface{}, settings *common.BackupSettings, httpClient *http.Client) error {
+	log := common.ComponentLogger(ctx, common.ComponentRest)
+	u := *settings.BaseUrl
+	u.Path = u.ResolveReference(&url.URL{Path: path}).Path
+	log.Debugf("requesting %s", u.Redacted())
+
+	resp, err := doRequest(log, httpClient, &u, http.MethodPost, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
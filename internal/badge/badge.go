@@ -0,0 +1,114 @@
+package badge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+const (
+	SVGName  = storage.BadgeSVGName
+	JSONName = storage.BadgeJSONName
+
+	charWidth = 7 // approximate width of a character in pixels (11px Verdana)
+	padding   = 10
+)
+
+// Badge summarizes how many devices were backed up recently
+type Badge struct {
+	Label   string
+	Message string
+	Color   string
+	Healthy int // devices successfully backed up within the max age
+	Total   int
+}
+
+// New counts devices (hosts) whose last successful backup recorded in the state is younger than maxAge
+func New(hosts []string, st *state.Store, maxAge time.Duration, now time.Time) (*Badge, error) {
+	b := &Badge{Label: "fleet", Total: len(hosts)}
+	for _, host := range hosts {
+		record, found, err := st.GetDevice(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Mikrotik %s state: %w", host, err)
+		}
+		if found && now.Sub(record.LastSuccess) < maxAge {
+			b.Healthy++
+		}
+	}
+	b.Message = fmt.Sprintf("%d/%d backed up <%s", b.Healthy, b.Total, formatAge(maxAge))
+	switch {
+	case b.Healthy == b.Total:
+		b.Color = "#4c1"
+	case b.Healthy*10 >= b.Total*9:
+		b.Color = "#dfb317"
+	default:
+		b.Color = "#e05d44"
+	}
+	return b, nil
+}
+
+// JSON returns the badge in the shields.io endpoint format
+func (b *Badge) JSON() ([]byte, error) {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false) // the message contains "<"
+	err := enc.Encode(map[string]interface{}{
+		"schemaVersion": 1,
+		"label":         b.Label,
+		"message":       b.Message,
+		"color":         b.Color,
+	})
+	return out.Bytes(), err
+}
+
+// SVG renders flat badge with the label on the left and the message on the right
+func (b *Badge) SVG() []byte {
+	labelWidth := len(b.Label)*charWidth + padding
+	messageWidth := len(b.Message)*charWidth + padding
+	width := labelWidth + messageWidth
+	label, message := html.EscapeString(b.Label), html.EscapeString(b.Message)
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">
+<title>%s: %s</title>
+<rect width="%d" height="20" fill="#555"/>
+<rect x="%d" width="%d" height="20" fill="%s"/>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%d" y="14">%s</text>
+<text x="%d" y="14">%s</text>
+</g>
+</svg>
+`, width, label, message, label, message, labelWidth, labelWidth, messageWidth, b.Color, labelWidth/2, label, labelWidth+messageWidth/2, message))
+}
+
+// Publish stores both badge formats at the storage root
+func Publish(ctx context.Context, store storage.Storage, b *Badge) error {
+	contents, err := b.JSON()
+	if err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{SVGName: b.SVG(), JSONName: contents} {
+		file, err := common.SpoolBytes(name, data)
+		if err != nil {
+			return err
+		}
+		err = store.Put(ctx, "", file, nil)
+		file.Remove()
+		if err != nil {
+			return fmt.Errorf("%s failed to store %s: %w", store, name, err)
+		}
+	}
+	return nil
+}
+
+// formatAge returns whole hours as e.g. 24h instead of 24h0m0s
+func formatAge(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return d.String()
+}
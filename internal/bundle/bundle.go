@@ -0,0 +1,230 @@
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+const (
+	ManifestName = "bundle.json" // the last entry of the bundle, lists the bundled objects
+
+	// PAX records of every object entry, the contents are verified and the metadata restored on import
+	paxSha256         = "TIKTOCKER.sha256"
+	paxMetadataPrefix = "TIKTOCKER.metadata."
+)
+
+// Object is single bundled artifact, Key is relative to the storage root (without the bucket path prefix)
+type Object struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	Sha256       string            `json:"sha256"`
+	LastModified time.Time         `json:"lastModified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// Manifest describes the bundle, the same keys are tar entries holding the contents
+type Manifest struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Source    string    `json:"source"`
+	Since     time.Time `json:"since"` // zero - all current objects
+	Objects   []Object  `json:"objects"`
+}
+
+// Export writes tar archive of the current artifacts stored since the given time, followed by the catalog (if present) and the bundle manifest.
+// keyPrefix is stripped from the listed keys, so the bundle can be imported into storage with different path
+func Export(ctx context.Context, store storage.Storage, keyPrefix string, since time.Time, w io.Writer, now time.Time) (*Manifest, error) {
+	listed, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s listing failure: %w", store, err)
+	}
+	objects := make([]storage.ObjectInfo, 0)
+	for _, o := range listed {
+		o.Key = storage.RelativeKey(keyPrefix, o.Key)
+		if o.IsLatest && !o.LastModified.Before(since) && storage.Transferable(o.Key) {
+			objects = append(objects, o)
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	manifest := &Manifest{CreatedAt: now.UTC(), Source: store.String(), Since: since.UTC(), Objects: make([]Object, 0, len(objects))}
+	tw := tar.NewWriter(w)
+	for _, o := range objects {
+		object, err := exportObject(ctx, store, tw, o)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Objects = append(manifest.Objects, *object)
+	}
+
+	catalog, err := storage.LoadCatalog(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if len(catalog.Devices) > 0 {
+		if err := writeJSON(tw, storage.CatalogName, catalog, now); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeJSON(tw, ManifestName, manifest, now); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return manifest, nil
+}
+
+// exportObject spools the object first, the tar header carries the size and checksum of the contents
+func exportObject(ctx context.Context, store storage.Storage, tw *tar.Writer, o storage.ObjectInfo) (*Object, error) {
+	file, metadata, err := storage.ReadObject(ctx, store, o.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Remove()
+
+	object := &Object{Key: o.Key, Size: file.Size, Sha256: file.ComputedSha256, LastModified: o.LastModified.UTC(), Metadata: metadata}
+	records := map[string]string{paxSha256: object.Sha256}
+	for k, v := range object.Metadata {
+		records[paxMetadataPrefix+k] = v
+	}
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       o.Key,
+		Size:       file.Size,
+		Mode:       0644,
+		ModTime:    object.LastModified,
+		Format:     tar.FormatPAX,
+		PAXRecords: records,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to write bundle entry %s: %w", o.Key, err)
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(tw, f); err != nil {
+		return nil, fmt.Errorf("failed to write bundle entry %s: %w", o.Key, err)
+	}
+	return object, nil
+}
+
+// Import stores the bundled artifacts with their metadata, catalog (if not nil) is updated with the bundled devices which were checked later than its own entries.
+// Returns the manifest of the imported objects
+func Import(ctx context.Context, store storage.Storage, r io.Reader, catalog *storage.Catalog, now time.Time) (*Manifest, error) {
+	imported := &Manifest{CreatedAt: now.UTC(), Objects: make([]Object, 0)}
+	stored := make(map[string]*common.BackupFile)
+	var bundledCatalog *storage.Catalog
+	var bundledManifest *Manifest
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		key := header.Name
+		if key == "" || path.Clean("/"+key) != "/"+key {
+			return imported, fmt.Errorf("invalid bundle entry: %s", key)
+		}
+		switch key {
+		case ManifestName:
+			bundledManifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(bundledManifest); err != nil {
+				return imported, fmt.Errorf("invalid %s: %w", ManifestName, err)
+			}
+		case storage.CatalogName:
+			bundledCatalog = &storage.Catalog{}
+			if err := json.NewDecoder(tr).Decode(bundledCatalog); err != nil {
+				return imported, fmt.Errorf("invalid bundled %s: %w", storage.CatalogName, err)
+			}
+		default:
+			object, file, err := importObject(ctx, store, tr, header)
+			if err != nil {
+				return imported, err
+			}
+			stored[key] = file
+			imported.Objects = append(imported.Objects, *object)
+		}
+	}
+	if bundledManifest == nil {
+		return imported, fmt.Errorf("not a tiktocker bundle or truncated: %s missing", ManifestName)
+	}
+	imported.Source = bundledManifest.Source
+	imported.Since = bundledManifest.Since
+	if catalog != nil && bundledCatalog != nil {
+		catalog.MergeCopied(bundledCatalog, stored)
+	}
+	return imported, nil
+}
+
+func importObject(ctx context.Context, store storage.Storage, tr *tar.Reader, header *tar.Header) (*Object, *common.BackupFile, error) {
+	key := header.Name
+	if !storage.Transferable(key) {
+		return nil, nil, fmt.Errorf("bundle entry %s is not a tiktocker artifact", key)
+	}
+	_, name := storage.SplitKey(key)
+	spool, err := common.NewSpoolWriter()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(spool, tr); err != nil {
+		spool.Discard()
+		return nil, nil, fmt.Errorf("failed to read bundle entry %s: %w", key, err)
+	}
+	file, err := spool.Close(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Remove()
+	if expected := header.PAXRecords[paxSha256]; expected != "" && expected != file.ComputedSha256 {
+		return nil, nil, fmt.Errorf("bundle entry %s corrupted: sha256 %s, expected %s", key, file.ComputedSha256, expected)
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, paxMetadataPrefix) {
+			metadata[strings.TrimPrefix(k, paxMetadataPrefix)] = v
+		}
+	}
+	if err := storage.WriteObject(ctx, store, key, file, metadata); err != nil {
+		return nil, nil, err
+	}
+	common.Log.Debugf("bundle entry %s stored in %s", key, store)
+	object := &Object{Key: key, Size: file.Size, Sha256: file.ComputedSha256, LastModified: header.ModTime.UTC(), Metadata: metadata}
+	return object, &common.BackupFile{Name: file.Name, Size: file.Size, VersionId: file.VersionId, ComputedSha256: file.ComputedSha256}, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, v interface{}, now time.Time) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	contents = append(contents, '\n')
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(contents)), Mode: 0644, ModTime: now.UTC(), Format: tar.FormatPAX}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write bundle entry %s: %w", name, err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		return fmt.Errorf("failed to write bundle entry %s: %w", name, err)
+	}
+	return nil
+}
@@ -1,95 +1,140 @@
 package common
 
 import (
-	"bytes"
-	"context"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"net/url"
-	"path/filepath"
-	"strings"
+	"os"
+	"text/template"
 	"time"
 )
 
 const (
 	Sha256WithoutFirstLine = "tiktockersha256"
+	BackupSha256           = "tiktockerbackupsha256" // sha256 of the binary backup or extra file contents (before post-processing)
+	TiktockerVersion       = "tiktockerversion"      // version of the binary which stored the artifact
 )
 
 type BackupSettings struct {
-	BaseUrl       *url.URL
-	EncryptionKey string
-	Timeout       time.Duration
-	Metadata      map[string]string
+	BaseUrl         *url.URL
+	EncryptionKey   string
+	Timeout         time.Duration
+	Metadata        map[string]string
+	PrefixTemplate  *template.Template // per-device storage prefix, nil - files are stored directly under the prefix
+	UploadRateLimit int64              // upload bytes per second, 0 - unlimited
+	ExtraFiles      []string           // globs of additional device files to back up
+	ExportOnly      bool               // only the export is stored, no binary backup is made on the device
+	Force           bool               // change detection is skipped, the backup is made and stored regardless of the stored checksums
+	Schedule        string             // cron expression of the daemon mode
+	Window          *BackupWindow      // allowed backup hours, nil - any time
+	MinInterval     time.Duration      // skipped if successfully backed up within, 0 - never skipped
+	PreHooks        []HookConfig       // global hooks followed by the device ones
+	PostHooks       []HookConfig
+
+	MetadataTemplates map[string]*template.Template // metadata entries rendered with the device facts, Metadata holds the static ones
+}
+
+// DeviceFacts describes the device state at the time of export
+type DeviceFacts struct {
+	RouterOSVersion string
+	Architecture    string
+	BoardName       string
+	Model           string
+	SerialNumber    string // empty for CHR/x86
+	ExportedAt      time.Time
+}
+
+// Metadata returns facts as object metadata entries, empty facts are omitted
+func (f *DeviceFacts) Metadata() map[string]string {
+	m := make(map[string]string)
+	if f == nil {
+		return m
+	}
+	for k, v := range map[string]string{
+		"routeros-version": f.RouterOSVersion,
+		"architecture":     f.Architecture,
+		"board-name":       f.BoardName,
+		"model":            f.Model,
+		"serial-number":    f.SerialNumber,
+	} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	if !f.ExportedAt.IsZero() {
+		m["export-timestamp"] = f.ExportedAt.UTC().Format(time.RFC3339)
+	}
+	return m
+}
+
+// ConfigChange is the config change entry of the device log
+type ConfigChange struct {
+	Time    string `json:"time"` // as logged by the device, in its timezone
+	By      string `json:"by"`   // user making the change, e.g. admin@192.168.88.254
+	Message string `json:"message"`
 }
 
 type BackupFile struct {
 	Name                           string
-	Contents                       []byte
+	Path                           string // local spool file holding the contents, avoids keeping large backups in memory
+	Size                           int64
+	VersionId                      string // storage version of the uploaded file, empty if storage is not versioned
 	ComputedSha256                 string // base64 encoded sha256 checksum of the file contents
 	ComputedSha256WithoutFirstLine string // base64 encoded sha256 checksum of the file contents without the first line
 }
 
-type S3Connector struct {
-	Client *s3.Client
-	Bucket string
-	Prefix string
+func (f *BackupFile) Open() (*os.File, error) {
+	return os.Open(f.Path)
+}
+
+func (f *BackupFile) ReadAll() ([]byte, error) {
+	return os.ReadFile(f.Path)
 }
 
-// GetObjectSha256 returns modified sha256 to detect Mikrotik config changes, modified == sha256 based on full file without first line that contains date
-func (c *S3Connector) GetObjectSha256(ctx context.Context, fileName string) *string {
-	bucketPath := c.Prefix
-	if !strings.HasSuffix(bucketPath, fileName) {
-		bucketPath = filepath.Join(bucketPath, fileName)
+// Remove deletes the local spool file
+func (f *BackupFile) Remove() {
+	if f.Path == "" {
+		return
 	}
-	head, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket:       aws.String(c.Bucket),
-		Key:          aws.String(bucketPath),
-		ChecksumMode: types.ChecksumModeEnabled, //otherwise won't fetch the checksum
-	})
-
-	// checksum might be computed with first line omitted hence it is kept in different field
-	if err == nil && head.Metadata != nil {
-		val := head.Metadata[Sha256WithoutFirstLine]
-		return &val
+	if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+		Log.Warnf("failed to remove spool file %s: %v", f.Path, err)
 	}
-	return nil
 }
 
-func (c *S3Connector) UploadFile(ctx context.Context, file *BackupFile, metadata *map[string]string) error {
-	bucketPath := c.Prefix
-	if !strings.HasSuffix(bucketPath, file.Name) {
-		bucketPath = filepath.Join(bucketPath, file.Name)
-	}
+// Timings is the per-device duration breakdown of the run, phases which didn't run are zero
+type Timings struct {
+	Identity time.Duration // identity and facts requests
+	Export   time.Duration // export request
+	Backup   time.Duration // backup request
+	Scp      time.Duration // all downloads from the device
+	Upload   time.Duration // storing all artifacts
 
-	m := metadata
+	ScpBytes    int64
+	UploadBytes int64
+}
 
-	if file.ComputedSha256WithoutFirstLine != "" {
-		modifiedMetadata := make(map[string]string, len(*metadata)+1)
-		for k, v := range *metadata {
-			modifiedMetadata[k] = v
-		}
-		modifiedMetadata[Sha256WithoutFirstLine] = file.ComputedSha256WithoutFirstLine
-		m = &modifiedMetadata
-	}
+func (t *Timings) Add(other Timings) {
+	t.Identity += other.Identity
+	t.Export += other.Export
+	t.Backup += other.Backup
+	t.Scp += other.Scp
+	t.Upload += other.Upload
+	t.ScpBytes += other.ScpBytes
+	t.UploadBytes += other.UploadBytes
+}
 
-	uploader := manager.NewUploader(c.Client)
-	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket:            aws.String(c.Bucket),
-		Key:               aws.String(bucketPath),
-		Body:              bytes.NewReader(file.Contents),
-		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
-		ChecksumSHA256:    aws.String(file.ComputedSha256),
-		Metadata:          *m,
-	})
-	return err
+// Throughput returns bytes per second, 0 if nothing was transferred
+func Throughput(bytes int64, d time.Duration) float64 {
+	if bytes == 0 || d <= 0 {
+		return 0
+	}
+	return float64(bytes) / d.Seconds()
 }
 
 type RequestResult struct {
 	MikrotikIdentity     string
+	Facts                *DeviceFacts
 	File                 BackupFile
 	ExistingConfigSha256 *string // base64 encoded sha256 checksum of the remote file
+	Timings              Timings
 
 	Err error
 }
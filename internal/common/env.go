@@ -0,0 +1,29 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envReference matches the value which is entirely ${VAR} or ${VAR:-default}
+var envReference = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}$`)
+
+// ExpandEnv replaces the value which is entirely ${VAR} with the environment variable, ${VAR:-default} with the default if VAR is unset or empty.
+// Other values are kept as they are (e.g. passwords containing $), referenced undefined variable without default is an error
+func ExpandEnv(value string) (string, error) {
+	m := envReference.FindStringSubmatch(value)
+	if m == nil {
+		return value, nil
+	}
+	if v := os.Getenv(m[1]); v != "" {
+		return v, nil
+	}
+	if m[2] != "" {
+		return m[3], nil
+	}
+	if _, ok := os.LookupEnv(m[1]); !ok {
+		return "", fmt.Errorf("undefined environment variable: %s", m[1])
+	}
+	return "", nil
+}
@@ -0,0 +1,50 @@
+package common
+
+import "testing"
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("TT_TEST_SET", "secret")
+	t.Setenv("TT_TEST_EMPTY", "")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain value", value: "backupuser", want: "backupuser"},
+		{name: "empty value", value: "", want: ""},
+		{name: "set variable", value: "${TT_TEST_SET}", want: "secret"},
+		{name: "set variable with default", value: "${TT_TEST_SET:-fallback}", want: "secret"},
+		{name: "unset variable with default", value: "${TT_TEST_UNSET:-192.168.88.1}", want: "192.168.88.1"},
+		{name: "empty variable with default", value: "${TT_TEST_EMPTY:-fallback}", want: "fallback"},
+		{name: "unset variable with empty default", value: "${TT_TEST_UNSET:-}", want: ""},
+		{name: "empty variable without default", value: "${TT_TEST_EMPTY}", want: ""},
+		{name: "undefined variable", value: "${TT_TEST_UNSET}", wantErr: true},
+		{name: "escape kept", value: "pa$$word", want: "pa$$word"},
+		{name: "escaped reference kept", value: "$${TT_TEST_SET}", want: "$${TT_TEST_SET}"},
+		{name: "dollar in password kept", value: "p$ss$word", want: "p$ss$word"},
+		{name: "embedded reference kept", value: "prefix-${TT_TEST_SET}", want: "prefix-${TT_TEST_SET}"},
+		{name: "embedded undefined reference kept", value: "${TT_TEST_UNSET}-suffix", want: "${TT_TEST_UNSET}-suffix"},
+		{name: "two references kept", value: "${TT_TEST_SET}${TT_TEST_SET}", want: "${TT_TEST_SET}${TT_TEST_SET}"},
+		{name: "bare reference kept", value: "$TT_TEST_SET", want: "$TT_TEST_SET"},
+		{name: "invalid name kept", value: "${1VAR}", want: "${1VAR}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandEnv(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ExpandEnv(%q) = %q, want error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandEnv(%q) unexpected error: %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("ExpandEnv(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package common
+
+import "time"
+
+// HookConfig is a command or a webhook executed before or after the device backup, exactly one of them is set
+type HookConfig struct {
+	Command []string          `mapstructure:"command"` // executable and its arguments, not run by shell
+	Url     string            `mapstructure:"url"`     // posted the JSON of the backup
+	Headers map[string]string `mapstructure:"headers"` // of the webhook request, e.g. Authorization
+	Timeout time.Duration     `mapstructure:"timeout"` // default 30s
+}
+
+type HooksConfig struct {
+	Pre  []HookConfig `mapstructure:"pre"`  // before the device is contacted, failure fails the device backup
+	Post []HookConfig `mapstructure:"post"` // after the backup, succeeded or not, failures are logged
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// maxExpandedHosts limits the addresses of a single range, guards against typos like 10.0.0.0/8
+const maxExpandedHosts = 4096
+
+// ExpandHosts returns the addresses of the range (10.0.0.1-10.0.0.20) or CIDR (10.0.5.0/28, network and broadcast addresses excluded),
+// other hosts (names, addresses with port) are returned as they are
+func ExpandHosts(host string) ([]string, error) {
+	if strings.Contains(host, "/") {
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s: %w", host, err)
+		}
+		return expandPrefix(prefix.Masked())
+	}
+	if first, last, ok := strings.Cut(host, "-"); ok {
+		from, fromErr := netip.ParseAddr(first)
+		to, toErr := netip.ParseAddr(last)
+		if fromErr != nil || toErr != nil {
+			return []string{host}, nil // host name with hyphen
+		}
+		return expandRange(host, from, to)
+	}
+	return []string{host}, nil
+}
+
+func expandPrefix(prefix netip.Prefix) ([]string, error) {
+	first := prefix.Addr()
+	bits := first.BitLen() - prefix.Bits()
+	if bits >= 63 || 1<<bits > maxExpandedHosts {
+		return nil, fmt.Errorf("CIDR %s has more than %d addresses", prefix, maxExpandedHosts)
+	}
+	count := 1 << bits
+	hosts := make([]string, 0, count)
+	for a, i := first, 0; i < count; a, i = a.Next(), i+1 {
+		hosts = append(hosts, a.String())
+	}
+	if first.Is4() && bits >= 2 {
+		hosts = hosts[1 : len(hosts)-1] // network and broadcast
+	}
+	return hosts, nil
+}
+
+func expandRange(host string, from netip.Addr, to netip.Addr) ([]string, error) {
+	if from.Is4() != to.Is4() || to.Less(from) {
+		return nil, fmt.Errorf("invalid range %s, must be first-last addresses of the same family", host)
+	}
+	hosts := make([]string, 0)
+	for a := from; ; a = a.Next() {
+		if len(hosts) == maxExpandedHosts {
+			return nil, fmt.Errorf("range %s has more than %d addresses", host, maxExpandedHosts)
+		}
+		hosts = append(hosts, a.String())
+		if a == to {
+			return hosts, nil
+		}
+	}
+}
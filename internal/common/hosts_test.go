@@ -0,0 +1,78 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		want    []string // nil - only count, first and last are checked
+		count   int
+		first   string
+		last    string
+		wantErr bool
+	}{
+		{name: "address", host: "192.168.88.1", want: []string{"192.168.88.1"}},
+		{name: "host name", host: "router1.example.com", want: []string{"router1.example.com"}},
+		{name: "host name with hyphen", host: "core-router", want: []string{"core-router"}},
+		{name: "address with port", host: "192.168.88.1:8443", want: []string{"192.168.88.1:8443"}},
+		{name: "address and name range is a host name", host: "10.0.0.1-router", want: []string{"10.0.0.1-router"}},
+
+		{name: "/32 single address", host: "10.0.5.7/32", want: []string{"10.0.5.7"}},
+		{name: "/31 point-to-point keeps both addresses", host: "10.0.5.6/31", want: []string{"10.0.5.6", "10.0.5.7"}},
+		{name: "/30 excludes network and broadcast", host: "10.0.5.4/30", want: []string{"10.0.5.5", "10.0.5.6"}},
+		{name: "/29", host: "10.0.5.8/29", want: []string{"10.0.5.9", "10.0.5.10", "10.0.5.11", "10.0.5.12", "10.0.5.13", "10.0.5.14"}},
+		{name: "host bits are masked", host: "10.0.5.6/30", want: []string{"10.0.5.5", "10.0.5.6"}},
+		{name: "/24", host: "192.168.88.0/24", count: 254, first: "192.168.88.1", last: "192.168.88.254"},
+		{name: "/20 at the cap", host: "10.0.0.0/20", count: 4094, first: "10.0.0.1", last: "10.0.15.254"},
+		{name: "/19 above the cap", host: "10.0.0.0/19", wantErr: true},
+		{name: "/8 above the cap", host: "10.0.0.0/8", wantErr: true},
+		{name: "/0 above the cap", host: "0.0.0.0/0", wantErr: true},
+		{name: "invalid prefix length", host: "10.0.0.0/33", wantErr: true},
+		{name: "invalid CIDR address", host: "router/24", wantErr: true},
+
+		{name: "IPv6 /128", host: "fd00::1/128", want: []string{"fd00::1"}},
+		{name: "IPv6 /127", host: "fd00::/127", want: []string{"fd00::", "fd00::1"}},
+		{name: "IPv6 /126 keeps every address", host: "fd00::4/126", want: []string{"fd00::4", "fd00::5", "fd00::6", "fd00::7"}},
+		{name: "IPv6 /116 at the cap", host: "fd00::/116", count: 4096, first: "fd00::", last: "fd00::fff"},
+		{name: "IPv6 /64 above the cap", host: "fd00::/64", wantErr: true},
+
+		{name: "range", host: "10.0.0.1-10.0.0.3", want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{name: "single address range", host: "10.0.0.1-10.0.0.1", want: []string{"10.0.0.1"}},
+		{name: "range across octets", host: "10.0.0.254-10.0.1.1", want: []string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"}},
+		{name: "IPv6 range", host: "fd00::ff-fd00::101", want: []string{"fd00::ff", "fd00::100", "fd00::101"}},
+		{name: "range at the cap", host: "10.0.0.0-10.0.15.255", count: 4096, first: "10.0.0.0", last: "10.0.15.255"},
+		{name: "range above the cap", host: "10.0.0.0-10.0.16.0", wantErr: true},
+		{name: "reversed range", host: "10.0.0.3-10.0.0.1", wantErr: true},
+		{name: "mixed family range", host: "10.0.0.1-fd00::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandHosts(tt.host)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ExpandHosts(%q) = %d addresses, want error", tt.host, len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandHosts(%q) unexpected error: %v", tt.host, err)
+			}
+			if tt.want != nil {
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("ExpandHosts(%q) = %v, want %v", tt.host, got, tt.want)
+				}
+				return
+			}
+			if len(got) == 0 {
+				t.Fatalf("ExpandHosts(%q) returned no addresses, want %d", tt.host, tt.count)
+			}
+			if len(got) != tt.count || got[0] != tt.first || got[len(got)-1] != tt.last {
+				t.Errorf("ExpandHosts(%q) = %d addresses %s..%s, want %d addresses %s..%s", tt.host, len(got), got[0], got[len(got)-1], tt.count, tt.first, tt.last)
+			}
+		})
+	}
+}
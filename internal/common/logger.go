@@ -1,13 +1,29 @@
 package common
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
+	"io"
 	"strings"
 )
 
+// components of which log level may be overridden
+const (
+	ComponentRest    = "rest"    // RouterOS REST API requests
+	ComponentScp     = "scp"     // file transfers from the devices
+	ComponentStorage = "storage" // storage backends, caches and indexes
+	ComponentNotify  = "notify"  // notifications
+)
+
 var Log *logrus.Logger
 
-func Setup(logLevel string) {
+// componentLogs share output, formatter and hooks of Log, differ in level only
+var componentLogs map[string]*logrus.Logger
+
+type loggerKey struct{}
+
+// Setup creates the Log, componentLevels override the level of the components' entries, e.g. scp: debug
+func Setup(logLevel string, componentLevels map[string]string) {
 	Log = logrus.New()
 	level, err := logrus.ParseLevel(strings.ToLower(logLevel))
 	if err != nil {
@@ -19,4 +35,55 @@ func Setup(logLevel string) {
 	Log.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
+
+	componentLogs = make(map[string]*logrus.Logger, len(componentLevels))
+	for component, componentLevel := range componentLevels {
+		switch component {
+		case ComponentRest, ComponentScp, ComponentStorage, ComponentNotify:
+		default:
+			Log.Warnf("Unknown log component in config: %s, must be one of: %s, %s, %s, %s", component, ComponentRest, ComponentScp, ComponentStorage, ComponentNotify)
+			continue
+		}
+		l, err := logrus.ParseLevel(strings.ToLower(componentLevel))
+		if err != nil {
+			Log.Warnf("Invalid Log level of %s in config: %s. Using '%s'.", component, componentLevel, level)
+			continue
+		}
+		componentLog := logrus.New()
+		componentLog.SetOutput(Log.Out)
+		componentLog.SetFormatter(Log.Formatter)
+		componentLog.ReplaceHooks(Log.Hooks) // the same map, hooks added later apply too
+		componentLog.SetLevel(l)
+		componentLogs[component] = componentLog
+	}
+}
+
+// SetOutput redirects Log and the component logs, e.g. while the progress view is drawn
+func SetOutput(out io.Writer) {
+	Log.SetOutput(out)
+	for _, l := range componentLogs {
+		l.SetOutput(out)
+	}
+}
+
+// WithLogger returns ctx carrying the log entry, e.g. with fields of the device backed up
+func WithLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// Logger returns the log entry carried by ctx, entry of the global Log if none
+func Logger(ctx context.Context) *logrus.Entry {
+	if log, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return log
+	}
+	return logrus.NewEntry(Log)
+}
+
+// ComponentLogger returns the log entry carried by ctx, logged at the level of the component if overridden
+func ComponentLogger(ctx context.Context, component string) *logrus.Entry {
+	log := Logger(ctx)
+	if l, ok := componentLogs[component]; ok {
+		return logrus.NewEntry(l).WithFields(log.Data)
+	}
+	return log
 }
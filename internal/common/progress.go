@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// phases of the device backup reported to the progress view
+const (
+	PhaseWaiting         = "waiting" // for the backup window, splay or free concurrency slot
+	PhaseHooks           = "hooks"   // pre or post hooks
+	PhaseExport          = "export"  // identity, facts and export download
+	PhaseChangeDetection = "change detection"
+	PhaseBackup          = "backup" // binary backup and its download
+	PhaseUpload          = "upload"
+	PhaseExtraFiles      = "extra files"
+)
+
+type progressKey struct{}
+
+// DeviceProgress is the live state of the device backup shown by the progress view, safe for concurrent use.
+// Methods of nil progress are no-ops, so the backup doesn't care whether the view is shown
+type DeviceProgress struct {
+	mu       sync.Mutex
+	identity string
+	phase    string
+	bytes    int64 // downloaded from the device and stored
+	started  time.Time
+	finished time.Time
+}
+
+// ProgressSnapshot is the state of the device backup at the time of the call
+type ProgressSnapshot struct {
+	Identity string
+	Phase    string // status of the device once finished
+	Bytes    int64
+	Elapsed  time.Duration // 0 until started
+	Finished bool
+}
+
+func NewDeviceProgress() *DeviceProgress {
+	return &DeviceProgress{phase: PhaseWaiting}
+}
+
+// WithProgress returns ctx whose backup reports to the progress, nil progress is ignored
+func WithProgress(ctx context.Context, p *DeviceProgress) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// Progress returns progress carried by ctx, nil if none
+func Progress(ctx context.Context) *DeviceProgress {
+	p, _ := ctx.Value(progressKey{}).(*DeviceProgress)
+	return p
+}
+
+// Start starts the elapsed time of the backup
+func (p *DeviceProgress) Start() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = time.Now()
+}
+
+func (p *DeviceProgress) SetPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+}
+
+func (p *DeviceProgress) SetIdentity(identity string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.identity = identity
+}
+
+func (p *DeviceProgress) AddBytes(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes += n
+}
+
+// Finish stops the elapsed time, the status replaces the phase
+func (p *DeviceProgress) Finish(status string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = status
+	p.finished = time.Now()
+}
+
+func (p *DeviceProgress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := ProgressSnapshot{Identity: p.identity, Phase: p.phase, Bytes: p.bytes, Finished: !p.finished.IsZero()}
+	switch {
+	case p.started.IsZero():
+	case s.Finished:
+		s.Elapsed = p.finished.Sub(p.started)
+	default:
+		s.Elapsed = time.Since(p.started)
+	}
+	return s
+}
+
+// ProgressReader returns reader counting the bytes read into the progress of ctx, r itself without progress
+func ProgressReader(ctx context.Context, r io.Reader) io.Reader {
+	p := Progress(ctx)
+	if p == nil {
+		return r
+	}
+	return &progressReader{reader: r, progress: p}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *DeviceProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.progress.AddBytes(int64(n))
+	return n, err
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const sentryFlushTimeout = 5 * time.Second
+
+type SentryConfig struct {
+	Dsn         string `mapstructure:"dsn"`         // project DSN (or TT_SENTRY_DSN), if empty - errors are not reported
+	Environment string `mapstructure:"environment"` // e.g. production
+}
+
+// SetupSentry initializes reporting of panics and backup failures, the returned func sends the pending events
+func SetupSentry(cfg SentryConfig) (func(), error) {
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.Dsn,
+		Environment: cfg.Environment,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry configuration: %w", err)
+	}
+	return func() {
+		sentry.Flush(sentryFlushTimeout)
+	}, nil
+}
+
+// CapturePanic reports the panic of the goroutine and panics again, must be deferred directly, no-op without SetupSentry
+func CapturePanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if hub := sentry.CurrentHub(); hub.Client() != nil {
+		hub.Recover(r)
+		sentry.Flush(sentryFlushTimeout)
+	}
+	panic(r)
+}
+
+// CaptureFailure reports the failure, fields of the ctx log entry (run_id, host, device) and the tags are attached as tags, no-op without SetupSentry
+func CaptureFailure(ctx context.Context, message string, tags map[string]string) {
+	hub := sentry.CurrentHub()
+	if hub.Client() == nil {
+		return
+	}
+	hub = hub.Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		for k, v := range Logger(ctx).Data {
+			scope.SetTag(k, fmt.Sprint(v))
+		}
+		scope.SetTags(tags)
+		scope.SetLevel(sentry.LevelError)
+		hub.CaptureMessage(message)
+	})
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	syslogWriteTimeout = 5 * time.Second
+	// structured data ID of the entry fields, 32473 is the enterprise number reserved for documentation (RFC 5612)
+	syslogFieldsId = "fields@32473"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+type SyslogConfig struct {
+	Network  string `mapstructure:"network"`  // udp, tcp or unix (datagram), if empty - disabled
+	Address  string `mapstructure:"address"`  // host:port, or socket path for unix, e.g. /dev/log
+	Facility string `mapstructure:"facility"` // default daemon
+	AppName  string `mapstructure:"appName"`  // default tiktocker
+}
+
+// SyslogHook sends the log entries as RFC 5424 messages, fields of the entry (e.g. host, device) are the structured data
+type SyslogHook struct {
+	cfg      SyslogConfig
+	facility int
+	hostname string
+	pid      int
+
+	mu   sync.Mutex
+	conn net.Conn // nil - reconnected on the next entry
+}
+
+// AddSyslogHook sends the Log entries also to syslog
+func AddSyslogHook(cfg SyslogConfig) error {
+	if cfg.Network != "udp" && cfg.Network != "tcp" && cfg.Network != "unix" {
+		return fmt.Errorf("invalid log.syslog.network: %s, must be udp, tcp or unix", cfg.Network)
+	}
+	if cfg.Facility == "" {
+		cfg.Facility = "daemon"
+	}
+	facility, ok := syslogFacilities[strings.ToLower(cfg.Facility)]
+	if !ok {
+		return fmt.Errorf("invalid log.syslog.facility: %s", cfg.Facility)
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = "tiktocker"
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	h := &SyslogHook{cfg: cfg, facility: facility, hostname: hostname, pid: os.Getpid()}
+	if err := h.connect(); err != nil {
+		return fmt.Errorf("syslog %s connection failure: %w", cfg.Address, err)
+	}
+	Log.AddHook(h)
+	return nil
+}
+
+func (h *SyslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *SyslogHook) Fire(entry *logrus.Entry) error {
+	message := h.format(entry)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// stream connection may be closed by the server meanwhile, retried once with a new one
+	for attempt := 0; attempt < 2; attempt++ {
+		if h.conn == nil {
+			if err := h.connect(); err != nil {
+				return err
+			}
+		}
+		_ = h.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err := h.conn.Write(message); err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+	}
+	return fmt.Errorf("syslog %s write failure", h.cfg.Address)
+}
+
+func (h *SyslogHook) connect() error {
+	network := h.cfg.Network
+	if network == "unix" {
+		network = "unixgram"
+	}
+	conn, err := net.DialTimeout(network, h.cfg.Address, syslogWriteTimeout)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+// format renders the RFC 5424 message, framed with the octet count over TCP (RFC 6587)
+func (h *SyslogHook) format(entry *logrus.Entry) []byte {
+	priority := h.facility*8 + syslogSeverity(entry.Level)
+	message := fmt.Sprintf("<%d>1 %s %s %s %d - %s %s", priority, entry.Time.Format(time.RFC3339Nano), h.hostname, h.cfg.AppName, h.pid,
+		structuredData(entry.Data), entry.Message)
+	if h.cfg.Network == "tcp" {
+		return []byte(fmt.Sprintf("%d %s", len(message), message))
+	}
+	return []byte(message)
+}
+
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 // emergency
+	case logrus.FatalLevel:
+		return 2 // critical
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7 // debug
+	}
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func structuredData(fields logrus.Fields) string {
+	if len(fields) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("[" + syslogFieldsId)
+	for _, name := range names {
+		fmt.Fprintf(&b, ` %s="%s"`, name, sdEscaper.Replace(fmt.Sprint(fields[name])))
+	}
+	b.WriteString("]")
+	return b.String()
+}
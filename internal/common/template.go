@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// PrefixData is available in the storage prefix templates, metadata entries are additionally exposed with capitalized key, e.g. metadata `site` as {{.Site}}
+type PrefixData map[string]interface{}
+
+func NewPrefixData(identity string, host string, metadata map[string]string) PrefixData {
+	data := PrefixData{}
+	for k, v := range metadata {
+		if k == "" {
+			continue
+		}
+		r := []rune(k)
+		r[0] = unicode.ToUpper(r[0])
+		data[string(r)] = v
+	}
+	data["Identity"] = identity
+	data["Host"] = host
+	data["Metadata"] = metadata
+	return data
+}
+
+func ParsePrefixTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("prefix").Option("missingkey=error").Parse(text)
+}
+
+// RenderPrefix renders the per-device storage prefix, the result is relative to the configured bucket prefix or directory
+func RenderPrefix(t *template.Template, data PrefixData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render storage prefix: %w", err)
+	}
+	prefix := strings.Trim(path.Clean("/"+buf.String()), "/")
+	for _, segment := range strings.Split(buf.String(), "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("storage prefix must not contain '..': %s", buf.String())
+		}
+	}
+	return prefix, nil
+}
+
+// MetadataData is available in the metadata value templates, e.g. {{.RouterOSVersion}} or {{.Date}}
+type MetadataData struct {
+	DeviceFacts
+	Identity string
+	Host     string
+	Date     string // of the export, 2006-01-02 UTC
+}
+
+func NewMetadataData(identity string, host string, facts *DeviceFacts) MetadataData {
+	data := MetadataData{Identity: identity, Host: host}
+	if facts != nil {
+		data.DeviceFacts = *facts
+	}
+	exportedAt := data.ExportedAt
+	if exportedAt.IsZero() {
+		exportedAt = time.Now()
+	}
+	data.Date = exportedAt.UTC().Format(time.DateOnly)
+	return data
+}
+
+// ParseMetadataTemplates splits the metadata into the static entries and templates of the values containing {{
+func ParseMetadataTemplates(metadata map[string]string) (map[string]string, map[string]*template.Template, error) {
+	static := make(map[string]string, len(metadata))
+	templates := make(map[string]*template.Template)
+	for k, v := range metadata {
+		if !strings.Contains(v, "{{") {
+			static[k] = v
+			continue
+		}
+		t, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid metadata %s template: %w", k, err)
+		}
+		templates[k] = t
+	}
+	return static, templates, nil
+}
+
+// RenderMetadata returns the static metadata with the rendered templates, once the device facts are known
+func RenderMetadata(static map[string]string, templates map[string]*template.Template, data MetadataData) (map[string]string, error) {
+	if len(templates) == 0 {
+		return static, nil
+	}
+	metadata := make(map[string]string, len(static)+len(templates))
+	for k, v := range static {
+		metadata[k] = v
+	}
+	for k, t := range templates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render metadata %s: %w", k, err)
+		}
+		metadata[k] = buf.String()
+	}
+	return metadata, nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+const maxThrottleBurst = 256 * 1024 // max bytes read at once
+
+type uploadLimitersKey struct{}
+
+// NewRateLimiter returns limiter of bytesPerSecond, nil if unlimited (0)
+func NewRateLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// burst of at most one second of transfer, so even small files respect the limit
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxThrottleBurst)))
+}
+
+// WithUploadLimiter returns context whose uploads are additionally limited by the limiter (e.g. global and per-device), nil limiter is ignored
+func WithUploadLimiter(ctx context.Context, limiter *rate.Limiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	limiters := append(uploadLimiters(ctx), limiter)
+	return context.WithValue(ctx, uploadLimitersKey{}, limiters)
+}
+
+func uploadLimiters(ctx context.Context) []*rate.Limiter {
+	limiters, _ := ctx.Value(uploadLimitersKey{}).([]*rate.Limiter)
+	return append([]*rate.Limiter(nil), limiters...)
+}
+
+// OpenUpload opens the file for upload, reads are throttled by the limiters of the context
+func (f *BackupFile) OpenUpload(ctx context.Context) (io.ReadCloser, error) {
+	file, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	limiters := uploadLimiters(ctx)
+	if len(limiters) == 0 {
+		return file, nil // keeps io.Seeker, which uploaders use to avoid buffering
+	}
+	return &throttledReader{ctx: ctx, file: file, limiters: limiters}, nil
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	file     io.ReadCloser
+	limiters []*rate.Limiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	for _, l := range r.limiters {
+		if len(p) > l.Burst() {
+			p = p[:l.Burst()]
+		}
+	}
+	n, err := r.file.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.file.Close()
+}
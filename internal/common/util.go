@@ -1,13 +1,23 @@
 package common
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
+	"io"
 	"net/url"
+	"os"
 )
 
+// NewResultChannel returns channel for a single pending request at a time, it is never closed:
+// the request goroutine may still send after WaitForResult gave up (context done) and must neither block nor panic
+func NewResultChannel() chan *RequestResult {
+	return make(chan *RequestResult, 1)
+}
+
 func WaitForResult(ctx context.Context, ch <-chan *RequestResult) *RequestResult {
 	select {
 	case v, ok := <-ch:
@@ -37,3 +47,77 @@ func ComputeSha256(contents []byte) string {
 	sum := sha256.Sum256(contents)
 	return base64.StdEncoding.EncodeToString(sum[:])
 }
+
+// SpoolWriter streams contents into a temporary file while computing both checksums, so the contents are never fully kept in memory
+type SpoolWriter struct {
+	file           *os.File
+	size           int64
+	sha            hash.Hash
+	shaWithoutLine hash.Hash
+	firstLineSeen  bool
+}
+
+func NewSpoolWriter() (*SpoolWriter, error) {
+	f, err := os.CreateTemp("", "tiktocker-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return &SpoolWriter{file: f, sha: sha256.New(), shaWithoutLine: sha256.New()}, nil
+}
+
+func (w *SpoolWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	if err != nil {
+		return n, err
+	}
+	w.size += int64(n)
+	w.sha.Write(p)
+
+	if w.firstLineSeen {
+		w.shaWithoutLine.Write(p)
+	} else if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		// Skip date from the first line
+		w.firstLineSeen = true
+		w.shaWithoutLine.Write(p[i+1:])
+	}
+	return n, nil
+}
+
+// Close finalizes the spool file and returns the file description, the caller is responsible for BackupFile.Remove
+func (w *SpoolWriter) Close(name string) (*BackupFile, error) {
+	if err := w.file.Close(); err != nil {
+		_ = os.Remove(w.file.Name())
+		return nil, fmt.Errorf("failed to close spool file: %w", err)
+	}
+	file := &BackupFile{
+		Name:           name,
+		Path:           w.file.Name(),
+		Size:           w.size,
+		ComputedSha256: base64.StdEncoding.EncodeToString(w.sha.Sum(nil)),
+	}
+	if w.firstLineSeen {
+		file.ComputedSha256WithoutFirstLine = base64.StdEncoding.EncodeToString(w.shaWithoutLine.Sum(nil))
+	}
+	return file, nil
+}
+
+// SpoolBytes creates spooled file from in-memory contents, for small generated artifacts
+func SpoolBytes(name string, contents []byte) (*BackupFile, error) {
+	w, err := NewSpoolWriter()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(contents); err != nil {
+		w.Discard()
+		return nil, fmt.Errorf("failed to write spool file: %w", err)
+	}
+	return w.Close(name)
+}
+
+// Discard removes the spool file, used when the transfer failed
+func (w *SpoolWriter) Discard() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+var _ io.Writer = (*SpoolWriter)(nil)
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupWindow restricts when the device may be backed up, ranges are in local time
+type BackupWindow struct {
+	Allow    []TimeRange // the backup runs only within any of them, empty - any time
+	Blackout []TimeRange // the backup never runs within them, takes precedence over Allow
+}
+
+// TimeRange is daily range of time on selected weekdays, range ending before its start (e.g. 22:00-06:00) continues the next day
+type TimeRange struct {
+	Days  [7]bool       // indexed by time.Weekday, the day the range starts
+	Start time.Duration // since midnight
+	End   time.Duration // since midnight, up to 24h
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseBackupWindow parses ranges like "22:00-06:00", "Mon-Fri 01:00-05:00" or "Sat,Sun 00:00-24:00", nil if both are empty
+func ParseBackupWindow(allow []string, blackout []string) (*BackupWindow, error) {
+	if len(allow) == 0 && len(blackout) == 0 {
+		return nil, nil
+	}
+	w := &BackupWindow{}
+	for _, spec := range allow {
+		r, err := ParseTimeRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		w.Allow = append(w.Allow, r)
+	}
+	for _, spec := range blackout {
+		r, err := ParseTimeRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		w.Blackout = append(w.Blackout, r)
+	}
+	if w.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("backup window never opens, blackouts cover all allowed time")
+	}
+	return w, nil
+}
+
+func ParseTimeRange(spec string) (TimeRange, error) {
+	r := TimeRange{}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		for i := range r.Days {
+			r.Days[i] = true
+		}
+	case 2:
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return r, fmt.Errorf("invalid time range: %s, %w", spec, err)
+		}
+		r.Days = days
+	default:
+		return r, fmt.Errorf("invalid time range: %s, must be [days] HH:MM-HH:MM", spec)
+	}
+
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return r, fmt.Errorf("invalid time range: %s, must be [days] HH:MM-HH:MM", spec)
+	}
+	var err error
+	if r.Start, err = parseTimeOfDay(start); err != nil {
+		return r, fmt.Errorf("invalid time range: %s, %w", spec, err)
+	}
+	if r.End, err = parseTimeOfDay(end); err != nil {
+		return r, fmt.Errorf("invalid time range: %s, %w", spec, err)
+	}
+	if r.Start == r.End || r.Start == 24*time.Hour {
+		return r, fmt.Errorf("invalid time range: %s, empty", spec)
+	}
+	return r, nil
+}
+
+// parseDays parses comma separated weekdays or weekday ranges, e.g. Mon-Fri,Sun
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return days, fmt.Errorf("unknown weekday: %s", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return days, fmt.Errorf("unknown weekday: %s", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	h, m, ok := strings.Cut(value, ":")
+	hours, hoursErr := strconv.Atoi(h)
+	minutes, minutesErr := strconv.Atoi(m)
+	if !ok || hoursErr != nil || minutesErr != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s, must be HH:MM", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Contains returns whether t falls within the range
+func (r TimeRange) Contains(t time.Time) bool {
+	sinceMidnight := t.Sub(midnight(t))
+	if r.Start < r.End {
+		return r.Days[t.Weekday()] && sinceMidnight >= r.Start && sinceMidnight < r.End
+	}
+	// crosses midnight, the part after midnight belongs to the previous day
+	return (r.Days[t.Weekday()] && sinceMidnight >= r.Start) || (r.Days[(t.Weekday()+6)%7] && sinceMidnight < r.End)
+}
+
+// Open returns whether the device may be backed up at t
+func (w *BackupWindow) Open(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	for _, r := range w.Blackout {
+		if r.Contains(t) {
+			return false
+		}
+	}
+	if len(w.Allow) == 0 {
+		return true
+	}
+	for _, r := range w.Allow {
+		if r.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns t if the window is open, otherwise the time it opens next (within a week), zero if it never opens
+func (w *BackupWindow) Next(t time.Time) time.Time {
+	if w.Open(t) {
+		return t
+	}
+	// the window may only open when an allowed range starts or a blackout ends, a blackout of the previous day may end today
+	candidates := make([]time.Time, 0)
+	for day := -1; day <= 8; day++ {
+		date := midnight(t).AddDate(0, 0, day)
+		for _, r := range w.Allow {
+			candidates = append(candidates, date.Add(r.Start))
+		}
+		for _, r := range w.Blackout {
+			end := date.Add(r.End)
+			if r.End <= r.Start {
+				end = date.AddDate(0, 0, 1).Add(r.End)
+			}
+			candidates = append(candidates, end)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+	for _, c := range candidates {
+		if c.After(t) && w.Open(c) {
+			return c
+		}
+	}
+	return time.Time{}
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
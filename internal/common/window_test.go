@@ -0,0 +1,183 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// monday is 2026-01-05 00:00 UTC
+var monday = time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+
+func at(day int, clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return monday.AddDate(0, 0, day).Add(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)
+}
+
+func TestParseTimeRange(t *testing.T) {
+	allDays := [7]bool{true, true, true, true, true, true, true}
+	tests := []struct {
+		spec    string
+		want    TimeRange
+		wantErr bool
+	}{
+		{spec: "01:00-05:00", want: TimeRange{Days: allDays, Start: time.Hour, End: 5 * time.Hour}},
+		{spec: "22:00-04:00", want: TimeRange{Days: allDays, Start: 22 * time.Hour, End: 4 * time.Hour}},
+		{spec: "23:30-00:15", want: TimeRange{Days: allDays, Start: 23*time.Hour + 30*time.Minute, End: 15 * time.Minute}},
+		{spec: "00:00-24:00", want: TimeRange{Days: allDays, End: 24 * time.Hour}},
+		{spec: "1:05-2:00", want: TimeRange{Days: allDays, Start: time.Hour + 5*time.Minute, End: 2 * time.Hour}},
+		{spec: "Mon-Fri 22:00-06:00", want: TimeRange{Days: [7]bool{false, true, true, true, true, true, false}, Start: 22 * time.Hour, End: 6 * time.Hour}},
+		{spec: "Sat,Sun 00:00-24:00", want: TimeRange{Days: [7]bool{true, false, false, false, false, false, true}, End: 24 * time.Hour}},
+		{spec: "fri-mon 01:00-02:00", want: TimeRange{Days: [7]bool{true, true, false, false, false, true, true}, Start: time.Hour, End: 2 * time.Hour}},
+		{spec: "Wed 01:00-02:00", want: TimeRange{Days: [7]bool{false, false, false, true, false, false, false}, Start: time.Hour, End: 2 * time.Hour}},
+
+		{spec: "", wantErr: true},
+		{spec: "22:00", wantErr: true},
+		{spec: "22:00-", wantErr: true},
+		{spec: "-04:00", wantErr: true},
+		{spec: "22-04", wantErr: true},
+		{spec: "22:00-04:00x", wantErr: true},
+		{spec: "22:00-04:00:00", wantErr: true},
+		{spec: "25:00-04:00", wantErr: true},
+		{spec: "22:60-23:00", wantErr: true},
+		{spec: "24:01-01:00", wantErr: true},
+		{spec: "-1:00-04:00", wantErr: true},
+		{spec: "22:00-22:00", wantErr: true},
+		{spec: "24:00-01:00", wantErr: true},
+		{spec: "Mon-Fri", wantErr: true},
+		{spec: "Funday 01:00-02:00", wantErr: true},
+		{spec: "Mon-Funday 01:00-02:00", wantErr: true},
+		{spec: "Mon, Fri 01:00-02:00", wantErr: true},
+		{spec: "Mon 01:00-02:00 extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseTimeRange(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseTimeRange(%q) = %+v, want error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTimeRange(%q) unexpected error: %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTimeRange(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeRangeContains(t *testing.T) {
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{spec: "01:00-05:00", t: at(0, "01:00"), want: true},
+		{spec: "01:00-05:00", t: at(0, "04:59"), want: true},
+		{spec: "01:00-05:00", t: at(0, "05:00"), want: false},
+		{spec: "01:00-05:00", t: at(0, "00:59"), want: false},
+
+		{spec: "22:00-04:00", t: at(0, "22:00"), want: true},
+		{spec: "22:00-04:00", t: at(0, "23:59"), want: true},
+		{spec: "22:00-04:00", t: at(1, "00:00"), want: true},
+		{spec: "22:00-04:00", t: at(1, "03:59"), want: true},
+		{spec: "22:00-04:00", t: at(1, "04:00"), want: false},
+		{spec: "22:00-04:00", t: at(0, "21:59"), want: false},
+		{spec: "22:00-04:00", t: at(0, "12:00"), want: false},
+
+		// the part after midnight belongs to the day the range starts
+		{spec: "Fri 22:00-04:00", t: at(4, "23:00"), want: true},
+		{spec: "Fri 22:00-04:00", t: at(5, "02:00"), want: true},
+		{spec: "Fri 22:00-04:00", t: at(4, "02:00"), want: false},
+		{spec: "Fri 22:00-04:00", t: at(5, "23:00"), want: false},
+		{spec: "Sun 22:00-04:00", t: at(7, "01:00"), want: true},
+		{spec: "Mon 22:00-04:00", t: at(0, "01:00"), want: false},
+
+		{spec: "00:00-24:00", t: at(0, "00:00"), want: true},
+		{spec: "00:00-24:00", t: at(0, "23:59"), want: true},
+		{spec: "Sat,Sun 00:00-24:00", t: at(5, "12:00"), want: true},
+		{spec: "Sat,Sun 00:00-24:00", t: at(0, "00:00"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+" "+tt.t.Format("Mon 15:04"), func(t *testing.T) {
+			r, err := ParseTimeRange(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseTimeRange(%q) unexpected error: %v", tt.spec, err)
+			}
+			if got := r.Contains(tt.t); got != tt.want {
+				t.Errorf("%q Contains(%s) = %v, want %v", tt.spec, tt.t.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBackupWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    []string
+		blackout []string
+		nilWant  bool
+		wantErr  bool
+	}{
+		{name: "no ranges", nilWant: true},
+		{name: "allow", allow: []string{"22:00-04:00"}},
+		{name: "blackout", blackout: []string{"Mon-Fri 08:00-18:00"}},
+		{name: "allow and blackout", allow: []string{"22:00-06:00"}, blackout: []string{"Sat 00:00-24:00"}},
+		{name: "invalid allow", allow: []string{"22:00-04:00x"}, wantErr: true},
+		{name: "invalid blackout", allow: []string{"22:00-04:00"}, blackout: []string{"25:00-01:00"}, wantErr: true},
+		{name: "blackout covers the day", blackout: []string{"00:00-24:00"}, wantErr: true},
+		{name: "blackout covers the allowed range", allow: []string{"22:00-04:00"}, blackout: []string{"21:00-05:00"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := ParseBackupWindow(tt.allow, tt.blackout)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseBackupWindow(%q, %q) = %+v, want error", tt.allow, tt.blackout, w)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseBackupWindow(%q, %q) unexpected error: %v", tt.allow, tt.blackout, err)
+			}
+			if (w == nil) != tt.nilWant {
+				t.Errorf("ParseBackupWindow(%q, %q) = %+v, want nil: %v", tt.allow, tt.blackout, w, tt.nilWant)
+			}
+		})
+	}
+}
+
+func TestBackupWindowNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    []string
+		blackout []string
+		t        time.Time
+		want     time.Time
+	}{
+		{name: "open", allow: []string{"22:00-04:00"}, t: at(1, "02:00"), want: at(1, "02:00")},
+		{name: "opens in the evening", allow: []string{"22:00-04:00"}, t: at(0, "12:00"), want: at(0, "22:00")},
+		{name: "opens at the end of the range", allow: []string{"22:00-04:00"}, t: at(1, "04:00"), want: at(1, "22:00")},
+		{name: "blackout across midnight ends the next day", blackout: []string{"22:00-04:00"}, t: at(0, "23:00"), want: at(1, "04:00")},
+		{name: "blackout after midnight", blackout: []string{"22:00-04:00"}, t: at(1, "01:00"), want: at(1, "04:00")},
+		{name: "weekend range", allow: []string{"Sat,Sun 00:00-24:00"}, t: at(2, "12:00"), want: at(5, "00:00")},
+		{name: "range of the previous day continues", allow: []string{"Sun 22:00-04:00"}, t: at(6, "21:00"), want: at(6, "22:00")},
+		{name: "blackout within allowed range", allow: []string{"22:00-04:00"}, blackout: []string{"23:00-01:00"}, t: at(0, "23:30"), want: at(1, "01:00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := ParseBackupWindow(tt.allow, tt.blackout)
+			if err != nil {
+				t.Fatalf("ParseBackupWindow(%q, %q) unexpected error: %v", tt.allow, tt.blackout, err)
+			}
+			if got := w.Next(tt.t); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.t.Format(time.RFC3339), got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package drift
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+const diffContext = 3 // unchanged lines around the changes
+
+// Normalize returns lines of the config export without differences not caused by configuration changes:
+// the timestamp line, line endings, trailing whitespace and line wrapping of long commands
+func Normalize(export []byte) []string {
+	text := strings.ReplaceAll(string(export), "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#") {
+		lines = lines[1:] // # <date> <time> by RouterOS <version>
+	}
+	normalized := make([]string, 0, len(lines))
+	continued := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if continued {
+			line = normalized[len(normalized)-1] + strings.TrimLeft(line, " ")
+			normalized = normalized[:len(normalized)-1]
+		}
+		continued = strings.HasSuffix(line, "\\")
+		if continued {
+			line = strings.TrimSuffix(line, "\\")
+		}
+		normalized = append(normalized, line)
+	}
+	for len(normalized) > 0 && normalized[len(normalized)-1] == "" {
+		normalized = normalized[:len(normalized)-1]
+	}
+	for i, line := range normalized {
+		normalized[i] = line + "\n"
+	}
+	return normalized
+}
+
+// Rules are normalization rules of the export applied on top of Normalize, so changes not worth a backup (e.g. dynamic entries) are not detected
+type Rules struct {
+	StripComments bool     `mapstructure:"stripComments"` // # lines, e.g. # software id = ...
+	Ignore        []string `mapstructure:"ignore"`        // regexes of the ignored lines, matched against the joined commands
+	SortSections  bool     `mapstructure:"sortSections"`  // sections (/ip address, ...) compared regardless of their order, lines within keep their order
+}
+
+// Normalizer normalizes the exports with the rules, nil Normalizer applies Normalize only
+type Normalizer struct {
+	stripComments bool
+	ignore        []*regexp.Regexp
+	sortSections  bool
+}
+
+// NewNormalizer compiles the rules, nil if no rule is set
+func NewNormalizer(rules Rules) (*Normalizer, error) {
+	if !rules.StripComments && len(rules.Ignore) == 0 && !rules.SortSections {
+		return nil, nil
+	}
+	n := &Normalizer{stripComments: rules.StripComments, sortSections: rules.SortSections}
+	for i, expr := range rules.Ignore {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("ignore[%d]: %w", i, err)
+		}
+		n.ignore = append(n.ignore, re)
+	}
+	return n, nil
+}
+
+// Lines returns lines of the export normalized with Normalize and the rules
+func (n *Normalizer) Lines(export []byte) []string {
+	lines := Normalize(export)
+	if n == nil {
+		return lines
+	}
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !n.ignored(strings.TrimSuffix(line, "\n")) {
+			kept = append(kept, line)
+		}
+	}
+	sections := splitSections(kept)
+	if n.sortSections {
+		sort.SliceStable(sections, func(i, j int) bool {
+			return sectionHeader(sections[i]) < sectionHeader(sections[j])
+		})
+	}
+	return slices.Concat(sections...)
+}
+
+func (n *Normalizer) ignored(line string) bool {
+	if n.stripComments && strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return true
+	}
+	for _, re := range n.ignore {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns whether the exports don't differ once normalized
+func (n *Normalizer) Equal(a []byte, b []byte) bool {
+	return slices.Equal(n.Lines(a), n.Lines(b))
+}
+
+// Unified returns unified diff of the normalized exports, empty if they don't differ
+func (n *Normalizer) Unified(stored []byte, storedName string, current []byte, currentName string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        n.Lines(stored),
+		B:        n.Lines(current),
+		FromFile: storedName,
+		ToFile:   currentName,
+		Context:  diffContext,
+	})
+}
+
+// Change summarizes differences of two exports
+type Change struct {
+	Added    int      // lines of the current export not in the previous one
+	Removed  int      // lines of the previous export not in the current one
+	Sections []string // headers of the changed sections in order of the changes, e.g. /ip address
+}
+
+// Empty returns whether the exports don't differ
+func (c *Change) Empty() bool {
+	return c.Added == 0 && c.Removed == 0
+}
+
+// Summarize returns the changes of the normalized exports
+func (n *Normalizer) Summarize(previous []byte, current []byte) Change {
+	a, b := n.Lines(previous), n.Lines(current)
+	aHeaders, bHeaders := lineHeaders(a), lineHeaders(b)
+	c := Change{Sections: make([]string, 0)}
+	seen := make(map[string]bool)
+	changed := func(header string) {
+		if header != "" && !seen[header] {
+			seen[header] = true
+			c.Sections = append(c.Sections, header)
+		}
+	}
+	for _, op := range difflib.NewMatcher(a, b).GetOpCodes() {
+		if op.Tag == 'e' {
+			continue
+		}
+		c.Removed += op.I2 - op.I1
+		c.Added += op.J2 - op.J1
+		for i := op.I1; i < op.I2; i++ {
+			changed(aHeaders[i])
+		}
+		for j := op.J1; j < op.J2; j++ {
+			changed(bHeaders[j])
+		}
+	}
+	return c
+}
+
+// lineHeaders returns the header of the section every line belongs to, empty for lines before the first header
+func lineHeaders(lines []string) []string {
+	headers := make([]string, len(lines))
+	header := ""
+	for i, line := range lines {
+		if strings.HasPrefix(line, "/") {
+			header = strings.TrimSuffix(line, "\n")
+		}
+		headers[i] = header
+	}
+	return headers
+}
+
+// splitSections returns the lines split at the section headers (/ip address), sections left with the header only (their lines ignored) are dropped
+func splitSections(lines []string) [][]string {
+	sections := make([][]string, 0)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "/") || len(sections) == 0 {
+			sections = append(sections, nil)
+		}
+		sections[len(sections)-1] = append(sections[len(sections)-1], line)
+	}
+	return slices.DeleteFunc(sections, func(section []string) bool {
+		return len(section) == 1 && sectionHeader(section) != ""
+	})
+}
+
+// sectionHeader returns the header line of the section, empty for lines before the first header
+func sectionHeader(section []string) string {
+	if !strings.HasPrefix(section[0], "/") {
+		return ""
+	}
+	return section[0]
+}
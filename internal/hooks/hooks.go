@@ -0,0 +1,166 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"tiktocker/internal/common"
+	"time"
+)
+
+const (
+	Pre  = "pre"
+	Post = "post"
+
+	defaultTimeout = 30 * time.Second
+	outputLimit    = 512 // bytes of the failed command output kept in the error
+)
+
+var envKeyReplacer = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// Event is the device backup the hook is executed for: environment of the commands, JSON body of the webhooks
+type Event struct {
+	Hook       string            `json:"hook"` // pre or post
+	RunId      string            `json:"runId"`
+	Host       string            `json:"host"`
+	Identity   string            `json:"identity,omitempty"`   // post only, empty if the device failed before the export
+	Status     string            `json:"status,omitempty"`     // post only
+	Error      string            `json:"error,omitempty"`      // post only
+	DurationMs int64             `json:"durationMs,omitempty"` // post only
+	Artifacts  []string          `json:"artifacts,omitempty"`  // keys of the artifacts stored in the run, post only
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// Env returns the event as TIKTOCKER_ variables, metadata entries as TIKTOCKER_METADATA_<KEY>, e.g. TIKTOCKER_METADATA_SITE
+func (e *Event) Env() []string {
+	env := []string{
+		"TIKTOCKER_HOOK=" + e.Hook,
+		"TIKTOCKER_RUN_ID=" + e.RunId,
+		"TIKTOCKER_HOST=" + e.Host,
+	}
+	if e.Hook == Post {
+		env = append(env,
+			"TIKTOCKER_IDENTITY="+e.Identity,
+			"TIKTOCKER_STATUS="+e.Status,
+			"TIKTOCKER_ERROR="+e.Error,
+			"TIKTOCKER_DURATION_MS="+strconv.FormatInt(e.DurationMs, 10),
+			"TIKTOCKER_ARTIFACTS="+strings.Join(e.Artifacts, " "),
+		)
+	}
+	for k, v := range e.Metadata {
+		env = append(env, "TIKTOCKER_METADATA_"+envKeyReplacer.ReplaceAllString(strings.ToUpper(k), "_")+"="+v)
+	}
+	return env
+}
+
+// Validate checks the hooks of the setting, e.g. hooks.pre
+func Validate(hooks []common.HookConfig, setting string) error {
+	for i, h := range hooks {
+		switch {
+		case len(h.Command) > 0 && h.Url != "":
+			return fmt.Errorf("%s[%d]: command and url are exclusive", setting, i)
+		case len(h.Command) > 0:
+		case h.Url != "":
+			if u, err := url.Parse(h.Url); err != nil || u.Host == "" {
+				return fmt.Errorf("%s[%d]: invalid url: %s", setting, i, h.Url)
+			}
+		default:
+			return fmt.Errorf("%s[%d]: command or url is required", setting, i)
+		}
+	}
+	return nil
+}
+
+// Run executes the hooks in order, stops at the first failure. Hooks are executed even when ctx is done (e.g. after the backup timed out):
+// each of them is limited by its own timeout only
+func Run(ctx context.Context, hooks []common.HookConfig, e *Event) error {
+	log := common.Logger(ctx)
+	for i, h := range hooks {
+		timeout := h.Timeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		hookCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		start := time.Now()
+		var err error
+		if len(h.Command) > 0 {
+			err = runCommand(hookCtx, h.Command, e)
+		} else {
+			err = post(hookCtx, h.Url, h.Headers, e)
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s hook %d (%s) failure: %w", e.Hook, i, describe(h), err)
+		}
+		log.Debugf("%s hook %d (%s) executed in %s", e.Hook, i, describe(h), time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func describe(h common.HookConfig) string {
+	if len(h.Command) > 0 {
+		return h.Command[0]
+	}
+	u, _ := url.Parse(h.Url)
+	return u.Host
+}
+
+func runCommand(ctx context.Context, command []string, e *Event) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), e.Env()...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out: %w", err)
+	}
+	if detail := strings.TrimSpace(tail(output.String())); detail != "" {
+		return fmt.Errorf("%w: %s", err, detail)
+	}
+	return err
+}
+
+// tail returns the end of the output, the failure cause is usually printed last
+func tail(output string) string {
+	if len(output) <= outputLimit {
+		return output
+	}
+	return output[len(output)-outputLimit:]
+}
+
+func post(ctx context.Context, target string, headers map[string]string, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, outputLimit))
+		return fmt.Errorf("request returned status: %s %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
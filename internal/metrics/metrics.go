@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/report"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	pushTimeout    = 30 * time.Second
+	defaultPushJob = "tiktocker"
+)
+
+// Registry holds tiktocker metrics only, no Go runtime collectors so the textfile stays small, replaced by MetadataLabels
+var Registry *prometheus.Registry
+
+var (
+	deviceDuration     *prometheus.GaugeVec
+	deviceSuccess      *prometheus.GaugeVec
+	phaseDuration      *prometheus.GaugeVec
+	transferBytes      *prometheus.GaugeVec
+	transferThroughput *prometheus.GaugeVec
+
+	metadataLabels []string // device metadata keys added as labels of every device metric
+)
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func init() {
+	register(nil)
+}
+
+// MetadataLabels adds the device metadata entries (e.g. site, role) as labels of every device metric, devices without the entry have it empty.
+// Replaces the recorded metrics, must be called before the first RecordDevice
+func MetadataLabels(keys []string) error {
+	seen := map[string]bool{"host": true, "identity": true, "phase": true, "direction": true}
+	for _, k := range keys {
+		if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid metrics.labels entry: %s, must be valid Prometheus label name", k)
+		}
+		if seen[k] {
+			return fmt.Errorf("invalid metrics.labels entry: %s, duplicate or reserved label", k)
+		}
+		seen[k] = true
+	}
+	register(keys)
+	return nil
+}
+
+func register(keys []string) {
+	metadataLabels = keys
+	names := func(extra ...string) []string {
+		return append(append([]string{"host", "identity"}, keys...), extra...)
+	}
+	deviceDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiktocker_device_duration_seconds",
+		Help: "Duration of the last device backup.",
+	}, names())
+	deviceSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiktocker_device_success",
+		Help: "Whether the last device backup succeeded (1) or failed (0).",
+	}, names())
+	phaseDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiktocker_device_phase_duration_seconds",
+		Help: "Duration of the last device backup phases.",
+	}, names("phase"))
+	transferBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiktocker_device_transfer_bytes",
+		Help: "Bytes transferred during the last device backup, download - from the device, upload - to the storage.",
+	}, names("direction"))
+	transferThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiktocker_device_transfer_throughput_bytes_per_second",
+		Help: "Transfer throughput of the last device backup.",
+	}, names("direction"))
+	// metrics of the same name keep their label names within registry, even unregistered
+	Registry = prometheus.NewRegistry()
+	Registry.MustRegister(deviceDuration, deviceSuccess, phaseDuration, transferBytes, transferThroughput)
+}
+
+// deviceLabels returns labels of the device metrics, with the given label set if not empty
+func deviceLabels(result *report.DeviceResult, name string, value string) prometheus.Labels {
+	labels := prometheus.Labels{"host": result.Host, "identity": result.Identity}
+	for _, k := range metadataLabels {
+		labels[k] = result.Metadata[k]
+	}
+	if name != "" {
+		labels[name] = value
+	}
+	return labels
+}
+
+// RecordDevice updates the device metrics with the backup result, cancelled and skipped devices keep previous values
+func RecordDevice(result *report.DeviceResult) {
+	if result.Status == report.StatusCancelled || result.Status == report.StatusSkipped {
+		return
+	}
+	labels := deviceLabels(result, "", "")
+	deviceDuration.With(labels).Set(result.Duration.Seconds())
+	success := 0.0
+	if result.Status != report.StatusFailed {
+		success = 1
+	}
+	deviceSuccess.With(labels).Set(success)
+
+	t := result.Timings
+	for phase, d := range map[string]float64{
+		"identity": t.Identity.Seconds(),
+		"export":   t.Export.Seconds(),
+		"backup":   t.Backup.Seconds(),
+		"scp":      t.Scp.Seconds(),
+		"upload":   t.Upload.Seconds(),
+	} {
+		phaseDuration.With(deviceLabels(result, "phase", phase)).Set(d)
+	}
+	download := deviceLabels(result, "direction", "download")
+	upload := deviceLabels(result, "direction", "upload")
+	transferBytes.With(download).Set(float64(t.ScpBytes))
+	transferBytes.With(upload).Set(float64(t.UploadBytes))
+	transferThroughput.With(download).Set(common.Throughput(t.ScpBytes, t.Scp))
+	transferThroughput.With(upload).Set(common.Throughput(t.UploadBytes, t.Upload))
+}
+
+// WriteTextfile writes metrics in the node_exporter textfile collector format, the file is replaced atomically
+func WriteTextfile(path string) error {
+	if err := prometheus.WriteToTextfile(path, Registry); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	return nil
+}
+
+// Pushgateway is the Prometheus Pushgateway the metrics of one-shot run are pushed to
+type Pushgateway struct {
+	Url      string
+	Job      string            // default tiktocker
+	Grouping map[string]string // additional grouping labels, e.g. instance
+	Username string            // basic auth, if empty - not used
+	Password string
+}
+
+// Push pushes metrics of the run to the Pushgateway group, metrics of devices not recorded in the run (cancelled, skipped) are not pushed
+func Push(p Pushgateway) error {
+	job := p.Job
+	if job == "" {
+		job = defaultPushJob
+	}
+	pusher := push.New(p.Url, job).
+		Gatherer(Registry).
+		Client(&http.Client{Timeout: pushTimeout})
+	for name, value := range p.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if p.Username != "" {
+		pusher = pusher.BasicAuth(p.Username, p.Password)
+	}
+	if err := pusher.Add(); err != nil {
+		return fmt.Errorf("failed to push metrics to %s: %w", p.Url, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+const (
+	ReasonMissing = "missing"
+	ReasonChanged = "changed"
+)
+
+// Filter selects the mirrored artifacts, empty fields select all
+type Filter struct {
+	Devices []string  // globs of device identities, e.g. core-*
+	Prefix  string    // relative key prefix, e.g. site directory rendered by prefixTemplate
+	Since   time.Time // artifacts stored earlier are skipped
+}
+
+func (f *Filter) matches(o storage.ObjectInfo) bool {
+	if o.LastModified.Before(f.Since) || !strings.HasPrefix(o.Key, f.Prefix) {
+		return false
+	}
+	if len(f.Devices) == 0 {
+		return true
+	}
+	device := storage.DeviceFromFileName(o.Key)
+	for _, pattern := range f.Devices {
+		if matched, _ := path.Match(pattern, device); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy is artifact to be copied, Key is relative to the storage roots
+type Copy struct {
+	Key          string
+	Reason       string
+	Size         int64
+	LastModified time.Time
+}
+
+// Endpoint is the storage with its bucket path prefix (storage.Config.KeyPrefix) stripped from the listed keys
+type Endpoint struct {
+	Store     storage.Storage
+	KeyPrefix string
+}
+
+// Plan returns current artifacts of the source missing in the target or changed since they were copied (size differs or the source is newer), ordered by key
+func Plan(ctx context.Context, source Endpoint, target Endpoint, filter Filter) ([]Copy, error) {
+	sourceObjects, err := latest(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	targetObjects, err := latest(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make([]Copy, 0)
+	for key, o := range sourceObjects {
+		if !storage.Transferable(key) || !filter.matches(o) {
+			continue
+		}
+		c := Copy{Key: key, Size: o.Size, LastModified: o.LastModified}
+		switch existing, ok := targetObjects[key]; {
+		case !ok:
+			c.Reason = ReasonMissing
+		case existing.Size != o.Size || o.LastModified.After(existing.LastModified):
+			c.Reason = ReasonChanged
+		default:
+			continue
+		}
+		copies = append(copies, c)
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].Key < copies[j].Key
+	})
+	return copies, nil
+}
+
+// Execute copies the artifacts with their metadata, returns the stored files by key (e.g. to update the target catalog) also when copying fails midway
+func Execute(ctx context.Context, source Endpoint, target Endpoint, copies []Copy) (map[string]*common.BackupFile, error) {
+	copied := make(map[string]*common.BackupFile, len(copies))
+	for _, c := range copies {
+		file, metadata, err := storage.ReadObject(ctx, source.Store, c.Key)
+		if err != nil {
+			return copied, err
+		}
+		err = storage.WriteObject(ctx, target.Store, c.Key, file, metadata)
+		file.Remove()
+		if err != nil {
+			return copied, err
+		}
+		common.Log.Infof("%s (%s) copied to %s", c.Key, c.Reason, target.Store)
+		copied[c.Key] = file
+	}
+	return copied, nil
+}
+
+// MergeCatalog updates the target catalog with newer device entries of the source catalog pointing to the copied artifacts, no-op if the source has no catalog
+func MergeCatalog(ctx context.Context, source Endpoint, target Endpoint, copied map[string]*common.BackupFile, now time.Time) error {
+	sourceCatalog, err := storage.LoadCatalog(ctx, source.Store)
+	if err != nil {
+		return err
+	}
+	if len(sourceCatalog.Devices) == 0 {
+		return nil
+	}
+	targetCatalog, err := storage.LoadCatalog(ctx, target.Store)
+	if err != nil {
+		return err
+	}
+	targetCatalog.MergeCopied(sourceCatalog, copied)
+	return targetCatalog.Save(ctx, target.Store, now)
+}
+
+// latest lists current objects by relative key
+func latest(ctx context.Context, e Endpoint) (map[string]storage.ObjectInfo, error) {
+	listed, err := e.Store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s listing failure: %w", e.Store, err)
+	}
+	objects := make(map[string]storage.ObjectInfo, len(listed))
+	for _, o := range listed {
+		if o.IsLatest {
+			o.Key = storage.RelativeKey(e.KeyPrefix, o.Key)
+			objects[o.Key] = o
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,141 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EmailTlsStartTls = "starttls" // upgrade the plain connection, usually port 587
+	EmailTlsImplicit = "tls"      // TLS from the start, usually port 465
+	EmailTlsNone     = "none"     // plain connection, e.g. local relay
+)
+
+type EmailConfig struct {
+	Host               string   `mapstructure:"host"` // SMTP server, if empty - disabled
+	Port               int      `mapstructure:"port"` // default 587
+	Tls                string   `mapstructure:"tls"`  // starttls, tls or none, default starttls
+	InsecureSkipVerify bool     `mapstructure:"insecureSkipVerify"`
+	Username           string   `mapstructure:"username"` // PLAIN auth, if empty - no auth
+	Password           string   `mapstructure:"password"`
+	From               string   `mapstructure:"from"`
+	To                 []string `mapstructure:"to"`
+	Filter             `mapstructure:",squash"`
+}
+
+// Email sends events as plain text mail, summaries list every device (success digest)
+type Email struct {
+	cfg EmailConfig
+}
+
+func newEmail(cfg EmailConfig) (*Email, error) {
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	if cfg.Tls == "" {
+		cfg.Tls = EmailTlsStartTls
+	}
+	switch {
+	case cfg.Tls != EmailTlsStartTls && cfg.Tls != EmailTlsImplicit && cfg.Tls != EmailTlsNone:
+		return nil, fmt.Errorf("email: invalid tls: %s, must be starttls, tls or none", cfg.Tls)
+	case cfg.From == "" || len(cfg.To) == 0:
+		return nil, fmt.Errorf("email: from and to are required")
+	}
+	return &Email{cfg: cfg}, nil
+}
+
+func (m *Email) String() string {
+	return fmt.Sprintf("email %s", m.cfg.Host)
+}
+
+func (m *Email) Notify(ctx context.Context, e *Event) error {
+	client, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return fmt.Errorf("auth failure: %w", err)
+		}
+	}
+	if err := client.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range m.cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.message(e)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// connect dials the server honoring ctx deadline, the connection is upgraded to TLS as configured
+func (m *Email) connect(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host, InsecureSkipVerify: m.cfg.InsecureSkipVerify}
+	var conn net.Conn
+	var err error
+	if m.cfg.Tls == EmailTlsImplicit {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m.cfg.Tls == EmailTlsStartTls {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("starttls failure: %w", err)
+		}
+	}
+	return client, nil
+}
+
+func (m *Email) message(e *Event) []byte {
+	body := e.Text()
+	if e.Kind == EventSummary {
+		lines := make([]string, 0, len(e.Devices))
+		for _, d := range e.Devices {
+			lines = append(lines, fmt.Sprintf("%s: %s", deviceWithMetadata(d), d.Status))
+		}
+		body = strings.Join(lines, "\n") + "\n\n" + body
+	}
+	headers := []string{
+		"From: " + m.cfg.From,
+		"To: " + strings.Join(m.cfg.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", e.Title()),
+		"Date: " + e.Time.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.ReplaceAll(body, "\n", "\r\n") + "\r\n")
+}
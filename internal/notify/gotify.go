@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Gotify priorities from 0 to 10, clients notify loudly from 8
+var gotifyPriorities = map[Severity]int{SeverityInfo: 2, SeverityWarning: 5, SeverityError: 8}
+
+type GotifyConfig struct {
+	Url      string `mapstructure:"url"`      // Gotify server, if empty - disabled
+	Token    string `mapstructure:"token"`    // application token
+	Priority int    `mapstructure:"priority"` // 1-10, 0 - by severity: info 2, warning 5, error 8
+	Filter   `mapstructure:",squash"`
+}
+
+// Gotify sends events as messages of the Gotify application
+type Gotify struct {
+	cfg GotifyConfig
+}
+
+func newGotify(cfg GotifyConfig) (*Gotify, error) {
+	switch {
+	case cfg.Priority < 0 || cfg.Priority > 10:
+		return nil, fmt.Errorf("gotify: invalid priority: %d, must be 1-10", cfg.Priority)
+	case cfg.Token == "":
+		return nil, fmt.Errorf("gotify: token is required")
+	}
+	if u, err := url.Parse(cfg.Url); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("gotify: invalid url: %s", cfg.Url)
+	}
+	cfg.Url = strings.TrimSuffix(cfg.Url, "/")
+	return &Gotify{cfg: cfg}, nil
+}
+
+func (g *Gotify) String() string {
+	u, _ := url.Parse(g.cfg.Url)
+	return fmt.Sprintf("gotify %s", u.Host)
+}
+
+func (g *Gotify) Notify(ctx context.Context, e *Event) error {
+	priority := g.cfg.Priority
+	if priority == 0 {
+		priority = gotifyPriorities[e.Severity]
+	}
+	payload := map[string]interface{}{
+		"title":    e.Title(),
+		"message":  e.Text(),
+		"priority": priority,
+	}
+	return postJSON(ctx, g.cfg.Url+"/message", payload, map[string]string{"X-Gotify-Key": g.cfg.Token})
+}
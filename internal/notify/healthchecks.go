@@ -0,0 +1,47 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type HealthchecksConfig struct {
+	Url string `mapstructure:"url"` // ping URL of the check, e.g. https://hc-ping.com/<uuid>, if empty - disabled
+}
+
+// Healthchecks pings the dead man's switch (Healthchecks.io or compatible) when the run starts and finishes,
+// missed runs are detected by the service when no ping arrives in time
+type Healthchecks struct {
+	url string
+}
+
+func newHealthchecks(cfg HealthchecksConfig) (*Healthchecks, error) {
+	if u, err := url.Parse(cfg.Url); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("healthchecks: invalid url: %s", cfg.Url)
+	}
+	return &Healthchecks{url: strings.TrimSuffix(cfg.Url, "/")}, nil
+}
+
+func (h *Healthchecks) String() string {
+	u, _ := url.Parse(h.url)
+	return fmt.Sprintf("healthchecks %s", u.Host)
+}
+
+// Start signals the run started, the service measures the run duration
+func (h *Healthchecks) Start(ctx context.Context) error {
+	return post(ctx, h.url+"/start", "text/plain", nil, nil)
+}
+
+// Notify signals success of the run summary, failure if any device failed or the run was interrupted, the summary is the ping body
+func (h *Healthchecks) Notify(ctx context.Context, e *Event) error {
+	if e.Kind != EventSummary {
+		return nil
+	}
+	ping := h.url
+	if e.Severity >= SeverityWarning {
+		ping += "/fail"
+	}
+	return post(ctx, ping, "text/plain; charset=utf-8", []byte(e.Title()+"\n\n"+e.Text()), nil)
+}
@@ -0,0 +1,414 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"tiktocker/internal/common"
+	"tiktocker/internal/report"
+	"tiktocker/internal/storage"
+	"time"
+)
+
+// notifications must not hold the backups, every notifier gets at most this long
+const notifyTimeout = 15 * time.Second
+
+type EventKind string
+
+const (
+	EventFailure EventKind = "failure" // device backup failed, sent right away
+	EventSummary EventKind = "summary" // results of the run
+	EventChange  EventKind = "change"  // device config differs from its previous backup, sent right away (Config.ConfigChanges only)
+	EventAudit   EventKind = "audit"   // stored artifacts are corrupted or missing, found by the scheduled audit of the daemon mode
+	EventAnomaly EventKind = "anomaly" // device artifacts are dramatically smaller than the recent ones, stored nevertheless (sizeAnomaly)
+)
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severities = map[string]Severity{"info": SeverityInfo, "warning": SeverityWarning, "error": SeverityError}
+
+func (s Severity) String() string {
+	for name, severity := range severities {
+		if severity == s {
+			return name
+		}
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// ParseSeverity parses info, warning or error, empty - info
+func ParseSeverity(value string) (Severity, error) {
+	if value == "" {
+		return SeverityInfo, nil
+	}
+	s, ok := severities[strings.ToLower(value)]
+	if !ok {
+		return SeverityInfo, fmt.Errorf("invalid severity: %s, must be info, warning or error", value)
+	}
+	return s, nil
+}
+
+// Event is a notification of the device failure or the run results
+type Event struct {
+	Kind        EventKind
+	Severity    Severity
+	RunId       string
+	Time        time.Time
+	Annotations map[string]string
+	Device      *report.DeviceResult      // the failed, changed or anomalous device, EventFailure, EventChange and EventAnomaly only
+	Devices     []*report.DeviceResult    // results of the run, EventSummary only
+	Partial     bool                      // the run was interrupted, EventSummary only
+	Integrity   []storage.IntegrityResult // the failed artifacts, EventAudit only
+}
+
+// NewFailure returns the event of the failed device backup
+func NewFailure(runId string, result *report.DeviceResult, annotations map[string]string) *Event {
+	return &Event{Kind: EventFailure, Severity: SeverityError, RunId: runId, Time: time.Now(), Annotations: annotations, Device: result}
+}
+
+// NewConfigChange returns the event of the device config changed since its previous backup, result.Drift must be set
+func NewConfigChange(runId string, result *report.DeviceResult, annotations map[string]string) *Event {
+	return &Event{Kind: EventChange, Severity: SeverityWarning, RunId: runId, Time: time.Now(), Annotations: annotations, Device: result}
+}
+
+// NewSizeAnomaly returns the event of the device artifacts dramatically smaller than the recent ones, result.SizeAnomalies must be set
+func NewSizeAnomaly(runId string, result *report.DeviceResult, annotations map[string]string) *Event {
+	return &Event{Kind: EventAnomaly, Severity: SeverityWarning, RunId: runId, Time: time.Now(), Annotations: annotations, Device: result}
+}
+
+// NewAudit returns the event of the stored artifacts which failed the integrity audit
+func NewAudit(runId string, failed []storage.IntegrityResult, annotations map[string]string) *Event {
+	return &Event{Kind: EventAudit, Severity: SeverityError, RunId: runId, Time: time.Now(), Annotations: annotations, Integrity: failed}
+}
+
+// NewSummary returns the event of the run results, warning if any device failed or the run was interrupted, error if all devices failed
+func NewSummary(runId string, manifest *report.Manifest) *Event {
+	e := &Event{Kind: EventSummary, Severity: SeverityInfo, RunId: runId, Time: time.Now(), Annotations: manifest.Annotations, Devices: manifest.Results(), Partial: manifest.Partial}
+	counts := e.Counts()
+	switch {
+	case counts[report.StatusFailed] > 0 && counts[report.StatusFailed] == len(e.Devices):
+		e.Severity = SeverityError
+	case counts[report.StatusFailed] > 0 || e.Partial:
+		e.Severity = SeverityWarning
+	}
+	return e
+}
+
+// Counts returns number of devices per status, EventSummary only
+func (e *Event) Counts() map[report.Status]int {
+	counts := make(map[report.Status]int)
+	for _, d := range e.Devices {
+		counts[d.Status]++
+	}
+	return counts
+}
+
+// Title returns single line description of the event
+func (e *Event) Title() string {
+	switch e.Kind {
+	case EventFailure:
+		return fmt.Sprintf("tiktocker: backup of %s failed", deviceName(e.Device))
+	case EventChange:
+		return fmt.Sprintf("tiktocker: config of %s changed", deviceName(e.Device))
+	case EventAnomaly:
+		return fmt.Sprintf("tiktocker: backup of %s is dramatically smaller", deviceName(e.Device))
+	case EventAudit:
+		return fmt.Sprintf("tiktocker: audit found %d corrupted or missing artifacts", len(e.Integrity))
+	}
+	counts := e.Counts()
+	title := fmt.Sprintf("tiktocker: %d changed, %d unchanged, %d skipped, %d failed",
+		counts[report.StatusChanged], counts[report.StatusUnchanged], counts[report.StatusSkipped], counts[report.StatusFailed])
+	if e.Partial {
+		title += fmt.Sprintf(", %d cancelled (interrupted)", counts[report.StatusCancelled])
+	}
+	return title
+}
+
+// Text returns plain text details of the event: errors of the failed devices, changes of the device log or the failed artifacts, and the annotations
+func (e *Event) Text() string {
+	lines := make([]string, 0)
+	switch e.Kind {
+	case EventFailure:
+		lines = append(lines, e.Device.Error)
+	case EventChange:
+		if len(e.Device.Drift.Changes) == 0 {
+			lines = append(lines, "no changes found in the device log")
+		}
+		for _, c := range e.Device.Drift.Changes {
+			lines = append(lines, fmt.Sprintf("%s %s: %s", c.Time, c.By, c.Message))
+		}
+	case EventAnomaly:
+		for _, a := range e.Device.SizeAnomalies {
+			lines = append(lines, fmt.Sprintf("%s: %d bytes, recent median %d bytes", a.Name, a.Size, a.MedianSize))
+		}
+	case EventAudit:
+		for _, r := range e.Integrity {
+			lines = append(lines, fmt.Sprintf("%s: %s %s", r.Key, r.Status, r.Detail))
+		}
+	}
+	if e.Device != nil && len(e.Device.Metadata) > 0 {
+		lines = append(lines, fmt.Sprintf("metadata: %s", metadataText(e.Device.Metadata)))
+	}
+	for _, d := range e.Devices {
+		if d.Status == report.StatusFailed {
+			lines = append(lines, fmt.Sprintf("%s: %s", deviceWithMetadata(d), d.Error))
+		}
+	}
+	for _, k := range sortedKeys(e.Annotations) {
+		lines = append(lines, fmt.Sprintf("%s: %s", k, e.Annotations[k]))
+	}
+	lines = append(lines, fmt.Sprintf("run: %s", e.RunId))
+	return strings.Join(lines, "\n")
+}
+
+// metadataText returns the device metadata as key=value pairs in key order, e.g. role=core site=waw
+func metadataText(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for _, k := range sortedKeys(metadata) {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, metadata[k]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deviceWithMetadata returns the device name followed by its metadata, e.g. router1 (192.168.88.1) [site=waw]
+func deviceWithMetadata(d *report.DeviceResult) string {
+	if len(d.Metadata) == 0 {
+		return deviceName(d)
+	}
+	return fmt.Sprintf("%s [%s]", deviceName(d), metadataText(d.Metadata))
+}
+
+func deviceName(d *report.DeviceResult) string {
+	if d.Identity == "" {
+		return d.Host
+	}
+	return fmt.Sprintf("%s (%s)", d.Identity, d.Host)
+}
+
+// Notifier delivers the event to single destination
+type Notifier interface {
+	Notify(ctx context.Context, e *Event) error
+	String() string
+}
+
+// Filter selects events delivered by the notifier, embedded in the notifier settings
+type Filter struct {
+	Severity string      `mapstructure:"severity"` // minimum severity: info, warning or error, default info
+	Events   []EventKind `mapstructure:"events"`   // failure, summary, change, audit and/or anomaly, default all
+}
+
+type filtered struct {
+	notifier Notifier
+	severity Severity
+	events   map[EventKind]bool // empty - all
+}
+
+func newFiltered(n Notifier, f Filter) (*filtered, error) {
+	severity, err := ParseSeverity(f.Severity)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n, err)
+	}
+	events := make(map[EventKind]bool, len(f.Events))
+	for _, kind := range f.Events {
+		if kind != EventFailure && kind != EventSummary && kind != EventChange && kind != EventAudit && kind != EventAnomaly {
+			return nil, fmt.Errorf("%s: invalid event: %s, must be failure, summary, change, audit or anomaly", n, kind)
+		}
+		events[kind] = true
+	}
+	return &filtered{notifier: n, severity: severity, events: events}, nil
+}
+
+func (f *filtered) accepts(e *Event) bool {
+	return e.Severity >= f.severity && (len(f.events) == 0 || f.events[e.Kind])
+}
+
+// Config holds settings of all notifiers, notifiers without their destination set are disabled
+type Config struct {
+	Slack    SlackConfig     `mapstructure:"slack"`
+	Email    EmailConfig     `mapstructure:"email"`
+	Webhooks []WebhookConfig `mapstructure:"webhooks"`
+	Telegram TelegramConfig  `mapstructure:"telegram"`
+	Ntfy     NtfyConfig      `mapstructure:"ntfy"`
+	Gotify   GotifyConfig    `mapstructure:"gotify"`
+
+	Healthchecks HealthchecksConfig `mapstructure:"healthchecks"`
+
+	ConfigChanges bool `mapstructure:"configChanges"` // send change events, the device log is read for the changes
+}
+
+// Dispatcher sends events to the configured notifiers, nil Dispatcher sends nothing
+type Dispatcher struct {
+	notifiers     []*filtered
+	healthchecks  *Healthchecks // nil - not pinged
+	configChanges bool
+}
+
+// New creates the configured notifiers, nil if none is configured
+func New(cfg *Config) (*Dispatcher, error) {
+	notifiers := make([]Notifier, 0)
+	filters := make([]Filter, 0)
+	if cfg.Slack.WebhookUrl != "" {
+		notifiers = append(notifiers, newSlack(cfg.Slack))
+		filters = append(filters, cfg.Slack.Filter)
+	}
+	if cfg.Email.Host != "" {
+		email, err := newEmail(cfg.Email)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, email)
+		filters = append(filters, cfg.Email.Filter)
+	}
+	if cfg.Telegram.BotToken != "" {
+		telegram, err := newTelegram(cfg.Telegram)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, telegram)
+		filters = append(filters, cfg.Telegram.Filter)
+	}
+	if cfg.Ntfy.Topic != "" {
+		ntfy, err := newNtfy(cfg.Ntfy)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, ntfy)
+		filters = append(filters, cfg.Ntfy.Filter)
+	}
+	if cfg.Gotify.Url != "" {
+		gotify, err := newGotify(cfg.Gotify)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, gotify)
+		filters = append(filters, cfg.Gotify.Filter)
+	}
+	for _, c := range cfg.Webhooks {
+		webhook, err := newWebhook(c)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, webhook)
+		filters = append(filters, c.Filter)
+	}
+	var healthchecks *Healthchecks
+	if cfg.Healthchecks.Url != "" {
+		var err error
+		if healthchecks, err = newHealthchecks(cfg.Healthchecks); err != nil {
+			return nil, err
+		}
+		// pings of all runs, the service alerts on its own
+		notifiers = append(notifiers, healthchecks)
+		filters = append(filters, Filter{Events: []EventKind{EventSummary}})
+	}
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+	d := &Dispatcher{healthchecks: healthchecks, configChanges: cfg.ConfigChanges}
+	for i, n := range notifiers {
+		f, err := newFiltered(n, filters[i])
+		if err != nil {
+			return nil, err
+		}
+		d.notifiers = append(d.notifiers, f)
+	}
+	return d, nil
+}
+
+// Start signals start of the run to the dead man's switch, failures are logged
+func (d *Dispatcher) Start(ctx context.Context) {
+	if d == nil || d.healthchecks == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	if err := d.healthchecks.Start(ctx); err != nil {
+		common.ComponentLogger(ctx, common.ComponentNotify).Errorf("%s start ping failure: %v", d.healthchecks, err)
+	}
+}
+
+// ConfigChanges returns whether change events are sent
+func (d *Dispatcher) ConfigChanges() bool {
+	return d != nil && d.configChanges
+}
+
+// Notify delivers the event to the notifiers accepting it concurrently, failures are logged
+func (d *Dispatcher) Notify(ctx context.Context, e *Event) {
+	if d == nil || (e.Kind == EventChange && !d.configChanges) {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, f := range d.notifiers {
+		if !f.accepts(e) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout) // interrupted runs are still reported
+			defer cancel()
+			if err := f.notifier.Notify(ctx, e); err != nil {
+				common.ComponentLogger(ctx, common.ComponentNotify).Errorf("%s notification failure: %v", f.notifier, err)
+				return
+			}
+			common.ComponentLogger(ctx, common.ComponentNotify).Debugf("%s %s notification sent", f.notifier, e.Kind)
+		}()
+	}
+	wg.Wait()
+}
+
+// postJSON sends the payload, responses other than 2xx are errors
+func postJSON(ctx context.Context, url string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return post(ctx, url, "application/json", body, headers)
+}
+
+func post(ctx context.Context, url string, contentType string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("request returned status: %s %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+func basicAuth(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
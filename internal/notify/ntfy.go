@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const ntfyServer = "https://ntfy.sh"
+
+// ntfy priorities from 1 (min) to 5 (max)
+var ntfyPriorities = map[Severity]int{SeverityInfo: 2, SeverityWarning: 4, SeverityError: 5}
+
+type NtfyConfig struct {
+	Server   string `mapstructure:"server"`   // default https://ntfy.sh
+	Topic    string `mapstructure:"topic"`    // if empty - disabled
+	Priority int    `mapstructure:"priority"` // 1-5, 0 - by severity: info 2, warning 4, error 5
+	Token    string `mapstructure:"token"`    // access token, if empty - username and password are used if set
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Filter   `mapstructure:",squash"`
+}
+
+// Ntfy publishes events to the ntfy topic
+type Ntfy struct {
+	cfg NtfyConfig
+}
+
+func newNtfy(cfg NtfyConfig) (*Ntfy, error) {
+	if cfg.Priority < 0 || cfg.Priority > 5 {
+		return nil, fmt.Errorf("ntfy: invalid priority: %d, must be 1-5", cfg.Priority)
+	}
+	if cfg.Server == "" {
+		cfg.Server = ntfyServer
+	}
+	cfg.Server = strings.TrimSuffix(cfg.Server, "/")
+	return &Ntfy{cfg: cfg}, nil
+}
+
+func (n *Ntfy) String() string {
+	return fmt.Sprintf("ntfy %s", n.cfg.Topic)
+}
+
+func (n *Ntfy) Notify(ctx context.Context, e *Event) error {
+	priority := n.cfg.Priority
+	if priority == 0 {
+		priority = ntfyPriorities[e.Severity]
+	}
+	headers := map[string]string{
+		"Title":    mime.QEncoding.Encode("utf-8", e.Title()),
+		"Priority": strconv.Itoa(priority),
+		"Tags":     e.Severity.String(),
+	}
+	if n.cfg.Token != "" {
+		headers["Authorization"] = "Bearer " + n.cfg.Token
+	} else if n.cfg.Username != "" {
+		headers["Authorization"] = basicAuth(n.cfg.Username, n.cfg.Password)
+	}
+	return post(ctx, n.cfg.Server+"/"+n.cfg.Topic, "text/plain; charset=utf-8", []byte(e.Text()), headers)
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+)
+
+var slackEmoji = map[Severity]string{SeverityInfo: ":white_check_mark:", SeverityWarning: ":warning:", SeverityError: ":rotating_light:"}
+
+type SlackConfig struct {
+	WebhookUrl string `mapstructure:"webhookUrl"` // incoming webhook URL, if empty - disabled
+	Channel    string `mapstructure:"channel"`    // overrides the webhook channel (legacy webhooks only)
+	Filter     `mapstructure:",squash"`
+}
+
+// Slack posts events to the incoming webhook
+type Slack struct {
+	cfg SlackConfig
+}
+
+func newSlack(cfg SlackConfig) *Slack {
+	return &Slack{cfg: cfg}
+}
+
+func (s *Slack) String() string {
+	return "slack"
+}
+
+func (s *Slack) Notify(ctx context.Context, e *Event) error {
+	payload := map[string]string{
+		"text": fmt.Sprintf("%s *%s*\n```%s```", slackEmoji[e.Severity], e.Title(), e.Text()),
+	}
+	if s.cfg.Channel != "" {
+		payload["channel"] = s.cfg.Channel
+	}
+	return postJSON(ctx, s.cfg.WebhookUrl, payload, nil)
+}
@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const telegramApiUrl = "https://api.telegram.org"
+
+type TelegramConfig struct {
+	BotToken string `mapstructure:"botToken"` // if empty - disabled
+	ChatId   string `mapstructure:"chatId"`   // user, group (negative) or @channel
+	ApiUrl   string `mapstructure:"apiUrl"`   // self-hosted Bot API server, default https://api.telegram.org
+	Filter   `mapstructure:",squash"`
+}
+
+// Telegram sends events as bot messages, info events are sent silently
+type Telegram struct {
+	cfg TelegramConfig
+}
+
+func newTelegram(cfg TelegramConfig) (*Telegram, error) {
+	if cfg.ChatId == "" {
+		return nil, fmt.Errorf("telegram: chatId is required")
+	}
+	if cfg.ApiUrl == "" {
+		cfg.ApiUrl = telegramApiUrl
+	}
+	cfg.ApiUrl = strings.TrimSuffix(cfg.ApiUrl, "/")
+	return &Telegram{cfg: cfg}, nil
+}
+
+func (t *Telegram) String() string {
+	return "telegram"
+}
+
+func (t *Telegram) Notify(ctx context.Context, e *Event) error {
+	payload := map[string]interface{}{
+		"chat_id":              t.cfg.ChatId,
+		"text":                 e.Title() + "\n\n" + e.Text(),
+		"disable_notification": e.Severity == SeverityInfo,
+	}
+	err := postJSON(ctx, fmt.Sprintf("%s/bot%s/sendMessage", t.cfg.ApiUrl, t.cfg.BotToken), payload, nil)
+	if err != nil {
+		// the token is part of the URL quoted by the client errors
+		return errors.New(strings.ReplaceAll(err.Error(), t.cfg.BotToken, "***"))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"tiktocker/internal/backup"
+	"tiktocker/internal/report"
+	"time"
+)
+
+// SignatureHeader carries HMAC-SHA256 of the request body keyed with the webhook secret: sha256=<hex>
+const SignatureHeader = "X-Tiktocker-Signature-256"
+
+type WebhookConfig struct {
+	Url     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"` // e.g. Authorization
+	Secret  string            `mapstructure:"secret"`  // signs the body (SignatureHeader), if empty - not signed
+	Filter  `mapstructure:",squash"`
+}
+
+// WebhookPayload is the JSON body posted to the webhooks
+type WebhookPayload struct {
+	Event       EventKind         `json:"event"`
+	Severity    string            `json:"severity"`
+	Title       string            `json:"title"`
+	RunId       string            `json:"runId"`
+	Time        time.Time         `json:"time"`
+	Partial     bool              `json:"partial,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Devices     []WebhookDevice   `json:"devices"`             // the failed or changed device, or results of the run
+	Integrity   []WebhookArtifact `json:"integrity,omitempty"` // the failed artifacts of the audit
+}
+
+type WebhookDevice struct {
+	Host          string            `json:"host"`
+	Identity      string            `json:"identity,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"` // of the device settings, e.g. site
+	Status        report.Status     `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	Artifacts     []report.Artifact `json:"artifacts,omitempty"`
+	DiffAvailable bool              `json:"diffAvailable"` // new config export was stored, it can be compared with the previous one
+	Drift         *report.Drift     `json:"drift,omitempty"`
+
+	SizeAnomalies []report.SizeAnomaly `json:"sizeAnomalies,omitempty"`
+}
+
+// WebhookArtifact is the stored artifact which failed the integrity audit
+type WebhookArtifact struct {
+	Key    string `json:"key"`
+	Device string `json:"device"`
+	Status string `json:"status"` // corrupted, missing or failed
+	Detail string `json:"detail,omitempty"`
+}
+
+// Webhook posts events as WebhookPayload
+type Webhook struct {
+	cfg WebhookConfig
+}
+
+func newWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if u, err := url.Parse(cfg.Url); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("webhook: invalid url: %s", cfg.Url)
+	}
+	return &Webhook{cfg: cfg}, nil
+}
+
+func (w *Webhook) String() string {
+	u, _ := url.Parse(w.cfg.Url)
+	return fmt.Sprintf("webhook %s", u.Host)
+}
+
+func (w *Webhook) Notify(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(NewWebhookPayload(e))
+	if err != nil {
+		return err
+	}
+	headers := make(map[string]string, len(w.cfg.Headers)+1)
+	for k, v := range w.cfg.Headers {
+		headers[k] = v
+	}
+	if w.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+		mac.Write(body)
+		headers[SignatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return post(ctx, w.cfg.Url, "application/json", body, headers)
+}
+
+func NewWebhookPayload(e *Event) *WebhookPayload {
+	payload := &WebhookPayload{
+		Event:       e.Kind,
+		Severity:    e.Severity.String(),
+		Title:       e.Title(),
+		RunId:       e.RunId,
+		Time:        e.Time.UTC(),
+		Partial:     e.Partial,
+		Annotations: e.Annotations,
+		Devices:     make([]WebhookDevice, 0),
+	}
+	devices := e.Devices
+	if e.Device != nil {
+		devices = []*report.DeviceResult{e.Device}
+	}
+	for _, d := range devices {
+		payload.Devices = append(payload.Devices, WebhookDevice{
+			Host:          d.Host,
+			Identity:      d.Identity,
+			Metadata:      d.Metadata,
+			Status:        d.Status,
+			Error:         d.Error,
+			Artifacts:     d.Artifacts,
+			DiffAvailable: exportStored(d),
+			Drift:         d.Drift,
+			SizeAnomalies: d.SizeAnomalies,
+		})
+	}
+	for _, r := range e.Integrity {
+		payload.Integrity = append(payload.Integrity, WebhookArtifact{Key: r.Key, Device: r.Device, Status: r.Status, Detail: r.Detail})
+	}
+	return payload
+}
+
+// exportStored returns whether the device config export (possibly post-processed) was stored in the run
+func exportStored(d *report.DeviceResult) bool {
+	if d.Identity == "" {
+		return false
+	}
+	for _, a := range d.Artifacts {
+		if strings.HasPrefix(a.Name, backup.ExportFileName(d.Identity)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package postprocess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"tiktocker/internal/common"
+)
+
+// StageConfig declares single post-processing stage, only the settings of the given type are used
+type StageConfig struct {
+	Type  string `mapstructure:"type"`  // gzip, encrypt, sign, rename
+	Match string `mapstructure:"match"` // artifact name glob the stage applies to, e.g. "*.rsc", empty - all artifacts
+
+	Level      int      `mapstructure:"level"`      // gzip: compression level, 0 - default
+	Recipients []string `mapstructure:"recipients"` // encrypt: age recipients (age1...)
+	Passphrase string   `mapstructure:"passphrase"` // encrypt: age passphrase, used when no recipients are given
+	KeyFile    string   `mapstructure:"keyFile"`    // sign: PEM encoded (PKCS #8) ed25519 private key
+	Template   string   `mapstructure:"template"`   // rename: artifact name template, e.g. "{{.Name}}.bin"
+}
+
+// Stage transforms the artifact contents while the contents are streamed through it
+type Stage interface {
+	// Rename returns artifact name after the stage, it must only depend on the given name as the name is also used to look up stored artifacts
+	Rename(name string) (string, error)
+	// Wrap returns writer transforming contents written to it into w, the returned writer must be closed to flush the contents
+	Wrap(w io.Writer) (io.WriteCloser, error)
+}
+
+// sidecarWriter is implemented by stage writers producing additional artifact (e.g. detached signature), available once the writer is closed
+type sidecarWriter interface {
+	Sidecar() (suffix string, contents []byte)
+}
+
+type matchedStage struct {
+	Stage
+	match string
+}
+
+// Pipeline is an ordered chain of stages applied to every artifact before it is stored, safe for concurrent use
+type Pipeline struct {
+	stages []matchedStage
+}
+
+func New(configs []StageConfig) (*Pipeline, error) {
+	p := &Pipeline{}
+	for i, c := range configs {
+		if c.Match != "" {
+			if _, err := path.Match(c.Match, ""); err != nil {
+				return nil, fmt.Errorf("postProcess[%d] invalid match %q: %w", i, c.Match, err)
+			}
+		}
+		stage, err := newStage(&c)
+		if err != nil {
+			return nil, fmt.Errorf("postProcess[%d] (%s): %w", i, c.Type, err)
+		}
+		p.stages = append(p.stages, matchedStage{Stage: stage, match: c.Match})
+	}
+	return p, nil
+}
+
+func newStage(c *StageConfig) (Stage, error) {
+	switch c.Type {
+	case "gzip":
+		return newGzipStage(c.Level)
+	case "encrypt":
+		return newEncryptStage(c.Recipients, c.Passphrase)
+	case "sign":
+		return newSignStage(c.KeyFile)
+	case "rename":
+		return newRenameStage(c.Template)
+	default:
+		return nil, fmt.Errorf("unknown stage type, available: gzip, encrypt, sign, rename")
+	}
+}
+
+// stagesFor returns stages applicable to the artifact along with artifact name after each of them, match is evaluated against the name produced by preceding stages
+func (p *Pipeline) stagesFor(name string) ([]Stage, []string, error) {
+	if p == nil {
+		return nil, nil, nil
+	}
+	stages := make([]Stage, 0, len(p.stages))
+	names := make([]string, 0, len(p.stages))
+	for _, s := range p.stages {
+		if s.match != "" {
+			if ok, _ := path.Match(s.match, name); !ok {
+				continue
+			}
+		}
+		renamed, err := s.Rename(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		name = renamed
+		stages = append(stages, s.Stage)
+		names = append(names, name)
+	}
+	return stages, names, nil
+}
+
+// Name returns the stored artifact name of the downloaded file name
+func (p *Pipeline) Name(name string) (string, error) {
+	_, names, err := p.stagesFor(name)
+	if err != nil || len(names) == 0 {
+		return name, err
+	}
+	return names[len(names)-1], nil
+}
+
+// Apply streams the file through the chain, returns the processed file followed by sidecars produced by stages.
+// The change detection checksum of the original contents is kept, processed contents are usually not stable between runs (e.g. encryption).
+// Returned files are new spool files (caller removes them), the file itself is returned when no stage applies.
+func (p *Pipeline) Apply(file *common.BackupFile) ([]*common.BackupFile, error) {
+	stages, names, err := p.stagesFor(file.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return []*common.BackupFile{file}, nil
+	}
+
+	in, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	spool, err := common.NewSpoolWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	// wrapping from the last stage, so the first stage receives the original contents
+	writers := make([]io.WriteCloser, len(stages))
+	var w io.Writer = spool
+	for i := len(stages) - 1; i >= 0; i-- {
+		if writers[i], err = stages[i].Wrap(w); err != nil {
+			spool.Discard()
+			return nil, fmt.Errorf("%s post-processing failure: %w", file.Name, err)
+		}
+		w = writers[i]
+	}
+	_, err = io.Copy(w, in)
+	for _, sw := range writers {
+		// closing from the first stage, each close flushes into the following stage
+		err = errors.Join(err, sw.Close())
+	}
+	if err != nil {
+		spool.Discard()
+		return nil, fmt.Errorf("%s post-processing failure: %w", file.Name, err)
+	}
+
+	finalName := names[len(names)-1]
+	processed, err := spool.Close(finalName)
+	if err != nil {
+		return nil, err
+	}
+	processed.ComputedSha256WithoutFirstLine = file.ComputedSha256WithoutFirstLine
+	files := []*common.BackupFile{processed}
+
+	for _, sw := range writers {
+		if sc, ok := sw.(sidecarWriter); ok {
+			suffix, contents := sc.Sidecar()
+			sidecar, err := common.SpoolBytes(finalName+suffix, contents)
+			if err != nil {
+				for _, f := range files {
+					f.Remove()
+				}
+				return nil, err
+			}
+			sidecar.ComputedSha256WithoutFirstLine = ""
+			files = append(files, sidecar)
+		}
+	}
+	return files, nil
+}
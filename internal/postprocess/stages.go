@@ -0,0 +1,178 @@
+package postprocess
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+type gzipStage struct {
+	level int
+}
+
+func newGzipStage(level int) (Stage, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level: %d", level)
+	}
+	return &gzipStage{level: level}, nil
+}
+
+func (s *gzipStage) Rename(name string) (string, error) {
+	return name + ".gz", nil
+}
+
+// Wrap returns gzip writer, the header carries neither name nor modification time so identical input gives identical output
+func (s *gzipStage) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, s.level)
+}
+
+// encryptStage encrypts with age (https://age-encryption.org), stored artifacts are decrypted with: age -d -i key.txt
+type encryptStage struct {
+	recipients []age.Recipient
+}
+
+func newEncryptStage(recipients []string, passphrase string) (Stage, error) {
+	s := &encryptStage{}
+	switch {
+	case len(recipients) > 0:
+		parsed, err := age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		s.recipients = parsed
+	case passphrase != "":
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		s.recipients = []age.Recipient{r}
+	default:
+		return nil, errors.New("recipients or passphrase required")
+	}
+	return s, nil
+}
+
+func (s *encryptStage) Rename(name string) (string, error) {
+	return name + ".age", nil
+}
+
+func (s *encryptStage) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, s.recipients...)
+}
+
+// signStage creates detached Ed25519ph (RFC 8032) signature of the contents produced by preceding stages, stored as <name>.sig
+type signStage struct {
+	key ed25519.PrivateKey
+}
+
+func newSignStage(keyFile string) (Stage, error) {
+	if keyFile == "" {
+		return nil, errors.New("keyFile required")
+	}
+	contents, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 private key", keyFile)
+	}
+	return &signStage{key: edKey}, nil
+}
+
+func (s *signStage) Rename(name string) (string, error) {
+	return name, nil
+}
+
+func (s *signStage) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return &signWriter{key: s.key, w: w, digest: sha512.New()}, nil
+}
+
+type signWriter struct {
+	key       ed25519.PrivateKey
+	w         io.Writer
+	digest    hash.Hash
+	signature []byte
+}
+
+func (w *signWriter) Write(p []byte) (int, error) {
+	w.digest.Write(p)
+	return w.w.Write(p)
+}
+
+func (w *signWriter) Close() error {
+	signature, err := w.key.Sign(nil, w.digest.Sum(nil), &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		return fmt.Errorf("signing failure: %w", err)
+	}
+	w.signature = signature
+	return nil
+}
+
+func (w *signWriter) Sidecar() (string, []byte) {
+	return ".sig", []byte(base64.StdEncoding.EncodeToString(w.signature) + "\n")
+}
+
+type renameStage struct {
+	template *template.Template
+}
+
+func newRenameStage(text string) (Stage, error) {
+	if text == "" {
+		return nil, errors.New("template required")
+	}
+	t, err := template.New("rename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &renameStage{template: t}, nil
+}
+
+// Rename renders the template with {{.Name}} being the name produced by preceding stages
+func (s *renameStage) Rename(name string) (string, error) {
+	var out bytes.Buffer
+	if err := s.template.Execute(&out, map[string]string{"Name": name}); err != nil {
+		return "", fmt.Errorf("rename template failure: %w", err)
+	}
+	renamed := out.String()
+	// extra files names contain directories, the name must stay relative to the device prefix
+	if renamed == "" || strings.Contains(renamed, "\\") || path.Clean("/"+renamed) != "/"+renamed {
+		return "", fmt.Errorf("invalid artifact name: %q", renamed)
+	}
+	return renamed, nil
+}
+
+func (s *renameStage) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return nopCloser{w}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
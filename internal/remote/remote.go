@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const remoteTimeout = 30 * time.Second
+
+const (
+	ProviderConsul = "consul"
+	ProviderEtcd   = "etcd"
+)
+
+// Config is the KV store holding the YAML configuration merged over the config files
+type Config struct {
+	Provider string        `mapstructure:"provider"` // consul or etcd, if empty - disabled
+	Endpoint string        `mapstructure:"endpoint"` // e.g. http://127.0.0.1:8500 (Consul) or http://127.0.0.1:2379 (etcd v3)
+	Key      string        `mapstructure:"key"`      // key holding the configuration, e.g. tiktocker/config.yaml
+	Token    string        `mapstructure:"token"`    // Consul ACL token (or CONSUL_HTTP_TOKEN)
+	Watch    time.Duration `mapstructure:"watch"`    // interval the daemon checks the key at and reloads the configuration when it changes, 0 - not watched
+}
+
+func (c *Config) Enabled() bool {
+	return c.Provider != ""
+}
+
+// Fetch returns the configuration stored at the key
+func Fetch(ctx context.Context, cfg Config) ([]byte, error) {
+	if cfg.Endpoint == "" || cfg.Key == "" {
+		return nil, fmt.Errorf("remote.endpoint and remote.key are required by remote.provider %s", cfg.Provider)
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	switch cfg.Provider {
+	case ProviderConsul:
+		return fetchConsul(ctx, endpoint, cfg)
+	case ProviderEtcd:
+		return fetchEtcd(ctx, endpoint, cfg.Key)
+	default:
+		return nil, fmt.Errorf("unknown remote.provider: %s, must be one of: %s, %s", cfg.Provider, ProviderConsul, ProviderEtcd)
+	}
+}
+
+func fetchConsul(ctx context.Context, endpoint string, cfg Config) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/kv/%s?raw", endpoint, strings.TrimPrefix(cfg.Key, "/")), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	return do(req, cfg.Key)
+}
+
+// fetchEtcd reads the key with the JSON gateway of etcd v3 API
+func fetchEtcd(ctx context.Context, endpoint string, key string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	contents, err := do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(contents, &response); err != nil {
+		return nil, fmt.Errorf("invalid etcd response: %w", err)
+	}
+	if len(response.Kvs) == 0 {
+		return nil, fmt.Errorf("key %s not found", key)
+	}
+	return base64.StdEncoding.DecodeString(response.Kvs[0].Value)
+}
+
+func do(req *http.Request, key string) ([]byte, error) {
+	client := &http.Client{Timeout: remoteTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("key %s not found", key)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(contents)))
+	}
+	return contents, nil
+}
@@ -0,0 +1,246 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"tiktocker/internal/common"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusChanged   Status = "changed"
+	StatusUnchanged Status = "unchanged"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled" // device was never scheduled due to interrupt
+	StatusSkipped   Status = "skipped"   // device was backed up within its minInterval
+)
+
+type Artifact struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"` // relative to the storage prefix
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type DeviceResult struct {
+	Host         string     `json:"host"`
+	Identity     string     `json:"identity,omitempty"`
+	Status       Status     `json:"status"`
+	ConfigSha256 string     `json:"configSha256,omitempty"` // change detection checksum of the export (without its timestamp line)
+	Artifacts    []Artifact `json:"artifacts,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Stats        *Stats     `json:"stats,omitempty"` // only with Manifest.IncludeStats
+	Drift        *Drift     `json:"drift,omitempty"` // the export differs from the previous one
+
+	SizeAnomalies []SizeAnomaly `json:"sizeAnomalies,omitempty"` // artifacts dramatically smaller than the recent ones
+
+	Metadata map[string]string `json:"-"` // of the device settings, e.g. site, for metrics labels and notifications
+
+	Duration time.Duration  `json:"-"` // not part of the manifest by default, it must be stable between runs
+	Timings  common.Timings `json:"-"`
+}
+
+// Drift is the change of the device config since its previous backup
+type Drift struct {
+	PreviousSha256 string                `json:"previousSha256"`
+	Changes        []common.ConfigChange `json:"changes,omitempty"` // recent changes of the device log, only with config change notifications
+	Diff           string                `json:"diff,omitempty"`    // key of the stored diff, only with storeDiff
+}
+
+// SizeAnomaly is the artifact dramatically smaller than the recent ones of the device, e.g. truncated transfer or factory reset device
+type SizeAnomaly struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	MedianSize int64  `json:"medianSize"` // of the recent successful runs
+	Stored     bool   `json:"stored"`     // false - blocked, the previous artifact is kept
+}
+
+// Stats is the manifest representation of the device timings
+type Stats struct {
+	DurationMs           int64   `json:"durationMs"`
+	IdentityMs           int64   `json:"identityMs"`
+	ExportMs             int64   `json:"exportMs"`
+	BackupMs             int64   `json:"backupMs"`
+	ScpMs                int64   `json:"scpMs"`
+	UploadMs             int64   `json:"uploadMs"`
+	ScpBytes             int64   `json:"scpBytes"`
+	UploadBytes          int64   `json:"uploadBytes"`
+	ScpBytesPerSecond    float64 `json:"scpBytesPerSecond"`
+	UploadBytesPerSecond float64 `json:"uploadBytesPerSecond"`
+}
+
+func NewStats(duration time.Duration, t common.Timings) *Stats {
+	return &Stats{
+		DurationMs:           duration.Milliseconds(),
+		IdentityMs:           t.Identity.Milliseconds(),
+		ExportMs:             t.Export.Milliseconds(),
+		BackupMs:             t.Backup.Milliseconds(),
+		ScpMs:                t.Scp.Milliseconds(),
+		UploadMs:             t.Upload.Milliseconds(),
+		ScpBytes:             t.ScpBytes,
+		UploadBytes:          t.UploadBytes,
+		ScpBytesPerSecond:    common.Throughput(t.ScpBytes, t.Scp),
+		UploadBytesPerSecond: common.Throughput(t.UploadBytes, t.Upload),
+	}
+}
+
+// TimingSummary returns human readable timings breakdown
+func (d *DeviceResult) TimingSummary() string {
+	t := d.Timings
+	return fmt.Sprintf("total: %s, identity: %s, export: %s, backup: %s, scp: %s (%d bytes, %s), upload: %s (%d bytes, %s)",
+		d.Duration.Round(time.Millisecond), t.Identity.Round(time.Millisecond), t.Export.Round(time.Millisecond), t.Backup.Round(time.Millisecond),
+		t.Scp.Round(time.Millisecond), t.ScpBytes, formatThroughput(common.Throughput(t.ScpBytes, t.Scp)),
+		t.Upload.Round(time.Millisecond), t.UploadBytes, formatThroughput(common.Throughput(t.UploadBytes, t.Upload)))
+}
+
+func formatThroughput(bytesPerSecond float64) string {
+	switch {
+	case bytesPerSecond >= 1<<20:
+		return fmt.Sprintf("%.1f MiB/s", bytesPerSecond/(1<<20))
+	case bytesPerSecond >= 1<<10:
+		return fmt.Sprintf("%.1f KiB/s", bytesPerSecond/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", bytesPerSecond)
+	}
+}
+
+// Manifest collects per-device results of a single run, safe for concurrent use
+type Manifest struct {
+	Partial     bool              `json:"partial"`               // set when the run was interrupted
+	Annotations map[string]string `json:"annotations,omitempty"` // attached to the run by the caller, e.g. change ticket
+	Devices     []*DeviceResult   `json:"devices"`
+
+	IncludeStats bool   `json:"-"` // include per-device timings, the manifest is no longer byte-stable between runs
+	RunId        string `json:"-"` // identifier of the run in the logs
+
+	mu sync.Mutex
+}
+
+func NewManifest() *Manifest {
+	return &Manifest{Devices: make([]*DeviceResult, 0)}
+}
+
+func (m *Manifest) Add(result *DeviceResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Devices = append(m.Devices, result)
+}
+
+// Merge replaces results of the devices present in other manifest (e.g. of single device run), results of other devices are kept
+func (m *Manifest) Merge(other *Manifest) {
+	other.mu.Lock()
+	results := append([]*DeviceResult(nil), other.Devices...)
+	other.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Partial = m.Partial || other.Partial
+	for _, r := range results {
+		replaced := false
+		for i, d := range m.Devices {
+			if d.Host == r.Host {
+				m.Devices[i] = r
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			m.Devices = append(m.Devices, r)
+		}
+	}
+}
+
+// Retain keeps results of the given devices only, e.g. once devices were removed from the config
+func (m *Manifest) Retain(hosts map[string]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.Devices[:0]
+	for _, d := range m.Devices {
+		if hosts[d.Host] {
+			kept = append(kept, d)
+		}
+	}
+	m.Devices = kept
+}
+
+// Counts returns number of devices per status
+func (m *Manifest) Counts() map[Status]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[Status]int)
+	for _, d := range m.Devices {
+		counts[d.Status]++
+	}
+	return counts
+}
+
+// Results returns the device results in the order they were added
+func (m *Manifest) Results() []*DeviceResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*DeviceResult(nil), m.Devices...)
+}
+
+func (m *Manifest) MarkPartial() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Partial = true
+}
+
+// Sort orders devices by host (then identity) and artifacts by name, devices finish in random order so it is required for stable output
+func (m *Manifest) Sort() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.SliceStable(m.Devices, func(i, j int) bool {
+		if m.Devices[i].Host != m.Devices[j].Host {
+			return m.Devices[i].Host < m.Devices[j].Host
+		}
+		return m.Devices[i].Identity < m.Devices[j].Identity
+	})
+	for _, d := range m.Devices {
+		sort.SliceStable(d.Artifacts, func(i, j int) bool {
+			return d.Artifacts[i].Name < d.Artifacts[j].Name
+		})
+	}
+}
+
+// Marshal returns byte-stable JSON representation, identical results always produce identical bytes (unless IncludeStats is set)
+func (m *Manifest) Marshal() ([]byte, error) {
+	m.Sort()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.Devices {
+		d.Stats = nil
+		if m.IncludeStats && d.Status != StatusCancelled {
+			d.Stats = NewStats(d.Duration, d.Timings)
+		}
+	}
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return append(contents, '\n'), nil
+}
+
+// Write stores the manifest as JSON, the file is replaced atomically so an interrupted write never leaves a truncated manifest
+func (m *Manifest) Write(path string) error {
+	contents, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,60 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RunResult is the machine-readable outcome of the run for CI pipelines and wrappers,
+// unlike the manifest it always includes the timings and details of the run, so it is not byte-stable
+type RunResult struct {
+	RunId       string            `json:"runId"`
+	Version     string            `json:"version"`
+	Storage     string            `json:"storage"`
+	StartedAt   time.Time         `json:"startedAt"`
+	FinishedAt  time.Time         `json:"finishedAt"`
+	DryRun      bool              `json:"dryRun,omitempty"`
+	Partial     bool              `json:"partial"`
+	ExitCode    int               `json:"exitCode"`
+	Counts      map[Status]int    `json:"counts"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Devices     []*DeviceResult   `json:"devices"`
+}
+
+// NewRunResult returns the result of the manifest devices with their timings, the manifest is not modified
+func NewRunResult(m *Manifest) *RunResult {
+	m.Sort()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := &RunResult{
+		RunId:       m.RunId,
+		Partial:     m.Partial,
+		Counts:      make(map[Status]int),
+		Annotations: m.Annotations,
+		Devices:     make([]*DeviceResult, 0, len(m.Devices)),
+	}
+	for _, d := range m.Devices {
+		device := *d
+		device.Stats = nil
+		if d.Status != StatusCancelled {
+			device.Stats = NewStats(d.Duration, d.Timings)
+		}
+		r.Devices = append(r.Devices, &device)
+		r.Counts[d.Status]++
+	}
+	return r
+}
+
+// Write writes the result as indented JSON
+func (r *RunResult) Write(w io.Writer) error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run result: %w", err)
+	}
+	if _, err := w.Write(append(contents, '\n')); err != nil {
+		return fmt.Errorf("failed to write run result: %w", err)
+	}
+	return nil
+}
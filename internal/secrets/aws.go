@@ -0,0 +1,135 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+type AwsConfig struct {
+	Region  string `mapstructure:"region"`  // region of ssm: parameters, default of the environment (AWS_REGION), ARNs carry their own
+	Profile string `mapstructure:"profile"` // shared config profile, default of the environment (AWS_PROFILE)
+}
+
+// Aws reads Secrets Manager secrets and SSM parameters, referenced as
+// arn:aws:secretsmanager:<region>:<account>:secret:<name>[#<json key>], arn:aws:ssm:<region>:<account>:parameter/<name> or ssm:<name>.
+// Credentials are of the default chain: environment, shared config, web identity (IRSA), instance or task role
+type Aws struct {
+	cfg aws.Config
+
+	mu      sync.Mutex
+	secrets map[string]string // by secret ARN or parameter name, every secret is read once
+}
+
+func NewAws(ctx context.Context, cfg AwsConfig) (*Aws, error) {
+	options := make([]func(*config.LoadOptions) error, 0)
+	if cfg.Region != "" {
+		options = append(options, config.WithRegion(cfg.Region))
+	}
+	if cfg.Profile != "" {
+		options = append(options, config.WithSharedConfigProfile(cfg.Profile))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	return &Aws{cfg: awsConfig, secrets: make(map[string]string)}, nil
+}
+
+// Resolver returns the resolver of the scheme: arn or ssm
+func (a *Aws) Resolver(scheme string) Resolver {
+	return awsScheme{aws: a, scheme: scheme}
+}
+
+type awsScheme struct {
+	aws    *Aws
+	scheme string
+}
+
+func (s awsScheme) Resolve(ctx context.Context, ref string) (string, error) {
+	if s.scheme == "ssm" {
+		return s.aws.parameter(ctx, ref, s.aws.cfg.Region)
+	}
+	// arn:partition:service:region:account:resource
+	arn := "arn:" + ref
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return "", fmt.Errorf("invalid ARN")
+	}
+	service, region, resource := parts[2], parts[3], parts[5]
+	switch {
+	case service == "secretsmanager":
+		id, key, _ := strings.Cut(arn, "#")
+		return s.aws.secret(ctx, id, key, region)
+	case service == "ssm" && strings.HasPrefix(resource, "parameter/"):
+		return s.aws.parameter(ctx, arn, region)
+	}
+	return "", fmt.Errorf("unsupported ARN, must be of secretsmanager secret or ssm parameter")
+}
+
+// secret returns the secret string, its JSON key if not empty
+func (a *Aws) secret(ctx context.Context, id string, key string, region string) (string, error) {
+	value, err := a.cached(id, func() (string, error) {
+		client := secretsmanager.NewFromConfig(a.cfg, func(o *secretsmanager.Options) {
+			o.Region = region
+		})
+		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+		if err != nil {
+			return "", err
+		}
+		if out.SecretString == nil {
+			return "", fmt.Errorf("binary secrets are not supported")
+		}
+		return *out.SecretString, nil
+	})
+	if err != nil || key == "" {
+		return value, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret is not JSON object, cannot select key %s", key)
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %s", key)
+	}
+	if s, ok := field.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(field), nil
+}
+
+// parameter returns the decrypted value of the parameter, name or ARN
+func (a *Aws) parameter(ctx context.Context, name string, region string) (string, error) {
+	return a.cached(name, func() (string, error) {
+		client := ssm.NewFromConfig(a.cfg, func(o *ssm.Options) {
+			o.Region = region
+		})
+		out, err := client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(out.Parameter.Value), nil
+	})
+}
+
+func (a *Aws) cached(id string, read func() (string, error)) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if value, ok := a.secrets[id]; ok {
+		return value, nil
+	}
+	value, err := read()
+	if err != nil {
+		return "", err
+	}
+	a.secrets[id] = value
+	return value, nil
+}
@@ -0,0 +1,34 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// File resolves file:<path> references, e.g. file:/run/secrets/router-key, the trailing newline is stripped
+type File struct{}
+
+func (File) Resolve(_ context.Context, ref string) (string, error) {
+	contents, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(contents), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("file %s is empty", ref)
+	}
+	return secret, nil
+}
+
+// Env resolves env:<name> references to the environment variable, e.g. env:ROUTER_KEY
+type Env struct{}
+
+func (Env) Resolve(_ context.Context, ref string) (string, error) {
+	secret := os.Getenv(ref)
+	if secret == "" {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return secret, nil
+}
@@ -0,0 +1,36 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Resolver fetches secrets of single reference scheme, e.g. vault
+type Resolver interface {
+	// Resolve returns the secret of the reference without the scheme, e.g. secret/data/routers#password
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// Resolvers are the configured resolvers by their scheme
+type Resolvers map[string]Resolver
+
+// IsReference returns whether the value references secret of the configured scheme, e.g. vault:secret/data/routers#password
+func (r Resolvers) IsReference(value string) bool {
+	scheme, _, ok := strings.Cut(value, ":")
+	_, configured := r[scheme]
+	return ok && configured
+}
+
+// Resolve returns the referenced secret, the value itself if it is no reference
+func (r Resolvers) Resolve(ctx context.Context, value string) (string, error) {
+	if !r.IsReference(value) {
+		return value, nil
+	}
+	scheme, ref, _ := strings.Cut(value, ":")
+	secret, err := r[scheme].Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", value, err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,221 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultTimeout = 30 * time.Second
+	// service account token of the pod, used by the kubernetes auth
+	kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+type VaultConfig struct {
+	Address   string `mapstructure:"address"`   // e.g. https://vault.example.com:8200 (or VAULT_ADDR), if empty - disabled
+	Namespace string `mapstructure:"namespace"` // Vault Enterprise namespace
+	CAFile    string `mapstructure:"caFile"`    // PEM bundle of CAs trusted in addition to the system ones
+
+	Auth struct {
+		Method   string `mapstructure:"method"`   // token (default), approle or kubernetes
+		Mount    string `mapstructure:"mount"`    // path the auth method is enabled at, default approle or kubernetes
+		Token    string `mapstructure:"token"`    // token auth (or VAULT_TOKEN)
+		RoleId   string `mapstructure:"roleId"`   // approle auth
+		SecretId string `mapstructure:"secretId"` // approle auth
+		Role     string `mapstructure:"role"`     // kubernetes auth, the service account token of the pod is used
+	} `mapstructure:"auth"`
+}
+
+// Vault reads fields of the secrets referenced as <path>#<field>, e.g. secret/data/routers#password for KV v2 mounted at secret
+type Vault struct {
+	address   string
+	namespace string
+	token     string
+	client    *http.Client
+
+	mu      sync.Mutex
+	secrets map[string]map[string]interface{} // by path, every secret is read once
+}
+
+// NewVault logs in with the configured auth method
+func NewVault(ctx context.Context, cfg VaultConfig) (*Vault, error) {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("vault.address (or VAULT_ADDR) is required by vault: references")
+	}
+	client := &http.Client{Timeout: vaultTimeout}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault.caFile: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault.caFile: %s", cfg.CAFile)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	v := &Vault{
+		address:   strings.TrimSuffix(cfg.Address, "/"),
+		namespace: cfg.Namespace,
+		client:    client,
+		secrets:   make(map[string]map[string]interface{}),
+	}
+
+	var err error
+	switch cfg.Auth.Method {
+	case "", "token":
+		v.token = cfg.Auth.Token
+		if v.token == "" {
+			v.token = os.Getenv("VAULT_TOKEN")
+		}
+		if v.token == "" {
+			err = fmt.Errorf("vault.auth.token (or VAULT_TOKEN) is required by the token auth")
+		}
+	case "approle":
+		if cfg.Auth.RoleId == "" || cfg.Auth.SecretId == "" {
+			return nil, fmt.Errorf("vault.auth.roleId and vault.auth.secretId are required by the approle auth")
+		}
+		v.token, err = v.login(ctx, mountOrDefault(cfg.Auth.Mount, "approle"), map[string]string{"role_id": cfg.Auth.RoleId, "secret_id": cfg.Auth.SecretId})
+	case "kubernetes":
+		if cfg.Auth.Role == "" {
+			return nil, fmt.Errorf("vault.auth.role is required by the kubernetes auth")
+		}
+		jwt, readErr := os.ReadFile(kubernetesTokenPath)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read service account token: %w", readErr)
+		}
+		v.token, err = v.login(ctx, mountOrDefault(cfg.Auth.Mount, "kubernetes"), map[string]string{"role": cfg.Auth.Role, "jwt": strings.TrimSpace(string(jwt))})
+	default:
+		return nil, fmt.Errorf("invalid vault.auth.method: %s, must be token, approle or kubernetes", cfg.Auth.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func mountOrDefault(mount string, method string) string {
+	if mount == "" {
+		return method
+	}
+	return strings.Trim(mount, "/")
+}
+
+func (v *Vault) String() string {
+	return fmt.Sprintf("vault %s", v.address)
+}
+
+// login returns the client token issued by the auth method
+func (v *Vault) login(ctx context.Context, mount string, credentials map[string]string) (string, error) {
+	body, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Auth *struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.request(ctx, http.MethodPost, "auth/"+mount+"/login", body, &response); err != nil {
+		return "", fmt.Errorf("%s login failure: %w", v, err)
+	}
+	if response.Auth == nil || response.Auth.ClientToken == "" {
+		return "", fmt.Errorf("%s login failure: no client token returned", v)
+	}
+	return response.Auth.ClientToken, nil
+}
+
+// Resolve returns the field of the secret, KV v2 secrets (path with data/ after the mount) are unwrapped
+func (v *Vault) Resolve(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid vault reference, must be vault:<path>#<field>")
+	}
+	data, err := v.secret(ctx, strings.Trim(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("%s secret %s has no field %s", v, path, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func (v *Vault) secret(ctx context.Context, path string) (map[string]interface{}, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if data, ok := v.secrets[path]; ok {
+		return data, nil
+	}
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.request(ctx, http.MethodGet, path, nil, &response); err != nil {
+		return nil, fmt.Errorf("%s failed to read %s: %w", v, path, err)
+	}
+	data := response.Data
+	// KV v2 wraps the secret in data with its metadata alongside
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+	v.secrets[path] = data
+	return data, nil
+}
+
+func (v *Vault) request(ctx context.Context, method string, path string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.address+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errorResponse struct {
+			Errors []string `json:"errors"`
+		}
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(detail, &errorResponse) == nil && len(errorResponse.Errors) > 0 {
+			return fmt.Errorf("status: %s, %s", resp.Status, strings.Join(errorResponse.Errors, ", "))
+		}
+		return fmt.Errorf("status: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
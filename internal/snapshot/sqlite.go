@@ -0,0 +1,200 @@
+package snapshot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+	"tiktocker/internal/storage"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const Name = storage.SnapshotName
+
+// schema of the snapshot, timestamps are RFC3339 (UTC) strings usable with SQLite date functions
+const schema = `
+CREATE TABLE snapshot (created_at TEXT NOT NULL);
+CREATE TABLE devices (
+	host TEXT PRIMARY KEY,
+	config_sha256 TEXT,
+	last_success TEXT,
+	duration_ms INTEGER,
+	export_size INTEGER,
+	backup_size INTEGER
+);
+CREATE TABLE device_durations (
+	host TEXT NOT NULL,
+	seq INTEGER NOT NULL, -- 0 is the oldest recorded run
+	duration_ms INTEGER NOT NULL
+);
+CREATE TABLE catalog (
+	host TEXT NOT NULL,
+	identity TEXT,
+	artifact TEXT NOT NULL, -- export or backup
+	key TEXT NOT NULL,
+	version_id TEXT,
+	sha256 TEXT,
+	size INTEGER,
+	last_modified TEXT,
+	checked_at TEXT
+);
+CREATE TABLE objects (
+	key TEXT NOT NULL,
+	device TEXT,
+	version_id TEXT,
+	is_latest INTEGER NOT NULL,
+	last_modified TEXT,
+	size INTEGER,
+	etag TEXT
+);
+CREATE INDEX objects_device ON objects (device, last_modified);
+`
+
+// Sources of the snapshot, nil sources leave their tables empty
+type Sources struct {
+	State   *state.Store
+	Catalog *storage.Catalog
+	Objects []storage.ObjectInfo // all stored object versions
+}
+
+// Write creates the SQLite database file at path, an existing file is replaced
+func Write(ctx context.Context, path string, src *Sources, now time.Time) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("failed to create sqlite snapshot: %w", err)
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("failed to create sqlite snapshot schema: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO snapshot VALUES (?)", timestamp(now)); err != nil {
+		return err
+	}
+	for _, fill := range []func(context.Context, *sql.Tx, *Sources) error{insertDevices, insertCatalog, insertObjects} {
+		if err := fill(ctx, tx, src); err != nil {
+			return fmt.Errorf("failed to fill sqlite snapshot: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Publish writes the snapshot and stores it at the storage root
+func Publish(ctx context.Context, store storage.Storage, src *Sources, now time.Time) error {
+	dir, err := os.MkdirTemp("", "tiktocker-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, Name)
+	if err := Write(ctx, path, src, now); err != nil {
+		return err
+	}
+
+	file, err := spool(path)
+	if err != nil {
+		return err
+	}
+	defer file.Remove()
+	if err := store.Put(ctx, "", file, nil); err != nil {
+		return fmt.Errorf("%s failed to store %s: %w", store, Name, err)
+	}
+	common.Log.Infof("sqlite snapshot (%d bytes) stored in %s", file.Size, store)
+	return nil
+}
+
+func spool(path string) (*common.BackupFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w, err := common.NewSpoolWriter()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Discard()
+		return nil, err
+	}
+	file, err := w.Close(Name)
+	if err != nil {
+		return nil, err
+	}
+	file.ComputedSha256WithoutFirstLine = "" // binary file, no change detection
+	return file, nil
+}
+
+func insertDevices(ctx context.Context, tx *sql.Tx, src *Sources) error {
+	if src.State == nil {
+		return nil
+	}
+	return src.State.ForEachDevice(func(host string, r *state.DeviceRecord) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO devices VALUES (?, ?, ?, ?, ?, ?)",
+			host, r.ConfigSha256, timestamp(r.LastSuccess), r.Duration.Milliseconds(), r.ExportSize, r.BackupSize)
+		if err != nil {
+			return err
+		}
+		for i, d := range r.RecentDurations {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO device_durations VALUES (?, ?, ?)", host, i, d.Milliseconds()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func insertCatalog(ctx context.Context, tx *sql.Tx, src *Sources) error {
+	if src.Catalog == nil {
+		return nil
+	}
+	for _, d := range src.Catalog.Devices {
+		for artifact, a := range map[string]*storage.CatalogArtifact{"export": d.Export, "backup": d.Backup} {
+			if a == nil {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO catalog VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				d.Host, d.Identity, artifact, a.Key, a.VersionId, a.Sha256, a.Size, timestamp(a.LastModified), timestamp(d.CheckedAt))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func insertObjects(ctx context.Context, tx *sql.Tx, src *Sources) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO objects VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, o := range src.Objects {
+		_, err := stmt.ExecContext(ctx, o.Key, storage.DeviceFromFileName(o.Key), o.VersionId, o.IsLatest, timestamp(o.LastModified), o.Size, o.ETag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func timestamp(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+const (
+	devicesBucket = "devices"
+
+	recentDurationsKept = 10
+	recentSizesKept     = 10
+)
+
+// DeviceRecord is the outcome of the last successful run for the device
+type DeviceRecord struct {
+	ConfigSha256 string        `json:"configSha256"` // export checksum without the first line
+	LastSuccess  time.Time     `json:"lastSuccess"`
+	Duration     time.Duration `json:"duration"`   // duration of the last successful run
+	ExportSize   int64         `json:"exportSize"` // size of the last export
+	BackupSize   int64         `json:"backupSize"` // size of the last stored backup, kept when backup was skipped
+
+	RecentDurations   []time.Duration `json:"recentDurations,omitempty"`   // durations of recent successful runs, oldest first
+	RecentExportSizes []int64         `json:"recentExportSizes,omitempty"` // export sizes of recent successful runs, oldest first
+	RecentBackupSizes []int64         `json:"recentBackupSizes,omitempty"` // sizes of recent backups made, oldest first
+}
+
+// AddDuration records duration of successful run, only the most recent ones are kept
+func (r *DeviceRecord) AddDuration(d time.Duration) {
+	r.Duration = d
+	r.RecentDurations = keepRecent(append(r.RecentDurations, d), recentDurationsKept)
+}
+
+// AddSizes records artifact sizes of successful run, 0 backupSize - no backup was made. Only the most recent ones are kept
+func (r *DeviceRecord) AddSizes(exportSize int64, backupSize int64) {
+	r.ExportSize = exportSize
+	r.RecentExportSizes = keepRecent(append(r.RecentExportSizes, exportSize), recentSizesKept)
+	if backupSize > 0 {
+		r.BackupSize = backupSize
+		r.RecentBackupSizes = keepRecent(append(r.RecentBackupSizes, backupSize), recentSizesKept)
+	}
+}
+
+// MedianExportSize returns median of the recent export sizes, the last size if recorded before the sizes were kept, 0 if not known
+func (r *DeviceRecord) MedianExportSize() int64 {
+	return medianSize(r.RecentExportSizes, r.ExportSize)
+}
+
+// MedianBackupSize returns median of the recent backup sizes, the last size if recorded before the sizes were kept, 0 if not known
+func (r *DeviceRecord) MedianBackupSize() int64 {
+	return medianSize(r.RecentBackupSizes, r.BackupSize)
+}
+
+func medianSize(sizes []int64, last int64) int64 {
+	if len(sizes) == 0 {
+		return last
+	}
+	sorted := slices.Sorted(slices.Values(sizes))
+	return sorted[len(sorted)/2]
+}
+
+func keepRecent[T any](values []T, kept int) []T {
+	if len(values) > kept {
+		return values[len(values)-kept:]
+	}
+	return values
+}
+
+// MaxRecentDuration returns the longest recent run duration and the number of runs it is based on
+func (r *DeviceRecord) MaxRecentDuration() (time.Duration, int) {
+	longest := time.Duration(0)
+	for _, d := range r.RecentDurations {
+		longest = max(longest, d)
+	}
+	return longest, len(r.RecentDurations)
+}
+
+func (s *Store) GetDevice(host string) (*DeviceRecord, bool, error) {
+	var record DeviceRecord
+	found, err := s.Get(devicesBucket, host, &record)
+	return &record, found, err
+}
+
+func (s *Store) PutDevice(host string, record *DeviceRecord) error {
+	return s.Put(devicesBucket, host, record)
+}
+
+// ForEachDevice calls fn for every recorded device in host order
+func (s *Store) ForEachDevice(fn func(host string, record *DeviceRecord) error) error {
+	return s.ForEach(devicesBucket, func(key string, value []byte) error {
+		var record DeviceRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		return fn(key, &record)
+	})
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+
+	"github.com/Backblaze/blazer/b2"
+)
+
+const b2MaxInfoKeys = 10
+
+type B2Config struct {
+	KeyId          string `mapstructure:"keyId"`
+	ApplicationKey string `mapstructure:"applicationKey"`
+	Path           string `mapstructure:"path"`        // bucket/pathPrefix
+	PartSize       int    `mapstructure:"partSize"`    // large file chunk size in bytes
+	Concurrency    int    `mapstructure:"concurrency"` // chunks uploaded in parallel
+	AllowPrune     bool   `mapstructure:"allowPrune"`  // allow destructive operations without --yes-delete
+	Lifecycle      struct {
+		DaysFromUploadingToHiding int `mapstructure:"daysFromUploadingToHiding"`
+		DaysFromHidingToDeleting  int `mapstructure:"daysFromHidingToDeleting"` // previous versions retention
+	} `mapstructure:"lifecycle"`
+}
+
+func init() {
+	Register("b2", newB2Storage)
+}
+
+func newB2Storage(ctx context.Context, cfg *Config, _ *state.Store) (Storage, error) {
+	c := &cfg.B2
+	bucketName, bucketPath, err := splitBucketPath(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b2.NewClient(ctx, c.KeyId, c.ApplicationKey, b2.UserAgent("tiktocker"))
+	if err != nil {
+		return nil, fmt.Errorf("b2 authorization failure: %w", err)
+	}
+	bucket, err := client.Bucket(ctx, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("b2 bucket: %s not accessible: %w", bucketName, err)
+	}
+
+	connector := &B2Connector{
+		Bucket:      bucket,
+		Prefix:      bucketPath,
+		PartSize:    c.PartSize,
+		Concurrency: c.Concurrency,
+		listed:      make(map[string]*b2.Object),
+	}
+	if lc := c.Lifecycle; lc.DaysFromUploadingToHiding > 0 || lc.DaysFromHidingToDeleting > 0 {
+		if err := connector.ApplyLifecycle(ctx, lc.DaysFromUploadingToHiding, lc.DaysFromHidingToDeleting); err != nil {
+			return nil, fmt.Errorf("b2 bucket: %s lifecycle update failure (application key needs writeBuckets capability): %w", bucketName, err)
+		}
+	}
+	return connector, nil
+}
+
+type B2Connector struct {
+	Bucket      *b2.Bucket
+	Prefix      string
+	PartSize    int // large file chunk size in bytes, 0 - client default
+	Concurrency int // chunks uploaded in parallel, 0 - client default
+
+	mu     sync.Mutex
+	listed map[string]*b2.Object // file ID -> object, B2 file versions can be deleted only via listed objects
+}
+
+func (c *B2Connector) String() string {
+	return fmt.Sprintf("b2 bucket: %s", c.Bucket.Name())
+}
+
+func (c *B2Connector) objectName(devicePrefix string, fileName string) string {
+	return path.Join(c.Prefix, devicePrefix, fileName)
+}
+
+// GetChangeHash returns modified sha256 stored in the file info, the same semantics as S3Connector.GetChangeHash
+func (c *B2Connector) GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string {
+	info, err := c.Head(ctx, devicePrefix, fileName)
+	if err != nil {
+		common.ComponentLogger(ctx, common.ComponentStorage).Warnf("%s failed to get %s attributes: %v", c, fileName, err)
+	}
+	return changeHash(info, err)
+}
+
+func (c *B2Connector) Head(ctx context.Context, devicePrefix string, fileName string) (*ObjectInfo, error) {
+	obj := c.Bucket.Object(c.objectName(devicePrefix, fileName))
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if b2.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          obj.Name(),
+		VersionId:    obj.ID(),
+		IsLatest:     true,
+		LastModified: attrs.UploadTimestamp,
+		Size:         attrs.Size,
+		ETag:         attrs.SHA1,
+		Metadata:     attrs.Info,
+	}, nil
+}
+
+func (c *B2Connector) Open(ctx context.Context, devicePrefix string, fileName string) (io.ReadCloser, error) {
+	obj := c.Bucket.Object(c.objectName(devicePrefix, fileName))
+	// the reader reports missing file only once read, checking upfront to return consistent error
+	if _, err := obj.Attrs(ctx); err != nil {
+		if b2.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", obj.Name(), os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return obj.NewReader(ctx), nil
+}
+
+func (c *B2Connector) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error {
+	body, err := file.OpenUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	obj := c.Bucket.Object(c.objectName(devicePrefix, file.Name))
+	w := obj.NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{
+		Info: c.fileInfo(ctx, file, metadata),
+	}))
+	if c.PartSize > 0 {
+		w.ChunkSize = c.PartSize
+	}
+	if c.Concurrency > 0 {
+		w.ConcurrentUploads = c.Concurrency
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	file.VersionId = obj.ID()
+	return nil
+}
+
+// fileInfo builds B2 file info, B2 allows at most 10 entries so the change detection checksums go first and the rest is taken in key order
+func (c *B2Connector) fileInfo(ctx context.Context, file *common.BackupFile, metadata map[string]string) map[string]string {
+	info := make(map[string]string, b2MaxInfoKeys)
+	if file.ComputedSha256WithoutFirstLine != "" {
+		info[common.Sha256WithoutFirstLine] = file.ComputedSha256WithoutFirstLine
+	}
+	if v, ok := metadata[common.BackupSha256]; ok {
+		info[common.BackupSha256] = v
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		if _, reserved := info[k]; !reserved {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if len(info) == b2MaxInfoKeys {
+			common.ComponentLogger(ctx, common.ComponentStorage).Warnf("%s file %s: too many metadata entries, dropped: %s", c, file.Name, strings.Join(keys[i:], ", "))
+			break
+		}
+		info[k] = metadata[k]
+	}
+	return info
+}
+
+// List lists all file versions under the Prefix, B2 returns versions of a file newest first
+func (c *B2Connector) List(ctx context.Context) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	seen := make(map[string]bool)
+	iter := c.Bucket.List(ctx, b2.ListPrefix(strings.TrimSuffix(c.Prefix, "/")+"/"), b2.ListHidden())
+	for iter.Next() {
+		obj := iter.Object()
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Status != b2.Uploaded {
+			seen[obj.Name()] = true // hide marker, older versions are not current
+			continue
+		}
+		c.mu.Lock()
+		c.listed[obj.ID()] = obj
+		c.mu.Unlock()
+		objects = append(objects, ObjectInfo{
+			Key:          obj.Name(),
+			VersionId:    obj.ID(),
+			IsLatest:     !seen[obj.Name()],
+			LastModified: attrs.UploadTimestamp,
+			Size:         attrs.Size,
+			ETag:         attrs.SHA1,
+		})
+		seen[obj.Name()] = true
+	}
+	return objects, iter.Err()
+}
+
+// openVersion returns contents of the file version, only versions returned by List can be read
+func (c *B2Connector) openVersion(ctx context.Context, o ObjectInfo) (io.ReadCloser, error) {
+	c.mu.Lock()
+	obj, ok := c.listed[o.VersionId]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("file %s version %s not listed", o.Key, o.VersionId)
+	}
+	return obj.NewReader(ctx), nil
+}
+
+// versionMetadata returns file info of the file version, only versions returned by List can be read
+func (c *B2Connector) versionMetadata(ctx context.Context, o ObjectInfo) (map[string]string, error) {
+	c.mu.Lock()
+	obj, ok := c.listed[o.VersionId]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("file %s version %s not listed", o.Key, o.VersionId)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return attrs.Info, nil
+}
+
+// Delete permanently removes file versions, only versions returned by List can be deleted
+func (c *B2Connector) Delete(ctx context.Context, objects []ObjectInfo) error {
+	for _, o := range objects {
+		c.mu.Lock()
+		obj, ok := c.listed[o.VersionId]
+		c.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("file %s version %s not listed", o.Key, o.VersionId)
+		}
+		if err := obj.Delete(ctx); err != nil {
+			return fmt.Errorf("failed to delete %s version %s: %w", o.Key, o.VersionId, err)
+		}
+	}
+	return nil
+}
+
+// ApplyLifecycle replaces the bucket lifecycle rules for the Prefix, previous versions of files (backups of older runs) are deleted daysHiddenUntilDeleted after being superseded
+func (c *B2Connector) ApplyLifecycle(ctx context.Context, daysNewUntilHidden int, daysHiddenUntilDeleted int) error {
+	attrs, err := c.Bucket.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimSuffix(c.Prefix, "/") + "/"
+	rules := []b2.LifecycleRule{{
+		Prefix:                 prefix,
+		DaysNewUntilHidden:     daysNewUntilHidden,
+		DaysHiddenUntilDeleted: daysHiddenUntilDeleted,
+	}}
+	for _, r := range attrs.LifecycleRules {
+		if r.Prefix != prefix {
+			rules = append(rules, r)
+		}
+	}
+	return c.Bucket.Update(ctx, &b2.BucketAttrs{LifecycleRules: rules})
+}
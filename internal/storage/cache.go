@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sync"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+	"time"
+)
+
+const checksumCacheBucket = "checksums"
+
+type cachedChecksum struct {
+	Sha256    *string   `json:"sha256"` // nil - object doesn't exist (or has no checksum)
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// ChecksumCache is a read-through cache of the stored change detection checksums, kept in memory and optionally in the state database
+type ChecksumCache struct {
+	Storage
+	scope string // backend, bucket and prefix of the storage, so storages sharing the state database don't share entries
+	ttl   time.Duration
+	state *state.Store // nil - memory only
+
+	mu      sync.Mutex
+	entries map[string]cachedChecksum
+}
+
+func NewChecksumCache(store Storage, scope string, ttl time.Duration, st *state.Store) *ChecksumCache {
+	return &ChecksumCache{
+		Storage: store,
+		scope:   scope,
+		ttl:     ttl,
+		state:   st,
+		entries: make(map[string]cachedChecksum),
+	}
+}
+
+func (c *ChecksumCache) key(devicePrefix string, fileName string) string {
+	return c.scope + "/" + path.Join(devicePrefix, fileName)
+}
+
+func (c *ChecksumCache) GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string {
+	key := c.key(devicePrefix, fileName)
+	if entry, ok := c.lookup(ctx, key); ok {
+		common.ComponentLogger(ctx, common.ComponentStorage).Debugf("checksum cache hit: %s", key)
+		return entry.Sha256
+	}
+
+	sha := c.Storage.GetChangeHash(ctx, devicePrefix, fileName)
+	c.store(ctx, key, cachedChecksum{Sha256: sha, FetchedAt: time.Now()})
+	return sha
+}
+
+// Put refreshes the cached checksum after successful upload, so the next check doesn't need to reach the storage
+func (c *ChecksumCache) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error {
+	if err := c.Storage.Put(ctx, devicePrefix, file, metadata); err != nil {
+		return err
+	}
+	if file.ComputedSha256WithoutFirstLine != "" {
+		sha := file.ComputedSha256WithoutFirstLine
+		c.store(ctx, c.key(devicePrefix, file.Name), cachedChecksum{Sha256: &sha, FetchedAt: time.Now()})
+	}
+	return nil
+}
+
+func (c *ChecksumCache) lookup(ctx context.Context, key string) (cachedChecksum, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if !ok && c.state != nil {
+		found, err := c.state.Get(checksumCacheBucket, key, &entry)
+		if err != nil {
+			common.ComponentLogger(ctx, common.ComponentStorage).Warnf("failed to read cached checksum %s: %v", key, err)
+		}
+		ok = found && err == nil
+	}
+	if !ok || time.Since(entry.FetchedAt) > c.ttl {
+		return cachedChecksum{}, false
+	}
+	return entry, true
+}
+
+func (c *ChecksumCache) store(ctx context.Context, key string, entry cachedChecksum) {
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	if c.state != nil {
+		if err := c.state.Put(checksumCacheBucket, key, entry); err != nil {
+			common.ComponentLogger(ctx, common.ComponentStorage).Warnf("failed to persist cached checksum %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"tiktocker/internal/common"
+	"time"
+)
+
+const (
+	CatalogName  = "index.json"
+	SnapshotName = "catalog.sqlite" // SQLite snapshot of the state and history, see internal/snapshot
+
+	// fleet status badges, see internal/badge
+	BadgeSVGName  = "badge.svg"
+	BadgeJSONName = "badge.json"
+)
+
+// CatalogArtifact points to stored artifact, Key is relative to the catalog location (storage root)
+type CatalogArtifact struct {
+	Key          string    `json:"key"`
+	VersionId    string    `json:"versionId,omitempty"`
+	Sha256       string    `json:"sha256,omitempty"` // empty if the artifact was stored before the catalog was enabled
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type CatalogDevice struct {
+	Host      string           `json:"host"`
+	Identity  string           `json:"identity"`
+	Export    *CatalogArtifact `json:"export,omitempty"`
+	Backup    *CatalogArtifact `json:"backup,omitempty"`
+	CheckedAt time.Time        `json:"checkedAt"` // last successful run, the artifacts are older if the config has not changed
+}
+
+// Catalog is index.json stored at the storage root listing the latest artifacts of every device, safe for concurrent use
+type Catalog struct {
+	UpdatedAt time.Time        `json:"updatedAt"`
+	Devices   []*CatalogDevice `json:"devices"`
+
+	mu sync.Mutex
+}
+
+// LoadCatalog reads the stored catalog, devices not present in the run keep their entries
+func LoadCatalog(ctx context.Context, store Storage) (*Catalog, error) {
+	c := &Catalog{Devices: make([]*CatalogDevice, 0)}
+	r, err := store.Open(ctx, "", CatalogName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("%s failed to read %s: %w", store, CatalogName, err)
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return nil, fmt.Errorf("%s invalid %s: %w", store, CatalogName, err)
+	}
+	return c, nil
+}
+
+func NewCatalogArtifact(devicePrefix string, file *common.BackupFile, now time.Time) *CatalogArtifact {
+	return &CatalogArtifact{
+		Key:          path.Join(devicePrefix, file.Name),
+		VersionId:    file.VersionId,
+		Sha256:       file.ComputedSha256,
+		Size:         file.Size,
+		LastModified: now.UTC(),
+	}
+}
+
+// Get returns a copy of the device entry, nil if not present
+func (c *Catalog) Get(host string) *CatalogDevice {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range c.Devices {
+		if d.Host == host {
+			entry := *d
+			return &entry
+		}
+	}
+	return nil
+}
+
+// Update replaces the device entry
+func (c *Catalog) Update(device *CatalogDevice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, d := range c.Devices {
+		if d.Host == device.Host {
+			c.Devices[i] = device
+			return
+		}
+	}
+	c.Devices = append(c.Devices, device)
+}
+
+// Save stores the catalog with a single upload, readers see either the previous or the new catalog
+func (c *Catalog) Save(ctx context.Context, store Storage, now time.Time) error {
+	c.mu.Lock()
+	c.UpdatedAt = now.UTC()
+	sort.SliceStable(c.Devices, func(i, j int) bool {
+		return c.Devices[i].Host < c.Devices[j].Host
+	})
+	contents, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := common.SpoolBytes(CatalogName, append(contents, '\n'))
+	if err != nil {
+		return err
+	}
+	defer file.Remove()
+	if err := store.Put(ctx, "", file, nil); err != nil {
+		return fmt.Errorf("%s failed to store %s: %w", store, CatalogName, err)
+	}
+	return nil
+}
+
+// MergeCopied takes the device entries of the source catalog which are newer, their artifacts point to the copied object versions (by key).
+// Artifacts which were not copied (e.g. filtered out) are kept from the existing entry
+func (c *Catalog) MergeCopied(source *Catalog, copied map[string]*common.BackupFile) {
+	for _, d := range source.Devices {
+		existing := c.Get(d.Host)
+		if existing != nil && !existing.CheckedAt.Before(d.CheckedAt) {
+			continue
+		}
+		if existing == nil {
+			existing = &CatalogDevice{}
+		}
+		export, backup := copiedArtifact(d.Export, existing.Export, copied), copiedArtifact(d.Backup, existing.Backup, copied)
+		if export == existing.Export && backup == existing.Backup {
+			continue // none of the device artifacts was copied
+		}
+		c.Update(&CatalogDevice{
+			Host:      d.Host,
+			Identity:  d.Identity,
+			Export:    export,
+			Backup:    backup,
+			CheckedAt: d.CheckedAt,
+		})
+	}
+}
+
+func copiedArtifact(source *CatalogArtifact, existing *CatalogArtifact, copied map[string]*common.BackupFile) *CatalogArtifact {
+	if source == nil {
+		return existing
+	}
+	file, ok := copied[source.Key]
+	if !ok {
+		return existing
+	}
+	return &CatalogArtifact{
+		Key:          source.Key,
+		VersionId:    file.VersionId,
+		Sha256:       file.ComputedSha256,
+		Size:         file.Size,
+		LastModified: source.LastModified,
+	}
+}
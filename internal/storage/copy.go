@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"tiktocker/internal/common"
+)
+
+// Transferable returns whether the object is copied into other storage (bundle, sync), generated objects are skipped:
+// the catalog is merged separately, sidecar manifests are recreated from the metadata and latest markers point to versions of the source storage
+func Transferable(key string) bool {
+	switch name := path.Base(key); {
+	case name == CatalogName, name == SnapshotName, name == BadgeSVGName, name == BadgeJSONName:
+		return false
+	case strings.HasSuffix(name, ManifestSuffix), strings.HasSuffix(name, LatestMarkerSuffix):
+		return false
+	}
+	return IsArtifact(key)
+}
+
+// RelativeKey strips the bucket path prefix (Config.KeyPrefix) of the listed key
+func RelativeKey(keyPrefix string, key string) string {
+	if keyPrefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, keyPrefix+"/")
+}
+
+// SplitKey returns devicePrefix and file name of the relative key as passed to the Storage calls, extra files are named <identity>.files/<device path>
+func SplitKey(key string) (string, string) {
+	dirs := strings.Split(key, "/")
+	for i, dir := range dirs[:len(dirs)-1] {
+		if strings.HasSuffix(dir, extraFilesSuffix) && dir != extraFilesSuffix {
+			return path.Join(dirs[:i]...), path.Join(dirs[i:]...)
+		}
+	}
+	dir, name := path.Split(key)
+	return strings.TrimSuffix(dir, "/"), name
+}
+
+// ReadObject spools current contents of the object with its metadata, the caller is responsible for BackupFile.Remove
+func ReadObject(ctx context.Context, store Storage, key string) (*common.BackupFile, map[string]string, error) {
+	devicePrefix, name := SplitKey(key)
+	info, err := store.Head(ctx, devicePrefix, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s failed to get %s metadata: %w", store, key, err)
+	}
+	r, err := store.Open(ctx, devicePrefix, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s failed to read %s: %w", store, key, err)
+	}
+	file, err := spoolObject(store, key, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var metadata map[string]string
+	if info != nil && len(info.Metadata) > 0 {
+		metadata = info.Metadata
+	}
+	return file, metadata, nil
+}
+
+// ReadVersion spools contents of the version listed under the relative key with its metadata, the caller is responsible for BackupFile.Remove
+func ReadVersion(ctx context.Context, store Storage, key string, o ObjectInfo) (*common.BackupFile, map[string]string, error) {
+	if o.IsLatest {
+		return ReadObject(ctx, store, key)
+	}
+	metadata, err := VersionMetadata(ctx, store, key, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := OpenVersion(ctx, store, key, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := spoolObject(store, key, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, metadata, nil
+}
+
+// spoolObject reads the object contents into the spool file and closes r
+func spoolObject(store Storage, key string, r io.ReadCloser) (*common.BackupFile, error) {
+	defer r.Close()
+	spool, err := common.NewSpoolWriter()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(spool, r); err != nil {
+		spool.Discard()
+		return nil, fmt.Errorf("%s failed to read %s: %w", store, key, err)
+	}
+	return spool.Close(path.Base(key))
+}
+
+// WriteObject stores the file read from other storage under the same relative key with the metadata read along
+func WriteObject(ctx context.Context, store Storage, key string, file *common.BackupFile, metadata map[string]string) error {
+	devicePrefix, _ := SplitKey(key)
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		m[k] = v
+	}
+	// change detection checksum of the original contents, the stored contents may be post-processed (compressed, encrypted)
+	file.ComputedSha256WithoutFirstLine = m[common.Sha256WithoutFirstLine]
+	delete(m, common.Sha256WithoutFirstLine)
+	if err := store.Put(ctx, devicePrefix, file, m); err != nil {
+		return fmt.Errorf("%s failed to store %s: %w", store, key, err)
+	}
+	return nil
+}
+
+// versionReader is implemented by the versioned storages
+type versionReader interface {
+	openVersion(ctx context.Context, o ObjectInfo) (io.ReadCloser, error)
+	versionMetadata(ctx context.Context, o ObjectInfo) (map[string]string, error)
+}
+
+// OpenVersion returns contents of the version listed under the relative key, previous versions can be read only from the versioned storages (S3, B2)
+func OpenVersion(ctx context.Context, store Storage, key string, o ObjectInfo) (io.ReadCloser, error) {
+	if o.IsLatest {
+		devicePrefix, name := SplitKey(key)
+		return store.Open(ctx, devicePrefix, name)
+	}
+	if cache, ok := store.(*ChecksumCache); ok {
+		store = cache.Storage
+	}
+	versioned, ok := store.(versionReader)
+	if !ok {
+		return nil, fmt.Errorf("%s is not versioned, only the latest version of %s can be read", store, key)
+	}
+	r, err := versioned.openVersion(ctx, o)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to read %s version %s: %w", store, key, o.VersionId, err)
+	}
+	return r, nil
+}
+
+// VersionMetadata returns metadata recorded with the version listed under the relative key, nil if none
+func VersionMetadata(ctx context.Context, store Storage, key string, o ObjectInfo) (map[string]string, error) {
+	if o.IsLatest {
+		devicePrefix, name := SplitKey(key)
+		info, err := store.Head(ctx, devicePrefix, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s failed to get %s metadata: %w", store, key, err)
+		}
+		if info == nil || len(info.Metadata) == 0 {
+			return nil, nil
+		}
+		return info.Metadata, nil
+	}
+	if cache, ok := store.(*ChecksumCache); ok {
+		store = cache.Storage
+	}
+	versioned, ok := store.(versionReader)
+	if !ok {
+		return nil, fmt.Errorf("%s is not versioned, only the latest version of %s can be read", store, key)
+	}
+	metadata, err := versioned.versionMetadata(ctx, o)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to get %s version %s metadata: %w", store, key, o.VersionId, err)
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return metadata, nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DiffSuffix = ".diff"
+
+	diffTimeLayout = "20060102T150405Z"
+)
+
+// DiffFileName returns name of the unified diff of the device config changed at t: <identity>-<timestamp>.diff, every change is stored under its own name
+func DiffFileName(identity string, t time.Time) string {
+	return fmt.Sprintf("%s-%s%s", identity, t.UTC().Format(diffTimeLayout), DiffSuffix)
+}
+
+// splitDiffName returns the identity of the diff name, the suffix may be followed by extensions added by post-processing (e.g. .diff.gz)
+func splitDiffName(name string) (string, bool) {
+	base, found := strings.CutSuffix(name, DiffSuffix)
+	if !found {
+		i := strings.Index(name, DiffSuffix+".")
+		if i <= 0 {
+			return "", false
+		}
+		base = name[:i]
+	}
+	i := strings.LastIndex(base, "-")
+	if i <= 0 {
+		return "", false
+	}
+	if _, err := time.Parse(diffTimeLayout, base[i+1:]); err != nil {
+		return "", false
+	}
+	return base[:i], true
+}
+
+// diffGroup returns the key shared by the diffs of the device for retention: <dir>/<identity>.diff followed by the post-processing extensions
+func diffGroup(key string) (string, bool) {
+	name := path.Base(key)
+	identity, ok := splitDiffName(name)
+	if !ok {
+		return "", false
+	}
+	return path.Join(path.Dir(key), identity+name[strings.LastIndex(name, DiffSuffix):]), true
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+)
+
+const listingIndexBucket = "index"
+
+type indexEntry struct {
+	ETag   string  `json:"etag"`
+	Sha256 *string `json:"sha256"`
+}
+
+// ListingIndex replaces per-device HEAD requests with a single prefix listing, the checksum (not returned by the listing) is taken from the local index as long as the object ETag didn't change
+type ListingIndex struct {
+	*S3Connector
+	state *state.Store // nil - index kept in memory only
+
+	mu      sync.Mutex
+	listing map[string]string // object key -> ETag
+	entries map[string]indexEntry
+}
+
+func NewListingIndex(s3Client *S3Connector, st *state.Store) *ListingIndex {
+	return &ListingIndex{
+		S3Connector: s3Client,
+		state:       st,
+		entries:     make(map[string]indexEntry),
+	}
+}
+
+// Refresh fetches the prefix listing, must be called at the start of every run before any checksum lookups.
+// Until refreshed or if the listing fails the checksums are read with HEAD requests
+func (i *ListingIndex) Refresh(ctx context.Context) error {
+	listing, err := i.S3Connector.ListObjectETags(ctx)
+	if err != nil {
+		i.mu.Lock()
+		i.listing = nil
+		i.mu.Unlock()
+		return fmt.Errorf("%s listing failure: %w", i.S3Connector, err)
+	}
+	i.mu.Lock()
+	i.listing = listing
+	i.mu.Unlock()
+	common.ComponentLogger(ctx, common.ComponentStorage).Debugf("%s listed %d objects", i.S3Connector, len(listing))
+	return nil
+}
+
+// RefreshIndex refreshes the listing index of the storage, no-op for storages without it
+func RefreshIndex(ctx context.Context, store Storage) error {
+	if cache, ok := store.(*ChecksumCache); ok {
+		store = cache.Storage
+	}
+	if index, ok := store.(*ListingIndex); ok {
+		return index.Refresh(ctx)
+	}
+	return nil
+}
+
+// Put stores the file and indexes its ETag and checksum, so the next lookup doesn't require HEAD request
+func (i *ListingIndex) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error {
+	etag, err := i.S3Connector.upload(ctx, devicePrefix, file, metadata)
+	if err != nil {
+		return err
+	}
+	key := i.S3Connector.ObjectKey(devicePrefix, file.Name)
+	sha := changeMetadata(file, metadata)[common.Sha256WithoutFirstLine]
+	i.mu.Lock()
+	if i.listing != nil {
+		i.listing[key] = etag
+	}
+	i.mu.Unlock()
+	i.store(ctx, key, indexEntry{ETag: etag, Sha256: &sha})
+	return nil
+}
+
+func (i *ListingIndex) GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string {
+	key := i.S3Connector.ObjectKey(devicePrefix, fileName)
+
+	i.mu.Lock()
+	etag, listed := i.listing[key]
+	fresh := i.listing != nil
+	i.mu.Unlock()
+	if !fresh {
+		return i.S3Connector.GetChangeHash(ctx, devicePrefix, fileName)
+	}
+	if !listed {
+		return nil
+	}
+
+	if entry, ok := i.lookup(ctx, key); ok && entry.ETag == etag {
+		common.ComponentLogger(ctx, common.ComponentStorage).Debugf("index hit: %s", key)
+		return entry.Sha256
+	}
+
+	info, err := i.S3Connector.headKey(ctx, key)
+	sha := changeHash(info, err)
+	if info != nil {
+		i.store(ctx, key, indexEntry{ETag: info.ETag, Sha256: sha})
+	}
+	return sha
+}
+
+func (i *ListingIndex) lookup(ctx context.Context, key string) (indexEntry, bool) {
+	i.mu.Lock()
+	entry, ok := i.entries[key]
+	i.mu.Unlock()
+	if ok || i.state == nil {
+		return entry, ok
+	}
+
+	found, err := i.state.Get(listingIndexBucket, i.stateKey(key), &entry)
+	if err != nil {
+		common.ComponentLogger(ctx, common.ComponentStorage).Warnf("failed to read index entry %s: %v", key, err)
+	}
+	return entry, found && err == nil
+}
+
+func (i *ListingIndex) store(ctx context.Context, key string, entry indexEntry) {
+	i.mu.Lock()
+	i.entries[key] = entry
+	i.mu.Unlock()
+
+	if i.state != nil {
+		if err := i.state.Put(listingIndexBucket, i.stateKey(key), entry); err != nil {
+			common.ComponentLogger(ctx, common.ComponentStorage).Warnf("failed to persist index entry %s: %v", key, err)
+		}
+	}
+}
+
+func (i *ListingIndex) stateKey(key string) string {
+	return i.S3Connector.Bucket + "/" + key
+}
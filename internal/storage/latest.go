@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"encoding/json"
+	"tiktocker/internal/common"
+	"time"
+)
+
+const LatestMarkerSuffix = ".latest.json"
+
+type LatestEntry struct {
+	Name      string `json:"name"`
+	VersionId string `json:"versionId,omitempty"` // exact object version, empty for non-versioned storage
+	Sha256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+}
+
+// LatestMarker points to the newest backup and export of the device, both coming from the same run
+type LatestMarker struct {
+	Identity  string       `json:"identity"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	Export    LatestEntry  `json:"export"`
+	Backup    *LatestEntry `json:"backup,omitempty"` // nil - export only run
+}
+
+func NewLatestMarker(identity string, export *common.BackupFile, backup *common.BackupFile, now time.Time) *LatestMarker {
+	entry := func(f *common.BackupFile) LatestEntry {
+		return LatestEntry{Name: f.Name, VersionId: f.VersionId, Sha256: f.ComputedSha256, Size: f.Size}
+	}
+	m := &LatestMarker{
+		Identity:  identity,
+		UpdatedAt: now.UTC(),
+		Export:    entry(export),
+	}
+	if backup != nil {
+		b := entry(backup)
+		m.Backup = &b
+	}
+	return m
+}
+
+// File returns the marker as spooled file ready to be stored next to the artifacts
+func (m *LatestMarker) File() (*common.BackupFile, error) {
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return common.SpoolBytes(m.Identity+LatestMarkerSuffix, append(contents, '\n'))
+}
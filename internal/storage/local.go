@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+)
+
+func init() {
+	Register("local", newLocalStorage)
+}
+
+func newLocalStorage(_ context.Context, cfg *Config, _ *state.Store) (Storage, error) {
+	if cfg.Directory == "" {
+		return nil, fmt.Errorf("local storage requires directory")
+	}
+	return NewSidecarManifests(&LocalStorage{Directory: cfg.Directory}), nil
+}
+
+// LocalStorage keeps the latest files in the directory, it is not versioned
+type LocalStorage struct {
+	Directory string
+}
+
+func (l *LocalStorage) String() string {
+	return fmt.Sprintf("directory: %s", l.Directory)
+}
+
+func (l *LocalStorage) path(devicePrefix string, fileName string) string {
+	return filepath.Join(l.Directory, devicePrefix, fileName)
+}
+
+func (l *LocalStorage) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, _ map[string]string) error {
+	destPath := l.path(devicePrefix, file.Name)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := copyFile(file, destPath); err != nil {
+		return fmt.Errorf("failed to save backup: %w", err)
+	}
+	common.ComponentLogger(ctx, common.ComponentStorage).Infof("backup saved to %s", destPath)
+	return nil
+}
+
+func (l *LocalStorage) Head(_ context.Context, devicePrefix string, fileName string) (*ObjectInfo, error) {
+	fi, err := os.Stat(l.path(devicePrefix, fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          filepath.ToSlash(filepath.Join(devicePrefix, fileName)),
+		IsLatest:     true,
+		LastModified: fi.ModTime(),
+		Size:         fi.Size(),
+	}, nil
+}
+
+// GetChangeHash local files carry no metadata, the change is always assumed unless sidecar manifests are used
+func (l *LocalStorage) GetChangeHash(_ context.Context, _ string, _ string) *string {
+	return nil
+}
+
+func (l *LocalStorage) Open(_ context.Context, devicePrefix string, fileName string) (io.ReadCloser, error) {
+	return os.Open(l.path(devicePrefix, fileName))
+}
+
+func (l *LocalStorage) List(_ context.Context) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	err := filepath.WalkDir(l.Directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == l.Directory {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.Directory, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          filepath.ToSlash(rel),
+			IsLatest:     true,
+			LastModified: fi.ModTime(),
+			Size:         fi.Size(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (l *LocalStorage) Delete(_ context.Context, objects []ObjectInfo) error {
+	for _, o := range objects {
+		if err := os.Remove(filepath.Join(l.Directory, filepath.FromSlash(o.Key))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(file *common.BackupFile, destPath string) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// written next to the destination and renamed, readers never see partially written file
+	tmp := destPath + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, destPath)
+}
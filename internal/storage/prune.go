@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnsafePrune = errors.New("refusing to prune")
+
+	// artifactSuffixes are the only objects tiktocker ever stores, besides the diffs (DiffFileName)
+	artifactSuffixes = []string{".config.rsc", ".backup", LatestMarkerSuffix, ManifestSuffix}
+)
+
+const extraFilesSuffix = ".files" // extra device files are stored under <identity>.files/<device path>
+
+type RetentionPolicy struct {
+	KeepLast int           // number of newest versions of each object that are always kept (the latest version is never removed), the diffs of a device count as one object
+	MaxAge   time.Duration // versions beyond KeepLast are removed only once older than MaxAge, 0 - removed regardless of age
+}
+
+func (p *RetentionPolicy) Enabled() bool {
+	return p.KeepLast > 0 || p.MaxAge > 0
+}
+
+func (p *RetentionPolicy) String() string {
+	if p.MaxAge == 0 {
+		return fmt.Sprintf("retention keepLast: %d", p.KeepLast)
+	}
+	return fmt.Sprintf("retention keepLast: %d, maxAge: %s", p.KeepLast, p.MaxAge)
+}
+
+type PruneCandidate struct {
+	Device string
+	ObjectInfo
+}
+
+// PlanPrune returns object versions which violate the retention policy, grouped by device and ordered by key and age
+func PlanPrune(ctx context.Context, store Storage, policy RetentionPolicy, now time.Time) ([]PruneCandidate, error) {
+	if !policy.Enabled() {
+		return nil, fmt.Errorf("no retention policy configured")
+	}
+	versions, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s listing failure: %w", store, err)
+	}
+
+	byKey := make(map[string][]ObjectInfo)
+	for _, v := range versions {
+		byKey[v.Key] = append(byKey[v.Key], v)
+	}
+	if err := checkPruneSafety(byKey); err != nil {
+		return nil, err
+	}
+
+	// every diff is stored under its own key, the diffs of a device are retained as versions of one object
+	groups := make(map[string][]ObjectInfo, len(byKey))
+	diffGroups := make(map[string]bool)
+	for key, keyVersions := range byKey {
+		group := key
+		if diffs, ok := diffGroup(key); ok {
+			group = diffs
+			diffGroups[group] = true
+		}
+		groups[group] = append(groups[group], keyVersions...)
+	}
+
+	candidates := make([]PruneCandidate, 0)
+	for group, groupVersions := range groups {
+		sort.SliceStable(groupVersions, func(i, j int) bool {
+			return groupVersions[i].LastModified.After(groupVersions[j].LastModified)
+		})
+		for i, v := range groupVersions {
+			// the newest diff of the device is kept as the latest version
+			if (v.IsLatest && !diffGroups[group]) || i < max(policy.KeepLast, 1) {
+				continue
+			}
+			if policy.MaxAge > 0 && now.Sub(v.LastModified) < policy.MaxAge {
+				continue
+			}
+			candidates = append(candidates, PruneCandidate{Device: DeviceFromFileName(v.Key), ObjectInfo: v})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Device != candidates[j].Device {
+			return candidates[i].Device < candidates[j].Device
+		}
+		if candidates[i].Key != candidates[j].Key {
+			return candidates[i].Key < candidates[j].Key
+		}
+		return candidates[i].LastModified.After(candidates[j].LastModified)
+	})
+	return candidates, nil
+}
+
+func ExecutePrune(ctx context.Context, store Storage, candidates []PruneCandidate) error {
+	versions := make([]ObjectInfo, 0, len(candidates))
+	for _, c := range candidates {
+		versions = append(versions, c.ObjectInfo)
+	}
+	if err := store.Delete(ctx, versions); err != nil {
+		return fmt.Errorf("%s prune failure: %w", store, err)
+	}
+	return nil
+}
+
+// checkPruneSafety refuses to prune listings that don't look like tiktocker owned, a misconfigured prefix must not wipe objects of other tenants
+func checkPruneSafety(byKey map[string][]ObjectInfo) error {
+	for key, keyVersions := range byKey {
+		if !IsArtifact(key) {
+			return fmt.Errorf("%w: found object not created by tiktocker: %s, check s3.path", ErrUnsafePrune, key)
+		}
+		hasLatest := false
+		for _, v := range keyVersions {
+			hasLatest = hasLatest || v.IsLatest
+		}
+		if !hasLatest {
+			return fmt.Errorf("%w: object %s has no current version (deleted?), its history won't be pruned", ErrUnsafePrune, key)
+		}
+	}
+	return nil
+}
+
+// IsArtifact returns whether the object could have been stored by tiktocker
+func IsArtifact(key string) bool {
+	if name := path.Base(key); name == CatalogName || name == SnapshotName || name == BadgeSVGName || name == BadgeJSONName {
+		return true
+	}
+	if _, ok := extraFilesDevice(key); ok {
+		return true
+	}
+	_, ok := splitArtifactName(path.Base(key))
+	return ok
+}
+
+// DeviceFromFileName returns Mikrotik identity the artifact belongs to, artifacts are named after the identity
+func DeviceFromFileName(key string) string {
+	if device, ok := extraFilesDevice(key); ok {
+		return device
+	}
+	name := path.Base(key)
+	if device, ok := splitArtifactName(name); ok {
+		return device
+	}
+	return name
+}
+
+// splitArtifactName returns the name part before artifact suffix, the suffix may be followed by extensions added by post-processing (e.g. .config.rsc.gz.age)
+func splitArtifactName(name string) (string, bool) {
+	if device, ok := splitDiffName(name); ok {
+		return device, true
+	}
+	for _, suffix := range artifactSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+		if i := strings.Index(name, suffix+"."); i > 0 {
+			return name[:i], true
+		}
+	}
+	return "", false
+}
+
+// extraFilesDevice returns the identity of the <identity>.files directory the key is stored under
+func extraFilesDevice(key string) (string, bool) {
+	dirs := strings.Split(path.Dir(key), "/")
+	for _, dir := range dirs {
+		if device := strings.TrimSuffix(dir, extraFilesSuffix); device != dir && device != "" {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+// DeviceHistory returns the listed versions of the device artifacts newest first, e.g. to pick a backup to restore
+func DeviceHistory(objects []ObjectInfo, identity string) []ObjectInfo {
+	history := make([]ObjectInfo, 0)
+	for _, o := range objects {
+		if IsArtifact(o.Key) && DeviceFromFileName(o.Key) == identity {
+			history = append(history, o)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].LastModified.After(history[j].LastModified)
+	})
+	return history
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// listedStorage returns the objects from List, the other methods are not used by PlanPrune
+type listedStorage struct {
+	Storage
+	objects []ObjectInfo
+}
+
+func (s *listedStorage) List(context.Context) ([]ObjectInfo, error) {
+	return s.objects, nil
+}
+
+func (s *listedStorage) String() string {
+	return "listed storage"
+}
+
+var pruneNow = time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+
+func daysAgo(days int) time.Time {
+	return pruneNow.AddDate(0, 0, -days)
+}
+
+func prunedKeys(t *testing.T, objects []ObjectInfo, policy RetentionPolicy) []string {
+	t.Helper()
+	candidates, err := PlanPrune(context.Background(), &listedStorage{objects: objects}, policy, pruneNow)
+	if err != nil {
+		t.Fatalf("PlanPrune unexpected error: %v", err)
+	}
+	keys := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		keys = append(keys, c.Key+"@"+c.VersionId)
+	}
+	return keys
+}
+
+// versions returns the versions of the key stored the given days ago, the first one is the current version
+func versions(key string, days ...int) []ObjectInfo {
+	listed := make([]ObjectInfo, 0, len(days))
+	for i, day := range days {
+		listed = append(listed, ObjectInfo{Key: key, VersionId: "v" + string(rune('a'+i)), IsLatest: i == 0, LastModified: daysAgo(day)})
+	}
+	return listed
+}
+
+func TestPlanPrune(t *testing.T) {
+	export := "router1/router1.config.rsc"
+	backup := "router1/router1.backup"
+	objects := slices.Concat(versions(export, 0, 1, 10, 40), versions(backup, 5, 60))
+	month := 30 * 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []string
+	}{
+		{name: "keepLast 1 keeps only the current versions", policy: RetentionPolicy{KeepLast: 1}, want: []string{backup + "@vb", export + "@vb", export + "@vc", export + "@vd"}},
+		{name: "keepLast boundary", policy: RetentionPolicy{KeepLast: 3}, want: []string{export + "@vd"}},
+		{name: "keepLast equal to the versions", policy: RetentionPolicy{KeepLast: 4}, want: []string{}},
+		{name: "keepLast above the versions", policy: RetentionPolicy{KeepLast: 10}, want: []string{}},
+		{name: "maxAge alone keeps the current version", policy: RetentionPolicy{MaxAge: 2 * 24 * time.Hour}, want: []string{backup + "@vb", export + "@vc", export + "@vd"}},
+		{name: "maxAge with keepLast", policy: RetentionPolicy{KeepLast: 2, MaxAge: 7 * 24 * time.Hour}, want: []string{export + "@vc", export + "@vd"}},
+		{name: "maxAge keeps the younger versions beyond keepLast", policy: RetentionPolicy{KeepLast: 1, MaxAge: month}, want: []string{backup + "@vb", export + "@vd"}},
+		{name: "maxAge older than every version", policy: RetentionPolicy{KeepLast: 1, MaxAge: 100 * 24 * time.Hour}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prunedKeys(t, objects, tt.policy); !slices.Equal(got, tt.want) {
+				t.Errorf("pruned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanPruneRefuses(t *testing.T) {
+	deleted := versions("router1/router1.config.rsc", 1, 2)
+	deleted[0].IsLatest = false
+
+	tests := []struct {
+		name    string
+		objects []ObjectInfo
+		wantErr error
+	}{
+		{name: "key without current version", objects: slices.Concat(versions("router1/router1.backup", 1, 2), deleted), wantErr: ErrUnsafePrune},
+		{name: "non-tiktocker key", objects: slices.Concat(versions("router1/router1.backup", 1, 2), versions("customer/invoices.pdf", 1)), wantErr: ErrUnsafePrune},
+		{name: "non-tiktocker key in device directory", objects: versions("router1/notes.txt", 1, 2), wantErr: ErrUnsafePrune},
+		{name: "no retention policy", objects: versions("router1/router1.backup", 1, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := RetentionPolicy{KeepLast: 1}
+			if tt.wantErr == nil {
+				policy = RetentionPolicy{}
+			}
+			candidates, err := PlanPrune(context.Background(), &listedStorage{objects: tt.objects}, policy, pruneNow)
+			if err == nil {
+				t.Fatalf("PlanPrune = %v, want error", candidates)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("PlanPrune error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArtifactNames(t *testing.T) {
+	tests := []struct {
+		key      string
+		artifact bool
+		device   string
+	}{
+		{key: "router1/router1.config.rsc", artifact: true, device: "router1"},
+		{key: "router1/router1.config.rsc.gz.age", artifact: true, device: "router1"},
+		{key: "router1/router1.backup", artifact: true, device: "router1"},
+		{key: "router1/router1.latest.json", artifact: true, device: "router1"},
+		{key: "router1/router1.config.rsc.manifest.json", artifact: true, device: "router1"},
+		{key: "router1/router1.backup.manifest.json", artifact: true, device: "router1"},
+		{key: "router1/router1.manifest.json", artifact: true, device: "router1"},
+		{key: "router1/router1.files/flash/user-manager5.sqlite", artifact: true, device: "router1"},
+		{key: "site/router1.files/hotspot/login.html", artifact: true, device: "router1"},
+		{key: "router1/router1.files/cert.manifest.json", artifact: true, device: "router1"},
+		{key: "router1/router1-20260101T030000Z.diff", artifact: true, device: "router1"},
+		{key: "router1/router1-20260101T030000Z.diff.gz", artifact: true, device: "router1"},
+		{key: "router1/router1-20260101T030000Z.diff.manifest.json", artifact: true, device: "router1"},
+		{key: "router1/core-router-20260101T030000Z.diff", artifact: true, device: "core-router"},
+		{key: "index.json", artifact: true, device: "index.json"},
+		{key: "catalog.sqlite", artifact: true, device: "catalog.sqlite"},
+		{key: "router1/router1.diff", artifact: false, device: "router1.diff"},
+		{key: "router1/router1-yesterday.diff", artifact: false, device: "router1-yesterday.diff"},
+		{key: "router1/-20260101T030000Z.diff", artifact: false, device: "-20260101T030000Z.diff"},
+		{key: "router1/.files", artifact: false, device: ".files"},
+		{key: "router1/notes.txt", artifact: false, device: "notes.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := IsArtifact(tt.key); got != tt.artifact {
+				t.Errorf("IsArtifact(%q) = %v, want %v", tt.key, got, tt.artifact)
+			}
+			if got := DeviceFromFileName(tt.key); got != tt.device {
+				t.Errorf("DeviceFromFileName(%q) = %q, want %q", tt.key, got, tt.device)
+			}
+		})
+	}
+}
+
+func TestPlanPruneDiffs(t *testing.T) {
+	diff := func(day int) ObjectInfo {
+		return ObjectInfo{Key: "site/" + DiffFileName("router1", daysAgo(day)), IsLatest: true, LastModified: daysAgo(day)}
+	}
+	compressed := func(day int) ObjectInfo {
+		return ObjectInfo{Key: "site/" + DiffFileName("router2", daysAgo(day)) + ".gz", IsLatest: true, LastModified: daysAgo(day)}
+	}
+	objects := []ObjectInfo{diff(1), diff(2), diff(3), diff(40), compressed(1), compressed(50)}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []string
+	}{
+		{
+			name:   "keepLast across the device diffs",
+			policy: RetentionPolicy{KeepLast: 2},
+			want:   []string{diff(40).Key + "@", diff(3).Key + "@"},
+		},
+		{
+			name:   "maxAge beyond keepLast",
+			policy: RetentionPolicy{KeepLast: 1, MaxAge: 30 * 24 * time.Hour},
+			want:   []string{diff(40).Key + "@", compressed(50).Key + "@"},
+		},
+		{
+			name:   "newest diff always kept",
+			policy: RetentionPolicy{MaxAge: time.Hour},
+			want:   []string{diff(40).Key + "@", diff(3).Key + "@", diff(2).Key + "@", compressed(50).Key + "@"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prunedKeys(t, objects, tt.policy); !slices.Equal(got, tt.want) {
+				t.Errorf("pruned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
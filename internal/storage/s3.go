@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+)
+
+const writeCheckObject = ".tiktocker-write-check"
+
+type S3Config struct {
+	Host         string   `mapstructure:"host"`
+	AccessKey    string   `mapstructure:"accessKey"`
+	SecretKey    string   `mapstructure:"secretKey"`
+	Region       string   `mapstructure:"region"`
+	Path         string   `mapstructure:"path"`         // bucket/pathPrefix
+	UsePathStyle bool     `mapstructure:"usePathStyle"` // ex Minio uses path style, AWS S3 does not
+	PartSize     int64    `mapstructure:"partSize"`     // multipart upload part size in bytes (min 5MiB)
+	Concurrency  int      `mapstructure:"concurrency"`  // number of parts uploaded in parallel
+	TagKeys      []string `mapstructure:"tagKeys"`      // metadata keys to attach as object tags
+	AllowPrune   bool     `mapstructure:"allowPrune"`   // allow destructive operations without --yes-delete
+	CreateBucket bool     `mapstructure:"createBucket"` // create the bucket on startup if missing
+	CheckWrite   bool     `mapstructure:"checkWrite"`   // verify write access on startup
+	ListingIndex bool     `mapstructure:"listingIndex"` // detect changes using single prefix listing instead of per-device HEAD
+
+	SecretKeyFile      string `mapstructure:"secretKeyFile"`      // file with the secret key, e.g. mounted secret, instead of secretKey
+	CAFile             string `mapstructure:"caFile"`             // PEM bundle of CAs trusted in addition to the system ones, e.g. private MinIO CA
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"` // disable TLS certificate verification, testing only
+}
+
+func init() {
+	Register("s3", newS3Storage)
+}
+
+func newS3Storage(ctx context.Context, cfg *Config, st *state.Store) (Storage, error) {
+	connector, err := NewS3Connector(&cfg.S3)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.S3.CreateBucket {
+		if err := connector.EnsureBucket(ctx, cfg.S3.Region); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.S3.CheckWrite {
+		if err := connector.CheckWriteAccess(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.S3.ListingIndex {
+		return NewListingIndex(connector, st), nil
+	}
+	return connector, nil
+}
+
+type S3Connector struct {
+	Client      *s3.Client
+	Bucket      string
+	Prefix      string
+	PartSize    int64    // multipart upload part size in bytes, 0 - uploader default
+	Concurrency int      // number of parts uploaded in parallel, 0 - uploader default
+	TagKeys     []string // metadata keys which are additionally attached as object tags
+}
+
+func NewS3Connector(c *S3Config) (*S3Connector, error) {
+	bucket, bucketPath, err := splitBucketPath(c.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newS3HttpClient(c)
+	if err != nil {
+		return nil, err
+	}
+	cfg := aws.Config{
+		Region:       c.Region,
+		BaseEndpoint: aws.String(c.Host),
+		Credentials:  credentials.NewStaticCredentialsProvider(c.AccessKey, c.SecretKey, ""),
+		HTTPClient:   httpClient,
+	}
+
+	connector := &S3Connector{
+		Client: s3.NewFromConfig(
+			cfg,
+			func(o *s3.Options) {
+				o.UsePathStyle = c.UsePathStyle
+			},
+		),
+		Bucket:      bucket,
+		Prefix:      bucketPath,
+		PartSize:    c.PartSize,
+		Concurrency: c.Concurrency,
+		TagKeys:     c.TagKeys,
+	}
+	return connector, nil
+}
+
+// newS3HttpClient returns SDK default HTTP client with the configured TLS settings
+func newS3HttpClient(c *S3Config) (aws.HTTPClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read s3.caFile: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in s3.caFile: %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.InsecureSkipVerify {
+		common.Log.Warnf("s3 TLS certificate verification disabled")
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+		t.TLSClientConfig = tlsConfig
+	}), nil
+}
+
+func (c *S3Connector) String() string {
+	return fmt.Sprintf("s3 bucket: %s", c.Bucket)
+}
+
+// tagging encodes metadata entries selected by TagKeys as S3 tagging query string
+func (c *S3Connector) tagging(metadata map[string]string) string {
+	tags := url.Values{}
+	for _, k := range c.TagKeys {
+		if v, ok := metadata[k]; ok {
+			tags.Set(k, v)
+		}
+	}
+	return tags.Encode()
+}
+
+// ObjectKey returns the full object key of the file stored in devicePrefix (relative to Prefix)
+func (c *S3Connector) ObjectKey(devicePrefix string, fileName string) string {
+	return path.Join(c.Prefix, devicePrefix, fileName)
+}
+
+func (c *S3Connector) listPrefix() string {
+	return strings.TrimSuffix(c.Prefix, "/") + "/"
+}
+
+// GetChangeHash returns modified sha256 to detect Mikrotik config changes, modified == sha256 based on full file without first line that contains date
+func (c *S3Connector) GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string {
+	info, err := c.Head(ctx, devicePrefix, fileName)
+	return changeHash(info, err)
+}
+
+// changeHash extracts change detection checksum, checksum might be computed with first line omitted hence it is kept in different field than the object checksum
+func changeHash(info *ObjectInfo, err error) *string {
+	if err != nil || info == nil || info.Metadata == nil {
+		return nil
+	}
+	val := info.Metadata[common.Sha256WithoutFirstLine]
+	return &val
+}
+
+func (c *S3Connector) Head(ctx context.Context, devicePrefix string, fileName string) (*ObjectInfo, error) {
+	return c.headKey(ctx, c.ObjectKey(devicePrefix, fileName))
+}
+
+func (c *S3Connector) headKey(ctx context.Context, key string) (*ObjectInfo, error) {
+	head, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(c.Bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled, //otherwise won't fetch the checksum
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          key,
+		VersionId:    aws.ToString(head.VersionId),
+		IsLatest:     true,
+		LastModified: aws.ToTime(head.LastModified),
+		Size:         aws.ToInt64(head.ContentLength),
+		ETag:         aws.ToString(head.ETag),
+		Metadata:     head.Metadata,
+	}, nil
+}
+
+func (c *S3Connector) Open(ctx context.Context, devicePrefix string, fileName string) (io.ReadCloser, error) {
+	key := c.ObjectKey(devicePrefix, fileName)
+	out, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// openVersion returns contents of the listed object version
+func (c *S3Connector) openVersion(ctx context.Context, o ObjectInfo) (io.ReadCloser, error) {
+	out, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(c.Bucket),
+		Key:       aws.String(o.Key),
+		VersionId: aws.String(o.VersionId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// versionMetadata returns metadata of the listed object version
+func (c *S3Connector) versionMetadata(ctx context.Context, o ObjectInfo) (map[string]string, error) {
+	head, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(c.Bucket),
+		Key:       aws.String(o.Key),
+		VersionId: aws.String(o.VersionId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return head.Metadata, nil
+}
+
+// ListObjectETags lists current objects under the Prefix, returns object key to ETag mapping
+func (c *S3Connector) ListObjectETags(ctx context.Context) (map[string]string, error) {
+	etags := make(map[string]string)
+	paginator := s3.NewListObjectsV2Paginator(c.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.Bucket),
+		Prefix: aws.String(c.listPrefix()),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			etags[aws.ToString(o.Key)] = aws.ToString(o.ETag)
+		}
+	}
+	return etags, nil
+}
+
+func (c *S3Connector) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error {
+	_, err := c.upload(ctx, devicePrefix, file, metadata)
+	return err
+}
+
+// upload stores the file, returns ETag of the stored object
+func (c *S3Connector) upload(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) (string, error) {
+	body, err := file.OpenUpload(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	uploader := manager.NewUploader(c.Client, func(u *manager.Uploader) {
+		if c.PartSize > 0 {
+			u.PartSize = c.PartSize
+		}
+		if c.Concurrency > 0 {
+			u.Concurrency = c.Concurrency
+		}
+	})
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(c.Bucket),
+		Key:               aws.String(c.ObjectKey(devicePrefix, file.Name)),
+		Body:              body,
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		Metadata:          changeMetadata(file, metadata),
+	}
+	if tagging := c.tagging(metadata); tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+	// full object checksum is only valid for single part uploads, multipart uploads get per-part checksums
+	if file.Size < uploader.PartSize {
+		input.ChecksumSHA256 = aws.String(file.ComputedSha256)
+	}
+	out, err := uploader.Upload(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	file.VersionId = aws.ToString(out.VersionID)
+	return aws.ToString(out.ETag), nil
+}
+
+// EnsureBucket creates the bucket if it doesn't exist, meant for self-hosted S3 (e.g. MinIO)
+func (c *S3Connector) EnsureBucket(ctx context.Context, region string) error {
+	_, err := c.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.Bucket)})
+	if err == nil {
+		return nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("%s not accessible: %w", c, err)
+	}
+
+	input := &s3.CreateBucketInput{Bucket: aws.String(c.Bucket)}
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{LocationConstraint: types.BucketLocationConstraint(region)}
+	}
+	if _, err := c.Client.CreateBucket(ctx, input); err != nil {
+		return fmt.Errorf("%s creation failure: %w", c, err)
+	}
+	common.Log.Infof("%s created", c)
+	return nil
+}
+
+// CheckWriteAccess writes and removes probe object under the Prefix, so missing permissions are reported on startup instead of the first upload
+func (c *S3Connector) CheckWriteAccess(ctx context.Context) error {
+	key := path.Join(c.Prefix, writeCheckObject)
+	out, err := c.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("tiktocker write check"),
+	})
+	if err != nil {
+		return fmt.Errorf("%s no write access to %s: %w", c, key, err)
+	}
+	// removing the exact version, otherwise versioned bucket keeps the probe with delete marker
+	_, err = c.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(c.Bucket),
+		Key:       aws.String(key),
+		VersionId: out.VersionId,
+	})
+	if err != nil {
+		return fmt.Errorf("%s failed to remove write check object %s: %w", c, key, err)
+	}
+	return nil
+}
+
+// List lists all versions of all objects under the Prefix, history of backups is kept by bucket versioning
+func (c *S3Connector) List(ctx context.Context) ([]ObjectInfo, error) {
+	versions := make([]ObjectInfo, 0)
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(c.Bucket),
+		Prefix: aws.String(c.listPrefix()),
+	}
+	for {
+		out, err := c.Client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range out.Versions {
+			versions = append(versions, ObjectInfo{
+				Key:          aws.ToString(v.Key),
+				VersionId:    aws.ToString(v.VersionId),
+				IsLatest:     aws.ToBool(v.IsLatest),
+				LastModified: aws.ToTime(v.LastModified),
+				Size:         aws.ToInt64(v.Size),
+				ETag:         aws.ToString(v.ETag),
+			})
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return versions, nil
+		}
+		input.KeyMarker = out.NextKeyMarker
+		input.VersionIdMarker = out.NextVersionIdMarker
+	}
+}
+
+// Delete permanently removes given object versions, in batches of at most 1000 (S3 limit)
+func (c *S3Connector) Delete(ctx context.Context, objects []ObjectInfo) error {
+	const batchSize = 1000
+	for start := 0; start < len(objects); start += batchSize {
+		end := min(start+batchSize, len(objects))
+		ids := make([]types.ObjectIdentifier, 0, end-start)
+		for _, o := range objects[start:end] {
+			id := types.ObjectIdentifier{Key: aws.String(o.Key)}
+			if o.VersionId != "" {
+				id.VersionId = aws.String(o.VersionId)
+			}
+			ids = append(ids, id)
+		}
+		out, err := c.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(c.Bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed to delete %d object versions, first: %s (%s): %s", len(out.Errors), aws.ToString(e.Key), aws.ToString(e.VersionId), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"tiktocker/internal/common"
+	"time"
+)
+
+const ManifestSuffix = ".manifest.json"
+
+// SidecarManifest describes the artifact stored next to it, it replaces object metadata on backends which have none
+type SidecarManifest struct {
+	Name                   string            `json:"name"`
+	Identity               string            `json:"identity"`
+	Sha256                 string            `json:"sha256"`
+	Sha256WithoutFirstLine string            `json:"sha256WithoutFirstLine,omitempty"`
+	Size                   int64             `json:"size"`
+	StoredAt               time.Time         `json:"storedAt"`
+	Metadata               map[string]string `json:"metadata,omitempty"`
+}
+
+// SidecarManifests stores <name>.manifest.json next to every artifact and serves Head metadata and change detection from it
+type SidecarManifests struct {
+	Storage
+}
+
+func NewSidecarManifests(backend Storage) *SidecarManifests {
+	return &SidecarManifests{Storage: backend}
+}
+
+func (s *SidecarManifests) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error {
+	if err := s.Storage.Put(ctx, devicePrefix, file, metadata); err != nil {
+		return err
+	}
+	manifest := &SidecarManifest{
+		Name:                   file.Name,
+		Identity:               DeviceFromFileName(file.Name),
+		Sha256:                 file.ComputedSha256,
+		Sha256WithoutFirstLine: file.ComputedSha256WithoutFirstLine,
+		Size:                   file.Size,
+		StoredAt:               time.Now().UTC(),
+		Metadata:               metadata,
+	}
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	sidecar, err := common.SpoolBytes(file.Name+ManifestSuffix, append(contents, '\n'))
+	if err != nil {
+		return err
+	}
+	defer sidecar.Remove()
+	if err := s.Storage.Put(ctx, devicePrefix, sidecar, nil); err != nil {
+		return fmt.Errorf("failed to store %s: %w", sidecar.Name, err)
+	}
+	return nil
+}
+
+// Head returns the stored object with metadata read from its sidecar, the metadata is nil when sidecar is missing (stored by older version)
+func (s *SidecarManifests) Head(ctx context.Context, devicePrefix string, fileName string) (*ObjectInfo, error) {
+	info, err := s.Storage.Head(ctx, devicePrefix, fileName)
+	if err != nil || info == nil || strings.HasSuffix(fileName, ManifestSuffix) {
+		return info, err
+	}
+	manifest, err := s.readManifest(ctx, devicePrefix, fileName)
+	if err != nil || manifest == nil {
+		return info, err
+	}
+	info.Metadata = make(map[string]string, len(manifest.Metadata)+1)
+	for k, v := range manifest.Metadata {
+		info.Metadata[k] = v
+	}
+	info.Metadata[common.Sha256WithoutFirstLine] = manifest.Sha256WithoutFirstLine
+	return info, nil
+}
+
+func (s *SidecarManifests) GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string {
+	info, err := s.Head(ctx, devicePrefix, fileName)
+	if err != nil {
+		common.ComponentLogger(ctx, common.ComponentStorage).Warnf("failed to read %s sidecar manifest: %v", fileName, err)
+	}
+	return changeHash(info, err)
+}
+
+func (s *SidecarManifests) readManifest(ctx context.Context, devicePrefix string, fileName string) (*SidecarManifest, error) {
+	r, err := s.Open(ctx, devicePrefix, fileName+ManifestSuffix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	manifest := &SidecarManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid sidecar manifest of %s: %w", fileName, err)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+	"time"
+)
+
+// ObjectInfo describes single stored object (version), Key is relative to the storage root
+type ObjectInfo struct {
+	Key          string
+	VersionId    string // empty for non-versioned storage
+	IsLatest     bool
+	LastModified time.Time
+	Size         int64
+	ETag         string
+	Metadata     map[string]string // not populated by List
+}
+
+// Storage is a destination for backup artifacts
+type Storage interface {
+	// Put stores the file in devicePrefix, sets file.VersionId when the storage is versioned
+	Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error
+	// Head returns current version of the file, nil if it doesn't exist
+	Head(ctx context.Context, devicePrefix string, fileName string) (*ObjectInfo, error)
+	// Open returns contents of the current version of the file, the error satisfies errors.Is(err, os.ErrNotExist) if it doesn't exist
+	Open(ctx context.Context, devicePrefix string, fileName string) (io.ReadCloser, error)
+	// List returns all objects (including previous versions) under the storage root
+	List(ctx context.Context) ([]ObjectInfo, error)
+	// Delete permanently removes given objects (versions)
+	Delete(ctx context.Context, objects []ObjectInfo) error
+	// GetChangeHash returns stored change detection checksum of the file, nil if not known
+	GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string
+	String() string
+}
+
+// Config holds settings of all storage backends, only the selected backend settings are used
+type Config struct {
+	Backend   string      `mapstructure:"backend"`   // storage backend name, if empty - selected based on configured sections
+	Directory string      `mapstructure:"directory"` // directory to store backups, if empty - uses S3
+	S3        S3Config    `mapstructure:"s3"`
+	B2        B2Config    `mapstructure:"b2"`
+	Swift     SwiftConfig `mapstructure:"swift"`
+
+	PruneAllowed bool `mapstructure:"allowPrune"` // allow destructive operations without --yes-delete, any backend
+
+	ChecksumCache struct {
+		TTL        time.Duration `mapstructure:"ttl"`        // 0 - stored checksums are always fetched
+		Persistent bool          `mapstructure:"persistent"` // keep cached checksums in the state database
+	} `mapstructure:"checksumCache"`
+}
+
+// BackendName returns the configured backend, for backward compatibility: local if directory is set, b2 if b2.path is set, swift if swift.path is set, s3 otherwise
+func (c *Config) BackendName() string {
+	switch {
+	case c.Backend != "":
+		return c.Backend
+	case c.Directory != "":
+		return "local"
+	case c.B2.Path != "":
+		return "b2"
+	case c.Swift.Path != "":
+		return "swift"
+	default:
+		return "s3"
+	}
+}
+
+// KeyPrefix returns the path prefix of the selected bucket backend, keys listed by these backends start with it, empty for the local directory
+func (c *Config) KeyPrefix() string {
+	var bucketPath string
+	switch c.BackendName() {
+	case "s3":
+		bucketPath = c.S3.Path
+	case "b2":
+		bucketPath = c.B2.Path
+	case "swift":
+		bucketPath = c.Swift.Path
+	default:
+		return ""
+	}
+	_, prefix, err := splitBucketPath(bucketPath)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(prefix, "/")
+}
+
+// cacheScope identifies objects of the selected backend in the checksum cache: backend name, bucket and prefix (directory of the local backend)
+func (c *Config) cacheScope() string {
+	var bucketPath string
+	switch name := c.BackendName(); name {
+	case "local":
+		return name + ":" + filepath.Clean(c.Directory)
+	case "s3":
+		bucketPath = c.S3.Path
+	case "b2":
+		bucketPath = c.B2.Path
+	case "swift":
+		bucketPath = c.Swift.Path
+	default:
+		return name
+	}
+	bucket, _, _ := splitBucketPath(bucketPath)
+	return c.BackendName() + ":" + bucket + "/" + c.KeyPrefix()
+}
+
+// AllowPrune returns whether the selected backend allows destructive operations without explicit confirmation,
+// for backward compatibility s3.allowPrune and b2.allowPrune are honoured as well
+func (c *Config) AllowPrune() bool {
+	if c.PruneAllowed {
+		return true
+	}
+	switch c.BackendName() {
+	case "s3":
+		return c.S3.AllowPrune
+	case "b2":
+		return c.B2.AllowPrune
+	default:
+		return false
+	}
+}
+
+// Factory creates the backend, st is nil when no state database is configured
+type Factory func(ctx context.Context, cfg *Config, st *state.Store) (Storage, error)
+
+var backends = make(map[string]Factory)
+
+// Register makes the backend available by name, meant to be called from init
+func Register(name string, factory Factory) {
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("storage backend %s registered twice", name))
+	}
+	backends[name] = factory
+}
+
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the configured backend, wrapped with the checksum cache if enabled
+func New(ctx context.Context, cfg *Config, st *state.Store) (Storage, error) {
+	name := cfg.BackendName()
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend: %s, available: %s", name, strings.Join(Backends(), ", "))
+	}
+	store, err := factory(ctx, cfg, st)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ChecksumCache.TTL > 0 {
+		var cacheState *state.Store
+		if cfg.ChecksumCache.Persistent {
+			cacheState = st
+		}
+		store = NewChecksumCache(store, cfg.cacheScope(), cfg.ChecksumCache.TTL, cacheState)
+	}
+	return store, nil
+}
+
+// PutFile stores the file reporting the outcome to mainComms
+func PutFile(
+	ctx context.Context,
+	store Storage,
+	devicePrefix string,
+	file *common.BackupFile,
+	metadata map[string]string,
+	mainComms chan *common.RequestResult,
+) {
+	err := store.Put(ctx, devicePrefix, file, metadata)
+	if err != nil {
+		mainComms <- &common.RequestResult{Err: fmt.Errorf("%s store failure: %w", store, err)}
+		return
+	}
+	common.ComponentLogger(ctx, common.ComponentStorage).Infof("file: %s stored in %s", file.Name, store)
+	mainComms <- &common.RequestResult{Err: nil}
+}
+
+// CheckWriteAccess stores and removes probe file at the storage root, e.g. to check the credentials before the first backup
+func CheckWriteAccess(ctx context.Context, store Storage) error {
+	probe, err := common.SpoolBytes(writeCheckObject, []byte("tiktocker write check"))
+	if err != nil {
+		return err
+	}
+	defer probe.Remove()
+	if err := store.Put(ctx, "", probe, nil); err != nil {
+		return fmt.Errorf("%s no write access: %w", store, err)
+	}
+	// every version of the probe and its sidecar manifest, removing the exact versions leaves no delete markers in versioned storage
+	listed, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("%s listing failure: %w", store, err)
+	}
+	probes := make([]ObjectInfo, 0, 2)
+	for _, o := range listed {
+		if name := path.Base(o.Key); name == writeCheckObject || name == writeCheckObject+ManifestSuffix {
+			probes = append(probes, o)
+		}
+	}
+	if err := store.Delete(ctx, probes); err != nil {
+		return fmt.Errorf("%s failed to remove %s: %w", store, writeCheckObject, err)
+	}
+	return nil
+}
+
+// changeMetadata returns metadata extended with the change detection checksum
+func changeMetadata(file *common.BackupFile, metadata map[string]string) map[string]string {
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	if file.ComputedSha256WithoutFirstLine != "" {
+		m[common.Sha256WithoutFirstLine] = file.ComputedSha256WithoutFirstLine
+	}
+	return m
+}
+
+func splitBucketPath(bucketPrefix string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(bucketPrefix, "/"), "/", 2)
+	if (len(parts) < 2) || (parts[0] == "" || parts[1] == "") {
+		return "", "", fmt.Errorf("invalid bucket path: %s, must be in format bucket/prefix", bucketPrefix)
+	}
+	return parts[0], parts[1], nil
+}
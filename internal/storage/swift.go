@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"tiktocker/internal/common"
+	"tiktocker/internal/state"
+
+	"github.com/ncw/swift/v2"
+)
+
+type SwiftConfig struct {
+	AuthUrl                     string `mapstructure:"authUrl"`     // keystone endpoint, e.g. https://keystone.example.com:5000/v3
+	AuthVersion                 int    `mapstructure:"authVersion"` // 0 - detected from the authUrl
+	Username                    string `mapstructure:"username"`
+	Password                    string `mapstructure:"password"`
+	Domain                      string `mapstructure:"domain"`                  // user domain (v3 auth)
+	Project                     string `mapstructure:"project"`                 // project (tenant) name
+	ProjectDomain               string `mapstructure:"projectDomain"`           // only needed if it differs from the user domain
+	ApplicationCredentialId     string `mapstructure:"applicationCredentialId"` // used instead of username and password
+	ApplicationCredentialSecret string `mapstructure:"applicationCredentialSecret"`
+	Region                      string `mapstructure:"region"` // if empty - the first region of the catalog
+	Path                        string `mapstructure:"path"`   // container/pathPrefix
+}
+
+func init() {
+	Register("swift", newSwiftStorage)
+}
+
+func newSwiftStorage(ctx context.Context, cfg *Config, _ *state.Store) (Storage, error) {
+	c := &cfg.Swift
+	container, prefix, err := splitBucketPath(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	conn := &swift.Connection{
+		AuthUrl:                     c.AuthUrl,
+		AuthVersion:                 c.AuthVersion,
+		UserName:                    c.Username,
+		ApiKey:                      c.Password,
+		Domain:                      c.Domain,
+		Tenant:                      c.Project,
+		TenantDomain:                c.ProjectDomain,
+		ApplicationCredentialId:     c.ApplicationCredentialId,
+		ApplicationCredentialSecret: c.ApplicationCredentialSecret,
+		Region:                      c.Region,
+		UserAgent:                   "tiktocker",
+	}
+	if err := conn.Authenticate(ctx); err != nil {
+		return nil, fmt.Errorf("swift authentication failure: %w", err)
+	}
+	if _, _, err := conn.Container(ctx, container); err != nil {
+		return nil, fmt.Errorf("swift container: %s not accessible: %w", container, err)
+	}
+	return &SwiftConnector{Conn: conn, Container: container, Prefix: prefix}, nil
+}
+
+// SwiftConnector stores files in OpenStack Swift container, only current objects are listed (container versioning keeps the history elsewhere)
+type SwiftConnector struct {
+	Conn      *swift.Connection
+	Container string
+	Prefix    string
+}
+
+func (c *SwiftConnector) String() string {
+	return fmt.Sprintf("swift container: %s", c.Container)
+}
+
+func (c *SwiftConnector) objectName(devicePrefix string, fileName string) string {
+	return path.Join(c.Prefix, devicePrefix, fileName)
+}
+
+// GetChangeHash returns modified sha256 stored in the object metadata, the same semantics as S3Connector.GetChangeHash
+func (c *SwiftConnector) GetChangeHash(ctx context.Context, devicePrefix string, fileName string) *string {
+	info, err := c.Head(ctx, devicePrefix, fileName)
+	if err != nil {
+		common.ComponentLogger(ctx, common.ComponentStorage).Warnf("%s failed to get %s metadata: %v", c, fileName, err)
+	}
+	return changeHash(info, err)
+}
+
+func (c *SwiftConnector) Head(ctx context.Context, devicePrefix string, fileName string) (*ObjectInfo, error) {
+	name := c.objectName(devicePrefix, fileName)
+	obj, headers, err := c.Conn.Object(ctx, c.Container, name)
+	if err != nil {
+		if errors.Is(err, swift.ObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          name,
+		IsLatest:     true,
+		LastModified: obj.LastModified,
+		Size:         obj.Bytes,
+		ETag:         obj.Hash,
+		Metadata:     headers.ObjectMetadata(),
+	}, nil
+}
+
+func (c *SwiftConnector) Open(ctx context.Context, devicePrefix string, fileName string) (io.ReadCloser, error) {
+	name := c.objectName(devicePrefix, fileName)
+	file, _, err := c.Conn.ObjectOpen(ctx, c.Container, name, false, nil)
+	if err != nil {
+		if errors.Is(err, swift.ObjectNotFound) {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (c *SwiftConnector) Put(ctx context.Context, devicePrefix string, file *common.BackupFile, metadata map[string]string) error {
+	body, err := file.OpenUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	headers := swift.Metadata(changeMetadata(file, metadata)).ObjectHeaders()
+	_, err = c.Conn.ObjectPut(ctx, c.Container, c.objectName(devicePrefix, file.Name), body, false, "", "application/octet-stream", headers)
+	return err
+}
+
+// List lists objects under the Prefix, Swift objects are not versioned so each one is the latest
+func (c *SwiftConnector) List(ctx context.Context) ([]ObjectInfo, error) {
+	listed, err := c.Conn.ObjectsAll(ctx, c.Container, &swift.ObjectsOpts{Prefix: strings.TrimSuffix(c.Prefix, "/") + "/"})
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectInfo, 0, len(listed))
+	for _, o := range listed {
+		if o.PseudoDirectory {
+			continue
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          o.Name,
+			IsLatest:     true,
+			LastModified: o.LastModified,
+			Size:         o.Bytes,
+			ETag:         o.Hash,
+		})
+	}
+	return objects, nil
+}
+
+func (c *SwiftConnector) Delete(ctx context.Context, objects []ObjectInfo) error {
+	for _, o := range objects {
+		if err := c.Conn.ObjectDelete(ctx, c.Container, o.Key); err != nil && !errors.Is(err, swift.ObjectNotFound) {
+			return fmt.Errorf("failed to delete %s: %w", o.Key, err)
+		}
+	}
+	return nil
+}
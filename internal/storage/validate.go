@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// bucketName is the S3 bucket naming rule
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Validate checks settings of the selected backend without connecting to it, prefix is prepended to the setting names, e.g. destinations.dr.
+func (c *Config) Validate(prefix string) error {
+	var errs []error
+	required := func(value string, setting string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s%s is required by the %s backend", prefix, setting, c.BackendName()))
+		}
+	}
+	bucketPath := func(path string, setting string) {
+		if path == "" {
+			return // reported as required
+		}
+		bucket, _, err := splitBucketPath(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %w", prefix, setting, err))
+		} else if c.BackendName() == "s3" && !bucketName.MatchString(bucket) {
+			errs = append(errs, fmt.Errorf("%s%s: invalid bucket name: %s, must be 3-63 lowercase letters, digits, dots or hyphens", prefix, setting, bucket))
+		}
+	}
+
+	switch name := c.BackendName(); name {
+	case "local":
+		required(c.Directory, "directory")
+	case "s3":
+		required(c.S3.Path, "s3.path")
+		bucketPath(c.S3.Path, "s3.path")
+		required(c.S3.AccessKey, "s3.accessKey")
+		required(c.S3.SecretKey, "s3.secretKey")
+		required(c.S3.Region, "s3.region")
+		if c.S3.Host != "" {
+			if u, err := url.Parse(c.S3.Host); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("%ss3.host: invalid URL: %s, must be http(s)://host[:port]", prefix, c.S3.Host))
+			}
+		}
+		if c.S3.PartSize != 0 && c.S3.PartSize < 5*1024*1024 {
+			errs = append(errs, fmt.Errorf("%ss3.partSize: %d is below the S3 minimum of 5MiB", prefix, c.S3.PartSize))
+		}
+	case "b2":
+		required(c.B2.Path, "b2.path")
+		bucketPath(c.B2.Path, "b2.path")
+		required(c.B2.KeyId, "b2.keyId")
+		required(c.B2.ApplicationKey, "b2.applicationKey")
+	case "swift":
+		required(c.Swift.Path, "swift.path")
+		bucketPath(c.Swift.Path, "swift.path")
+		required(c.Swift.AuthUrl, "swift.authUrl")
+		if c.Swift.ApplicationCredentialId == "" {
+			required(c.Swift.Username, "swift.username")
+			required(c.Swift.Password, "swift.password")
+		}
+	default:
+		if _, ok := backends[name]; !ok {
+			errs = append(errs, fmt.Errorf("%sbackend: unknown storage backend: %s, available: %s", prefix, name, strings.Join(Backends(), ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
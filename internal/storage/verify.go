@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"tiktocker/internal/common"
+)
+
+const (
+	IntegrityOk         = "ok"
+	IntegrityCorrupted  = "corrupted"  // contents or size differ from the recorded ones
+	IntegrityMissing    = "missing"    // listed in the catalog, not stored
+	IntegrityFailed     = "failed"     // could not be read
+	IntegrityUnverified = "unverified" // no checksum recorded (e.g. local directory without sidecar manifests) or the contents are post-processed
+)
+
+// IntegrityResult is the check of the stored artifact, Key is relative to the storage root
+type IntegrityResult struct {
+	Key    string
+	Device string
+	Status string
+	Detail string
+}
+
+// Failed returns whether the artifact is corrupted, missing or unreadable
+func (r *IntegrityResult) Failed() bool {
+	return r.Status == IntegrityCorrupted || r.Status == IntegrityMissing || r.Status == IntegrityFailed
+}
+
+// VerifyIntegrity checks the latest artifacts of the selected devices (nil selects all) against the checksums recorded in their metadata and in the catalog,
+// artifacts of the catalog not stored are missing. Without download only the metadata is read, the contents are not compared.
+// Results are ordered by device and key
+func VerifyIntegrity(ctx context.Context, store Storage, keyPrefix string, catalog *Catalog, selected func(device string) bool, download bool) ([]IntegrityResult, error) {
+	listed, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s listing failure: %w", store, err)
+	}
+	cataloged := catalogArtifacts(catalog)
+
+	results := make([]IntegrityResult, 0, len(listed))
+	stored := make(map[string]bool, len(listed))
+	for _, o := range listed {
+		o.Key = RelativeKey(keyPrefix, o.Key)
+		if !o.IsLatest || !Transferable(o.Key) {
+			continue
+		}
+		stored[o.Key] = true
+		r := IntegrityResult{Key: o.Key, Device: DeviceFromFileName(o.Key)}
+		if selected != nil && !selected(r.Device) {
+			continue
+		}
+		r.Status, r.Detail = verifyObject(ctx, store, o, cataloged[o.Key], download)
+		results = append(results, r)
+	}
+	for key, a := range cataloged {
+		if device := DeviceFromFileName(key); !stored[key] && (selected == nil || selected(device)) {
+			results = append(results, IntegrityResult{Key: key, Device: device, Status: IntegrityMissing, Detail: fmt.Sprintf("catalog entry of %s", a.LastModified.Format("2006-01-02"))})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Device != results[j].Device {
+			return results[i].Device < results[j].Device
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results, nil
+}
+
+// verifyObject returns status of the listed object and its detail
+func verifyObject(ctx context.Context, store Storage, o ObjectInfo, cataloged *CatalogArtifact, download bool) (string, string) {
+	// catalog records the stored (post-processed) contents of the version it points to
+	if cataloged != nil && cataloged.VersionId != "" && cataloged.VersionId != o.VersionId {
+		cataloged = nil
+	}
+	if cataloged != nil && cataloged.Size != o.Size {
+		return IntegrityCorrupted, fmt.Sprintf("size %d, catalog %d", o.Size, cataloged.Size)
+	}
+
+	var metadata map[string]string
+	var file *common.BackupFile
+	if download {
+		f, m, err := ReadObject(ctx, store, o.Key)
+		if err != nil {
+			return IntegrityFailed, err.Error()
+		}
+		defer f.Remove()
+		file, metadata = f, m
+	} else {
+		devicePrefix, name := SplitKey(o.Key)
+		info, err := store.Head(ctx, devicePrefix, name)
+		switch {
+		case err != nil:
+			return IntegrityFailed, fmt.Sprintf("%s failed to get %s metadata: %v", store, o.Key, err)
+		case info == nil:
+			return IntegrityMissing, "deleted while verified"
+		}
+		metadata = info.Metadata
+	}
+
+	recorded, withoutFirstLine := recordedChecksum(o.Key, metadata)
+	catalogSha := ""
+	if cataloged != nil {
+		catalogSha = cataloged.Sha256
+	}
+	if recorded == "" && catalogSha == "" {
+		return IntegrityUnverified, "no checksum recorded"
+	}
+	if file == nil {
+		return IntegrityOk, "checksum recorded"
+	}
+
+	if catalogSha != "" && catalogSha != file.ComputedSha256 {
+		return IntegrityCorrupted, fmt.Sprintf("sha256 %s, catalog %s", file.ComputedSha256, catalogSha)
+	}
+	computed := file.ComputedSha256
+	if withoutFirstLine {
+		computed = file.ComputedSha256WithoutFirstLine
+	}
+	if recorded != "" && recorded != computed {
+		return IntegrityCorrupted, fmt.Sprintf("sha256 %s, recorded %s", computed, recorded)
+	}
+	return IntegrityOk, "sha256 " + computed
+}
+
+// recordedChecksum returns the metadata checksum of the stored contents and whether it is of the export without its timestamp line,
+// empty if not recorded or the contents are post-processed (the checksum is of the original contents)
+func recordedChecksum(key string, metadata map[string]string) (string, bool) {
+	name := path.Base(key)
+	switch {
+	case strings.HasSuffix(name, ".config.rsc"):
+		return metadata[common.Sha256WithoutFirstLine], true
+	case strings.HasSuffix(name, ".backup"):
+		return metadata[common.BackupSha256], false
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".age"), strings.HasSuffix(name, ".sig"):
+		return "", false
+	}
+	if _, ok := extraFilesDevice(key); ok {
+		return metadata[common.BackupSha256], false
+	}
+	return "", false
+}
+
+// catalogArtifacts returns the artifacts of the catalog devices by key, nil catalog has none
+func catalogArtifacts(catalog *Catalog) map[string]*CatalogArtifact {
+	artifacts := make(map[string]*CatalogArtifact)
+	if catalog == nil {
+		return artifacts
+	}
+	for _, d := range catalog.Devices {
+		for _, a := range []*CatalogArtifact{d.Export, d.Backup} {
+			if a != nil {
+				artifacts[a.Key] = a
+			}
+		}
+	}
+	return artifacts
+}